@@ -22,6 +22,15 @@ var (
 	STACK_OFFSET uint64 = 8
 
 	WRITE_FSTAT_TIMES = true
+
+	// Config.ForkMode
+	FORK_PARENT = "parent" // caller gets the child pid
+	FORK_CHILD  = "child"  // caller gets 0 and carries on as the child
+	FORK_FAIL   = "fail"   // fork fails with EAGAIN
+
+	// Config.Network
+	NET_DENY = "deny" // every connection is refused
+	NET_HOST = "host" // inet sockets are passed through to the host
 )
 
 type Config struct {
@@ -31,6 +40,36 @@ type Config struct {
 	AndroidID string `json:"android_id"`
 	Ip        string `json:"ip"`
 	Mac       Mac    `json:"mac"`
+	Ppid      int    `json:"ppid"`
+
+	AntiDebug AntiDebugConfig `json:"anti_debug"`
+
+	// process modelling, see Processes
+	ForkMode     string `json:"fork_mode"`
+	ForkRunChild bool   `json:"fork_run_child"`
+	ChildPid     int    `json:"child_pid"`
+	WaitStatus   int    `json:"wait_status"`
+	ExecveResult int    `json:"execve_result"`
+
+	// default backend of the socket layer, see Network
+	Network string `json:"network"`
+
+	// guard every guest malloc and report misuse, see HeapChecker
+	HeapCheck bool `json:"heap_check"`
+	// fail LoadModule on missing DT_NEEDED libraries, unresolved non weak
+	// symbols and unsupported relocations instead of leaving zeros behind
+	StrictRelocations bool `json:"strict_relocations"`
+
+	// linker search paths, see LinkerNamespace. Empty ones default to
+	// /system/lib and /vendor/lib, and the app's lib/<abi> directory
+	LibraryPaths    []string `json:"library_paths"`
+	AppLibraryPaths []string `json:"app_library_paths"`
+	// keep app libraries away from non public system libraries, like
+	// Android N and later do
+	LinkerIsolation bool     `json:"linker_isolation"`
+	// what an isolated app may load from the system, PUBLIC_LIBRARIES
+	// when empty
+	PublicLibraries []string `json:"public_libraries"`
 }
 
 func NewDefaultConfig() *Config {
@@ -41,6 +80,13 @@ func NewDefaultConfig() *Config {
 		AndroidID: "39cc04a2ae83db0b",
 		Ip:        "192.168.43.22",
 		Mac:       Mac{204, 250, 166, 0, 138, 169},
+		Ppid:      197,
+		AntiDebug: NewDefaultAntiDebugConfig(),
+
+		ForkMode:     FORK_PARENT,
+		ChildPid:     4420,
+
+		Network: NET_DENY,
 	}
 }
 
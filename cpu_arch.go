@@ -0,0 +1,305 @@
+package emulator
+
+import (
+	"fmt"
+	"sync"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// hwcaps the arm64 ifunc resolvers and AT_HWCAP see: fp asimd evtstrm
+	// aes pmull sha1 sha2 crc32
+	ARM64_HWCAP uint64 = 0xff
+
+	EM_ARM     uint16 = 40
+	EM_AARCH64 uint16 = 183
+)
+
+// Arch describes the guest CPU: the unicorn mode, the registers of the
+// calling convention and the syscall ABI, and how hook stubs look.
+type Arch struct {
+	Name     string
+	UcArch   int
+	UcMode   int
+	// ELF e_machine and class the loader accepts
+	Machine  uint16
+	Is64     bool
+	// pointer and stack slot size
+	PtrSize  uint64
+	// argument and result registers
+	ArgRegs  []int
+	// double arguments, arm passes variadic ones in ArgRegs
+	FPArgRegs []int
+	// general purpose registers saved as R0-R12 of RegistryContext, the
+	// rest of them go to RegistryContext.Ext
+	GPRegs   []int
+	ExtRegs  []int
+	PC, SP, LR, Status, TLS int
+	// syscall number and argument registers
+	SyscallNr   int
+	SyscallArgs []int
+	// the hook stub loads its id into HookReg, the callback runs when the
+	// stub reaches HookMarker, StackOffset is what the stub pushed by then
+	HookReg     int
+	HookMarker  []byte
+	HookInsns   uint64
+	StackOffset uint64
+	StackAlign  uint64
+	// set on code pointers, the Thumb bit
+	CodeBit  uint64
+	// thread pointer to the first static TLS block
+	TcbSize  uint32
+	Hwcap    uint64
+	// process image mapped like zygote children have it
+	AppProcess string
+	// system library directory name and the ABI apps ship libraries for
+	LibDir string
+	Abi    string
+}
+
+var (
+	ARCH_ARM32 = &Arch{
+		Name: "arm",
+		UcArch: uc.ARCH_ARM,
+		UcMode: uc.MODE_ARM,
+		Machine: EM_ARM,
+		PtrSize: 4,
+		ArgRegs: []int{uc.ARM_REG_R0, uc.ARM_REG_R1, uc.ARM_REG_R2, uc.ARM_REG_R3},
+		GPRegs: []int{
+			uc.ARM_REG_R0, uc.ARM_REG_R1, uc.ARM_REG_R2, uc.ARM_REG_R3,
+			uc.ARM_REG_R4, uc.ARM_REG_R5, uc.ARM_REG_R6, uc.ARM_REG_R7,
+			uc.ARM_REG_R8, uc.ARM_REG_R9, uc.ARM_REG_R10, uc.ARM_REG_R11,
+			uc.ARM_REG_R12,
+		},
+		PC: uc.ARM_REG_PC,
+		SP: uc.ARM_REG_SP,
+		LR: uc.ARM_REG_LR,
+		Status: uc.ARM_REG_CPSR,
+		TLS: uc.ARM_REG_C13_C0_3,
+		SyscallNr: uc.ARM_REG_R7,
+		SyscallArgs: []int{
+			uc.ARM_REG_R0, uc.ARM_REG_R1, uc.ARM_REG_R2, uc.ARM_REG_R3,
+			uc.ARM_REG_R4, uc.ARM_REG_R5, uc.ARM_REG_R6,
+		},
+		HookReg: uc.ARM_REG_R4,
+		// IT AL
+		HookMarker: []byte{0xE8, 0xBF},
+		HookInsns: 4,
+		StackOffset: STACK_OFFSET,
+		StackAlign: 8,
+		CodeBit: 1,
+		TcbSize: 8,
+		Hwcap: ARM_HWCAP,
+		AppProcess: "/system/bin/app_process32",
+		LibDir: "lib",
+		Abi: "armeabi-v7a",
+	}
+	ARCH_ARM64 = &Arch{
+		Name: "arm64",
+		UcArch: uc.ARCH_ARM64,
+		UcMode: uc.MODE_ARM,
+		Machine: EM_AARCH64,
+		Is64: true,
+		PtrSize: 8,
+		ArgRegs: aarch64Regs(0, 8),
+		FPArgRegs: aarch64DRegs(0, 8),
+		GPRegs: aarch64Regs(0, 13),
+		ExtRegs: append(aarch64Regs(13, 29), uc.ARM64_REG_X29),
+		PC: uc.ARM64_REG_PC,
+		SP: uc.ARM64_REG_SP,
+		LR: uc.ARM64_REG_X30,
+		Status: uc.ARM64_REG_NZCV,
+		TLS: uc.ARM64_REG_TPIDR_EL0,
+		SyscallNr: uc.ARM64_REG_X8,
+		SyscallArgs: aarch64Regs(0, 7),
+		HookReg: uc.ARM64_REG_X16,
+		// NOP
+		HookMarker: []byte{0x1F, 0x20, 0x03, 0xD5},
+		HookInsns: 3,
+		StackOffset: 0,
+		StackAlign: 16,
+		TcbSize: 16,
+		Hwcap: ARM64_HWCAP,
+		AppProcess: "/system/bin/app_process64",
+		LibDir: "lib64",
+		Abi: "arm64-v8a",
+	}
+)
+
+// aarch64Regs lists X<from> up to X<to-1>, they are numbered in a row up
+// to X28.
+func aarch64Regs(from, to int) []int {
+	regs := make([]int, 0, to - from)
+	for i := from; i < to; i++ {
+		regs = append(regs, uc.ARM64_REG_X0 + i)
+	}
+	return regs
+}
+// aarch64DRegs lists D<from> up to D<to-1>, the low halves of the V
+// registers.
+func aarch64DRegs(from, to int) []int {
+	regs := make([]int, 0, to - from)
+	for i := from; i < to; i++ {
+		regs = append(regs, uc.ARM64_REG_D0 + i)
+	}
+	return regs
+}
+
+// ArchByName maps Options.Arch to the CPU, "" is arm.
+func ArchByName(name string) (*Arch, error) {
+	switch name {
+	case "", "arm", "armeabi-v7a":
+		return ARCH_ARM32, nil
+	case "arm64", "arm64-v8a", "aarch64":
+		return ARCH_ARM64, nil
+	}
+	return nil, fmt.Errorf("unknown arch %q", name)
+}
+// CodeAddr turns the address of a hook stub into a code pointer.
+func (a *Arch) CodeAddr(addr uint64) uint64 {
+	return addr | a.CodeBit
+}
+// PutPtr encodes a pointer of the guest size.
+func (a *Arch) PutPtr(v uint64) []byte {
+	return IntToBytes(int64(v), int(a.PtrSize))
+}
+// stubAsm is the hook stub. Thumb pushes R4 for the id and pops back to the
+// caller, arm64 uses the scratch register X16 and returns through X30.
+func (a *Arch) stubAsm(id uint64) string {
+	if a.Is64 {
+		return fmt.Sprintf("MOV X16, #0x%x\nNOP\nRET", id)
+	}
+	return fmt.Sprintf("PUSH {R4,LR}\nMOV R4, #0x%x\nIT AL\nPOP {R4,PC}", id)
+}
+
+// unicorn handles do not know their arch, NewEmulator records it for the
+// helpers that only get the handle.
+var (
+	archsMu sync.Mutex
+	archs   = map[uc.Unicorn]*Arch{}
+)
+func bindArch(mu uc.Unicorn, a *Arch) {
+	archsMu.Lock()
+	archs[mu] = a
+	archsMu.Unlock()
+}
+func archOf(mu uc.Unicorn) *Arch {
+	archsMu.Lock()
+	defer archsMu.Unlock()
+	if a, exist := archs[mu]; exist {
+		return a
+	}
+	return ARCH_ARM32
+}
+
+// arm64 uses the generic syscall table, the handlers are registered with
+// the arm EABI numbers, ARM64_SYSCALLS maps one onto the other. Handlers
+// that read or write structures check Arch.Is64 for the layout, signal
+// frames included.
+var ARM64_SYSCALLS = map[uint64]uint64{
+	17: 0xB7,   // getcwd
+	19: 0x164,  // eventfd2
+	20: 0x165,  // epoll_create1
+	21: 0xFB,   // epoll_ctl
+	22: 0x15A,  // epoll_pwait
+	23: 0x29,   // dup
+	24: 0x166,  // dup3
+	25: 0xDD,   // fcntl
+	29: 0x36,   // ioctl
+	34: 0x143,  // mkdirat
+	43: 0x10A,  // statfs
+	48: 0x14E,  // faccessat
+	49: 0x0C,   // chdir
+	50: 0x85,   // fchdir
+	56: 0x142,  // openat
+	57: 0x6,    // close
+	59: 0x167,  // pipe2
+	61: 0xD9,   // getdents64
+	62: 0x13,   // lseek
+	63: 0x3,    // read
+	64: 0x4,    // write
+	65: 0x91,   // readv
+	66: 0x92,   // writev
+	72: 0x14F,  // pselect6
+	73: 0x150,  // ppoll
+	78: 0x14C,  // readlinkat
+	79: 0x147,  // newfstatat
+	80: 0xC5,   // fstat
+	93: 0x1,    // exit
+	94: 0xF8,   // exit_group
+	96: 0x100,  // set_tid_address
+	98: 0xF0,   // futex
+	99: 0x152,  // set_robust_list
+	101: 0xA2,  // nanosleep
+	113: 0x107, // clock_gettime
+	117: 0x1A,  // ptrace
+	124: 0x9E,  // sched_yield
+	129: 0x25,  // kill
+	130: 0xEE,  // tkill
+	131: 0x10C, // tgkill
+	132: 0xBA,  // sigaltstack
+	134: 0xAE,  // rt_sigaction
+	135: 0xAF,  // rt_sigprocmask
+	136: 0xB0,  // rt_sigpending
+	139: 0xAD,  // rt_sigreturn
+	167: 0xAC,  // prctl
+	168: 0x159, // getcpu
+	169: 0x4E,  // gettimeofday
+	172: 0x14,  // getpid
+	173: 0x40,  // getppid
+	174: 0xC7,  // getuid
+	178: 0xE0,  // gettid
+	179: 0x74,  // sysinfo
+	198: 0x119, // socket
+	199: 0x120, // socketpair
+	200: 0x11A, // bind
+	201: 0x11C, // listen
+	202: 0x11D, // accept
+	203: 0x11B, // connect
+	204: 0x11E, // getsockname
+	205: 0x11F, // getpeername
+	206: 0x122, // sendto
+	207: 0x124, // recvfrom
+	208: 0x126, // setsockopt
+	209: 0x127, // getsockopt
+	210: 0x125, // shutdown
+	211: 0x128, // sendmsg
+	212: 0x129, // recvmsg
+	214: 0x2D,  // brk
+	215: 0x5B,  // munmap
+	220: 0x78,  // clone
+	221: 0x0B,  // execve
+	222: 0xC0,  // mmap, as mmap2 with the offset in pages
+	226: 0x7D,  // mprotect
+	227: 0x90,  // msync
+	233: 0xDC,  // madvise
+	242: 0x16E, // accept4
+	260: 0x72,  // wait4
+	270: 0x178, // process_vm_readv
+	278: 0x180, // getrandom
+}
+// syscall turns the number the guest asked for into the handler number
+// and fixes up the arguments that differ, a non zero errno fails the call
+// right away.
+func (a *Arch) syscall(nr uint64, args []uint64) (uint64, uint64) {
+	if !a.Is64 {
+		return nr, 0
+	}
+	idx, exist := ARM64_SYSCALLS[nr]
+	if !exist {
+		// unknown either way, keep it apart from the arm numbers
+		return nr | 0x80000000, 0
+	}
+	if nr == 222 && len(args) > 5 {
+		if args[5] % MMAP2_UNIT != 0 {
+			return idx, EINVAL
+		}
+		args[5] /= MMAP2_UNIT
+	}
+	if nr == 220 && len(args) > 4 {
+		// generic clone is (flags, stack, ptid, ctid, tls), arm swaps the
+		// last two
+		args[3], args[4] = args[4], args[3]
+	}
+	return idx, 0
+}
@@ -0,0 +1,91 @@
+package emulator
+
+import (
+	"fmt"
+	fp  "path/filepath"
+)
+
+var (
+	BACKTRACE_MAX_FRAMES = 16
+
+	// CPSR Thumb state bit
+	CPSR_T uint64 = 1 << 5
+)
+
+// Symbolize renders addr as "module+offset" when it falls inside a loaded
+// module, else relative to the mapping it lies in.
+func (emu *Emulator) Symbolize(addr uint64) string {
+	if emu.Modules != nil {
+		if md := emu.Modules.FindModuleByAddress(addr); md != nil {
+			name := fp.Base(md.Name())
+			if sym, ok := md.IsSymbolAddr(uint32(addr)); ok {
+				return fmt.Sprintf("%s!%s", name, sym)
+			}
+			return fmt.Sprintf("%s+0x%x", name, addr-md.address)
+		}
+	}
+	if emu.Memory != nil {
+		if v := emu.Memory.FindVma(addr); v != nil && v.Name != "" {
+			if v.File != nil {
+				return fmt.Sprintf("%s+0x%x", fp.Base(v.Name), v.Offset + addr - v.Start)
+			}
+			return fmt.Sprintf("%s+0x%x", v.Name, addr - v.Start)
+		}
+	}
+	return fmt.Sprintf("0x%08x", addr)
+}
+
+// Backtrace walks the frame record chain of ctx. There is no unwind info,
+// so it assumes the usual `push {fp, lr}` prologue: R7 in Thumb, R11 in ARM,
+// X29 on arm64.
+func (emu *Emulator) Backtrace(ctx *RegistryContext) []uint64 {
+	if ctx == nil {
+		return nil
+	}
+	frames := []uint64{ctx.PC}
+	if ctx.LR != 0 {
+		frames = append(frames, ctx.LR &^ 1)
+	}
+	fpReg := ctx.R11
+	if emu.Arch.Is64 {
+		fpReg = 0
+		if len(ctx.Ext) > 0 {
+			fpReg = ctx.Ext[len(ctx.Ext)-1]
+		}
+	}else if ctx.CPSR & CPSR_T != 0 {
+		fpReg = ctx.R7
+	}
+	for len(frames) < BACKTRACE_MAX_FRAMES && fpReg != 0 {
+		next, err := ReadPtr(emu.Mu, fpReg)
+		if err != nil {
+			break
+		}
+		lr, err := ReadPtr(emu.Mu, fpReg + emu.Arch.PtrSize)
+		if err != nil {
+			break
+		}
+		lr &^= 1
+		if lr == 0 {
+			break
+		}
+		if lr != frames[len(frames)-1] {
+			frames = append(frames, lr)
+		}
+		// stacks grow down, a sane chain only goes up
+		if next <= fpReg {
+			break
+		}
+		fpReg = next
+	}
+	return frames
+}
+
+// BacktraceStrings is Backtrace with every frame symbolized.
+func (emu *Emulator) BacktraceStrings(ctx *RegistryContext) []string {
+	frames := emu.Backtrace(ctx)
+	r := make([]string, len(frames))
+	for i, f := range frames {
+		r[i] = fmt.Sprintf("#%02d pc %08x %s", i, f, emu.Symbolize(f))
+	}
+	return r
+}
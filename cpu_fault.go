@@ -0,0 +1,180 @@
+package emulator
+
+import (
+	"fmt"
+	"strings"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// ARM exception numbers unicorn hands to HOOK_INTR
+	EXCP_UDEF           uint32 = 1
+	EXCP_PREFETCH_ABORT uint32 = 3
+	EXCP_DATA_ABORT     uint32 = 4
+	EXCP_BKPT           uint32 = 7
+)
+
+// EmulationFault describes a guest CPU fault. It is delivered as a signal
+// when the guest installed a handler, otherwise returned from CallNative.
+type EmulationFault struct {
+	Signo    int
+	Code     int
+	Access   string
+	Addr     uint64
+	Size     int
+	PC       uint64
+	Location string
+	Regs     *RegistryContext
+	Err      error
+}
+func (f *EmulationFault) Error() string {
+	what := "fault"
+	switch f.Signo {
+	case SIGSEGV:
+		what = "SIGSEGV"
+	case SIGBUS:
+		what = "SIGBUS"
+	case SIGILL:
+		what = "SIGILL"
+	case SIGTRAP:
+		what = "SIGTRAP"
+	}
+	return fmt.Sprintf("%s: %s 0x%08x at pc 0x%08x (%s)", what, f.Access, f.Addr, f.PC, f.Location)
+}
+func (f *EmulationFault) Unwrap() error {
+	return f.Err
+}
+// Dump renders the fault with its register file.
+func (f *EmulationFault) Dump() string {
+	var sb strings.Builder
+	sb.WriteString(f.Error())
+	if r := f.Regs; r != nil {
+		sb.WriteString(fmt.Sprintf("\n  r0 %08x  r1 %08x  r2  %08x  r3  %08x", r.R0, r.R1, r.R2, r.R3))
+		sb.WriteString(fmt.Sprintf("\n  r4 %08x  r5 %08x  r6  %08x  r7  %08x", r.R4, r.R5, r.R6, r.R7))
+		sb.WriteString(fmt.Sprintf("\n  r8 %08x  r9 %08x  r10 %08x  r11 %08x", r.R8, r.R9, r.R10, r.R11))
+		sb.WriteString(fmt.Sprintf("\n  ip %08x  sp %08x  lr  %08x  pc  %08x  cpsr %08x", r.R12, r.SP, r.LR, r.PC, r.CPSR))
+	}
+	return sb.String()
+}
+func (f *EmulationFault) sigInfo() *SigInfo {
+	return &SigInfo{
+		Signo: f.Signo,
+		Code: f.Code,
+		Addr: f.Addr,
+	}
+}
+
+// FaultHandler catches invalid accesses and CPU exceptions through unicorn
+// hooks and turns them into EmulationFault.
+type FaultHandler struct {
+	emu     *Emulator
+	pending *EmulationFault
+	logger  zl.Logger
+}
+func NewFaultHandler(emu *Emulator, ih *InterruptHandler, logger zl.Logger) *FaultHandler {
+	fh := &FaultHandler{
+		emu: emu,
+		logger: logger,
+	}
+	_, err := emu.Mu.HookAdd(uc.HOOK_MEM_INVALID, fh.hookMemInvalid, 1, 0)
+	if err != nil {
+		logger.Debug().Err(err).Msg("failed to add invalid memory hook")
+	}
+	ih.SetHandler(EXCP_UDEF, fh.exception(SIGILL, ILL_ILLOPC, "undefined instruction"))
+	ih.SetHandler(EXCP_PREFETCH_ABORT, fh.exception(SIGSEGV, SEGV_ACCERR, "prefetch abort"))
+	ih.SetHandler(EXCP_DATA_ABORT, fh.exception(SIGSEGV, SEGV_ACCERR, "data abort"))
+	ih.SetHandler(EXCP_BKPT, fh.exception(SIGTRAP, TRAP_BRKPT, "breakpoint"))
+	return fh
+}
+func (fh *FaultHandler) newFault(mu uc.Unicorn, signo, code int, access string, addr uint64, size int) *EmulationFault {
+	regs, err := RegContextSave(mu)
+	if err != nil {
+		fh.logger.Debug().Err(err).Msg("fault register dump failed")
+		regs = &RegistryContext{}
+	}
+	return &EmulationFault{
+		Signo: signo,
+		Code: code,
+		Access: access,
+		Addr: addr,
+		Size: size,
+		PC: regs.PC,
+		Location: fh.emu.Symbolize(regs.PC),
+		Regs: regs,
+	}
+}
+func (fh *FaultHandler) hookMemInvalid(mu uc.Unicorn, access int, addr uint64, size int, value int64) bool {
+	var (
+		code = SEGV_MAPERR
+		kind string
+	)
+	switch access {
+	case uc.MEM_READ_UNMAPPED:
+		kind = "read unmapped"
+	case uc.MEM_WRITE_UNMAPPED:
+		kind = "write unmapped"
+	case uc.MEM_FETCH_UNMAPPED:
+		kind = "fetch unmapped"
+	case uc.MEM_READ_PROT:
+		kind, code = "read protected", SEGV_ACCERR
+	case uc.MEM_WRITE_PROT:
+		kind, code = "write protected", SEGV_ACCERR
+	case uc.MEM_FETCH_PROT:
+		kind, code = "fetch protected", SEGV_ACCERR
+	default:
+		kind = fmt.Sprintf("access(%d)", access)
+	}
+	fh.pending = fh.newFault(mu, SIGSEGV, code, kind, addr, size)
+	fh.logger.Debug().
+		Str("access", kind).
+		Str("addr", ConvHex("0x%08X", addr)).
+		Int("size", size).
+		Str("pc", ConvHex("0x%08X", fh.pending.PC)).
+		Str("at", fh.pending.Location).
+		Msg("invalid memory access")
+	// let unicorn abort the run, Scheduler.Run decides what happens next
+	return false
+}
+func (fh *FaultHandler) exception(signo, code int, what string) func(uc.Unicorn) {
+	return func(mu uc.Unicorn) {
+		fh.pending = fh.newFault(mu, signo, code, what, 0, 0)
+		fh.pending.Addr = fh.pending.PC
+		fh.logger.Debug().
+			Str("pc", ConvHex("0x%08X", fh.pending.PC)).
+			Str("at", fh.pending.Location).
+			Msg(what)
+		if err := mu.Stop(); err != nil {
+			fh.logger.Debug().Err(err).Msg("stopping emulation")
+		}
+	}
+}
+// take returns the fault behind the last stop of the CPU, if any.
+func (fh *FaultHandler) take(mu uc.Unicorn, err error) *EmulationFault {
+	if fh == nil {
+		return nil
+	}
+	f := fh.pending
+	fh.pending = nil
+	if f == nil {
+		ucErr, ok := err.(uc.UcError)
+		if !ok {
+			return nil
+		}
+		switch ucErr {
+		case uc.ERR_INSN_INVALID:
+			f = fh.newFault(mu, SIGILL, ILL_ILLOPC, "invalid instruction", 0, 0)
+			f.Addr = f.PC
+		case uc.ERR_READ_UNALIGNED, uc.ERR_WRITE_UNALIGNED, uc.ERR_FETCH_UNALIGNED:
+			f = fh.newFault(mu, SIGBUS, BUS_ADRALN, "unaligned access", 0, 0)
+		case uc.ERR_READ_UNMAPPED, uc.ERR_WRITE_UNMAPPED, uc.ERR_FETCH_UNMAPPED:
+			f = fh.newFault(mu, SIGSEGV, SEGV_MAPERR, "unmapped access", 0, 0)
+		case uc.ERR_READ_PROT, uc.ERR_WRITE_PROT, uc.ERR_FETCH_PROT:
+			f = fh.newFault(mu, SIGSEGV, SEGV_ACCERR, "protected access", 0, 0)
+		default:
+			return nil
+		}
+	}
+	f.Err = err
+	return f
+}
@@ -7,6 +7,7 @@ import (
 type InterruptHandler struct {
 	mu       uc.Unicorn
 	handler  map[uint32]func(uc.Unicorn)
+	halted   bool
 
 	logger   zl.Logger
 }
@@ -24,10 +25,21 @@ func (ih *InterruptHandler) SetLogger(logger zl.Logger) {
 func (ih *InterruptHandler) SetHandler(intno uint32, handler func(uc.Unicorn)) {
 	ih.handler[intno] = handler
 }
+// Halt stops the emulation for good, as opposed to a scheduler yield.
+func (ih *InterruptHandler) Halt(mu uc.Unicorn) error {
+	ih.halted = true
+	return mu.Stop()
+}
+// takeHalted reports whether Halt was called since the last check.
+func (ih *InterruptHandler) takeHalted() bool {
+	h := ih.halted
+	ih.halted = false
+	return h
+}
 func (ih *InterruptHandler) hookInterrupt(mu uc.Unicorn, intno uint32) {
 	cb, exist := ih.handler[intno]
 	if !exist {
-		regx, err := mu.RegRead(uc.ARM_REG_PC)
+		regx, err := mu.RegRead(archOf(mu).PC)
 		ih.logger.Debug().
 			Err(err).
 			Msg("reading reg PC")
@@ -35,7 +47,7 @@ func (ih *InterruptHandler) hookInterrupt(mu uc.Unicorn, intno uint32) {
 			Uint32("intno", intno).
 			Uint64("pc", regx).
 			Msg("unhandled interrupt")
-		ih.logger.Debug().Err(mu.Stop()).Msg("stopping emulation")
+		ih.logger.Debug().Err(ih.Halt(mu)).Msg("stopping emulation")
 		//panic(fmt.Sprintf("Unhandled interrupt %d at %x, stopping emulation", intno, regx))
 		return
 	}
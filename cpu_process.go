@@ -0,0 +1,360 @@
+package emulator
+
+import (
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// upper bound on argv/envp entries read from an execve call
+	EXECVE_MAX_ARGS = 256
+)
+
+var (
+	// wait4 options
+	WNOHANG    uint64 = 0x1
+	WUNTRACED  uint64 = 0x2
+	WCONTINUED uint64 = 0x8
+	WNOTHREAD  uint64 = 0x20000000
+	WALL       uint64 = 0x40000000
+	WCLONE     uint64 = 0x80000000
+)
+
+// ChildProcess is a process the guest forked. Unless Config.ForkRunChild is
+// set it never runs, wait4 reaps it with Config.WaitStatus.
+type ChildProcess struct {
+	Pid     int
+	Ran     bool
+	Exited  bool
+	Status  int
+	Reaped  bool
+}
+
+// ExecRequest records one execve call.
+type ExecRequest struct {
+	Pid  int
+	Path string
+	Argv []string
+	Envp []string
+}
+
+// forkSnapshot is the parent side of a fork while the child path runs.
+type forkSnapshot struct {
+	child    *ChildProcess
+	memory   *MemorySnapshot
+	fds      *PcbSnapshot
+	files    *MemoryBackendSnapshot
+	signals  *signalSnapshot
+	traced   bool
+	children []*ChildProcess
+	brkBase  uint64
+	brkCur   uint64
+	thread   *EmulatedThread
+	ctx      *RegistryContext
+	threads  []*EmulatedThread
+	nextTid  int
+}
+
+// Processes models fork, vfork, execve and wait4 for a single emulated
+// process. Behaviour is driven by Config.ForkMode and friends.
+type Processes struct {
+	emu      *Emulator
+	sched    *Scheduler
+	config   *Config
+
+	children []*ChildProcess
+	Execs    []*ExecRequest
+	nextPid  int
+	parent   *forkSnapshot
+
+	logger   zl.Logger
+}
+func NewProcesses(emu *Emulator, sh *SyscallHandlers, sched *Scheduler, logger zl.Logger) *Processes {
+	p := &Processes{
+		emu: emu,
+		sched: sched,
+		config: emu.config,
+		nextPid: emu.config.ChildPid,
+		logger: logger,
+	}
+	if p.nextPid == 0 {
+		// keep clear of the thread ids handed out by the scheduler
+		p.nextPid = emu.config.Pid + 34
+	}
+	sh.SetHandler(0x2, "fork", 0, p.forkHandle)
+	sh.SetHandler(0x0B, "execve", 3, p.execveHandle)
+	sh.SetHandler(0x14, "getpid", 0, p.getpidHandle)
+	sh.SetHandler(0x40, "getppid", 0, p.getppidHandle)
+	sh.SetHandler(0x72, "wait4", 4, p.wait4Handle)
+	sh.SetHandler(0xBE, "vfork", 0, p.vforkHandle)
+	return p
+}
+func (p *Processes) Children() []*ChildProcess {
+	return p.children
+}
+// InChild reports whether the child path of a fork is currently running.
+func (p *Processes) InChild() bool {
+	return p != nil && p.parent != nil
+}
+// Pid is the pid of whichever side of a fork is running.
+func (p *Processes) Pid() int {
+	if p.InChild() {
+		return p.parent.child.Pid
+	}
+	return p.config.Pid
+}
+
+// fork returns what the calling side of fork sees.
+func (p *Processes) fork(mu uc.Unicorn, name string) (uint64, bool) {
+	mode := p.config.ForkMode
+	if mode == "" {
+		mode = FORK_PARENT
+	}
+	if p.InChild() {
+		// no grandchildren, the nested child never runs
+		mode = FORK_PARENT
+	}
+	switch mode {
+	case FORK_FAIL:
+		p.logger.Debug().Str("call", name).Msg("fork refused")
+		return errnoRet(EAGAIN), true
+	case FORK_CHILD:
+		p.logger.Debug().Str("call", name).Msg("fork, continuing as child")
+		return 0, true
+	}
+	child := &ChildProcess{
+		Pid: p.nextPid,
+	}
+	p.nextPid++
+	p.children = append(p.children, child)
+	if p.config.ForkRunChild && !p.InChild() {
+		err := p.enterChild(mu, child)
+		if err == nil {
+			p.logger.Debug().Str("call", name).Int("pid", child.Pid).Msg("fork, running child path first")
+			return 0, true
+		}
+		p.logger.Debug().Err(err).Msg("fork snapshot failed, child will not run")
+	}
+	p.logger.Debug().Str("call", name).Int("pid", child.Pid).Msg("fork, continuing as parent")
+	return uint64(child.Pid), true
+}
+// enterChild saves the parent and turns the calling thread into the only
+// thread of the child.
+func (p *Processes) enterChild(mu uc.Unicorn, child *ChildProcess) error {
+	s := p.sched
+	ctx, err := RegContextSave(mu)
+	if err != nil {
+		return err
+	}
+	mem, err := p.emu.Memory.Snapshot()
+	if err != nil {
+		return err
+	}
+	brkBase, brkCur := p.emu.NativeMemory.Brk()
+	// parent resumes after the svc with the child pid
+	ctx.R0 = uint64(child.Pid)
+	cur := s.current
+	if tls, err := mu.RegRead(p.emu.Arch.TLS); err == nil {
+		cur.tls = tls
+	}
+	p.parent = &forkSnapshot{
+		child: child,
+		memory: mem,
+		fds: p.emu.Pcb.Snapshot(),
+		files: p.emu.Vfs.Files().Snapshot(),
+		signals: p.emu.Signals.snapshot(),
+		traced: p.emu.AntiDebug.traced,
+		children: p.children,
+		brkBase: brkBase,
+		brkCur: brkCur,
+		thread: cur,
+		ctx: ctx,
+		threads: s.threads,
+		nextTid: s.nextTid,
+	}
+	t := &EmulatedThread{
+		Tid: child.Pid,
+		State: ThreadRunnable,
+		tls: cur.tls,
+		sigMask: cur.sigMask,
+		altStack: cur.altStack,
+	}
+	s.threads = []*EmulatedThread{t}
+	s.current = t
+	// the parent's other children are not the child's to wait for
+	p.children = nil
+	child.Ran = true
+	return nil
+}
+// leaveChild is called by Scheduler.Run once the child path is over, the
+// returned thread is the parent, ready to be switched to.
+func (p *Processes) leaveChild(status int) (*EmulatedThread, error) {
+	snap := p.parent
+	p.parent = nil
+	snap.child.Exited = true
+	snap.child.Status = status
+	p.logger.Debug().Int("pid", snap.child.Pid).Int("status", status).Msg("child path finished, back to parent")
+	err := p.emu.Memory.Restore(snap.memory)
+	if err != nil {
+		return nil, err
+	}
+	// descriptors the child closed or replaced are the parent's again
+	p.emu.Pcb.Restore(snap.fds)
+	// so are files, handlers and the tracer, the child has its own copies
+	p.emu.Vfs.Files().Restore(snap.files)
+	p.emu.Signals.restore(snap.signals)
+	p.emu.AntiDebug.traced = snap.traced
+	p.children = snap.children
+	p.emu.NativeMemory.brkBase = snap.brkBase
+	p.emu.NativeMemory.brkCur = snap.brkCur
+	s := p.sched
+	s.threads = snap.threads
+	s.nextTid = snap.nextTid
+	snap.thread.ctx = snap.ctx
+	return snap.thread, nil
+}
+
+// wstatus for a normal exit
+func exitWaitStatus(code int) uint64 {
+	return uint64(code & 0xff) << 8
+}
+
+func (p *Processes) readStrings(mu uc.Unicorn, addr uint64) []string {
+	var res []string
+	if addr == 0 {
+		return res
+	}
+	for i := 0; i < EXECVE_MAX_ARGS; i++ {
+		ptr, err := ReadPtr(mu, addr + uint64(i) * p.emu.Arch.PtrSize)
+		if err != nil || ptr == 0 {
+			break
+		}
+		s, err := ReadCString(mu, ptr, MAX_ARG_STRLEN)
+		if err != nil {
+			break
+		}
+		res = append(res, string(s))
+	}
+	return res
+}
+
+// syscall fork
+func (p *Processes) forkHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return p.fork(mu, "fork")
+}
+// syscall vfork, the parent is suspended until the child execs or exits
+// anyway, so it is modelled as fork
+func (p *Processes) vforkHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return p.fork(mu, "vfork")
+}
+/* syscall execve
+int execve(const char *filename, char *const argv[], char *const envp[]);
+*/
+func (p *Processes) execveHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	path, err := ReadCString(mu, args[0], uint64(PATH_MAX - 1))
+	if err == ErrStringTooLong {
+		return errnoRet(ENAMETOOLONG), true
+	}
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	req := &ExecRequest{
+		Pid: p.Pid(),
+		Path: string(path),
+		Argv: p.readStrings(mu, args[1]),
+		Envp: p.readStrings(mu, args[2]),
+	}
+	p.Execs = append(p.Execs, req)
+	p.logger.Info().
+		Int("pid", req.Pid).
+		Str("path", req.Path).
+		Strs("argv", req.Argv).
+		Int("result", p.config.ExecveResult).
+		Msg("execve")
+	if p.config.ExecveResult != 0 {
+		return uint64(int64(p.config.ExecveResult)), true
+	}
+	if p.InChild() {
+		// the new image replaces the child, it ends with the configured status
+		p.sched.exited = true
+		p.sched.exitCode = p.config.WaitStatus
+		p.sched.requestSwitch(mu)
+		return 0, false
+	}
+	// the emulated process itself cannot be replaced, pretend it went fine
+	p.emu.Pcb.CloseExecFds()
+	return 0, true
+}
+// syscall getpid
+func (p *Processes) getpidHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return uint64(p.Pid()), true
+}
+// syscall getppid
+func (p *Processes) getppidHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	if p.InChild() {
+		return uint64(p.config.Pid), true
+	}
+	return uint64(p.config.Ppid), true
+}
+// waitMatches reports whether wait4's pid selects c. Children stay in the
+// caller's process group, which is the one of the parent, Config.Ppid.
+func (p *Processes) waitMatches(c *ChildProcess, pid int) bool {
+	switch {
+	case pid > 0:
+		return c.Pid == pid
+	case pid < -1:
+		return -pid == p.config.Ppid
+	}
+	// -1 is any child, 0 any child in the caller's group
+	return true
+}
+/* syscall wait4
+pid_t wait4(pid_t pid, int *wstatus, int options, struct rusage *rusage);
+*/
+func (p *Processes) wait4Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	pid := int(int32(args[0]))
+	wstatus, options, rusage := args[1], args[2] & 0xffffffff, args[3]
+	if options &^ (WNOHANG | WUNTRACED | WCONTINUED | WNOTHREAD | WALL | WCLONE) != 0 {
+		return errnoRet(EINVAL), true
+	}
+	var child *ChildProcess
+	waiting := false
+	for _, c := range p.children {
+		if c.Reaped || !p.waitMatches(c, pid) {
+			continue
+		}
+		waiting = true
+		// a child that never runs has exited by the time it is waited for
+		if c.Ran && !c.Exited {
+			continue
+		}
+		child = c
+		break
+	}
+	if child == nil && waiting && options & WNOHANG != 0 {
+		return 0, true
+	}
+	if child == nil {
+		return errnoRet(ECHILD), true
+	}
+	status := p.config.WaitStatus
+	if child.Ran {
+		status = child.Status
+	}
+	if wstatus != 0 {
+		err := mu.MemWrite(wstatus, IntToBytes(int64(exitWaitStatus(status)), 4))
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	if rusage != 0 {
+		// struct rusage, 18 longs
+		err := mu.MemWrite(rusage, make([]byte, 18 * p.emu.Arch.PtrSize))
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	child.Reaped = true
+	p.logger.Debug().Int("pid", child.Pid).Int("status", status).Msg("wait4 reaped child")
+	return uint64(child.Pid), true
+}
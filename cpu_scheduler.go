@@ -0,0 +1,705 @@
+package emulator
+
+import (
+	"fmt"
+	"strings"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// instructions a thread may run before it is preempted,
+	// only enforced while more than one thread is alive
+	THREAD_INSTRUCTION_BUDGET uint64 = 100000
+	// stack given to a CLONE_VM child that did not bring its own
+	THREAD_STACK_SIZE uint64 = 0x00100000
+)
+
+const (
+	ThreadRunnable int = iota
+	ThreadBlocked
+	ThreadExited
+)
+
+func threadStateName(state int) string {
+	switch state {
+	case ThreadRunnable:
+		return "runnable"
+	case ThreadBlocked:
+		return "blocked"
+	case ThreadExited:
+		return "exited"
+	}
+	return "unknown"
+}
+
+// EmulatedThread is a guest thread created by clone(CLONE_VM).
+// Threads share the unicorn instance, only one of them owns the CPU at a time.
+type EmulatedThread struct {
+	Tid      int
+	State    int
+	ExitCode int
+
+	ctx      *RegistryContext
+	tls      uint64
+	clearTid uint64
+
+	// futex wait queue membership
+	futexAddr  uint64
+	futexMask  uint64
+	futexTimed bool
+	waitSeq    uint64
+
+	// blocked in a read, write or poll that runs again once woken
+	ioWait     string
+	ioTimed    bool
+	ioResume   uint64
+
+	// signal state, see Signals
+	sigMask    uint64
+	sigPending uint64
+	sigInfos   map[int]*SigInfo
+	altStack   sigAltStack
+	sigReturn  *RegistryContext
+}
+func (t *EmulatedThread) Context() *RegistryContext {
+	return t.ctx
+}
+func (t *EmulatedThread) Tls() uint64 {
+	return t.tls
+}
+
+// ExitError is returned by a run that ended with exit_group.
+type ExitError struct {
+	Code int
+}
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("emulated process exited with status %d", e.Code)
+}
+
+type ThreadReport struct {
+	Tid       int
+	State     string
+	PC        uint64
+	Location  string
+	FutexAddr uint64
+	IoWait    string
+	Backtrace []string
+}
+
+// DeadlockError is returned when every live thread is blocked.
+type DeadlockError struct {
+	Threads []ThreadReport
+}
+func (e *DeadlockError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("deadlock: all emulated threads are blocked")
+	for _, t := range e.Threads {
+		sb.WriteString(fmt.Sprintf("\n  tid %d (%s) pc %08x %s", t.Tid, t.State, t.PC, t.Location))
+		if t.FutexAddr != 0 {
+			sb.WriteString(fmt.Sprintf(" futex_wait 0x%08x", t.FutexAddr))
+		}
+		if t.IoWait != "" {
+			sb.WriteString(" " + t.IoWait)
+		}
+		for _, f := range t.Backtrace {
+			sb.WriteString("\n    " + f)
+		}
+	}
+	return sb.String()
+}
+
+// Scheduler switches guest threads cooperatively: on a blocking futex wait,
+// on thread exit, or when the running thread used up its instruction budget.
+type Scheduler struct {
+	emu     *Emulator
+	mu      uc.Unicorn
+	ih      *InterruptHandler
+
+	threads []*EmulatedThread
+	current *EmulatedThread
+	nextTid int
+	waitSeq uint64
+	yield   bool
+
+	exited   bool
+	exitCode int
+
+	InstructionBudget uint64
+
+	logger  zl.Logger
+}
+func NewScheduler(emu *Emulator, sh *SyscallHandlers, logger zl.Logger) *Scheduler {
+	s := &Scheduler{
+		emu: emu,
+		mu: emu.Mu,
+		ih: sh.ih,
+		nextTid: emu.config.Pid + 1,
+		InstructionBudget: THREAD_INSTRUCTION_BUDGET,
+		logger: logger,
+	}
+	// main thread, tid == pid
+	s.current = &EmulatedThread{
+		Tid: emu.config.Pid,
+		State: ThreadRunnable,
+	}
+	s.threads = append(s.threads, s.current)
+	sh.SetHandler(0x1, "exit", 1, s.exitHandle)
+	sh.SetHandler(0x78, "clone", 5, s.cloneHandle)
+	sh.SetHandler(0x9E, "sched_yield", 0, s.schedYieldHandle)
+	sh.SetHandler(0xE0, "gettid", 0, s.gettidHandle)
+	sh.SetHandler(0xF0, "futex", 6, s.futexHandle)
+	sh.SetHandler(0xF8, "exit_group", 1, s.exitGroupHandle)
+	sh.SetHandler(0x100, "set_tid_address", 1, s.setTidAddressHandle)
+	sh.SetHandler(0x152, "set_robust_list", 2, s.setRobustListHandle)
+	return s
+}
+func (s *Scheduler) Current() *EmulatedThread {
+	return s.current
+}
+func (s *Scheduler) Threads() []*EmulatedThread {
+	return s.threads
+}
+func (s *Scheduler) FindThread(tid int) *EmulatedThread {
+	for _, t := range s.threads {
+		if t.Tid == tid {
+			return t
+		}
+	}
+	return nil
+}
+func (s *Scheduler) alive() int {
+	n := 0
+	for _, t := range s.threads {
+		if t.State != ThreadExited {
+			n++
+		}
+	}
+	return n
+}
+// requestSwitch makes Run pick the next thread once the current hook returns.
+func (s *Scheduler) requestSwitch(mu uc.Unicorn) {
+	s.yield = true
+	if err := mu.Stop(); err != nil {
+		s.logger.Debug().Err(err).Msg("scheduler stop failed")
+	}
+}
+// pickNext returns the first runnable thread after cur, round robin.
+func (s *Scheduler) pickNext(cur *EmulatedThread) *EmulatedThread {
+	idx := 0
+	for i, t := range s.threads {
+		if t == cur {
+			idx = i
+			break
+		}
+	}
+	n := len(s.threads)
+	for i := 1; i <= n; i++ {
+		t := s.threads[(idx+i)%n]
+		if t.State == ThreadRunnable {
+			return t
+		}
+	}
+	return nil
+}
+// expireTimedWaits wakes every timed futex waiter with ETIMEDOUT; used when
+// nothing else can run, time is virtual so the timeout elapses immediately.
+func (s *Scheduler) expireTimedWaits() bool {
+	woken := false
+	for _, t := range s.threads {
+		if t.State == ThreadBlocked && t.futexTimed {
+			t.State = ThreadRunnable
+			t.futexAddr = 0
+			t.futexTimed = false
+			t.ctx.R0 = errnoRet(ETIMEDOUT)
+			woken = true
+		}else if t.State == ThreadBlocked && t.ioTimed {
+			// poll family, nothing became ready in time
+			t.State = ThreadRunnable
+			t.ioWait = ""
+			t.ioTimed = false
+			t.ctx.PC = t.ioResume
+			t.ctx.R0 = 0
+			woken = true
+		}
+	}
+	return woken
+}
+func (s *Scheduler) saveCurrent() error {
+	ctx, err := RegContextSave(s.mu)
+	if err != nil {
+		return err
+	}
+	s.current.ctx = ctx
+	if tls, err := s.mu.RegRead(s.emu.Arch.TLS); err == nil {
+		s.current.tls = tls
+	}
+	return nil
+}
+func (s *Scheduler) switchTo(t *EmulatedThread) error {
+	err := RegContextRestore(s.mu, t.ctx)
+	if err != nil {
+		return err
+	}
+	err = s.mu.RegWrite(s.emu.Arch.TLS, t.tls)
+	if err != nil {
+		s.logger.Debug().Err(err).Int("tid", t.Tid).Msg("failed to restore tls register")
+	}
+	s.emu.TLS.publish(s.mu, t.tls)
+	if s.current != t {
+		s.logger.Debug().Int("from", s.current.Tid).Int("to", t.Tid).Msg("thread switch")
+	}
+	s.current = t
+	return nil
+}
+func (s *Scheduler) deadlock() error {
+	e := &DeadlockError{}
+	for _, t := range s.threads {
+		r := ThreadReport{
+			Tid: t.Tid,
+			State: threadStateName(t.State),
+			FutexAddr: t.futexAddr,
+			IoWait: t.ioWait,
+		}
+		if t.ctx != nil {
+			r.PC = t.ctx.PC
+			r.Location = s.emu.Symbolize(t.ctx.PC)
+			r.Backtrace = s.emu.BacktraceStrings(t.ctx)
+		}
+		e.Threads = append(e.Threads, r)
+	}
+	return e
+}
+func startAddr(ctx *RegistryContext) uint64 {
+	if ctx.CPSR & CPSR_T != 0 {
+		return ctx.PC | 1
+	}
+	return ctx.PC
+}
+// Run executes from begin until the calling thread reaches until,
+// interleaving any other guest threads on the way.
+func (s *Scheduler) Run(begin, until uint64) error {
+	owner := s.current
+	pc := begin
+	s.exited = false
+	for {
+		opts := &uc.UcOptions{}
+		if s.alive() > 1 {
+			opts.Count = s.InstructionBudget
+		}
+		err := s.mu.StartWithOptions(pc, until, opts)
+		fault := s.emu.Faults.take(s.mu, err)
+		if fault == nil {
+			if err != nil {
+				return err
+			}
+			if s.ih.takeHalted() {
+				return nil
+			}
+			if s.exited && !s.emu.Processes.InChild() {
+				return &ExitError{Code: s.exitCode}
+			}
+		}
+		s.yield = false
+		err = s.saveCurrent()
+		if err != nil {
+			return err
+		}
+		if fault == nil && s.exited {
+			// exit_group or a successful execve ended the child path of a fork
+			s.exited = false
+			err = s.resumeParent(s.exitCode)
+			if err != nil {
+				return err
+			}
+			pc = startAddr(s.current.ctx)
+			continue
+		}
+		cur := s.current
+		if fault != nil {
+			if s.emu.Signals == nil || !s.emu.Signals.raiseFault(cur, fault) {
+				return fault
+			}
+			// the handler frame is built on the faulting context
+			cur.ctx = fault.Regs
+		}
+		if cur.State == ThreadRunnable && cur.ctx.PC == until {
+			if cur == owner {
+				return nil
+			}
+			// not ours to return to
+			cur.State = ThreadExited
+		}
+		next := s.pickNext(cur)
+		if next == nil && s.expireTimedWaits() {
+			next = s.pickNext(cur)
+		}
+		if next == nil && s.emu.Processes.InChild() {
+			// the child ran out of threads or returned past the forking call
+			err = s.resumeParent(cur.ExitCode)
+			if err != nil {
+				return err
+			}
+			pc = startAddr(s.current.ctx)
+			continue
+		}
+		if next == nil {
+			if owner.State == ThreadExited {
+				return nil
+			}
+			return s.deadlock()
+		}
+		if s.emu.Signals != nil {
+			err = s.emu.Signals.dispatch(next)
+			if err != nil {
+				return err
+			}
+		}
+		// always restore, signal delivery may have rewritten the context
+		err = s.switchTo(next)
+		if err != nil {
+			return err
+		}
+		pc = startAddr(next.ctx)
+	}
+}
+
+// resumeParent drops the child side of a fork and puts the parent back on
+// the CPU.
+func (s *Scheduler) resumeParent(status int) error {
+	t, err := s.emu.Processes.leaveChild(status)
+	if err != nil {
+		return err
+	}
+	return s.switchTo(t)
+}
+
+// syscall exit, ends the calling thread only
+func (s *Scheduler) exitHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	t := s.current
+	t.State = ThreadExited
+	t.ExitCode = int(int32(args[0]))
+	s.logger.Debug().Int("tid", t.Tid).Int("code", t.ExitCode).Msg("thread exit")
+	s.emu.TLS.Release(t.Tid)
+	if t.clearTid != 0 {
+		err := mu.MemWrite(t.clearTid, IntToBytes(0, 4))
+		if err != nil {
+			s.logger.Debug().Err(err).Msg("failed to clear child tid")
+		}
+		s.futexWake(t.clearTid, 1, FUTEX_BITSET_MATCH_ANY)
+	}
+	s.requestSwitch(mu)
+	return 0, true
+}
+// syscall exit_group
+func (s *Scheduler) exitGroupHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s.exited = true
+	s.exitCode = int(int32(args[0]))
+	s.logger.Debug().Int("code", s.exitCode).Msg("exit_group")
+	s.requestSwitch(mu)
+	return 0, true
+}
+/* syscall clone
+long clone(unsigned long flags, void *child_stack, int *ptid, unsigned long tls, int *ctid);
+*/
+func (s *Scheduler) cloneHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	flags, childStack, ptid, tls, ctid := args[0], args[1], args[2], args[3], args[4]
+	if flags & CLONE_VM == 0 {
+		// fork-like clone, the address space is not shared
+		s.logger.Debug().Str("flags", ConvHex("0x%X", flags)).Msg("clone without CLONE_VM")
+		return s.emu.Processes.fork(mu, "clone")
+	}
+	ctx, err := RegContextSave(mu)
+	if err != nil {
+		s.logger.Debug().Err(err).Msg("clone failed to save context")
+		return errnoRet(EAGAIN), true
+	}
+	t := &EmulatedThread{
+		Tid: s.nextTid,
+		State: ThreadRunnable,
+		ctx: ctx,
+	}
+	s.nextTid++
+	// child sees 0 and continues right after the svc
+	ctx.R0 = 0
+	if childStack == 0 {
+		stack, err := s.emu.Memory.Map(0, THREAD_STACK_SIZE, uc.PROT_READ | uc.PROT_WRITE, nil, 0)
+		if err != nil {
+			s.logger.Debug().Err(err).Msg("clone failed to map thread stack")
+			return errnoRet(ENOMEM), true
+		}
+		s.emu.Memory.SetName(stack, THREAD_STACK_SIZE, "[anon:thread stack]")
+		childStack = stack + THREAD_STACK_SIZE
+	}
+	ctx.SP = childStack
+	if flags & CLONE_SETTLS != 0 {
+		t.tls = tls
+	}else{
+		// errno and the static TLS blocks must not be shared
+		tp, err := s.emu.TLS.NewArea(t.Tid)
+		if err != nil {
+			s.logger.Debug().Err(err).Msg("clone failed to map thread tls")
+			return errnoRet(ENOMEM), true
+		}
+		t.tls = tp
+	}
+	tidBytes := IntToBytes(int64(t.Tid), 4)
+	if flags & CLONE_PARENT_SETTID != 0 && ptid != 0 {
+		if err := mu.MemWrite(ptid, tidBytes); err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	if flags & CLONE_CHILD_SETTID != 0 && ctid != 0 {
+		if err := mu.MemWrite(ctid, tidBytes); err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	if flags & CLONE_CHILD_CLEARTID != 0 {
+		t.clearTid = ctid
+	}
+	s.threads = append(s.threads, t)
+	s.logger.Debug().
+		Int("tid", t.Tid).
+		Str("flags", ConvHex("0x%X", flags)).
+		Str("sp", ConvHex("0x%08X", childStack)).
+		Str("tls", ConvHex("0x%08X", t.tls)).
+		Str("pc", ConvHex("0x%08X", ctx.PC)).
+		Msg("thread created")
+	return uint64(t.Tid), true
+}
+// syscall sched_yield
+func (s *Scheduler) schedYieldHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	if s.alive() > 1 {
+		s.requestSwitch(mu)
+	}
+	return 0, true
+}
+// syscall gettid
+func (s *Scheduler) gettidHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return uint64(s.current.Tid), true
+}
+// syscall set_tid_address
+func (s *Scheduler) setTidAddressHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s.current.clearTid = args[0]
+	return uint64(s.current.Tid), true
+}
+// syscall set_robust_list, robust futexes are not tracked
+func (s *Scheduler) setRobustListHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return 0, true
+}
+
+func (s *Scheduler) futexWait(mu uc.Unicorn, uaddr, mask uint64, timed bool) {
+	t := s.current
+	t.State = ThreadBlocked
+	t.futexAddr = uaddr
+	t.futexMask = mask
+	t.futexTimed = timed
+	s.waitSeq++
+	t.waitSeq = s.waitSeq
+	s.requestSwitch(mu)
+}
+// ioBlock parks the calling thread inside its syscall, the svc runs again
+// once ioWake is called. It returns false when no other thread could wake
+// it, the caller should then fail with EAGAIN instead of hanging.
+func (s *Scheduler) ioBlock(mu uc.Unicorn, what string, timed bool) bool {
+	if s.alive() < 2 {
+		return false
+	}
+	arch := s.emu.Arch
+	pc, err := mu.RegRead(arch.PC)
+	if err != nil {
+		return false
+	}
+	cpsr, err := mu.RegRead(arch.Status)
+	if err != nil {
+		return false
+	}
+	svc := uint64(4)
+	if !arch.Is64 && cpsr & CPSR_T != 0 {
+		svc = 2
+	}
+	err = mu.RegWrite(arch.PC, pc - svc)
+	if err != nil {
+		return false
+	}
+	t := s.current
+	t.State = ThreadBlocked
+	t.ioWait = what
+	t.ioTimed = timed
+	t.ioResume = pc
+	s.requestSwitch(mu)
+	return true
+}
+// ioWake makes every thread blocked by ioBlock retry its syscall.
+func (s *Scheduler) ioWake() {
+	for _, t := range s.threads {
+		if t.State == ThreadBlocked && t.ioWait != "" {
+			t.State = ThreadRunnable
+			t.ioWait = ""
+			t.ioTimed = false
+		}
+	}
+}
+// futexWaiters returns the threads waiting on uaddr, oldest first.
+func (s *Scheduler) futexWaiters(uaddr, mask uint64) []*EmulatedThread {
+	var r []*EmulatedThread
+	for _, t := range s.threads {
+		if t.State == ThreadBlocked && t.futexAddr == uaddr && t.futexMask & mask != 0 {
+			r = append(r, t)
+		}
+	}
+	for i := 1; i < len(r); i++ {
+		for j := i; j > 0 && r[j].waitSeq < r[j-1].waitSeq; j-- {
+			r[j], r[j-1] = r[j-1], r[j]
+		}
+	}
+	return r
+}
+func (s *Scheduler) futexWake(uaddr uint64, n int, mask uint64) int {
+	woken := 0
+	for _, t := range s.futexWaiters(uaddr, mask) {
+		if woken >= n {
+			break
+		}
+		t.State = ThreadRunnable
+		t.futexAddr = 0
+		t.futexTimed = false
+		woken++
+	}
+	return woken
+}
+func (s *Scheduler) futexRequeue(uaddr, uaddr2 uint64, nWake, nRequeue int) int {
+	woken := s.futexWake(uaddr, nWake, FUTEX_BITSET_MATCH_ANY)
+	moved := 0
+	for _, t := range s.futexWaiters(uaddr, FUTEX_BITSET_MATCH_ANY) {
+		if moved >= nRequeue {
+			break
+		}
+		t.futexAddr = uaddr2
+		moved++
+	}
+	return woken + moved
+}
+func futexOpCmp(cmp, oldval, cmparg int32) bool {
+	switch uint64(cmp) {
+	case FUTEX_OP_CMP_EQ:
+		return oldval == cmparg
+	case FUTEX_OP_CMP_NE:
+		return oldval != cmparg
+	case FUTEX_OP_CMP_LT:
+		return oldval < cmparg
+	case FUTEX_OP_CMP_LE:
+		return oldval <= cmparg
+	case FUTEX_OP_CMP_GT:
+		return oldval > cmparg
+	case FUTEX_OP_CMP_GE:
+		return oldval >= cmparg
+	}
+	return false
+}
+/* syscall futex
+long futex(uint32_t *uaddr, int futex_op, uint32_t val, const struct timespec *timeout, uint32_t *uaddr2, uint32_t val3);
+*/
+func (s *Scheduler) futexHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	uaddr, op, val, timeout, uaddr2, val3 := args[0], args[1], args[2], args[3], args[4], args[5]
+	cmd := op & FUTEX_CMD_MASK
+	s.logger.Debug().
+		Int("tid", s.current.Tid).
+		Str("op", ConvHex("%08X", op)).
+		Str("cmd", ConvHex("%X", cmd)).
+		Str("uaddr", ConvHex("%08X", uaddr)).
+		Str("val", ConvHex("%08X", val)).
+		Msg("futex call")
+	// only the compare ops look at *uaddr, a wake on an address that is
+	// gone still succeeds
+	load := func() (uint64, bool) {
+		v, err := mu.MemRead(uaddr, 4)
+		if err != nil {
+			s.logger.Debug().Msg("futex uaddr read failed")
+			return 0, false
+		}
+		return LE_BytesToUint(v), true
+	}
+	switch cmd {
+	case FUTEX_WAIT, FUTEX_WAIT_BITSET:
+		mask := FUTEX_BITSET_MATCH_ANY
+		if cmd == FUTEX_WAIT_BITSET {
+			mask = val3 & 0xffffffff
+			if mask == 0 {
+				return errnoRet(EINVAL), true
+			}
+		}
+		uaddrVal, ok := load()
+		if !ok {
+			return errnoRet(EFAULT), true
+		}
+		if uaddrVal != val & 0xffffffff {
+			return errnoRet(EAGAIN), true
+		}
+		s.futexWait(mu, uaddr, mask, timeout != 0)
+		return 0, true
+	case FUTEX_WAKE, FUTEX_WAKE_BITSET:
+		mask := FUTEX_BITSET_MATCH_ANY
+		if cmd == FUTEX_WAKE_BITSET {
+			mask = val3 & 0xffffffff
+			if mask == 0 {
+				return errnoRet(EINVAL), true
+			}
+		}
+		return uint64(s.futexWake(uaddr, int(int32(val)), mask)), true
+	case FUTEX_REQUEUE:
+		// val2 travels in the timeout slot
+		return uint64(s.futexRequeue(uaddr, uaddr2, int(int32(val)), int(int32(timeout)))), true
+	case FUTEX_CMP_REQUEUE:
+		uaddrVal, ok := load()
+		if !ok {
+			return errnoRet(EFAULT), true
+		}
+		if uaddrVal != val3 & 0xffffffff {
+			return errnoRet(EAGAIN), true
+		}
+		return uint64(s.futexRequeue(uaddr, uaddr2, int(int32(val)), int(int32(timeout)))), true
+	case FUTEX_WAKE_OP:
+		encoded := val3
+		opx    := (encoded >> 28) & 0xf
+		cmp    := int32((encoded >> 24) & 0xf)
+		// both are 12 bit signed, as sign_extend32(x, 11) in the kernel
+		oparg  := int32(uint32(encoded >> 12) << 20) >> 20
+		cmparg := int32(uint32(encoded) << 20) >> 20
+		if opx & FUTEX_OP_OPARG_SHIFT != 0 {
+			oparg = 1 << uint32(oparg & 31)
+			opx &^= FUTEX_OP_OPARG_SHIFT
+		}
+		b, err := mu.MemRead(uaddr2, 4)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		oldval := int32(LE_BytesToUint32(b))
+		newval := oldval
+		switch opx {
+		case FUTEX_OP_SET:
+			newval = oparg
+		case FUTEX_OP_ADD:
+			newval = oldval + oparg
+		case FUTEX_OP_OR:
+			newval = oldval | oparg
+		case FUTEX_OP_ANDN:
+			newval = oldval &^ oparg
+		case FUTEX_OP_XOR:
+			newval = oldval ^ oparg
+		default:
+			return errnoRet(ENOSYS), true
+		}
+		err = mu.MemWrite(uaddr2, IntToBytes(int64(newval), 4))
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		woken := s.futexWake(uaddr, int(int32(val)), FUTEX_BITSET_MATCH_ANY)
+		if futexOpCmp(cmp, oldval, cmparg) {
+			woken += s.futexWake(uaddr2, int(int32(timeout)), FUTEX_BITSET_MATCH_ANY)
+		}
+		return uint64(woken), true
+	}
+	s.logger.Debug().Str("cmd", ConvHex("%X", cmd)).Msg("futex command not supported")
+	return errnoRet(ENOSYS), true
+}
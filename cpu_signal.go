@@ -0,0 +1,795 @@
+package emulator
+
+import (
+	"fmt"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	NSIG int = 64
+
+	SIGHUP    int = 1
+	SIGINT    int = 2
+	SIGQUIT   int = 3
+	SIGILL    int = 4
+	SIGTRAP   int = 5
+	SIGABRT   int = 6
+	SIGBUS    int = 7
+	SIGFPE    int = 8
+	SIGKILL   int = 9
+	SIGUSR1   int = 10
+	SIGSEGV   int = 11
+	SIGUSR2   int = 12
+	SIGPIPE   int = 13
+	SIGALRM   int = 14
+	SIGTERM   int = 15
+	SIGSTKFLT int = 16
+	SIGCHLD   int = 17
+	SIGCONT   int = 18
+	SIGSTOP   int = 19
+	SIGTSTP   int = 20
+	SIGTTIN   int = 21
+	SIGTTOU   int = 22
+	SIGURG    int = 23
+	SIGXCPU   int = 24
+	SIGXFSZ   int = 25
+	SIGVTALRM int = 26
+	SIGPROF   int = 27
+	SIGWINCH  int = 28
+	SIGIO     int = 29
+	SIGPWR    int = 30
+	SIGSYS    int = 31
+
+	SIG_DFL uint64 = 0
+	SIG_IGN uint64 = 1
+
+	SIG_BLOCK   uint64 = 0
+	SIG_UNBLOCK uint64 = 1
+	SIG_SETMASK uint64 = 2
+
+	SA_NOCLDSTOP uint64 = 0x00000001
+	SA_NOCLDWAIT uint64 = 0x00000002
+	SA_SIGINFO   uint64 = 0x00000004
+	SA_RESTORER  uint64 = 0x04000000
+	SA_ONSTACK   uint64 = 0x08000000
+	SA_RESTART   uint64 = 0x10000000
+	SA_NODEFER   uint64 = 0x40000000
+	SA_RESETHAND uint64 = 0x80000000
+
+	SS_ONSTACK uint64 = 1
+	SS_DISABLE uint64 = 2
+	MINSIGSTKSZ uint64 = 2048
+
+	// si_code
+	SI_USER     int = 0
+	SI_KERNEL   int = 0x80
+	SI_TKILL    int = -6
+	SEGV_MAPERR int = 1
+	SEGV_ACCERR int = 2
+	BUS_ADRALN  int = 1
+	BUS_ADRERR  int = 2
+	ILL_ILLOPC  int = 1
+	TRAP_BRKPT  int = 1
+)
+
+const sigInfoSize uint64 = 128
+
+// rt_sigframe: struct siginfo, then struct ucontext, then the retcode.
+// arm64 keeps a frame record {fp, lr} for unwinders before the retcode.
+var (
+	SIGFRAME_ARM = sigFrameLayout{
+		stack: 8, mcontext: 20, sigmask: 104, ucontext: 744,
+		// mov r7, #__NR_rt_sigreturn; svc #0
+		retcode: []uint64{0xe3a070ad, 0xef000000},
+	}
+	SIGFRAME_ARM64 = sigFrameLayout{
+		stack: 16, mcontext: 176, sigmask: 40, ucontext: 4560, record: 16,
+		// mov x8, #__NR_rt_sigreturn; svc #0
+		retcode: []uint64{0xd2801168, 0xd4000001},
+	}
+)
+
+// sigFrameLayout has the ucontext offsets of the arch, relative to the
+// ucontext.
+type sigFrameLayout struct {
+	stack, mcontext, sigmask, ucontext, record uint64
+	retcode []uint64
+}
+func sigFrameOf(arch *Arch) sigFrameLayout {
+	if arch.Is64 {
+		return SIGFRAME_ARM64
+	}
+	return SIGFRAME_ARM
+}
+func (l sigFrameLayout) size() uint64 {
+	return sigInfoSize + l.ucontext + l.record + uint64(len(l.retcode)) * 4
+}
+
+type SignalAction struct {
+	Handler  uint64
+	Flags    uint64
+	Restorer uint64
+	Mask     uint64
+}
+
+type SigInfo struct {
+	Signo int
+	Errno int
+	Code  int
+	Pid   int
+	Uid   int
+	Addr  uint64
+}
+
+type sigAltStack struct {
+	sp    uint64
+	size  uint64
+	flags uint64
+}
+func (ss sigAltStack) contains(sp uint64) bool {
+	return ss.flags & SS_DISABLE == 0 && sp > ss.sp && sp <= ss.sp+ss.size
+}
+
+// SignalError is returned when a signal with the default action terminates
+// the emulated process.
+type SignalError struct {
+	Signo int
+	Info  *SigInfo
+}
+func (e *SignalError) Error() string {
+	return fmt.Sprintf("emulated process killed by signal %d", e.Signo)
+}
+
+func sigBit(sig int) uint64 {
+	return 1 << uint(sig-1)
+}
+func sigDefaultIgnored(sig int) bool {
+	switch sig {
+	case SIGCHLD, SIGCONT, SIGURG, SIGWINCH,
+		SIGSTOP, SIGTSTP, SIGTTIN, SIGTTOU:
+		return true
+	}
+	return false
+}
+
+// Signals keeps the process wide handler table, per thread masks live in
+// EmulatedThread. Delivery happens from Scheduler.Run, between two slices.
+type Signals struct {
+	emu      *Emulator
+	sched    *Scheduler
+	actions  []SignalAction
+	pending  uint64
+	infos    map[int]*SigInfo
+	logger   zl.Logger
+}
+func NewSignals(emu *Emulator, sh *SyscallHandlers, sched *Scheduler, logger zl.Logger) *Signals {
+	sg := &Signals{
+		emu: emu,
+		sched: sched,
+		actions: make([]SignalAction, NSIG+1),
+		infos: map[int]*SigInfo{},
+		logger: logger,
+	}
+	sh.SetHandler(0x25, "kill", 2, sg.killHandle)
+	sh.SetHandler(0x43, "sigaction", 3, sg.sigactionHandle)
+	sh.SetHandler(0x77, "sigreturn", 0, sg.sigreturnHandle)
+	sh.SetHandler(0x7E, "sigprocmask", 3, sg.sigprocmaskHandle)
+	sh.SetHandler(0xAD, "rt_sigreturn", 0, sg.rtSigreturnHandle)
+	sh.SetHandler(0xAE, "rt_sigaction", 4, sg.rtSigactionHandle)
+	sh.SetHandler(0xAF, "rt_sigprocmask", 4, sg.rtSigprocmaskHandle)
+	sh.SetHandler(0xB0, "rt_sigpending", 2, sg.rtSigpendingHandle)
+	sh.SetHandler(0xBA, "sigaltstack", 2, sg.sigaltstackHandle)
+	sh.SetHandler(0xEE, "tkill", 2, sg.tkillHandle)
+	sh.SetHandler(0x10C, "tgkill", 3, sg.tgkillHandle)
+	return sg
+}
+func (sg *Signals) Action(sig int) SignalAction {
+	if sig < 1 || sig > NSIG {
+		return SignalAction{}
+	}
+	return sg.actions[sig]
+}
+func (sg *Signals) HasHandler(sig int) bool {
+	h := sg.Action(sig).Handler
+	return h != SIG_DFL && h != SIG_IGN
+}
+
+// signalSnapshot is the handler table and process wide pending set at a
+// fork.
+type signalSnapshot struct {
+	actions []SignalAction
+	pending uint64
+	infos   map[int]*SigInfo
+}
+func (sg *Signals) snapshot() *signalSnapshot {
+	snap := &signalSnapshot{
+		actions: append([]SignalAction(nil), sg.actions...),
+		pending: sg.pending,
+		infos: map[int]*SigInfo{},
+	}
+	for sig, info := range sg.infos {
+		snap.infos[sig] = info
+	}
+	return snap
+}
+func (sg *Signals) restore(snap *signalSnapshot) {
+	sg.actions = snap.actions
+	sg.pending = snap.pending
+	sg.infos = snap.infos
+}
+
+// Raise queues sig for the process, or for a single thread when t is not nil.
+// A blocked thread that can take the signal is woken with EINTR.
+func (sg *Signals) Raise(t *EmulatedThread, info *SigInfo) {
+	sig := info.Signo
+	if sig < 1 || sig > NSIG {
+		return
+	}
+	sg.logger.Debug().Int("sig", sig).Int("code", info.Code).Msg("signal raised")
+	if t == nil {
+		sg.pending |= sigBit(sig)
+		sg.infos[sig] = info
+		for _, th := range sg.sched.threads {
+			if th.sigMask & sigBit(sig) == 0 {
+				t = th
+				break
+			}
+		}
+		if t == nil {
+			return
+		}
+	}else{
+		t.sigPending |= sigBit(sig)
+		if t.sigInfos == nil {
+			t.sigInfos = map[int]*SigInfo{}
+		}
+		t.sigInfos[sig] = info
+	}
+	if t.State == ThreadBlocked && t.sigMask & sigBit(sig) == 0 && sg.HasHandler(sig) {
+		t.State = ThreadRunnable
+		t.futexAddr = 0
+		t.futexTimed = false
+		if t.ctx != nil {
+			t.ctx.R0 = errnoRet(EINTR)
+		}
+	}
+}
+
+// raiseFault queues a synchronous fault for t. Like the kernel, a fault that
+// is blocked or has no handler is not deliverable and ends the run.
+func (sg *Signals) raiseFault(t *EmulatedThread, f *EmulationFault) bool {
+	if !sg.HasHandler(f.Signo) || t.sigMask & sigBit(f.Signo) != 0 {
+		return false
+	}
+	sg.Raise(t, f.sigInfo())
+	return true
+}
+
+// takePending picks the lowest deliverable signal for t.
+func (sg *Signals) takePending(t *EmulatedThread) (int, *SigInfo) {
+	for sig := 1; sig <= NSIG; sig++ {
+		bit := sigBit(sig)
+		if t.sigMask & bit != 0 && sig != SIGKILL && sig != SIGSTOP {
+			continue
+		}
+		if t.sigPending & bit != 0 {
+			t.sigPending &^= bit
+			info := t.sigInfos[sig]
+			delete(t.sigInfos, sig)
+			return sig, info
+		}
+		if sg.pending & bit != 0 {
+			sg.pending &^= bit
+			info := sg.infos[sig]
+			delete(sg.infos, sig)
+			return sig, info
+		}
+	}
+	return 0, nil
+}
+
+// dispatch runs before t gets the CPU, it applies a pending sigreturn and
+// sets up a handler frame for every deliverable signal.
+func (sg *Signals) dispatch(t *EmulatedThread) error {
+	if t.sigReturn != nil {
+		t.ctx = t.sigReturn
+		t.sigReturn = nil
+	}
+	for {
+		sig, info := sg.takePending(t)
+		if sig == 0 {
+			return nil
+		}
+		if info == nil {
+			info = &SigInfo{Signo: sig, Code: SI_USER}
+		}
+		act := sg.actions[sig]
+		if act.Handler == SIG_IGN || (act.Handler == SIG_DFL && sigDefaultIgnored(sig)) {
+			sg.logger.Debug().Int("sig", sig).Int("tid", t.Tid).Msg("signal ignored")
+			continue
+		}
+		if act.Handler == SIG_DFL || sig == SIGKILL {
+			sg.logger.Info().Int("sig", sig).Int("tid", t.Tid).Msg("signal default action, terminating")
+			return &SignalError{Signo: sig, Info: info}
+		}
+		err := sg.setupFrame(t, sig, act, info)
+		if err != nil {
+			return err
+		}
+		if act.Flags & SA_RESETHAND != 0 {
+			sg.actions[sig] = SignalAction{}
+		}
+	}
+}
+
+func (sg *Signals) writeSigInfo(addr uint64, info *SigInfo) error {
+	arch := sg.emu.Arch
+	buf := make([]byte, sigInfoSize)
+	copy(buf[0:], IntToBytes(int64(info.Signo), 4))
+	copy(buf[4:], IntToBytes(int64(info.Errno), 4))
+	copy(buf[8:], IntToBytes(int64(info.Code), 4))
+	// the union is pointer aligned
+	fields := arch.PtrSize * 2
+	if info.Addr != 0 {
+		copy(buf[fields:], arch.PutPtr(info.Addr))
+	}else{
+		copy(buf[fields:], IntToBytes(int64(info.Pid), 4))
+		copy(buf[fields+4:], IntToBytes(int64(info.Uid), 4))
+	}
+	return sg.emu.Mu.MemWrite(addr, buf)
+}
+func (sg *Signals) writeMcontext(addr uint64, ctx *RegistryContext, mask uint64, faultAddr uint64) error {
+	if sg.emu.Arch.Is64 {
+		return sg.emu.Mu.MemWrite(addr, packSigcontext64(ctx, faultAddr))
+	}
+	return WriteUints(sg.emu.Mu, addr, []uint64{
+		0, 0, mask & 0xffffffff, // trap_no, error_code, oldmask
+		ctx.R0, ctx.R1, ctx.R2, ctx.R3, ctx.R4, ctx.R5, ctx.R6,
+		ctx.R7, ctx.R8, ctx.R9, ctx.R10, ctx.R11, ctx.R12,
+		ctx.SP, ctx.LR, ctx.PC, ctx.CPSR,
+		faultAddr,
+	})
+}
+// packSigcontext64 is the arm64 struct sigcontext: fault_address, x0-x30,
+// sp, pc, pstate. The __reserved records stay zero, there is no FP state.
+func packSigcontext64(ctx *RegistryContext, faultAddr uint64) []byte {
+	regs := []uint64{faultAddr}
+	for _, r := range ctx.gp() {
+		regs = append(regs, *r)
+	}
+	for i := 0; i < 17; i++ {
+		var v uint64
+		if i < len(ctx.Ext) {
+			v = ctx.Ext[i]
+		}
+		regs = append(regs, v)
+	}
+	regs = append(regs, ctx.LR, ctx.SP, ctx.PC, ctx.CPSR)
+	buf := make([]byte, 0, len(regs) * 8)
+	for _, v := range regs {
+		buf = append(buf, IntToBytes(int64(v), 8)...)
+	}
+	return buf
+}
+func (sg *Signals) readMcontext(addr uint64, ctx *RegistryContext) error {
+	if sg.emu.Arch.Is64 {
+		b, err := sg.emu.Mu.MemRead(addr + 8, 34 * 8)
+		if err != nil {
+			return err
+		}
+		r := make([]uint64, 34)
+		for i := range r {
+			r[i] = LE_BytesToUint64(b[i*8:])
+		}
+		for i, dst := range ctx.gp() {
+			*dst = r[i]
+		}
+		ctx.Ext = append([]uint64{}, r[13:30]...)
+		ctx.LR, ctx.SP, ctx.PC, ctx.CPSR = r[30], r[31], r[32], r[33]
+		return nil
+	}
+	r, err := ReadUints(sg.emu.Mu, addr+12, 17)
+	if err != nil {
+		return err
+	}
+	ctx.R0, ctx.R1, ctx.R2, ctx.R3 = r[0], r[1], r[2], r[3]
+	ctx.R4, ctx.R5, ctx.R6, ctx.R7 = r[4], r[5], r[6], r[7]
+	ctx.R8, ctx.R9, ctx.R10, ctx.R11 = r[8], r[9], r[10], r[11]
+	ctx.R12, ctx.SP, ctx.LR, ctx.PC = r[12], r[13], r[14], r[15]
+	ctx.CPSR = r[16]
+	return nil
+}
+
+// setupFrame pushes an rt_sigframe and points t at the handler, like the
+// kernel setup_rt_frame does.
+func (sg *Signals) setupFrame(t *EmulatedThread, sig int, act SignalAction, info *SigInfo) error {
+	ctx := t.ctx
+	mu := sg.emu.Mu
+	arch := sg.emu.Arch
+	layout := sigFrameOf(arch)
+	sp := ctx.SP
+	onAltStack := t.altStack.contains(sp)
+	if act.Flags & SA_ONSTACK != 0 && t.altStack.flags & SS_DISABLE == 0 && t.altStack.size != 0 && !onAltStack {
+		sp = t.altStack.sp + t.altStack.size
+	}
+	frame := (sp - layout.size()) &^ (arch.StackAlign - 1)
+	ucAddr := frame + sigInfoSize
+	record := ucAddr + layout.ucontext
+	retcode := record + layout.record
+
+	err := sg.writeSigInfo(frame, info)
+	if err != nil {
+		return fmt.Errorf("signal %d frame at 0x%08X: %w", sig, frame, err)
+	}
+	ssFlags := t.altStack.flags
+	if onAltStack {
+		ssFlags |= SS_ONSTACK
+	}
+	writes := []error{
+		mu.MemWrite(ucAddr, make([]byte, layout.ucontext)),
+		writeStackT(mu, ucAddr+layout.stack, sigAltStack{sp: t.altStack.sp, flags: ssFlags, size: t.altStack.size}),
+		sg.writeMcontext(ucAddr+layout.mcontext, ctx, t.sigMask, info.Addr),
+		mu.MemWrite(ucAddr+layout.sigmask, IntToBytes(int64(t.sigMask), 8)),
+		WriteUints(mu, retcode, layout.retcode),
+	}
+	if arch.Is64 {
+		var fp uint64
+		if len(ctx.Ext) == 17 {
+			fp = ctx.Ext[16]
+		}
+		writes = append(writes, mu.MemWrite(record, append(IntToBytes(int64(fp), 8), IntToBytes(int64(ctx.LR), 8)...)))
+	}
+	for _, err := range writes {
+		if err != nil {
+			return fmt.Errorf("signal %d frame at 0x%08X: %w", sig, frame, err)
+		}
+	}
+	restorer := retcode
+	if act.Flags & SA_RESTORER != 0 && act.Restorer != 0 {
+		restorer = act.Restorer
+	}
+	handled := *ctx
+	handled.R0 = uint64(sig)
+	handled.R1 = frame
+	handled.R2 = ucAddr
+	handled.SP = frame
+	handled.LR = restorer
+	if arch.Is64 {
+		// x29 points at the frame record
+		handled.Ext = append([]uint64{}, ctx.Ext...)
+		if len(handled.Ext) == 17 {
+			handled.Ext[16] = record
+		}
+		handled.PC = act.Handler
+	}else{
+		handled.PC = act.Handler &^ 1
+		// drop IT state, pick the instruction set from the handler address
+		handled.CPSR = ctx.CPSR &^ (CPSR_T | 0x0600fc00)
+		if act.Handler & 1 != 0 {
+			handled.CPSR |= CPSR_T
+		}
+	}
+	t.ctx = &handled
+	t.sigMask |= act.Mask
+	if act.Flags & SA_NODEFER == 0 {
+		t.sigMask |= sigBit(sig)
+	}
+	sg.logger.Debug().
+		Int("sig", sig).
+		Int("tid", t.Tid).
+		Str("handler", ConvHex("0x%08X", act.Handler)).
+		Str("frame", ConvHex("0x%08X", frame)).
+		Str("pc", ConvHex("0x%08X", ctx.PC)).
+		Msg("signal delivered")
+	return nil
+}
+
+// sigreturnAt reads back the ucontext at ucAddr for the current thread.
+func (sg *Signals) sigreturnAt(mu uc.Unicorn, ucAddr uint64) (uint64, bool) {
+	t := sg.sched.current
+	ctx := &RegistryContext{}
+	layout := sigFrameOf(archOf(mu))
+	err := sg.readMcontext(ucAddr+layout.mcontext, ctx)
+	if err != nil {
+		sg.logger.Debug().Err(err).Msg("sigreturn bad frame")
+		return errnoRet(EFAULT), true
+	}
+	mask, err := mu.MemRead(ucAddr+layout.sigmask, 8)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	t.sigMask = LE_BytesToUint64(mask) &^ (sigBit(SIGKILL) | sigBit(SIGSTOP))
+	t.sigReturn = ctx
+	sg.sched.requestSwitch(mu)
+	// registers come from the frame, leave r0 alone
+	return 0, false
+}
+// syscall sigreturn
+func (sg *Signals) sigreturnHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	sp, err := mu.RegRead(archOf(mu).SP)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return sg.sigreturnAt(mu, sp)
+}
+// syscall rt_sigreturn
+func (sg *Signals) rtSigreturnHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	sp, err := mu.RegRead(archOf(mu).SP)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return sg.sigreturnAt(mu, sp+sigInfoSize)
+}
+
+func (sg *Signals) raiseFromSyscall(mu uc.Unicorn, t *EmulatedThread, sig int, code int) uint64 {
+	if sig < 0 || sig > NSIG {
+		return errnoRet(EINVAL)
+	}
+	if sig == 0 {
+		return 0
+	}
+	sg.Raise(t, &SigInfo{
+		Signo: sig,
+		Code: code,
+		Pid: sg.emu.config.Pid,
+		Uid: sg.emu.config.Uid,
+	})
+	// let the scheduler deliver it before the next instruction
+	sg.sched.requestSwitch(mu)
+	return 0
+}
+// syscall kill
+func (sg *Signals) killHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	pid, sig := int(int32(args[0])), int(int32(args[1]))
+	sg.logger.Debug().Int("pid", pid).Int("sig", sig).Msg("kill")
+	if pid == sg.emu.config.Pid || pid == 0 || pid == -1 {
+		return sg.raiseFromSyscall(mu, nil, sig, SI_USER), true
+	}
+	// some other process, pretend it got the signal
+	return 0, true
+}
+// syscall tkill
+func (sg *Signals) tkillHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	tid, sig := int(int32(args[0])), int(int32(args[1]))
+	t := sg.sched.FindThread(tid)
+	if t == nil || t.State == ThreadExited {
+		return errnoRet(ESRCH), true
+	}
+	return sg.raiseFromSyscall(mu, t, sig, SI_TKILL), true
+}
+// syscall tgkill
+func (sg *Signals) tgkillHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	tgid, tid, sig := int(int32(args[0])), int(int32(args[1])), int(int32(args[2]))
+	sg.logger.Debug().Int("tgid", tgid).Int("tid", tid).Int("sig", sig).Msg("tgkill")
+	if tgid != sg.emu.config.Pid {
+		return errnoRet(ESRCH), true
+	}
+	t := sg.sched.FindThread(tid)
+	if t == nil || t.State == ThreadExited {
+		return errnoRet(ESRCH), true
+	}
+	return sg.raiseFromSyscall(mu, t, sig, SI_TKILL), true
+}
+
+func (sg *Signals) setAction(mu uc.Unicorn, sig int, act *SignalAction, oact *SignalAction) uint64 {
+	if sig < 1 || sig > NSIG {
+		return errnoRet(EINVAL)
+	}
+	*oact = sg.actions[sig]
+	if act != nil {
+		if sig == SIGKILL || sig == SIGSTOP {
+			return errnoRet(EINVAL)
+		}
+		sg.actions[sig] = *act
+		sg.logger.Debug().
+			Int("sig", sig).
+			Str("handler", ConvHex("0x%08X", act.Handler)).
+			Str("flags", ConvHex("0x%08X", act.Flags)).
+			Msg("sigaction installed")
+	}
+	return 0
+}
+/* syscall sigaction
+struct old_sigaction { handler; old_sigset_t mask; flags; restorer; }
+*/
+func (sg *Signals) sigactionHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	sig, actPtr, oactPtr := int(int32(args[0])), args[1], args[2]
+	var act *SignalAction
+	if actPtr != 0 {
+		r, err := ReadUints(mu, actPtr, 4)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		act = &SignalAction{Handler: r[0], Mask: r[1], Flags: r[2], Restorer: r[3]}
+	}
+	var oact SignalAction
+	if ret := sg.setAction(mu, sig, act, &oact); ret != 0 {
+		return ret, true
+	}
+	if oactPtr != 0 {
+		err := WriteUints(mu, oactPtr, []uint64{oact.Handler, oact.Mask & 0xffffffff, oact.Flags, oact.Restorer})
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	return 0, true
+}
+/* syscall rt_sigaction
+struct sigaction { handler; flags; restorer; sigset_t mask; }, every field
+pointer sized on arm64
+*/
+func (sg *Signals) rtSigactionHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	sig, actPtr, oactPtr := int(int32(args[0])), args[1], args[2]
+	ptrSize := archOf(mu).PtrSize
+	var act *SignalAction
+	if actPtr != 0 {
+		b, err := mu.MemRead(actPtr, ptrSize * 3 + 8)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		act = &SignalAction{
+			Handler: LE_BytesToUint(b[:ptrSize]),
+			Flags: LE_BytesToUint(b[ptrSize:ptrSize*2]),
+			Restorer: LE_BytesToUint(b[ptrSize*2:ptrSize*3]),
+			Mask: LE_BytesToUint64(b[ptrSize*3:]),
+		}
+	}
+	var oact SignalAction
+	if ret := sg.setAction(mu, sig, act, &oact); ret != 0 {
+		return ret, true
+	}
+	if oactPtr != 0 {
+		arch := archOf(mu)
+		b := append(arch.PutPtr(oact.Handler), arch.PutPtr(oact.Flags)...)
+		b = append(b, arch.PutPtr(oact.Restorer)...)
+		b = append(b, IntToBytes(int64(oact.Mask), 8)...)
+		if err := mu.MemWrite(oactPtr, b); err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	return 0, true
+}
+
+func (sg *Signals) procmask(how uint64, set *uint64) (uint64, uint64) {
+	t := sg.sched.current
+	old := t.sigMask
+	if set != nil {
+		switch how {
+		case SIG_BLOCK:
+			t.sigMask |= *set
+		case SIG_UNBLOCK:
+			t.sigMask &^= *set
+		case SIG_SETMASK:
+			t.sigMask = *set
+		default:
+			return old, errnoRet(EINVAL)
+		}
+		t.sigMask &^= sigBit(SIGKILL) | sigBit(SIGSTOP)
+	}
+	return old, 0
+}
+// syscall sigprocmask
+func (sg *Signals) sigprocmaskHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	how, setPtr, osetPtr := args[0], args[1], args[2]
+	var set *uint64
+	if setPtr != 0 {
+		v, err := ReadPtr(mu, setPtr)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		set = &v
+	}
+	old, ret := sg.procmask(how, set)
+	if ret != 0 {
+		return ret, true
+	}
+	if osetPtr != 0 {
+		if err := mu.MemWrite(osetPtr, IntToBytes(int64(old), 4)); err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	return 0, true
+}
+// syscall rt_sigprocmask
+func (sg *Signals) rtSigprocmaskHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	how, setPtr, osetPtr := args[0], args[1], args[2]
+	var set *uint64
+	if setPtr != 0 {
+		b, err := mu.MemRead(setPtr, 8)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		v := LE_BytesToUint64(b)
+		set = &v
+	}
+	old, ret := sg.procmask(how, set)
+	if ret != 0 {
+		return ret, true
+	}
+	if osetPtr != 0 {
+		if err := mu.MemWrite(osetPtr, IntToBytes(int64(old), 8)); err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	if set != nil && (sg.pending | sg.sched.current.sigPending) &^ sg.sched.current.sigMask != 0 {
+		// unblocked something that is waiting
+		sg.sched.requestSwitch(mu)
+	}
+	return 0, true
+}
+// syscall rt_sigpending
+func (sg *Signals) rtSigpendingHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	t := sg.sched.current
+	pending := (sg.pending | t.sigPending) & t.sigMask
+	if err := mu.MemWrite(args[0], IntToBytes(int64(pending), 8)); err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return 0, true
+}
+// readStackT decodes a stack_t, ss_sp and ss_size are pointer sized.
+func readStackT(mu uc.Unicorn, addr uint64) (sigAltStack, error) {
+	ptrSize := archOf(mu).PtrSize
+	b, err := mu.MemRead(addr, ptrSize * 3)
+	if err != nil {
+		return sigAltStack{}, err
+	}
+	return sigAltStack{
+		sp: LE_BytesToUint(b[:ptrSize]),
+		flags: uint64(LE_BytesToUint32(b[ptrSize:])),
+		size: LE_BytesToUint(b[ptrSize*2:]),
+	}, nil
+}
+func writeStackT(mu uc.Unicorn, addr uint64, ss sigAltStack) error {
+	arch := archOf(mu)
+	b := make([]byte, arch.PtrSize * 3)
+	copy(b, arch.PutPtr(ss.sp))
+	copy(b[arch.PtrSize:], IntToBytes(int64(ss.flags), 4))
+	copy(b[arch.PtrSize*2:], arch.PutPtr(ss.size))
+	return mu.MemWrite(addr, b)
+}
+/* syscall sigaltstack
+typedef struct { void *ss_sp; int ss_flags; size_t ss_size; } stack_t;
+*/
+func (sg *Signals) sigaltstackHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	ssPtr, ossPtr := args[0], args[1]
+	t := sg.sched.current
+	sp, _ := mu.RegRead(archOf(mu).SP)
+	onStack := t.altStack.contains(sp)
+	if ossPtr != 0 {
+		flags := t.altStack.flags
+		if t.altStack.size == 0 {
+			flags = SS_DISABLE
+		}
+		if onStack {
+			flags |= SS_ONSTACK
+		}
+		if err := writeStackT(mu, ossPtr, sigAltStack{sp: t.altStack.sp, flags: flags, size: t.altStack.size}); err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	if ssPtr != 0 {
+		ss, err := readStackT(mu, ssPtr)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		if onStack {
+			return errnoRet(EPERM), true
+		}
+		if ss.flags &^ (SS_DISABLE | SS_ONSTACK) != 0 {
+			return errnoRet(EINVAL), true
+		}
+		if ss.flags & SS_DISABLE != 0 {
+			ss = sigAltStack{flags: SS_DISABLE}
+		}else if ss.size < MINSIGSTKSZ {
+			return errnoRet(ENOMEM), true
+		}
+		ss.flags &^= SS_ONSTACK
+		t.altStack = ss
+		sg.logger.Debug().
+			Str("sp", ConvHex("0x%08X", ss.sp)).
+			Str("size", ConvHex("0x%X", ss.size)).
+			Msg("sigaltstack set")
+	}
+	return 0, true
+}
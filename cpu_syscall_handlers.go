@@ -46,21 +46,22 @@ func (sh *SyscallHandlers) SetHandler(idx uint64, name string, argCount int, cal
 	sh.handler[idx] = s
 }
 func (sh *SyscallHandlers) handleSyscall(mu uc.Unicorn) {
-	idx, err := mu.RegRead(uc.ARM_REG_R7)
+	arch := archOf(mu)
+	nr, err := mu.RegRead(arch.SyscallNr)
 	if err != nil {
-		sh.logger.Debug().Err(err).Msg("read reg R7 failed")
+		sh.logger.Debug().Err(err).Msg("read syscall number register failed")
 	}
-	lr, err := mu.RegRead(uc.ARM_REG_LR)
+	lr, err := mu.RegRead(arch.LR)
 	if err != nil {
 		sh.logger.Debug().Err(err).Msg("read reg LR failed")
 	}
-	sh.logger.Info().Msgf("syscall 0x%X lr=0x%08X", idx, lr)
-	pc, err := mu.RegRead(uc.ARM_REG_PC)
+	sh.logger.Info().Msgf("syscall 0x%X lr=0x%08X", nr, lr)
+	pc, err := mu.RegRead(arch.PC)
 	if err != nil {
 		sh.logger.Debug().Err(err).Msg("read reg PC failed")
 	}
 	var args []uint64
-	for reg_idx := uc.ARM_REG_R0; reg_idx < (uc.ARM_REG_R6+1); reg_idx++ {
+	for _, reg_idx := range arch.SyscallArgs {
 		arg, err := mu.RegRead(reg_idx)
 		if err != nil {
 			sh.logger.Debug().Int("reg", reg_idx).Err(err).Msg("read reg failed")
@@ -68,6 +69,16 @@ func (sh *SyscallHandlers) handleSyscall(mu uc.Unicorn) {
 		}
 		args = append(args, arg)
 	}
+	idx, errno := arch.syscall(nr, args)
+	if errno != 0 {
+		err = mu.RegWrite(arch.ArgRegs[0], errnoRet(errno))
+		sh.logger.Debug().
+			Str("nr", ConvHex("0x%X",nr)).
+			Uint64("errno", errno).
+			Err(err).
+			Msg("syscall arguments rejected")
+		return
+	}
 	if h, exist := sh.handler[idx]; exist {
 		args = args[:h.ArgCount]
 		sh.logger.Debug().
@@ -78,7 +89,7 @@ func (sh *SyscallHandlers) handleSyscall(mu uc.Unicorn) {
 			Msg("executing syscall")
 		ret, hasRet := h.Callback(mu, args...)
 		if hasRet {
-			err = mu.RegWrite(uc.ARM_REG_R0, ret)
+			err = mu.RegWrite(arch.ArgRegs[0], ret)
 		}
 		sh.logger.Debug().
 			Str("id", ConvHex("0x%X",idx)).
@@ -94,6 +105,6 @@ func (sh *SyscallHandlers) handleSyscall(mu uc.Unicorn) {
 			Str("args", ConvHex("0x%X",args)).
 			Str("pc", ConvHex("0x%08X",pc)).
 			Msg("unhandled syscall")
-		sh.logger.Debug().Err(mu.Stop()).Msg("stopping emulation")
+		sh.logger.Debug().Err(sh.ih.Halt(mu)).Msg("stopping emulation")
 	}
 }
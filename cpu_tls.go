@@ -0,0 +1,169 @@
+package emulator
+
+import (
+	"sort"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// bionic's TLS slots, the thread pointer points at slot 0
+	BIONIC_TLS_SLOTS      uint64 = 64
+	TLS_SLOT_SELF         uint64 = 0
+	TLS_SLOT_THREAD_ID    uint64 = 1
+	TLS_SLOT_ERRNO        uint64 = 2
+	TLS_SLOT_STACK_GUARD  uint64 = 5
+	// words at the thread pointer bionic keeps for itself, the TLS block
+	// of an executable has to be aligned past them
+	BIONIC_TCB_SLOTS      uint64 = 8
+	// one mapping per thread: slots, static TLS blocks, the thread block
+	TLS_AREA_SIZE   uint64 = 0x4000
+	// zeroed room TLS_SLOT_THREAD_ID points at until libc sets its own
+	TLS_THREAD_SIZE uint64 = 0x400
+	// software TLS word of the kuser helpers, __kuser_get_tls reads it
+	// when the CPU has no TPIDRURO
+	KUSER_TLS_ADDR  uint64 = 0xffff0ff0
+)
+
+// TLS gives every emulated thread a thread pointer: bionic's slots at the
+// thread pointer and the PT_TLS blocks of loaded modules after them, at
+// the offsets Modules assigned. Threads whose libc passes CLONE_SETTLS
+// bring their own area, the static blocks are not set up for those.
+type TLS struct {
+	emu        *Emulator
+	// area base by tid, the thread pointer is the base
+	areas      map[int]uint64
+	StackGuard uint64
+	logger     zl.Logger
+}
+func NewTLS(emu *Emulator, sh *SyscallHandlers, logger zl.Logger) *TLS {
+	tl := &TLS{
+		emu: emu,
+		areas: map[int]uint64{},
+		StackGuard: randUint64(0, 0xffffffff) &^ 0xff,
+		logger: logger,
+	}
+	if !emu.Arch.Is64 {
+		sh.SetHandler(0xf0005, "ARM_set_tls", 1, tl.setTlsHandle)
+	}
+	return tl
+}
+
+// StaticStart is where the first static TLS block may go, past the TCB
+// and the slots.
+func (tl *TLS) StaticStart() uint32 {
+	start := uint32(BIONIC_TLS_SLOTS * tl.emu.Arch.PtrSize)
+	if start < tl.emu.Arch.TcbSize {
+		start = tl.emu.Arch.TcbSize
+	}
+	return start
+}
+func (tl *TLS) staticEnd() uint64 {
+	return TLS_AREA_SIZE - TLS_THREAD_SIZE
+}
+
+// NewArea maps and fills the TLS area of thread tid and returns its thread
+// pointer.
+func (tl *TLS) NewArea(tid int) (uint64, error) {
+	base, err := tl.emu.Memory.Map(0, TLS_AREA_SIZE, uc.PROT_READ | uc.PROT_WRITE, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	tl.emu.Memory.SetName(base, TLS_AREA_SIZE, "[anon:thread tls]")
+	slots := map[uint64]uint64{
+		TLS_SLOT_SELF: base,
+		TLS_SLOT_THREAD_ID: base + tl.staticEnd(),
+		TLS_SLOT_ERRNO: 0,
+		TLS_SLOT_STACK_GUARD: tl.StackGuard,
+	}
+	for slot, v := range slots {
+		if err = tl.SetSlot(base, slot, v); err != nil {
+			tl.emu.Memory.Unmap(base, TLS_AREA_SIZE)
+			return 0, err
+		}
+	}
+	for _, t := range tl.emu.Modules.tlsModules {
+		if err = tl.copyImage(base, t); err != nil {
+			tl.emu.Memory.Unmap(base, TLS_AREA_SIZE)
+			return 0, err
+		}
+	}
+	tl.areas[tid] = base
+	return base, nil
+}
+// SetSlot writes one of bionic's slots in the area at tp.
+func (tl *TLS) SetSlot(tp, slot, v uint64) error {
+	return tl.emu.Mu.MemWrite(tp + slot * tl.emu.Arch.PtrSize, tl.emu.Arch.PutPtr(v))
+}
+// Release unmaps the area of an exited thread.
+func (tl *TLS) Release(tid int) {
+	base, exist := tl.areas[tid]
+	if !exist {
+		return
+	}
+	delete(tl.areas, tid)
+	tl.emu.Memory.Unmap(base, TLS_AREA_SIZE)
+}
+
+// copyImage puts the initial content of a module's TLS block, .tdata from
+// the loaded module, into the area at base. .tbss is already zero.
+func (tl *TLS) copyImage(base uint64, t moduleTLS) error {
+	if t.Segment.pFilesz == 0 {
+		return nil
+	}
+	data, err := tl.emu.Mu.MemRead(t.image, uint64(t.Segment.pFilesz))
+	if err != nil {
+		return err
+	}
+	return tl.emu.Mu.MemWrite(base + uint64(t.Offset), data)
+}
+// addModule checks the new block fits and fills it in every area, Modules
+// calls it once the module is relocated.
+func (tl *TLS) addModule(t moduleTLS) error {
+	if uint64(t.Offset) + uint64(t.Segment.pMemsz) > tl.staticEnd() {
+		return ErrTLSFull
+	}
+	tids := make([]int, 0, len(tl.areas))
+	for tid := range tl.areas {
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+	for _, tid := range tids {
+		if err := tl.copyImage(tl.areas[tid], t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set makes tp the thread pointer of the running thread.
+func (tl *TLS) Set(mu uc.Unicorn, tp uint64) error {
+	err := mu.RegWrite(tl.emu.Arch.TLS, tp)
+	if err != nil {
+		return err
+	}
+	tl.emu.Scheduler.Current().tls = tp
+	tl.publish(mu, tp)
+	return nil
+}
+// publish updates the kuser helper word, threads switch without the guest
+// noticing so the scheduler calls it too.
+func (tl *TLS) publish(mu uc.Unicorn, tp uint64) {
+	if tl.emu.Arch.Is64 {
+		return
+	}
+	if err := mu.MemWrite(KUSER_TLS_ADDR, IntToBytes(int64(tp), 4)); err != nil {
+		tl.logger.Debug().Err(err).Msg("failed to write kuser tls word")
+	}
+}
+
+// syscall ARM_set_tls
+func (tl *TLS) setTlsHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	tp := args[0]
+	if err := tl.Set(mu, tp); err != nil {
+		tl.logger.Debug().Err(err).Msg("set_tls failed")
+		return errnoRet(EFAULT), true
+	}
+	tl.logger.Debug().Str("tls", ConvHex("0x%08X", tp)).Msg("set_tls")
+	return 0, true
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"fmt"
+	"errors"
 	"math/rand"
 	"github.com/mattn/go-colorable"
 	zl  "github.com/rs/zerolog"
@@ -37,6 +38,8 @@ type Options struct {
 	LogColor    bool
 	LogAs     	int
 	Config      *Config
+	// guest CPU, "arm" (default) or "arm64", see ArchByName
+	Arch        string
 }
 func NewDefaultOptions() *Options {
 	return &Options{
@@ -73,23 +76,42 @@ type Emulator struct {
 	JavaVM           *JavaVM
 	Modules          *Modules
 	NativeMemory     *NativeMemory
+	Heap             *Heap
+	HeapChecker      *HeapChecker
 	NativeHooks      *NativeHooks
+	Scheduler        *Scheduler
+	TLS              *TLS
+	KernelArgs       *KernelArgs
+	Signals          *Signals
+	Faults           *FaultHandler
+	Processes        *Processes
+	AntiDebug        *AntiDebug
+	ProcFS           *ProcFS
+	Net              *Network
+	Logd             *Logd
 
 	logger           zl.Logger
 	Pcb              *Pcb
 	Mu               uc.Unicorn
+	Arch             *Arch
 }
 func NewEmulator(opt *Options) (*Emulator, error) {
 	if opt == nil {
 		opt = NewDefaultOptions()
 	}
-	mu, err := uc.NewUnicorn(uc.ARCH_ARM, uc.MODE_ARM)
+	arch, err := ArchByName(opt.Arch)
 	if err != nil {
 		return nil, err
 	}
+	mu, err := uc.NewUnicorn(arch.UcArch, arch.UcMode)
+	if err != nil {
+		return nil, err
+	}
+	bindArch(mu, arch)
 	emu := &Emulator{
 		config: NewDefaultConfig(),
 		Mu: mu,
+		Arch: arch,
 	}
 	if opt.Config != nil {
 		err = LoadOrCreateConfig(opt.ConfigPath, emu.config)
@@ -132,6 +154,7 @@ func NewEmulator(opt *Options) (*Emulator, error) {
 		Str("pkgname", emu.config.PkgName).
 		Str("androidid", emu.config.AndroidID).
 		Str("vfs", emu.vfsRoot).
+		Str("arch", emu.Arch.Name).
 		Bool("vfp_inst_set", emu.vfpInstSet).
 		Msgf("init emu, mac:%X", emu.config.Mac)
 	//
@@ -141,23 +164,23 @@ func NewEmulator(opt *Options) (*Emulator, error) {
 		emu.logger.Debug().Msg("vfp finish")
 	}
 
-	emu.Pcb = GetPcb()
+	emu.Pcb = NewPcb(emu.config.Pid)
 	emu.logger.Info().
 		//program的pid
 		Int("pid", emu.Pcb.GetPid()).
 		Msg("pcb")
 
-	//注意，原有缺陷，libc_preinit init array中访问R1参数是从内核传过来的
-	//而这里直接将0映射空间，,强行运行过去，因为R1刚好为0,否则会报memory unmap异常
-	//FIXME:MRC指令总是返回0,TLS模擬
-	//TODO 初始化libc时候R1参数模拟内核传过去的KernelArgumentBlock	
-	emu.logger.Debug().
-		Err(emu.Mu.MemMapProt(0x0, 0x00001000, uc.PROT_READ | uc.PROT_WRITE)).
-		Msg("map memory libc_preinit")
+	//libc_preinit takes the KernelArgumentBlock from the TLS slot the
+	//linker leaves it in, both are set up at the end, see SetupKernelArgs.
+	//Page 0 stays unmapped so NULL dereferences fault.
 
 	//Android
+	abi2 := "armeabi"
+	if emu.Arch.Is64 {
+		abi2 = ""
+	}
 	emu.system_prop = map[string]string{
-		"libc.debug.malloc.options": "", "ro.build.version.sdk":"19", "ro.build.version.release":"4.4.4","persist.sys.dalvik.vm.lib":"libdvm.so", "ro.product.cpu.abi":"armeabi-v7a", "ro.product.cpu.abi2":"armeabi", 
+		"libc.debug.malloc.options": "", "ro.build.version.sdk":"19", "ro.build.version.release":"4.4.4","persist.sys.dalvik.vm.lib":"libdvm.so", "ro.product.cpu.abi":emu.Arch.Abi, "ro.product.cpu.abi2":abi2, 
 		"ro.product.manufacturer":"LGE", "ro.debuggable":"0", "ro.product.model":"AOSP on HammerHead","ro.hardware":"hammerhead", "ro.product.board":"hammerhead", "ro.product.device":"hammerhead", 
 		"ro.build.host":"833d1eed3ea3", "ro.build.type":"user", 
 		"ro.secure":"1", "wifi.interface":"wlan0", "ro.product.brand":"Android",
@@ -182,8 +205,9 @@ func NewEmulator(opt *Options) (*Emulator, error) {
 		emu.logger.Debug().Err(err).Msg("failed to map stack memory")
 		return nil, err
 	}
-	emu.Mu.RegWrite(uc.ARM_REG_SP, STACK_ADDR + STACK_SIZE)
-	sp, err := emu.Mu.RegRead(uc.ARM_REG_SP)
+	emu.Memory.SetName(STACK_ADDR, STACK_SIZE, "[stack]")
+	emu.Mu.RegWrite(emu.Arch.SP, STACK_ADDR + STACK_SIZE)
+	sp, err := emu.Mu.RegRead(emu.Arch.SP)
 	if err != nil {
 		return nil, err
 	}
@@ -197,6 +221,13 @@ func NewEmulator(opt *Options) (*Emulator, error) {
 	emu.syscallHandlers.SetLogger(emu.logger)
 	emu.syscallHooks = NewSyscallHooks(emu.Mu, emu.syscallHandlers)
 	emu.syscallHooks.SetLogger(emu.logger)
+	emu.Scheduler = NewScheduler(emu, emu.syscallHandlers, emu.logger)
+	emu.TLS = NewTLS(emu, emu.syscallHandlers, emu.logger)
+	emu.Signals = NewSignals(emu, emu.syscallHandlers, emu.Scheduler, emu.logger)
+	emu.Faults = NewFaultHandler(emu, emu.interruptHandler, emu.logger)
+	emu.Processes = NewProcesses(emu, emu.syscallHandlers, emu.Scheduler, emu.logger)
+
+	emu.AntiDebug = NewAntiDebug(emu, emu.syscallHandlers, emu.logger)
 
 	// File System
 	emu.logger.Debug().Msg("init vfs")
@@ -206,7 +237,14 @@ func NewEmulator(opt *Options) (*Emulator, error) {
 		emu.Memory,
 		emu.logger,
 		emu.config,
+		emu.Pcb,
+		emu.AntiDebug,
+		emu.Scheduler,
 	)
+	emu.ProcFS = NewProcFS(emu, emu.logger)
+	emu.Vfs.Mount("/proc", emu.ProcFS)
+	emu.Net = NewNetwork(emu, emu.syscallHandlers, emu.Vfs, emu.logger)
+	emu.Logd = NewLogd(emu, emu.Vfs, emu.Net, emu.logger)
 
 	// Hooker
 	emu.logger.Debug().Msg("init hooker")
@@ -239,8 +277,13 @@ func NewEmulator(opt *Options) (*Emulator, error) {
 		emu.Mu, emu.Memory,
 		emu.syscallHandlers,
 		emu.Vfs,
+		emu.Modules,
 		emu.logger,
 	)
+	emu.Heap = NewHeap(emu.Mu, emu.Memory, emu.logger)
+	if emu.config.HeapCheck {
+		emu.HeapChecker = NewHeapChecker(emu, emu.Memory, emu.logger)
+	}
 	emu.logger.Debug().Msg("init native hooks")
 	emu.NativeHooks  = NewNativeHooks(
 		emu, emu.NativeMemory, 
@@ -252,43 +295,160 @@ func NewEmulator(opt *Options) (*Emulator, error) {
 	emu.logger.Debug().Msg("register java class")
 	emu.addClasses()
 
-	//映射常用的文件，cpu一些原子操作的函数实现地方	
-	path := fmt.Sprintf("%s/system/lib/vectors", emu.vfsRoot)
+	//映射常用的文件，cpu一些原子操作的函数实现地方
+	//arm64 has no kuser helpers
+	if !emu.Arch.Is64 {
+		path := fmt.Sprintf("%s/system/lib/vectors", emu.vfsRoot)
+		emu.logger.Debug().Msgf("loading to memory: %s", path)
+		vfo, err := MyOpen(path, os.O_RDONLY)
+		if err != nil {
+			return nil, err
+		}
+		vf := NewVirtualFile("[vectors]", path, vfo)
+		_, err = emu.Memory.Map(0xffff0000, 0x1000, uc.PROT_EXEC | uc.PROT_READ, vf, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	//映射app_process，android系统基本特征
+	path := fmt.Sprintf("%s%s", emu.vfsRoot, emu.Arch.AppProcess)
 	emu.logger.Debug().Msgf("loading to memory: %s", path)
+	inf, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	sz := uint64(inf.Size())
 	vfo, err := MyOpen(path, os.O_RDONLY)
 	if err != nil {
 		return nil, err
 	}
-	vf := NewVirtualFile("[vectors]", path, vfo)
-	_, err = emu.Memory.Map(0xffff0000, 0x1000, uc.PROT_EXEC | uc.PROT_READ, vf, 0)
+	vf := NewVirtualFile(emu.Arch.AppProcess, path, vfo)
+	_, err = emu.Memory.Map(0xab006000, sz, uc.PROT_WRITE | uc.PROT_READ, vf, 0)
 	if err != nil {
 		return nil, err
 	}
-	
-	//映射app_process，android系统基本特征
-	path = fmt.Sprintf("%s/system/bin/app_process32", emu.vfsRoot)
-	emu.logger.Debug().Msgf("loading to memory: %s", path)
-	inf, err := os.Stat(path)
+
+	// argc, argv, envp and auxv at the top of the stack
+	exe, err := ExecImageAt(emu.Arch.AppProcess, path, 0xab006000)
 	if err != nil {
 		return nil, err
 	}
-	sz := uint64(inf.Size())
-	vfo, err = MyOpen(path, os.O_RDONLY)
+	// argv[0] is the package name, as zygote children have it
+	ka, err := emu.SetupKernelArgs(exe, []string{emu.config.PkgName}, PROC_ENVIRON, STACK_ADDR + STACK_SIZE)
 	if err != nil {
 		return nil, err
 	}
-	vf = NewVirtualFile("/system/bin/app_process32", path, vfo)
-	_, err = emu.Memory.Map(0xab006000, sz, uc.PROT_WRITE | uc.PROT_READ, vf, 0)
+	// main thread TLS, after [vectors] which holds the kuser TLS word on arm
+	tp, err := emu.TLS.NewArea(emu.Scheduler.Current().Tid)
 	if err != nil {
 		return nil, err
 	}
+	if err = emu.TLS.Set(emu.Mu, tp); err != nil {
+		return nil, err
+	}
+	if err = emu.TLS.SetSlot(tp, TLS_SLOT_BIONIC_PREINIT, ka.Block); err != nil {
+		return nil, err
+	}
+	emu.logger.Debug().
+		Str("tls", ConvHex("0x%08X", tp)).
+		Str("sp", ConvHex("0x%08X", ka.SP)).
+		Msg("main thread tls and kernel arguments")
 
 	return emu, nil
 }
 //
+// Close ends the emulation session and reports what the Go side heap
+// still holds.
+func (emu *Emulator) Close() error {
+	if emu.Heap != nil {
+		emu.Heap.ReportLeaks()
+	}
+	if emu.HeapChecker != nil {
+		emu.HeapChecker.ReportLeaks()
+	}
+	return nil
+}
 func (emu *Emulator) LoadLibrary(filename string, doInit bool) (*Module, error) {
 	return emu.Modules.LoadModule(filename, doInit)
 }
+// RunExecutable loads the ET_EXEC or ET_DYN program at path with its
+// DT_NEEDED libraries, starts it the way the kernel and the linker do and
+// runs it from e_entry until it exits. It returns the exit status. A nil
+// env is PROC_ENVIRON, an empty argv is just path.
+func (emu *Emulator) RunExecutable(path string, argv, env []string) (int, error) {
+	ms := emu.Modules
+	// constructors wait for the startup stack
+	ms.deferInit = true
+	exe, err := ms.LoadModule(path, false)
+	ms.deferInit = false
+	deferred := ms.deferred
+	ms.deferred = nil
+	if err != nil {
+		return 0, err
+	}
+	guestPath, err := SystemPathToVfsPath(emu.vfsRoot, path)
+	if err != nil {
+		return 0, err
+	}
+	if len(argv) == 0 {
+		argv = []string{guestPath}
+	}
+	if env == nil {
+		env = PROC_ENVIRON
+	}
+	ka, err := emu.SetupKernelArgs(exe.ExecImage(guestPath), argv, env, STACK_ADDR + STACK_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	tp := emu.Scheduler.Current().Tls()
+	err = emu.TLS.SetSlot(tp, TLS_SLOT_BIONIC_PREINIT, ka.Block)
+	if err == nil {
+		err = emu.TLS.SetSlot(tp, TLS_SLOT_STACK_GUARD, emu.TLS.StackGuard)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// libraries first, in load order, then the program's preinit and init
+	for _, m := range deferred {
+		m.CallInit(emu)
+	}
+	exe.CallInit(emu)
+	// the kernel enters with SP at argc and no atexit function in r0
+	entry := exe.ExecImage(guestPath).Entry
+	if err = emu.Mu.RegWrite(emu.Arch.SP, ka.SP); err != nil {
+		return 0, err
+	}
+	if err = emu.Mu.RegWrite(emu.Arch.ArgRegs[0], 0); err != nil {
+		return 0, err
+	}
+	stopPos := emu.Arch.CodeAddr(randUint64(
+		HOOK_MEMORY_BASE,
+		HOOK_MEMORY_BASE+HOOK_MEMORY_SIZE,
+	) &^ 3)
+	if err = emu.Mu.RegWrite(emu.Arch.LR, stopPos); err != nil {
+		return 0, err
+	}
+	emu.logger.Info().
+		Str("path", guestPath).
+		Strs("argv", argv).
+		Str("entry", ConvHex("0x%08X", entry)).
+		Msg("running executable")
+	err = emu.Scheduler.Run(entry, stopPos &^ 1)
+	var exit *ExitError
+	if errors.As(err, &exit) {
+		return exit.Code, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// _start returned instead of calling exit
+	ret, err := emu.Mu.RegRead(emu.Arch.ArgRegs[0])
+	if err != nil {
+		return 0, err
+	}
+	return int(int32(ret)), nil
+}
 func (emu *Emulator) CallSymbol(module *Module, symbolName string, args ...interface{}) (uint64, error) {
 	symbolAddress, exist := module.FindSymbol(symbolName)
 	if !exist {
@@ -310,15 +470,15 @@ func (emu *Emulator) CallNative(address uint32, args ...interface{}) (uint64, er
 	if err != nil {
 		return 0, err
 	}
-	stopPos := randUint64(
+	stopPos := emu.Arch.CodeAddr(randUint64(
 		HOOK_MEMORY_BASE,
 		HOOK_MEMORY_BASE+HOOK_MEMORY_SIZE,
-	) | 1
-	err = emu.Mu.RegWrite(uc.ARM_REG_LR, stopPos)
+	) &^ 3)
+	err = emu.Mu.RegWrite(emu.Arch.LR, stopPos)
 	if err != nil {
 		return 0, err
 	}
-	err = emu.Mu.Start(uint64(address), stopPos - 1)
+	err = emu.Scheduler.Run(uint64(address), stopPos &^ 1)
 	if err != nil {
 		return 0, err
 	}
@@ -328,7 +488,7 @@ func (emu *Emulator) CallNative(address uint32, args ...interface{}) (uint64, er
 			emu.JavaVM.JniEnv.ClearLocals()
 		}
 	}()
-	ret, err := emu.Mu.RegRead(uc.ARM_REG_R0)
+	ret, err := emu.Mu.RegRead(emu.Arch.ArgRegs[0])
 	if err != nil {
 		return 0, err
 	}
@@ -346,6 +506,15 @@ func (emu *Emulator) addClasses() {
 }
 //
 func (emu *Emulator) enableVfp() {
+	if emu.Arch.Is64 {
+		// CPACR_EL1.FPEN, no trapping of FP and SIMD at EL0 and EL1
+		cpacr, err := emu.Mu.RegRead(uc.ARM64_REG_CPACR_EL1)
+		if err == nil {
+			err = emu.Mu.RegWrite(uc.ARM64_REG_CPACR_EL1, cpacr | 3 << 20)
+		}
+		emu.logger.Debug().Err(err).Msg("vfp cpacr_el1")
+		return
+	}
 	// https://github.com/unicorn-engine/unicorn/blob/8c6cbe3f3cabed57b23b721c29f937dd5baafc90/tests/regress/arm_fp_vfp_disabled.py#L15
 	// MRC p15, #0, r1, c1, c0, #2
 	// ORR r1, r1, #(0xf << 20)
@@ -20,13 +20,23 @@ var (
 	ErrJavaClassLoaded       = errors.New("java class already loaded")
 
 	ErrFailConvertToInt      = errors.New("failed to parse binary")
+	ErrStringTooLong         = errors.New("guest string is too long")
 
 	ErrELFReadFail           = errors.New("reader ELF fail")
 	ErrELFReadNoDynamic      = errors.New("no dynamic in this ELF")
 	ErrELF64NotSupported     = errors.New("64bit not supported now")
+	ErrELFHashTable          = errors.New("ELF hash table runs past the end of the file")
 	ErrELFNHash              = errors.New("can not detect nsymbol by DT_HASH, DT_GNUHASH, not support now")
 	ErrELFStSize             = errors.New("unknown handler for stsize")
 	ErrELFSOFileTooLong      = errors.New("ELF SO filename is longer than 128")
+	ErrELFMachine            = errors.New("ELF class or machine does not match the emulated arch")
 
 	ErrELFSymbolNotFound     = errors.New("ELF Symbol not found")
+	ErrELFRelocation         = errors.New("unresolved symbols or unsupported relocations")
+	ErrLibraryNotFound       = errors.New("library not found")
+	ErrLibraryNotAccessible  = errors.New("library is not accessible for the namespace")
+	ErrTLSFull               = errors.New("static TLS area is full")
+	ErrTLSUnderaligned       = errors.New("executable's TLS segment is underaligned")
+
+	ErrAndroidLogAssert      = errors.New("__android_log_assert called")
 )
\ No newline at end of file
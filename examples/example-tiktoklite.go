@@ -27,6 +27,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	defer emu.Close()
 	libx, err := emu.LoadLibrary("./bin/libcms_new.so", true)
 	if err != nil {
 		panic(err)
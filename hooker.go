@@ -3,7 +3,6 @@ package emulator
 import (
 	"fmt"
 	"bytes"
-	bin "encoding/binary"
 	zl  "github.com/rs/zerolog"
 	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 	ks  "github.com/keystone-engine/keystone/bindings/go/keystone"
@@ -30,7 +29,11 @@ func NewHooker(emu *Emulator, logger zl.Logger, base, size uint64) *Hooker {
 		currId: 0xFF00,
 		hooks: map[uint64]HookerCallback{},
 	}
-	ks, err := ks.New(ks.ARCH_ARM, ks.MODE_THUMB)
+	ksArch, ksMode := ks.ARCH_ARM, ks.MODE_THUMB
+	if emu.Arch.Is64 {
+		ksArch, ksMode = ks.ARCH_ARM64, ks.MODE_LITTLE_ENDIAN
+	}
+	ks, err := ks.New(ksArch, ksMode)
 	if err != nil {
 		hk.logger.Debug().Err(err).Msg("keystone init failed")
 		return nil
@@ -52,10 +55,7 @@ func (hk *Hooker) writeFunction(f HookerCallback) (uint64, error) {
 	hookId := hk.getNextId()
 	hookAddr := hk.hookCurrent
 	addrHex := fmt.Sprintf("0x%x", hookId)
-	asm := "PUSH {R4,LR}\n" +
-	        "MOV R4, #" + addrHex + "\n" +
-	        "IT AL\n" +
-	        "POP {R4,PC}"
+	asm := hk.emu.Arch.stubAsm(hookId)
 //	fmt.Println(asm)
 	code, v, ok := hk.ks.Assemble(asm, 0)
 	if !ok {
@@ -64,7 +64,7 @@ func (hk *Hooker) writeFunction(f HookerCallback) (uint64, error) {
 			Msgf("keystone cannot write hook function %+v", v)
 		return 0, ErrAsmFailed
 	}
-	if v != 4 {
+	if v != hk.emu.Arch.HookInsns {
 		hk.logger.Debug().
 			Str("hAddr", addrHex).
 			Int("len", len(code)).
@@ -105,7 +105,10 @@ func (hk *Hooker) WriteFunctionTable(table map[uint64]HookerCallback) (uint64, u
 		hookMap[k] = address
 	}
 	// Then we write the function table.
+	arch := hk.emu.Arch
 	tableBytes := []byte{}
+	// stubs are 2 byte aligned on Thumb, pointers have to be on arm64
+	hk.hookCurrent = (hk.hookCurrent + arch.PtrSize - 1) &^ (arch.PtrSize - 1)
 	tableAddr := hk.hookCurrent
 	for index = 0; index < indexMax; index++ {
 		if o, exist := hookMap[index]; exist {
@@ -113,18 +116,14 @@ func (hk *Hooker) WriteFunctionTable(table map[uint64]HookerCallback) (uint64, u
 		}else{
 			address = 0
 		}
-		by := make([]byte, 4)
-		bin.LittleEndian.PutUint32(by,uint32(address + 1)) // explicit
-		tableBytes = append(tableBytes, by...)
+		tableBytes = append(tableBytes, arch.PutPtr(arch.CodeAddr(address))...) // explicit
 	}
 	hk.emu.Mu.MemWrite(tableAddr, tableBytes)
 	hk.hookCurrent = hk.hookCurrent + uint64(len(tableBytes))
 	// Then we write the a pointer to the table.
 	ptrAddr := hk.hookCurrent
-	by := make([]byte, 4)
-	bin.LittleEndian.PutUint32(by, uint32(tableAddr))
-	hk.emu.Mu.MemWrite(ptrAddr, by)
-	hk.hookCurrent = hk.hookCurrent + 4
+	hk.emu.Mu.MemWrite(ptrAddr, arch.PutPtr(tableAddr))
+	hk.hookCurrent = hk.hookCurrent + arch.PtrSize
 	return ptrAddr, tableAddr
 }
 func (hk *Hooker) hook(mu uc.Unicorn, addr uint64, size uint32) {
@@ -133,14 +132,14 @@ func (hk *Hooker) hook(mu uc.Unicorn, addr uint64, size uint32) {
 		//hk.logger.Debug().Err(err).Msg("hook memread failed")
 		return
 	}
-	// "IT AL"
-	cmp := []byte{0xE8, 0xBF}
-	if size != 2 || bytes.Compare(code, cmp) != 0 {
+	// "IT AL" or "NOP"
+	cmp := hk.emu.Arch.HookMarker
+	if int(size) != len(cmp) || bytes.Compare(code, cmp) != 0 {
 		//hk.logger.Debug().Err(ErrUnexpectedAsmLength).Msg("not 'IT AL' instruction")
 		return
 	}
 	// Find hook.
-	hookId, err := hk.emu.Mu.RegRead(uc.ARM_REG_R4)
+	hookId, err := hk.emu.Mu.RegRead(hk.emu.Arch.HookReg)
 	if err != nil {
 		return
 	}
@@ -148,7 +147,7 @@ func (hk *Hooker) hook(mu uc.Unicorn, addr uint64, size uint32) {
 	err = hookFunc(NativeMethodContext{hk.emu, mu})
 	if err != nil {
 		hk.logger.Info().Err(err).Msg("hook function callback error, stopping emulation")
-		mu.Stop()
+		hk.emu.interruptHandler.Halt(mu)
 		return
 	}
 }
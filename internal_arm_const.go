@@ -2,12 +2,28 @@ package emulator
 
 // From http://infocenter.arm.com/help/topic/com.arm.doc.ihi0044f/IHI0044F_aaelf.pdf
 var (
+	R_ARM_NONE uint32      = 0
 	R_ARM_ABS32 uint32     = 2
+	R_ARM_REL32 uint32     = 3
+	R_ARM_TLS_DTPMOD32 uint32 = 17
+	R_ARM_TLS_DTPOFF32 uint32 = 18
+	R_ARM_TLS_TPOFF32 uint32  = 19
+	R_ARM_COPY uint32      = 20
 	R_ARM_GLOB_DAT uint32  = 21
 	R_ARM_JUMP_SLOT uint32 = 22
 	R_ARM_RELATIVE uint32  = 23
+	R_ARM_IRELATIVE uint32 = 160
 	//64
+	R_AARCH64_NONE uint32      = 256
+	R_AARCH64_ABS64 uint32     = 257
+	R_AARCH64_PREL64 uint32    = 260
+	R_AARCH64_COPY uint32      = 1024
 	R_AARCH64_GLOB_DAT uint32  = 1025
 	R_AARCH64_JUMP_SLOT uint32 = 1026
 	R_AARCH64_RELATIVE uint32  = 1027
+	R_AARCH64_TLS_DTPMOD64 uint32 = 1028
+	R_AARCH64_TLS_DTPREL64 uint32 = 1029
+	R_AARCH64_TLS_TPREL64 uint32  = 1030
+	R_AARCH64_TLSDESC uint32   = 1031
+	R_AARCH64_IRELATIVE uint32 = 1032
 )
@@ -0,0 +1,190 @@
+package emulator
+
+import (
+	"io"
+	bin "encoding/binary"
+)
+
+// symKey is a symbol name with both of its ELF hashes, so looking it up in
+// every module hashes it once.
+type symKey struct {
+	name string
+	sysv uint32
+	gnu  uint32
+}
+func newSymKey(name string) symKey {
+	return symKey{name: name, sysv: elfSysvHash(name), gnu: elfGnuHash(name)}
+}
+func elfSysvHash(name string) uint32 {
+	var h uint32
+	for i := 0; i < len(name); i++ {
+		h = (h << 4) + uint32(name[i])
+		g := h & 0xf0000000
+		h ^= g
+		h ^= g >> 24
+	}
+	return h
+}
+func elfGnuHash(name string) uint32 {
+	var h uint32 = 5381
+	for i := 0; i < len(name); i++ {
+		h = h * 33 + uint32(name[i])
+	}
+	return h
+}
+
+// elfSymHash is the DT_GNU_HASH or DT_HASH table of a module, the GNU one
+// wins when both are there.
+type elfSymHash struct {
+	gnu       bool
+	nbucket   uint32
+	buckets   []uint32
+	chain     []uint32
+	// GNU only, first hashed symbol and the bloom filter
+	symoffset uint32
+	shift2    uint32
+	bloom     []uint64
+	// bits per bloom word, 32 or 64 for ELF64
+	bloomBits uint32
+}
+
+// hashReader is the file a hash table is read from, counts taken from the
+// table are checked against its size before anything is allocated.
+type hashReader interface {
+	io.ReaderAt
+	Size() int64
+}
+
+func readWords(r hashReader, off int64, n uint64) ([]uint32, error) {
+	if off < 0 || off > r.Size() || n > uint64(r.Size() - off) / 4 {
+		return nil, ErrELFHashTable
+	}
+	b := make([]byte, n * 4)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	w := make([]uint32, n)
+	for i := range w {
+		w[i] = bin.LittleEndian.Uint32(b[i*4:])
+	}
+	return w, nil
+}
+// readSysvHash parses DT_HASH: nbucket, nchain, buckets, chain.
+func readSysvHash(r hashReader, off int64) (*elfSymHash, error) {
+	head, err := readWords(r, off, 2)
+	if err != nil {
+		return nil, err
+	}
+	h := &elfSymHash{nbucket: head[0]}
+	if h.buckets, err = readWords(r, off + 8, uint64(head[0])); err != nil {
+		return nil, err
+	}
+	if h.chain, err = readWords(r, off + 8 + int64(head[0]) * 4, uint64(head[1])); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+// readGnuHash parses DT_GNU_HASH: nbucket, symoffset, bloom size, shift2,
+// bloom words, buckets, then the chain which has no length of its own, it
+// runs until the entry of the last bucket with bit 0 set. Bloom words are
+// pointer sized.
+func readGnuHash(r hashReader, off int64, is64 bool) (*elfSymHash, error) {
+	head, err := readWords(r, off, 4)
+	if err != nil {
+		return nil, err
+	}
+	h := &elfSymHash{gnu: true, nbucket: head[0], symoffset: head[1], shift2: head[3], bloomBits: 32}
+	pos := off + 16
+	n := uint64(head[2])
+	if is64 {
+		h.bloomBits = 64
+		n *= 2
+	}
+	words, err := readWords(r, pos, n)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < head[2]; i++ {
+		if is64 {
+			h.bloom = append(h.bloom, uint64(words[2*i]) | uint64(words[2*i+1]) << 32)
+		}else{
+			h.bloom = append(h.bloom, uint64(words[i]))
+		}
+	}
+	pos += int64(n) * 4
+	if h.buckets, err = readWords(r, pos, uint64(h.nbucket)); err != nil {
+		return nil, err
+	}
+	pos += int64(h.nbucket) * 4
+	var last uint32
+	for _, b := range h.buckets {
+		if b > last {
+			last = b
+		}
+	}
+	if last < h.symoffset {
+		return h, nil
+	}
+	for i := last - h.symoffset; ; i++ {
+		w, err := readWords(r, pos + int64(i) * 4, 1)
+		if err != nil {
+			return nil, err
+		}
+		h.chain = append(h.chain, w[0])
+		if w[0] & 1 != 0 {
+			break
+		}
+	}
+	// only the tail was needed to find the end, load the whole chain
+	n = uint64(len(h.chain)) + uint64(last - h.symoffset)
+	if h.chain, err = readWords(r, pos, n); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+// nsymbol is how many dynsym entries the table covers.
+func (h *elfSymHash) nsymbol() uint32 {
+	if !h.gnu {
+		return uint32(len(h.chain))
+	}
+	if len(h.chain) == 0 {
+		return h.symoffset
+	}
+	return h.symoffset + uint32(len(h.chain))
+}
+// lookup returns the index of k in syms.
+func (h *elfSymHash) lookup(k symKey, syms []dyn) (int, bool) {
+	if h.nbucket == 0 {
+		return 0, false
+	}
+	if !h.gnu {
+		for i := h.buckets[k.sysv % h.nbucket]; i != 0 && int(i) < len(syms) && int(i) < len(h.chain); i = h.chain[i] {
+			if syms[i].Name == k.name {
+				return int(i), true
+			}
+		}
+		return 0, false
+	}
+	if n := uint32(len(h.bloom)); n > 0 {
+		bits := h.bloomBits
+		word := h.bloom[(k.gnu / bits) % n]
+		mask := uint64(1) << (k.gnu % bits) | uint64(1) << ((k.gnu >> h.shift2) % bits)
+		if word & mask != mask {
+			return 0, false
+		}
+	}
+	i := h.buckets[k.gnu % h.nbucket]
+	if i < h.symoffset {
+		return 0, false
+	}
+	for ; int(i - h.symoffset) < len(h.chain) && int(i) < len(syms); i++ {
+		c := h.chain[i - h.symoffset]
+		if c | 1 == k.gnu | 1 && syms[i].Name == k.name {
+			return int(i), true
+		}
+		if c & 1 != 0 {
+			break
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,131 @@
+package emulator
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+)
+
+func TestElfHashes(t *testing.T) {
+	tests := []struct {
+		name string
+		sysv uint32
+		gnu  uint32
+	}{
+		{"", 0x00000000, 0x00001505},
+		{"exit", 0x0006cf04, 0x7c967e3f},
+		{"printf", 0x077905a6, 0x156b2bb8},
+		{"syscall", 0x0b09985c, 0xbac212a0},
+		{"printf_count", 0x0d216ff4, 0x7a9381c0},
+	}
+	for _, tt := range tests {
+		if h := elfSysvHash(tt.name); h != tt.sysv {
+			t.Errorf("elfSysvHash(%q) = %#x, want %#x", tt.name, h, tt.sysv)
+		}
+		if h := elfGnuHash(tt.name); h != tt.gnu {
+			t.Errorf("elfGnuHash(%q) = %#x, want %#x", tt.name, h, tt.gnu)
+		}
+	}
+}
+
+// the hash sections and dynsym order of a small shared object with
+// exit_code, syscall_nr, table, first, second and printf_count, linked for
+// i386 and x86_64, which share the layout with arm and arm64
+var hashTests = []struct {
+	name    string
+	section string
+	gnu     bool
+	is64    bool
+	syms    []string
+}{
+	{
+		name: "gnu32",
+		section: "03000000010000000200000006000000a364008000000202000000000100" +
+			"0000050000005e31bae57884394e8cfa68108d4b700f40207c1bc181937a",
+		gnu: true,
+		syms: []string{"", "syscall_nr", "exit_code", "table", "first", "second", "printf_count"},
+	},
+	{
+		name: "gnu64",
+		section: "03000000050000000100000006000000a320028000440002000000000500" +
+			"0000090000005e31bae57884394e8cfa68108d4b700f40207c1bc181937a",
+		gnu: true,
+		is64: true,
+		syms: []string{"", "__cxa_finalize", "_ITM_registerTMCloneTable", "_ITM_deregisterTMCloneTable",
+			"__gmon_start__", "syscall_nr", "exit_code", "table", "first", "second", "printf_count"},
+	},
+	{
+		name: "sysv",
+		section: "030000000700000006000000040000000500000000000000000000000100" +
+			"000000000000000000000300000002000000",
+		syms: []string{"", "syscall_nr", "second", "exit_code", "table", "printf_count", "first"},
+	},
+}
+
+func TestElfSymHashLookup(t *testing.T) {
+	for _, tt := range hashTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.section)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var h *elfSymHash
+			if tt.gnu {
+				h, err = readGnuHash(bytes.NewReader(b), 0, tt.is64)
+			}else{
+				h, err = readSysvHash(bytes.NewReader(b), 0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := h.nsymbol(); n != uint32(len(tt.syms)) {
+				t.Errorf("nsymbol() = %d, want %d", n, len(tt.syms))
+			}
+			syms := make([]dyn, len(tt.syms))
+			for i, name := range tt.syms {
+				syms[i].Name = name
+			}
+			for want, name := range tt.syms {
+				if name == "" {
+					continue
+				}
+				i, ok := h.lookup(newSymKey(name), syms)
+				if tt.gnu && want < int(h.symoffset) {
+					// undefined symbols are left out of the GNU table
+					if ok {
+						t.Errorf("lookup(%q) = %d, want not found", name, i)
+					}
+					continue
+				}
+				if !ok || i != want {
+					t.Errorf("lookup(%q) = %d, %v, want %d", name, i, ok, want)
+				}
+			}
+			for _, name := range []string{"printf", "exit", "syscall", "first_", "main"} {
+				if i, ok := h.lookup(newSymKey(name), syms); ok {
+					t.Errorf("lookup(%q) = %d, want not found", name, i)
+				}
+			}
+		})
+	}
+}
+
+func TestReadGnuHashTruncated(t *testing.T) {
+	b, _ := hex.DecodeString(hashTests[0].section)
+	for _, n := range []int{0, 12, 20, 36, len(b) - 4} {
+		if _, err := readGnuHash(bytes.NewReader(b[:n]), 0, false); err == nil {
+			t.Errorf("readGnuHash of %d bytes succeeded", n)
+		}
+	}
+}
+
+func TestReadHashOversized(t *testing.T) {
+	// counts near 2^32 with a few bytes behind them
+	huge := bytes.Repeat([]byte{0xff}, 32)
+	if _, err := readSysvHash(bytes.NewReader(huge), 0); err != ErrELFHashTable {
+		t.Errorf("readSysvHash = %v, want %v", err, ErrELFHashTable)
+	}
+	if _, err := readGnuHash(bytes.NewReader(huge), 0, true); err != ErrELFHashTable {
+		t.Errorf("readGnuHash = %v, want %v", err, ErrELFHashTable)
+	}
+}
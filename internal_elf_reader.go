@@ -1,8 +1,10 @@
 package emulator
 
 import (
+	"io"
 	"os"
 	"bytes"
+	"strings"
 	"github.com/pkg/errors"
 	bin "encoding/binary"
 	log "github.com/rs/zerolog/log"
@@ -18,6 +20,7 @@ var (
 	PT_NOTE      uint32 = 4
 	PT_SHLIB     uint32 = 5
 	PT_PHDR      uint32 = 6
+	PT_TLS       uint32 = 7
 	// DT
 	DT_NULL	     uint32 = 0
 	DT_NEEDED	 uint32 = 1
@@ -36,8 +39,11 @@ var (
 	DT_FINI_ARRAY    uint32 = 0x1a
 	DT_INIT_ARRAYSZ  uint32 = 0x1b
 	DT_FINI_ARRAYSZ  uint32 = 0x1c
+	DT_PREINIT_ARRAY   uint32 = 0x20
+	DT_PREINIT_ARRAYSZ uint32 = 0x21
 	DT_SONAME	  uint32 = 14
 	DT_RPATH 	  uint32 = 15
+	DT_RUNPATH    uint32 = 29
 	DT_SYMBOLIC	  uint32 = 16
 	DT_REL	      uint32 = 17
 	DT_RELSZ	  uint32 = 18
@@ -46,6 +52,15 @@ var (
 	DT_DEBUG      uint32 = 21
 	DT_TEXTREL    uint32 = 22
 	DT_JMPREL	  uint32 = 23
+	DT_RELRSZ     uint32 = 35
+	DT_RELR       uint32 = 36
+	DT_ANDROID_REL     uint32 = 0x6000000f
+	DT_ANDROID_RELSZ   uint32 = 0x60000010
+	DT_ANDROID_RELA    uint32 = 0x60000011
+	DT_ANDROID_RELASZ  uint32 = 0x60000012
+	DT_ANDROID_RELR    uint32 = 0x6fffe000
+	DT_ANDROID_RELRSZ  uint32 = 0x6fffe001
+	DT_GNU_HASH   uint32 = 0x6ffffef5
 	DT_LOPROC	  uint32 = 0x70000000
 	DT_HIPROC	  uint32 = 0x7fffffff
 	// SHN
@@ -66,6 +81,12 @@ var (
 	STT_FUNC      uint16 = 2
 	STT_SECTION   uint16 = 3
 	STT_FILE      uint16 = 4
+	// EI_CLASS
+	ELFCLASS32    byte = 1
+	ELFCLASS64    byte = 2
+	// e_type
+	ET_EXEC       uint16 = 2
+	ET_DYN        uint16 = 3
 )
 
 type ELFReader struct {
@@ -73,15 +94,24 @@ type ELFReader struct {
 	filename  string
 	phoff     uint64
 	phdrNum   uint64
+	// ELF64, values are kept in the 32 bit fields, the guest lives below 4G
+	is64      bool
+	machine   uint16
+	eType     uint16
+	entry     uint64
 
 	initArrayOff  uint32
 	initArraySize uint32
 	initOff       uint32
+	preinitArrayOff  uint32
+	preinitArraySize uint32
 
 	nbucket       uint32
 	nchain        uint32
 	bucket        uint32
 	chain         uint32
+	// DT_GNU_HASH or DT_HASH, for lookups by name
+	hash          *elfSymHash
 	pltGot        uint32
 	pltRel        uint32
 	pltRelCount   uint32
@@ -95,8 +125,13 @@ type ELFReader struct {
 	dynSymOff     uint32
 
 	soNeeded  []string
+	// DT_SONAME, DT_RPATH and DT_RUNPATH, empty when missing
+	soName    string
+	rpath     string
+	runpath   string
 	phdrs     []phdr
 	loads     []phdr
+	tls       *phdr
 	dynSym    []dyn
 	rels      rels
 	sz        uint32
@@ -130,6 +165,9 @@ func NewELFReader(filename string) (*ELFReader, error) {
 	if err != nil || cnt != ehdr32_sz {
 		return nil, errors.Wrap(err, "ehdr32 count mismatch")
 	}
+	elfr.eType   = bin.LittleEndian.Uint16(ehdr32[16:18])
+	elfr.machine = bin.LittleEndian.Uint16(ehdr32[18:20])
+	elfr.entry   = uint64(bin.LittleEndian.Uint32(ehdr32[24:28]))
 	// LE
 	//_, _ , _, _, _, phoff, _, _, _, _, phdr_num, _, _, _ = struct.unpack("<16sHHIIIIIHHHHHH", ehdr_bytes)
 	// <16s H H I I [I] I I H H [H] H H H
@@ -138,6 +176,23 @@ func NewELFReader(filename string) (*ELFReader, error) {
 	phoff    := bin.LittleEndian.Uint32(ehdr32[28:28+4])
 	// unsigned short, uint16
 	phdrNum := bin.LittleEndian.Uint16(ehdr32[44:44+2])
+	if ehdr32[4] == ELFCLASS64 {
+		// <16s H H I Q [Q] Q I H H H [H] H H
+		ehdr64 := make([]byte, 64)
+		if _, err = f.ReadAt(ehdr64, 0); err != nil {
+			return nil, errors.Wrap(err, "ehdr64 count mismatch")
+		}
+		elfr.is64 = true
+		elfr.entry = bin.LittleEndian.Uint64(ehdr64[24:32])
+		phoff   = uint32(bin.LittleEndian.Uint64(ehdr64[32:40]))
+		phdrNum = bin.LittleEndian.Uint16(ehdr64[56:58])
+		phdr32_sz    = 56
+		elf32_dyn_sz = 16
+		elf32_sym_sz = 24
+		elf32_rel_sz = 16
+	}else if ehdr32[4] != ELFCLASS32 {
+		return nil, ErrELFReadFail
+	}
 	log.Debug().Msgf("ELF reader: phoff:%08X phdrNum:%08X",phoff, phdrNum)
 	elfr.phoff   = uint64(phoff)
 	elfr.phdrNum = uint64(phdrNum)
@@ -163,21 +218,40 @@ func NewELFReader(filename string) (*ELFReader, error) {
 		}
 		//"<IIIIIIII"
 		//p_type, p_offset, p_vaddr, p_paddr, p_filesz, p_memsz, p_flags, p_align
-		phdrx := phdr{
-			pType:   bin.LittleEndian.Uint32(tmp[0:4]),
-			pOffset: bin.LittleEndian.Uint32(tmp[4:8]),
-			pVaddr:  bin.LittleEndian.Uint32(tmp[8:12]),
-			pPaddr:  bin.LittleEndian.Uint32(tmp[12:16]),
-			pFilesz: bin.LittleEndian.Uint32(tmp[16:20]),
-			pMemsz:  bin.LittleEndian.Uint32(tmp[20:24]),
-			pFlags:  bin.LittleEndian.Uint32(tmp[24:28]),
-			pAlign:  bin.LittleEndian.Uint32(tmp[28:32]),
+		var phdrx phdr
+		if elfr.is64 {
+			//"<IIQQQQQQ"
+			//p_type, p_flags, p_offset, p_vaddr, p_paddr, p_filesz, p_memsz, p_align
+			phdrx = phdr{
+				pType:   bin.LittleEndian.Uint32(tmp[0:4]),
+				pFlags:  bin.LittleEndian.Uint32(tmp[4:8]),
+				pOffset: uint32(bin.LittleEndian.Uint64(tmp[8:16])),
+				pVaddr:  uint32(bin.LittleEndian.Uint64(tmp[16:24])),
+				pPaddr:  uint32(bin.LittleEndian.Uint64(tmp[24:32])),
+				pFilesz: uint32(bin.LittleEndian.Uint64(tmp[32:40])),
+				pMemsz:  uint32(bin.LittleEndian.Uint64(tmp[40:48])),
+				pAlign:  uint32(bin.LittleEndian.Uint64(tmp[48:56])),
+			}
+		}else{
+			phdrx = phdr{
+				pType:   bin.LittleEndian.Uint32(tmp[0:4]),
+				pOffset: bin.LittleEndian.Uint32(tmp[4:8]),
+				pVaddr:  bin.LittleEndian.Uint32(tmp[8:12]),
+				pPaddr:  bin.LittleEndian.Uint32(tmp[12:16]),
+				pFilesz: bin.LittleEndian.Uint32(tmp[16:20]),
+				pMemsz:  bin.LittleEndian.Uint32(tmp[20:24]),
+				pFlags:  bin.LittleEndian.Uint32(tmp[24:28]),
+				pAlign:  bin.LittleEndian.Uint32(tmp[28:32]),
+			}
 		}
 		elfr.phdrs = append(elfr.phdrs, phdrx)
 		if phdrx.pType == PT_DYNAMIC {
 			dynOff = phdrx.pOffset
 		}else if phdrx.pType == PT_LOAD {
 			elfr.loads = append(elfr.loads, phdrx)
+		}else if phdrx.pType == PT_TLS {
+			tls := phdrx
+			elfr.tls = &tls
 		}
 		elfr.sz = elfr.sz + phdrx.pMemsz
 	}
@@ -198,12 +272,23 @@ func NewELFReader(filename string) (*ELFReader, error) {
 
 		dynSymOff   uint32 = 0
 		nsymbol     uint32 = 0 //
-		foundNsymbol  bool = false
+		hashOff     uint32 = 0
+		gnuHashOff  uint32 = 0
 		relOff      uint32 = 0
 		relCount    uint32 = 0
 		relpltOff   uint32 = 0
-		relpltCount uint32 = 0
+		relpltSz    uint32 = 0
+		pltRelType  uint32 = DT_REL
+		relaOff     uint32 = 0
+		relaCount   uint32 = 0
+		packedOff   uint32 = 0
+		packedSz    uint32 = 0
+		packedRela  bool
+		relrOff     uint32 = 0
+		relrSz      uint32 = 0
 		dtNeeded           = []uint32{}
+		// string table offsets, resolved once it is read
+		dtStrings          = map[uint32]uint32{}
 	)
 	_ = dynStrBuf
 	for {
@@ -216,10 +301,27 @@ func NewELFReader(filename string) (*ELFReader, error) {
 		tmp = tmp[:cnt]
 		dTag     := bin.LittleEndian.Uint32(tmp[0:4])
 		dValPtr  := bin.LittleEndian.Uint32(tmp[4:8])
+		if elfr.is64 {
+			dTag    = uint32(bin.LittleEndian.Uint64(tmp[0:8]))
+			dValPtr = uint32(bin.LittleEndian.Uint64(tmp[8:16]))
+		}
 		if dTag == DT_NULL {
 			break
 		}else if dTag == DT_RELA {
-			return nil, ErrELF64NotSupported
+			relaOff = dValPtr
+		}else if dTag == DT_RELASZ {
+			relaCount = dValPtr / relEntSize(elfr.is64, true)
+		}else if dTag == DT_PLTREL {
+			pltRelType = dValPtr
+		}else if dTag == DT_ANDROID_REL || dTag == DT_ANDROID_RELA {
+			packedOff = dValPtr
+			packedRela = dTag == DT_ANDROID_RELA
+		}else if dTag == DT_ANDROID_RELSZ || dTag == DT_ANDROID_RELASZ {
+			packedSz = dValPtr
+		}else if dTag == DT_RELR || dTag == DT_ANDROID_RELR {
+			relrOff = dValPtr
+		}else if dTag == DT_RELRSZ || dTag == DT_ANDROID_RELRSZ {
+			relrSz = dValPtr
 		}else if dTag == DT_REL {
 			relOff = dValPtr
 		}else if dTag == DT_RELSZ {
@@ -227,7 +329,7 @@ func NewELFReader(filename string) (*ELFReader, error) {
 		}else if dTag == DT_JMPREL {
 			relpltOff = dValPtr
 		}else if dTag == DT_PLTRELSZ {
-			relpltCount = uint32(dValPtr) / uint32(elf32_rel_sz)
+			relpltSz = dValPtr
 		}else if dTag == DT_SYMTAB {
 			dynSymOff = dValPtr
 		}else if dTag == DT_STRTAB {
@@ -235,41 +337,56 @@ func NewELFReader(filename string) (*ELFReader, error) {
 		}else if dTag == DT_STRSZ {
 			dynStrSz = dValPtr
 		}else if dTag == DT_HASH {
-			curPos, err := f.Seek(0, 1)
-			if err != nil {
-				return nil, errors.Wrap(err, "cannot get current read position")
-			}
-			_, err = f.Seek(int64(dValPtr), 0)
-			hashHeads := make([]byte,8)
-			cnt, err = f.Read(hashHeads)
-			hashHeads = hashHeads[:cnt]
-			if err != nil {
-				return nil, errors.Wrap(err, "cannot read DT_HASH")
-			}
-			_, err = f.Seek(curPos, 0)
-			if err != nil {
-				return nil, errors.Wrap(err, "cannot seek to readPos")
-			}
-			elfr.nbucket = bin.LittleEndian.Uint32(hashHeads[0:4])
-			elfr.nchain  = bin.LittleEndian.Uint32(hashHeads[4:8])
-			elfr.bucket  = dValPtr + 8
-			elfr.chain   = dValPtr + 8 + (elfr.nbucket * 4)
-			nsymbol = elfr.nchain
-			foundNsymbol = true
+			hashOff = dValPtr
+		}else if dTag == DT_GNU_HASH {
+			gnuHashOff = dValPtr
 		}else if dTag == DT_INIT {
 			elfr.initOff = dValPtr
 		}else if dTag == DT_INIT_ARRAY {
 			elfr.initArrayOff = dValPtr
 		}else if dTag == DT_INIT_ARRAYSZ {
 			elfr.initArraySize = dValPtr
+		}else if dTag == DT_PREINIT_ARRAY {
+			elfr.preinitArrayOff = dValPtr
+		}else if dTag == DT_PREINIT_ARRAYSZ {
+			elfr.preinitArraySize = dValPtr
 		}else if dTag == DT_NEEDED {
 			dtNeeded = append(dtNeeded, dValPtr)
+		}else if dTag == DT_SONAME || dTag == DT_RPATH || dTag == DT_RUNPATH {
+			dtStrings[dTag] = dValPtr
 		}else if dTag == DT_PLTGOT {
 			elfr.pltGot = dValPtr
 		}
 		readPos = readPos + uint32(len(tmp))
 	}
-	if !foundNsymbol {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot stat ELF file")
+	}
+	hashes := io.NewSectionReader(f, 0, st.Size())
+	if hashOff != 0 {
+		h, err := readSysvHash(hashes, int64(hashOff))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read DT_HASH")
+		}
+		elfr.nbucket = h.nbucket
+		elfr.nchain  = uint32(len(h.chain))
+		elfr.bucket  = hashOff + 8
+		elfr.chain   = hashOff + 8 + (elfr.nbucket * 4)
+		elfr.hash = h
+		nsymbol = elfr.nchain
+	}
+	if gnuHashOff != 0 {
+		h, err := readGnuHash(hashes, int64(gnuHashOff), elfr.is64)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read DT_GNU_HASH")
+		}
+		elfr.hash = h
+		if n := h.nsymbol(); n > nsymbol {
+			nsymbol = n
+		}
+	}
+	if elfr.hash == nil {
 		return nil, ErrELFNHash
 	}
 	elfr.dynStrOff = dynStrOff
@@ -277,6 +394,7 @@ func NewELFReader(filename string) (*ELFReader, error) {
 	
 	elfr.dynStrSz  = dynStrSz
 
+	relpltCount := relpltSz / relEntSize(elfr.is64, pltRelType == DT_RELA)
 	elfr.pltRel      = relpltOff
 	elfr.pltRelCount = relpltCount
 
@@ -314,6 +432,14 @@ func NewELFReader(filename string) (*ELFReader, error) {
 		// 255
 		stOther := uint32(symBytes[13:14][0])
 		stShndx := bin.LittleEndian.Uint16(symBytes[14:16])
+		if elfr.is64 {
+			// "<IccHQQ"
+			stInfo  = uint32(symBytes[4])
+			stOther = uint32(symBytes[5])
+			stShndx = bin.LittleEndian.Uint16(symBytes[6:8])
+			stVal   = uint32(bin.LittleEndian.Uint64(symBytes[8:16]))
+			stSize  = uint32(bin.LittleEndian.Uint64(symBytes[16:24]))
+		}
 		var intStInfo uint64 = uint64(stInfo)
 		//if stInfo == 2 {
 		//	intStInfo = bin.LittleEndian.Uint16()
@@ -336,57 +462,35 @@ func NewELFReader(filename string) (*ELFReader, error) {
 		elfr.dynSym = append(elfr.dynSym, dy)
 	}
 
-	_, err = f.Seek(int64(relOff), 0)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot seek to relOff")
+	if elfr.rels.dynrel, err = readRelTable(f, relOff, relCount, false, elfr.is64); err != nil {
+		return nil, errors.Wrap(err, "cannot read DT_REL")
 	}
-
-//	log.Debug().Msgf(">>> relOffset %08X count %08X", relOff, relCount)
-	relTable := []relx{}
-	for jj = 0; jj < relCount; jj++ {
-		tmp := make([]byte, elf32_rel_sz)
-		cnt, err := f.Read(tmp)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot read elf32 rel bytes")
+	if elfr.rels.dynrela, err = readRelTable(f, relaOff, relaCount, true, elfr.is64); err != nil {
+		return nil, errors.Wrap(err, "cannot read DT_RELA")
+	}
+	if elfr.rels.relplt, err = readRelTable(f, relpltOff, relpltCount, pltRelType == DT_RELA, elfr.is64); err != nil {
+		return nil, errors.Wrap(err, "cannot read DT_JMPREL")
+	}
+	if packedSz > 0 {
+		packed := make([]byte, packedSz)
+		if _, err = f.ReadAt(packed, int64(packedOff)); err != nil {
+			return nil, errors.Wrap(err, "cannot read packed relocations")
+		}
+		words := elfr.imageSize() / 4
+		if elfr.is64 {
+			words = elfr.imageSize() / 8
+		}
+		if elfr.rels.packed, err = decodePackedRelocs(packed, packedRela, elfr.is64, words); err != nil {
+			return nil, err
 		}
-		tmp = tmp[:cnt]
-		rOffset := bin.LittleEndian.Uint32(tmp[0:4])
-		rInfo := bin.LittleEndian.Uint32(tmp[4:8])
-		rInfoSym  := elf32_r_sym(rInfo)
-		rInfoType := elf32_r_type(rInfo)
-		relTable = append(relTable, relx{
-			ROffset: rOffset,
-			RInfo: rInfo,
-			RInfoType: rInfoType,
-			RInfoSym: rInfoSym,
-		})
-	}
-	elfr.rels.dynrel = relTable
-
-	_, err = f.Seek(int64(relpltOff), 0)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot seek to relPltOff")
 	}
-	relpltTable := []relx{}
-	for jj = 0; jj < relpltCount; jj++ {
-		tmp := make([]byte, elf32_rel_sz)
-		cnt, err := f.Read(tmp)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot read elf32 rel bytes")
+	if relrSz > 0 {
+		b := make([]byte, relrSz)
+		if _, err = f.ReadAt(b, int64(relrOff)); err != nil {
+			return nil, errors.Wrap(err, "cannot read DT_RELR")
 		}
-		tmp = tmp[:cnt]
-		rOffset := bin.LittleEndian.Uint32(tmp[0:4])
-		rInfo := bin.LittleEndian.Uint32(tmp[4:8])		
-		rInfoSym  := elf32_r_sym(rInfo)
-		rInfoType := elf32_r_type(rInfo)
-		relpltTable = append(relpltTable, relx{
-			ROffset: rOffset,
-			RInfo: rInfo,
-			RInfoType: rInfoType,
-			RInfoSym: rInfoSym,
-		})
-	}
-	elfr.rels.relplt = relpltTable
+		elfr.rels.relr = decodeRelr(b, elfr.is64)
+	}
 //	log.Debug().Str("filename", filename).Msg("load ok")
 	for _, needed := range dtNeeded {
 		endId := bytes.Index(elfr.dynStrBuf[int(needed):], []byte{0x0})
@@ -395,6 +499,20 @@ func NewELFReader(filename string) (*ELFReader, error) {
 		}
 		elfr.soNeeded = append(elfr.soNeeded, string( elfr.dynStrBuf[int(needed):int(needed)+endId]) )
 	}
+	for dTag, off := range dtStrings {
+		if int(off) >= len(elfr.dynStrBuf) {
+			continue
+		}
+		str := elfr.StNameToName(off)
+		switch dTag {
+		case DT_SONAME:
+			elfr.soName = str
+		case DT_RPATH:
+			elfr.rpath = str
+		case DT_RUNPATH:
+			elfr.runpath = str
+		}
+	}
 	return elfr, nil
 }
 func (elfr *ELFReader) StNameToName(stname uint32) string {
@@ -406,18 +524,85 @@ func (elfr *ELFReader) StNameToName(stname uint32) string {
 	return string(elfr.dynStrBuf[int(stname):int(stname)+endId])
 }
 
+// Is64 tells an ELFCLASS64 file, Machine is its e_machine.
+func (elfr *ELFReader) Is64() bool {
+	return elfr.is64
+}
+func (elfr *ELFReader) Machine() uint16 {
+	return elfr.machine
+}
+// Type is e_type, ET_EXEC or ET_DYN. Entry is e_entry, relative to the
+// load base for ET_DYN.
+func (elfr *ELFReader) Type() uint16 {
+	return elfr.eType
+}
+func (elfr *ELFReader) Entry() uint64 {
+	return elfr.entry
+}
+// GetPhdrAddr is where the program headers are once loaded, relative to
+// the load base: PT_PHDR, else the load segment mapping e_phoff.
+func (elfr *ELFReader) GetPhdrAddr() (uint64, bool) {
+	for _, p := range elfr.phdrs {
+		if p.pType == PT_PHDR {
+			return uint64(p.pVaddr), true
+		}
+	}
+	for _, p := range elfr.loads {
+		if elfr.phoff >= uint64(p.pOffset) && elfr.phoff < uint64(p.pOffset + p.pFilesz) {
+			return uint64(p.pVaddr) + elfr.phoff - uint64(p.pOffset), true
+		}
+	}
+	return 0, false
+}
+// GetPhdrs lists the program headers.
+func (elfr *ELFReader) GetPhdrs() []phdr {
+	return elfr.phdrs
+}
+// imageSize spans the PT_LOAD segments from the lowest to the highest
+// address.
+func (elfr *ELFReader) imageSize() uint64 {
+	var lo, hi uint64
+	for i, p := range elfr.loads {
+		start, end := uint64(p.pVaddr), uint64(p.pVaddr) + uint64(p.pMemsz)
+		if i == 0 || start < lo {
+			lo = start
+		}
+		if end > hi {
+			hi = end
+		}
+	}
+	return hi - lo
+}
 func (elfr *ELFReader) GetLoad() []phdr {
 	return elfr.loads
 }
+// GetTLS returns the PT_TLS segment, the thread local data template.
+func (elfr *ELFReader) GetTLS() (phdr, bool) {
+	if elfr.tls == nil {
+		return phdr{}, false
+	}
+	return *elfr.tls, true
+}
 func (elfr *ELFReader) GetSymbols() []dyn {
 	return elfr.dynSym
 }
+// LookupSymbol finds a symbol the module defines through its hash table.
+func (elfr *ELFReader) LookupSymbol(name string) (dyn, bool) {
+	return elfr.lookupKey(newSymKey(name))
+}
+func (elfr *ELFReader) lookupKey(k symKey) (dyn, bool) {
+	i, ok := elfr.hash.lookup(k, elfr.dynSym)
+	if !ok || elfr.dynSym[i].StShndx == SHN_UNDEF {
+		return dyn{}, false
+	}
+	return elfr.dynSym[i], true
+}
 func (elfr *ELFReader) GetRels() rels {
 	return elfr.rels
 }
 func (elfr *ELFReader) GetDynStringByRelSym(relSym int) string {
 	nsym := len(elfr.dynSym)
-	if relSym > nsym {
+	if relSym >= nsym {
 		return ""
 	}
 	sym := elfr.dynSym[relSym]
@@ -426,12 +611,38 @@ func (elfr *ELFReader) GetDynStringByRelSym(relSym int) string {
 func (elfr *ELFReader) GetInitArray() (uint32	, uint32) {
 	return elfr.initArrayOff, elfr.initArraySize
 }
+// GetPreinitArray is DT_PREINIT_ARRAY, executables only.
+func (elfr *ELFReader) GetPreinitArray() (uint32, uint32) {
+	return elfr.preinitArrayOff, elfr.preinitArraySize
+}
 func (elfr *ELFReader) GetInit() uint32 {
 	return elfr.initOff
 }
 func (elfr *ELFReader) GetSoNeeded() []string {
 	return elfr.soNeeded
 }
+// GetSoName is DT_SONAME, empty when the library has none.
+func (elfr *ELFReader) GetSoName() string {
+	return elfr.soName
+}
+// GetRunPath is the search path the library asks for, DT_RUNPATH or
+// DT_RPATH without one, split at ':'. $ORIGIN is left to the caller.
+func (elfr *ELFReader) GetRunPath() []string {
+	path := elfr.runpath
+	if path == "" {
+		path = elfr.rpath
+	}
+	if path == "" {
+		return nil
+	}
+	var dirs []string
+	for _, dir := range strings.Split(path, ":") {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
 
 func (elfr *ELFReader) WriteSoInfo(mu uc.Unicorn, loadBase, infoBase uint64) (uint32, error) {
 	//在虚拟机中构造一个soinfo结构
@@ -693,14 +904,22 @@ func elf_st_type(st uint64) uint64 {
 
 // rels name
 type rels struct {
-	dynrel []relx
-	relplt []relx
+	dynrel  []relx
+	dynrela []relx
+	relplt  []relx
+	// DT_ANDROID_REL(A)
+	packed  []relx
+	// DT_RELR, all R_ARM_RELATIVE
+	relr    []relx
 }
 type relx struct {
-	ROffset    uint32
-	RInfo      uint32
+	ROffset    uint64
+	RInfo      uint64
 	RInfoType  uint32
 	RInfoSym   uint32
+	// Rela entries carry the addend, Rel ones keep it at the target
+	RAddend    int64
+	HasAddend  bool
 }
 
 type dyn struct {
@@ -0,0 +1,221 @@
+package emulator
+
+import (
+	"io"
+	"bytes"
+	"github.com/pkg/errors"
+	bin "encoding/binary"
+)
+
+var (
+	ELF32_REL_SIZE  uint32 = 8
+	ELF32_RELA_SIZE uint32 = 12
+	ELF64_REL_SIZE  uint32 = 16
+	ELF64_RELA_SIZE uint32 = 24
+
+	// Android packed relocations, "APS2" then sleb128 groups
+	APS2_MAGIC = []byte("APS2")
+	RELOCATION_GROUPED_BY_INFO_FLAG         int64 = 1
+	RELOCATION_GROUPED_BY_OFFSET_DELTA_FLAG int64 = 2
+	RELOCATION_GROUPED_BY_ADDEND_FLAG       int64 = 4
+	RELOCATION_GROUP_HAS_ADDEND_FLAG        int64 = 8
+)
+
+// relSet is one relocation table, in the order the linker applies them.
+type relSet struct {
+	name string
+	list []relx
+}
+func (r rels) sets() []relSet {
+	return []relSet{
+		{"relr", r.relr},
+		{"packed", r.packed},
+		{"dynrel", r.dynrel},
+		{"dynrela", r.dynrela},
+		{"relplt", r.relplt},
+	}
+}
+
+func relEntSize(is64, rela bool) uint32 {
+	switch {
+	case is64 && rela:
+		return ELF64_RELA_SIZE
+	case is64:
+		return ELF64_REL_SIZE
+	case rela:
+		return ELF32_RELA_SIZE
+	}
+	return ELF32_REL_SIZE
+}
+// readRelTable reads count Elf32_Rel or Elf32_Rela entries at off, or the
+// Elf64 ones.
+func readRelTable(r io.ReaderAt, off, count uint32, rela, is64 bool) ([]relx, error) {
+	entsz := relEntSize(is64, rela)
+	b := make([]byte, count * entsz)
+	if _, err := r.ReadAt(b, int64(off)); err != nil {
+		return nil, err
+	}
+	table := make([]relx, 0, count)
+	for i := uint32(0); i < count; i++ {
+		e := b[i*entsz:]
+		var rel relx
+		if is64 {
+			rel = newRelx64(bin.LittleEndian.Uint64(e[0:8]), bin.LittleEndian.Uint64(e[8:16]))
+			if rela {
+				rel.RAddend = int64(bin.LittleEndian.Uint64(e[16:24]))
+			}
+		}else{
+			rel = newRelx(bin.LittleEndian.Uint32(e[0:4]), bin.LittleEndian.Uint32(e[4:8]))
+			if rela {
+				rel.RAddend = int64(int32(bin.LittleEndian.Uint32(e[8:12])))
+			}
+		}
+		rel.HasAddend = rela
+		table = append(table, rel)
+	}
+	return table, nil
+}
+func newRelx(offset, info uint32) relx {
+	return relx{
+		ROffset: uint64(offset),
+		RInfo: uint64(info),
+		RInfoType: elf32_r_type(info),
+		RInfoSym: elf32_r_sym(info),
+	}
+}
+// newRelx64 splits an Elf64 r_info, the symbol is in the upper half.
+func newRelx64(offset, info uint64) relx {
+	return relx{
+		ROffset: offset,
+		RInfo: info,
+		RInfoType: uint32(info),
+		RInfoSym: uint32(info >> 32),
+	}
+}
+
+// sleb128Decoder pops the numbers of a packed relocation stream.
+type sleb128Decoder struct {
+	b   []byte
+	err error
+}
+func (d *sleb128Decoder) pop() int64 {
+	var (
+		v     int64
+		shift uint
+	)
+	for {
+		if len(d.b) == 0 {
+			d.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		c := d.b[0]
+		d.b = d.b[1:]
+		v |= int64(c & 0x7f) << shift
+		shift += 7
+		if c & 0x80 == 0 {
+			if shift < 64 && c & 0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+	}
+}
+// decodePackedRelocs expands DT_ANDROID_REL or DT_ANDROID_RELA, the format
+// bionic's relocation_packer writes. There cannot be more relocations than
+// max, the words the image holds, the count comes from the file.
+func decodePackedRelocs(b []byte, rela, is64 bool, max uint64) ([]relx, error) {
+	if !bytes.HasPrefix(b, APS2_MAGIC) {
+		return nil, errors.New("bad packed relocation magic")
+	}
+	d := &sleb128Decoder{b: b[len(APS2_MAGIC):]}
+	count := d.pop()
+	offset := uint64(d.pop())
+	if count < 0 || uint64(count) > max {
+		return nil, errors.New("bad packed relocation count")
+	}
+	var (
+		info   uint64
+		addend int64
+		table  []relx
+	)
+	for int64(len(table)) < count && d.err == nil {
+		size := d.pop()
+		flags := d.pop()
+		var delta uint64
+		if flags & RELOCATION_GROUPED_BY_OFFSET_DELTA_FLAG != 0 {
+			delta = uint64(d.pop())
+		}
+		if flags & RELOCATION_GROUPED_BY_INFO_FLAG != 0 {
+			info = uint64(d.pop())
+		}
+		hasAddend := flags & RELOCATION_GROUP_HAS_ADDEND_FLAG != 0
+		if hasAddend && !rela {
+			return nil, errors.New("packed rel group has addends")
+		}
+		if hasAddend && flags & RELOCATION_GROUPED_BY_ADDEND_FLAG != 0 {
+			addend += d.pop()
+		}else if !hasAddend {
+			addend = 0
+		}
+		if size < 0 || size > count - int64(len(table)) {
+			return nil, errors.New("bad packed relocation group size")
+		}
+		for i := int64(0); i < size && d.err == nil; i++ {
+			if flags & RELOCATION_GROUPED_BY_OFFSET_DELTA_FLAG != 0 {
+				offset += delta
+			}else{
+				offset += uint64(d.pop())
+			}
+			if flags & RELOCATION_GROUPED_BY_INFO_FLAG == 0 {
+				info = uint64(d.pop())
+			}
+			if hasAddend && flags & RELOCATION_GROUPED_BY_ADDEND_FLAG == 0 {
+				addend += d.pop()
+			}
+			rel := newRelx(uint32(offset), uint32(info))
+			rel.RAddend = int64(int32(addend))
+			if is64 {
+				rel = newRelx64(offset, info)
+				rel.RAddend = addend
+			}
+			rel.HasAddend = rela
+			table = append(table, rel)
+		}
+	}
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "truncated packed relocations")
+	}
+	return table, nil
+}
+// decodeRelr expands DT_RELR: an even word is an address to relocate, an
+// odd one a bitmap of the 31 (63 on ELF64) words after the previous address.
+func decodeRelr(b []byte, is64 bool) []relx {
+	var (
+		table []relx
+		base  uint64
+	)
+	wsz, typ := uint64(4), uint64(R_ARM_RELATIVE)
+	if is64 {
+		wsz, typ = 8, uint64(R_AARCH64_RELATIVE)
+	}
+	for ; uint64(len(b)) >= wsz; b = b[wsz:] {
+		var w uint64
+		if is64 {
+			w = bin.LittleEndian.Uint64(b)
+		}else{
+			w = uint64(bin.LittleEndian.Uint32(b))
+		}
+		if w & 1 == 0 {
+			table = append(table, newRelx64(w, typ))
+			base = w + wsz
+			continue
+		}
+		for i, bits := uint64(0), w >> 1; bits != 0; i, bits = i + 1, bits >> 1 {
+			if bits & 1 != 0 {
+				table = append(table, newRelx64(base + i * wsz, typ))
+			}
+		}
+		base += (wsz * 8 - 1) * wsz
+	}
+	return table
+}
@@ -0,0 +1,250 @@
+package emulator
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"encoding/hex"
+)
+
+func aps2(stream ...byte) []byte {
+	return append(append([]byte{}, APS2_MAGIC...), stream...)
+}
+
+func TestSleb128Decoder(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want int64
+	}{
+		{[]byte{0x00}, 0},
+		{[]byte{0x3f}, 63},
+		{[]byte{0x40}, -64},
+		{[]byte{0x78}, -8},
+		{[]byte{0x80, 0x20}, 0x1000},
+		{[]byte{0x80, 0xc0, 0x00}, 0x2000},
+		{[]byte{0x80, 0x7f}, -128},
+		{[]byte{0x83, 0x08}, 0x403},
+	}
+	for _, tt := range tests {
+		d := &sleb128Decoder{b: tt.in}
+		if v := d.pop(); v != tt.want || d.err != nil || len(d.b) != 0 {
+			t.Errorf("pop(% x) = %d, %v, want %d", tt.in, v, d.err, tt.want)
+		}
+	}
+	d := &sleb128Decoder{b: []byte{0x80}}
+	if d.pop(); d.err == nil {
+		t.Errorf("pop of an unterminated number succeeded")
+	}
+}
+
+func TestDecodePackedRelocs(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		rela bool
+		is64 bool
+		want []relx
+	}{
+		{
+			// count 4 from 0x1000, a group sharing delta 4 and R_ARM_RELATIVE,
+			// then a group with its own deltas, one negative, and infos
+			name: "rel32",
+			in: aps2(0x04, 0x80, 0x20,
+				0x02, 0x03, 0x04, 0x17,
+				0x02, 0x00, 0x10, 0x95, 0x02, 0x78, 0x96, 0x04),
+			want: []relx{
+				{ROffset: 0x1004, RInfo: 0x17, RInfoType: 0x17},
+				{ROffset: 0x1008, RInfo: 0x17, RInfoType: 0x17},
+				{ROffset: 0x1018, RInfo: 0x115, RInfoType: 0x15, RInfoSym: 1},
+				{ROffset: 0x1010, RInfo: 0x216, RInfoType: 0x16, RInfoSym: 2},
+			},
+		},
+		{
+			// count 3 from 0x2000, R_AARCH64_RELATIVE every 8 bytes with
+			// addend deltas 0x100, -0x40 and 0x10
+			name: "rela64",
+			in: aps2(0x03, 0x80, 0xc0, 0x00,
+				0x03, 0x0b, 0x08, 0x83, 0x08, 0x80, 0x02, 0x40, 0x10),
+			rela: true,
+			is64: true,
+			want: []relx{
+				{ROffset: 0x2008, RInfo: 0x403, RInfoType: 0x403, RAddend: 0x100, HasAddend: true},
+				{ROffset: 0x2010, RInfo: 0x403, RInfoType: 0x403, RAddend: 0xc0, HasAddend: true},
+				{ROffset: 0x2018, RInfo: 0x403, RInfoType: 0x403, RAddend: 0xd0, HasAddend: true},
+			},
+		},
+		{
+			// one group sharing delta, info and the addend -3, then a group
+			// without addends which resets it
+			name: "rela64 grouped addend",
+			in: aps2(0x03, 0x00,
+				0x02, 0x0f, 0x10, 0x83, 0x08, 0x7d,
+				0x01, 0x01, 0x83, 0x08, 0x08),
+			rela: true,
+			is64: true,
+			want: []relx{
+				{ROffset: 0x10, RInfo: 0x403, RInfoType: 0x403, RAddend: -3, HasAddend: true},
+				{ROffset: 0x20, RInfo: 0x403, RInfoType: 0x403, RAddend: -3, HasAddend: true},
+				{ROffset: 0x28, RInfo: 0x403, RInfoType: 0x403, HasAddend: true},
+			},
+		},
+		{
+			// an addend that does not fit 32 bits
+			name: "rela64 wide addend",
+			in: aps2(0x01, 0x00,
+				0x01, 0x0b, 0x08, 0x83, 0x08, 0x80, 0x80, 0x80, 0x80, 0x70),
+			rela: true,
+			is64: true,
+			want: []relx{
+				{ROffset: 0x8, RInfo: 0x403, RInfoType: 0x403, RAddend: -0x100000000, HasAddend: true},
+			},
+		},
+		{
+			name: "empty",
+			in: aps2(0x00, 0x00),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodePackedRelocs(tt.in, tt.rela, tt.is64, 0x10000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodePackedRelocsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		rela bool
+	}{
+		{"bad magic", []byte{'A', 'P', 'S', '1', 0x00, 0x00}, false},
+		{"no header", aps2(), false},
+		{"truncated", aps2(0x02, 0x00, 0x02, 0x03, 0x04), false},
+		{"short group", aps2(0x02, 0x00, 0x01, 0x03, 0x04, 0x17), false},
+		{"oversized group", aps2(0x01, 0x00, 0x02, 0x03, 0x04, 0x17), false},
+		{"negative group", aps2(0x01, 0x00, 0x7f, 0x03, 0x04, 0x17), false},
+		{"addend in rel", aps2(0x01, 0x00, 0x01, 0x0f, 0x04, 0x17, 0x01), false},
+		{"negative count", aps2(0x7f, 0x00), false},
+		// 2^30 entries in a few bytes, more than the image has words
+		{"huge count", aps2(0x80, 0x80, 0x80, 0x80, 0x04, 0x00, 0x00), false},
+	}
+	for _, tt := range tests {
+		if got, err := decodePackedRelocs(tt.in, tt.rela, false, 0x10000); err == nil {
+			t.Errorf("%s: got %+v, want an error", tt.name, got)
+		}
+	}
+}
+
+func TestReadRelTable(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		rela bool
+		is64 bool
+		want relx
+	}{
+		{
+			name: "rel32",
+			in: "10200000" + "15030000",
+			want: relx{ROffset: 0x2010, RInfo: 0x315, RInfoType: 0x15, RInfoSym: 3},
+		},
+		{
+			name: "rela32",
+			in: "10200000" + "17000000" + "fcffffff",
+			rela: true,
+			want: relx{ROffset: 0x2010, RInfo: 0x17, RInfoType: 0x17, RAddend: -4, HasAddend: true},
+		},
+		{
+			name: "rela64",
+			in: "1020000001000000" + "0104000002000000" + "00000000ffffffff",
+			rela: true,
+			is64: true,
+			want: relx{ROffset: 0x100002010, RInfo: 0x200000401, RInfoType: 0x401, RInfoSym: 2, RAddend: -0x100000000, HasAddend: true},
+		},
+	}
+	for _, tt := range tests {
+		b, err := hex.DecodeString(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readRelTable(bytes.NewReader(b), 0, 1, tt.rela, tt.is64)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func relrOffsets(table []relx) []uint64 {
+	var offs []uint64
+	for _, r := range table {
+		offs = append(offs, r.ROffset)
+	}
+	return offs
+}
+
+func TestDecodeRelr(t *testing.T) {
+	// DT_RELR of the same object linked for i386 and x86_64, an address, a
+	// bitmap, then a bitmap whose high bits run into the next one
+	tests := []struct {
+		name string
+		in   string
+		is64 bool
+		typ  uint32
+		want []uint64
+	}{
+		{
+			name: "32",
+			in: "c0200000" + "21000000" + "01000080" + "83000000",
+			typ: R_ARM_RELATIVE,
+			want: []uint64{0x20c0, 0x20d4, 0x21b8, 0x21bc, 0x21d4},
+		},
+		{
+			name: "64",
+			in: "6021000000000000" + "21000000000000c0" + "4100000000000000",
+			is64: true,
+			typ: R_AARCH64_RELATIVE,
+			want: []uint64{0x2160, 0x2188, 0x2350, 0x2358, 0x2388},
+		},
+		{
+			name: "addresses only",
+			in: "00100000" + "08100000" + "04200000",
+			typ: R_ARM_RELATIVE,
+			want: []uint64{0x1000, 0x1008, 0x2004},
+		},
+		{
+			name: "trailing partial word",
+			in: "00100000" + "0300",
+			typ: R_ARM_RELATIVE,
+			want: []uint64{0x1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := decodeRelr(b, tt.is64)
+			if offs := relrOffsets(got); !reflect.DeepEqual(offs, tt.want) {
+				t.Errorf("offsets %#x, want %#x", offs, tt.want)
+			}
+			for _, r := range got {
+				if r.RInfoType != tt.typ || r.RInfoSym != 0 || r.HasAddend {
+					t.Errorf("%#x: got %+v, want a type %d relocation without symbol", r.ROffset, r, tt.typ)
+				}
+			}
+		})
+	}
+	if got := decodeRelr(bytes.Repeat([]byte{0}, 3), false); len(got) != 0 {
+		t.Errorf("decodeRelr of a short table = %+v", got)
+	}
+}
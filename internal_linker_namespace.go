@@ -0,0 +1,202 @@
+package emulator
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var (
+	// libraries an isolated app namespace gets from the system, the NDK
+	// stable ones
+	PUBLIC_LIBRARIES = []string{
+		"libandroid.so", "libc.so", "libdl.so", "libEGL.so",
+		"libGLESv1_CM.so", "libGLESv2.so", "libGLESv3.so", "libjnigraphics.so",
+		"liblog.so", "libm.so", "libmediandk.so", "libOpenMAXAL.so",
+		"libOpenSLES.so", "libstdc++.so", "libz.so",
+	}
+	// where an isolated app namespace may load from by path
+	APP_PERMITTED_PATHS = []string{"/data", "/mnt/expand"}
+)
+
+// LinkerNamespace is a set of loaded libraries with its own search path,
+// the way the Android linker keeps apps and the system apart. Libraries
+// are looked up by DT_SONAME or file name in the namespace first, then in
+// the directories, then in linked namespaces that share the name.
+type LinkerNamespace struct {
+	Name           string
+	SearchPaths    []string
+	// isolated namespaces only load from SearchPaths and PermittedPaths
+	PermittedPaths []string
+	Isolated       bool
+	links          []namespaceLink
+	modules        []*Module
+}
+type namespaceLink struct {
+	target *LinkerNamespace
+	// nil shares every library
+	shared map[string]bool
+}
+func NewLinkerNamespace(name string, isolated bool, searchPaths, permittedPaths []string) *LinkerNamespace {
+	return &LinkerNamespace{
+		Name: name,
+		SearchPaths: searchPaths,
+		PermittedPaths: permittedPaths,
+		Isolated: isolated,
+	}
+}
+// Link lets ns fall back to target for the libraries in shared, for all of
+// them when shared is nil.
+func (ns *LinkerNamespace) Link(target *LinkerNamespace, shared []string) {
+	l := namespaceLink{target: target}
+	if shared != nil {
+		l.shared = map[string]bool{}
+		for _, name := range shared {
+			l.shared[name] = true
+		}
+	}
+	ns.links = append(ns.links, l)
+}
+func (l namespaceLink) shares(name string) bool {
+	return l.shared == nil || l.shared[name]
+}
+// Accessible tells whether ns may load the library at guest path p.
+func (ns *LinkerNamespace) Accessible(p string) bool {
+	if !ns.Isolated {
+		return true
+	}
+	return underAny(p, ns.SearchPaths) || underAny(p, ns.PermittedPaths)
+}
+// Modules are the libraries loaded into ns, in load order.
+func (ns *LinkerNamespace) Modules() []*Module {
+	return ns.modules
+}
+// findLoaded is the library ns already has under name, its DT_SONAME or
+// file name.
+func (ns *LinkerNamespace) findLoaded(name string) *Module {
+	for _, m := range ns.modules {
+		if m.soName == name || path.Base(m.path) == name {
+			return m
+		}
+	}
+	return nil
+}
+func underAny(p string, dirs []string) bool {
+	p = path.Clean(p)
+	for _, dir := range dirs {
+		dir = path.Clean(dir)
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/") + "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadError is a library that failed to load with the libraries that
+// needed it, the one LoadModule was asked for first.
+type LoadError struct {
+	Chain []string
+	Err   error
+}
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%s: %v", strings.Join(e.Chain, " -> "), e.Err)
+}
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// initNamespaces sets up the default namespace for the system and the app
+// namespace linked to it, from Config.
+func (ms *Modules) initNamespaces() {
+	cfg := ms.emu.config
+	arch := ms.emu.Arch
+	libPaths := cfg.LibraryPaths
+	if len(libPaths) == 0 {
+		libPaths = []string{"/system/" + arch.LibDir, "/vendor/" + arch.LibDir}
+	}
+	appPaths := cfg.AppLibraryPaths
+	if len(appPaths) == 0 {
+		appPaths = []string{"/data/app/" + cfg.PkgName + "/lib/" + arch.Abi}
+	}
+	ms.Default = NewLinkerNamespace("default", false, libPaths, nil)
+	ms.App = NewLinkerNamespace("classloader-namespace", cfg.LinkerIsolation, appPaths, APP_PERMITTED_PATHS)
+	var shared []string
+	if cfg.LinkerIsolation {
+		shared = cfg.PublicLibraries
+		if len(shared) == 0 {
+			shared = PUBLIC_LIBRARIES
+		}
+	}
+	ms.App.Link(ms.Default, shared)
+}
+// namespaceOf is where a library LoadModule is given by path goes, system
+// directories belong to the default namespace and anything else to the
+// app.
+func (ms *Modules) namespaceOf(guestPath string) *LinkerNamespace {
+	if underAny(guestPath, ms.Default.SearchPaths) {
+		return ms.Default
+	}
+	return ms.App
+}
+
+// findLibrary resolves name, a DT_NEEDED entry of a library in ns, with the
+// runpath of that library. It returns the module when the library is
+// loaded already, otherwise its host path and the namespace to load it in.
+func (ms *Modules) findLibrary(ns *LinkerNamespace, name string, runpath []string) (*Module, string, *LinkerNamespace, error) {
+	if strings.Contains(name, "/") {
+		guestPath := path.Clean(name)
+		if !ns.Accessible(guestPath) {
+			return nil, "", nil, fmt.Errorf("%w: %s in %s", ErrLibraryNotAccessible, name, ns.Name)
+		}
+		hostPath := VfsPathToSystemPath(ms.vfsRoot, guestPath)
+		if m := ms.FindModuleByName(hostPath); m != nil {
+			return m, "", nil, nil
+		}
+		if _, err := os.Stat(hostPath); err != nil {
+			return nil, "", nil, fmt.Errorf("%w: %s", ErrLibraryNotFound, name)
+		}
+		return nil, hostPath, ns, nil
+	}
+	if m := ns.findLoaded(name); m != nil {
+		return m, "", nil, nil
+	}
+	dirs := make([]string, 0, len(runpath) + len(ns.SearchPaths))
+	for _, dir := range runpath {
+		if ns.Accessible(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	dirs = append(dirs, ns.SearchPaths...)
+	for _, dir := range dirs {
+		hostPath := VfsPathToSystemPath(ms.vfsRoot, path.Join(dir, name))
+		if m := ms.FindModuleByName(hostPath); m != nil {
+			return m, "", nil, nil
+		}
+		if _, err := os.Stat(hostPath); err == nil {
+			return nil, hostPath, ns, nil
+		}
+	}
+	for _, l := range ns.links {
+		if !l.shares(name) {
+			continue
+		}
+		m, hostPath, target, err := ms.findLibrary(l.target, name, nil)
+		if err == nil {
+			return m, hostPath, target, nil
+		}
+	}
+	return nil, "", nil, fmt.Errorf("%w: %s in %s", ErrLibraryNotFound, name, ns.Name)
+}
+// expandRunpath replaces $ORIGIN in the runpath of the library at guest
+// path p.
+func expandRunpath(runpath []string, p string) []string {
+	origin := path.Dir(p)
+	dirs := make([]string, 0, len(runpath))
+	for _, dir := range runpath {
+		dir = strings.Replace(dir, "${ORIGIN}", origin, -1)
+		dir = strings.Replace(dir, "$ORIGIN", origin, -1)
+		dirs = append(dirs, path.Clean(dir))
+	}
+	return dirs
+}
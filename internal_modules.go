@@ -2,6 +2,8 @@ package emulator
 
 import (
 	"os"
+	"fmt"
+	"strings"
 	"github.com/pkg/errors"
 	bin "encoding/binary"
 	zl  "github.com/rs/zerolog"
@@ -9,6 +11,16 @@ import (
 	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
+// moduleTLS is where the PT_TLS block of a module goes, Id 0 when it has
+// none.
+type moduleTLS struct {
+	Id      uint32
+	Offset  uint32
+	Segment phdr
+	// the initial image in the loaded module
+	image   uint64
+}
+
 type Module struct {
 	address      uint64
 	size         uint64
@@ -17,6 +29,13 @@ type Module struct {
 	initArray    []uint32
 	symbolLookup map[uint32]string
 	soinfoPtr    uint32
+	tls          moduleTLS
+	// hash table lookups of the symbols it defines
+	reader       *ELFReader
+	// DT_SONAME, guest path and the namespace it was loaded into
+	soName       string
+	path         string
+	ns           *LinkerNamespace
 }
 func NewModule(
 	filename string,
@@ -24,7 +43,9 @@ func NewModule(
 	size uint64,
 	symRes map[string]uint32,
 	initArray []uint32,
-	soinfoPtr uint32) *Module {
+	soinfoPtr uint32,
+	reader *ELFReader,
+	tls moduleTLS) *Module {
 	m := &Module{
 		filename: filename,
 		address: base,
@@ -33,6 +54,8 @@ func NewModule(
 		symbolLookup: map[uint32]string{},
 		initArray: initArray,
 		soinfoPtr: soinfoPtr,
+		reader: reader,
+		tls: tls,
 	}
 	for symName,symAddr := range m.symbols {
 		m.symbolLookup[symAddr] = symName
@@ -42,10 +65,33 @@ func NewModule(
 func (m *Module) Name() string {
 	return m.filename
 }
+// SoName is DT_SONAME, empty when the library has none.
+func (m *Module) SoName() string {
+	return m.soName
+}
+func (m *Module) Namespace() *LinkerNamespace {
+	return m.ns
+}
+// FindSymbol returns the address of a symbol, the ones the module defines
+// come from its hash table, imports from what they resolved to.
 func (m *Module) FindSymbol(symbolStr string) (uint32, bool) {
+	if addr, exist := m.findDefined(newSymKey(symbolStr)); exist {
+		return addr, true
+	}
 	addr, exist := m.symbols[symbolStr]
 	return addr, exist
 }
+// findDefined looks k up in the hash table, hooks still take precedence.
+func (m *Module) findDefined(k symKey) (uint32, bool) {
+	if m.reader == nil {
+		return 0, false
+	}
+	if _, exist := m.reader.lookupKey(k); !exist {
+		return 0, false
+	}
+	addr, exist := m.symbols[k.name]
+	return addr, exist
+}
 func (m *Module) IsSymbolAddr(addr uint32) (string, bool) {
 	if name, exist := m.symbolLookup[addr]; exist {
 		return name, true
@@ -54,10 +100,16 @@ func (m *Module) IsSymbolAddr(addr uint32) (string, bool) {
 	}
 	return "", false
 }
+// CallInit runs DT_INIT and DT_INIT_ARRAY, with argc, argv and envp as the
+// linker passes them.
 func (m *Module) CallInit(emu *Emulator) {
+	var args []interface{}
+	if ka := emu.KernelArgs; ka != nil {
+		args = []interface{}{len(ka.Argv), ka.ArgvPtr, ka.EnvpPtr}
+	}
 	for _, funPtr := range m.initArray {
 		funAddr := funPtr
-		ret, err := emu.CallNative(funAddr)
+		ret, err := emu.CallNative(funAddr, args...)
 		log.Debug().Str("ret", ConvHex("0x%X",ret)).Err(err).Msgf("Calling Init_array %s function: 0x%08X!!", m.filename, funAddr)
 	}
 }
@@ -72,6 +124,19 @@ type Modules struct {
 	counterMemory  uint64
 	symbolHooks    map[string]uint64
 	soinfoAreaBase uint64
+	// modules with a PT_TLS segment, the index is the module id - 1
+	tlsModules     []moduleTLS
+	// end of the static TLS area, as an offset from the thread pointer
+	tlsStaticEnd   uint32
+	// set while an executable is loaded, the constructors of its libraries
+	// wait until the startup stack is there, see RunExecutable
+	deferInit      bool
+	deferred       []*Module
+	// the system libraries and the app's, see LinkerNamespace
+	Default        *LinkerNamespace
+	App            *LinkerNamespace
+	// guest paths of the libraries being loaded, for LoadError
+	loading        []string
 	logger         zl.Logger
 }
 
@@ -82,6 +147,7 @@ func NewModules(emu *Emulator, vfsRoot string, logger zl.Logger) *Modules {
 		modules: []*Module{},
 		counterMemory: BASE_ADDR,
 		symbolHooks: map[string]uint64{},
+		tlsStaticEnd: emu.TLS.StaticStart(),
 		logger: logger,
 	}
 	var soinfoAreaSz uint64 = 0x40000
@@ -90,7 +156,9 @@ func NewModules(emu *Emulator, vfsRoot string, logger zl.Logger) *Modules {
 	if err != nil {
 		return nil
 	}
+	ms.emu.Memory.SetName(addr, soinfoAreaSz, "[anon:linker_alloc]")
 	ms.soinfoAreaBase = addr
+	ms.initNamespaces()
 	return ms
 }
 func (ms *Modules) GetModules() []*Module {
@@ -125,6 +193,14 @@ func (ms *Modules) FindModule(addr uint64) *Module {
 	}
 	return nil
 }
+func (ms *Modules) FindModuleByAddress(addr uint64) *Module {
+	for _, module := range ms.modules {
+		if addr >= module.address && addr < module.address+module.size {
+			return module
+		}
+	}
+	return nil
+}
 func (ms *Modules) FindModuleByName(filename string) *Module {
 	abs := filename
 	for _, module := range ms.modules {
@@ -143,17 +219,55 @@ func (ms *Modules) MemReserve(start, end uint64) uint64{
 	ms.counterMemory = ms.counterMemory + sz_aligned
 	return ret
 }
-//
+// LoadModule loads the library at host path filename with its DT_NEEDED
+// libraries, into the default namespace when it is in a system directory
+// and the app namespace otherwise. Failures are a *LoadError.
 func (ms *Modules) LoadModule(filename string, doInit bool) (*Module, error) {
+	relpt, err := SystemPathToVfsPath(ms.vfsRoot, filename)
+	if err != nil {
+		ms.logger.Debug().Err(err).Str("filename", filename).Str("rootfs", ms.vfsRoot).Msg("convert system path to vfs path failed")
+		return nil, err
+	}
+	return ms.LoadModuleIn(ms.namespaceOf(relpt), filename, doInit)
+}
+// LoadModuleIn is LoadModule into namespace ns.
+func (ms *Modules) LoadModuleIn(ns *LinkerNamespace, filename string, doInit bool) (*Module, error) {
+	relpt, err := SystemPathToVfsPath(ms.vfsRoot, filename)
+	if err != nil {
+		return nil, err
+	}
+	ms.loading = append(ms.loading, relpt)
+	chain := append([]string(nil), ms.loading...)
+	m, err := ms.loadModule(ns, filename, relpt, doInit)
+	ms.loading = ms.loading[:len(ms.loading)-1]
+	if err != nil {
+		if _, ok := err.(*LoadError); !ok {
+			err = &LoadError{Chain: chain, Err: err}
+		}
+		return nil, err
+	}
+	return m, nil
+}
+func (ms *Modules) loadModule(ns *LinkerNamespace, filename, relpt string, doInit bool) (*Module, error) {
 	m := ms.FindModuleByName(filename)
 	if m != nil {
 		return m, nil
 	}
-	ms.logger.Debug().Str("path", filename).Msg("loadmodule")
+	ms.logger.Debug().Str("path", filename).Str("namespace", ns.Name).Msg("loadmodule")
 	reader, err := NewELFReader(filename)
 	if err != nil {
 		return nil, err
 	}
+	if reader.Machine() != ms.emu.Arch.Machine || reader.Is64() != ms.emu.Arch.Is64 {
+		return nil, fmt.Errorf("%w: %s is not %s", ErrELFMachine, filename, ms.emu.Arch.Name)
+	}
+	// the same library under another name
+	if soName := reader.GetSoName(); soName != "" {
+		if m = ns.findLoaded(soName); m != nil {
+			ms.logger.Debug().Str("path", filename).Str("soname", soName).Msg("already loaded as " + m.path)
+			return m, nil
+		}
+	}
 	// Parse program header (Execution view).
 
 	// - LOAD (determinate what parts of the ELF file get mapped into memory)
@@ -179,17 +293,16 @@ func (ms *Modules) LoadModule(filename string, doInit bool) (*Module, error) {
 		}
 	}
 //	ms.logger.Debug().Msgf("boundLow: %08X boundHigh: %08X", boundLow, boundHigh)
-	relpt, err := SystemPathToVfsPath(ms.vfsRoot, filename)
-	if err != nil {
-		ms.logger.Debug().Err(err).Str("filename", filename).Str("rootfs", ms.vfsRoot).Msg("convert system path to vfs path failed")
-		return nil, err
-	}
 	fo, err := MyOpen(filename, os.O_RDONLY)
 	if err != nil {
 		ms.logger.Debug().Err(err).Str("filename", filename).Str("rootfs", ms.vfsRoot).Msg("failed to open file")
 		return nil, err
 	}
-	loadBase := ms.MemReserve(uint64(boundLow), uint64(boundHigh))
+	// ET_EXEC is linked at its final address
+	var loadBase uint64
+	if reader.Type() != ET_EXEC {
+		loadBase = ms.MemReserve(uint64(boundLow), uint64(boundHigh))
+	}
 	vf := NewVirtualFile(
 		relpt, filename, fo)
 //	var lastSegSz uint64
@@ -220,10 +333,12 @@ func (ms *Modules) LoadModule(filename string, doInit bool) (*Module, error) {
 		segPageEnd := PageEnd(segEnd)
 		segFileEnd := PageEnd(segStart+uint64(seg.pFilesz))
 //		lastSegSz = segPageEnd
-		_, err = ms.emu.Memory.Map(segFileEnd, segPageEnd-segFileEnd, prot, nil, 0)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot map memory seg page")
-		}	
+		if segPageEnd > segFileEnd {
+			_, err = ms.emu.Memory.Map(segFileEnd, segPageEnd-segFileEnd, prot, nil, 0)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot map memory seg page")
+			}
+		}
 	}
 
 	initArrayOffset, initArraySize := reader.GetInitArray()
@@ -232,18 +347,30 @@ func (ms *Modules) LoadModule(filename string, doInit bool) (*Module, error) {
 
 //	log.Debug().Msgf(">>> init arrOffs:%08X arrOffsz:%08X offst:%08X", initArrayOffset, initArraySize, initOffset)
 
+	// TLS block of this module, TLS relocations against it need its id and
+	// static offset. The executable's block is at a fixed offset, it goes
+	// in before its libraries take the area.
+	exe := ms.deferInit && len(ms.loading) == 1
+	var tls moduleTLS
+	if exe {
+		if tls, err = ms.allocTLS(reader, loadBase, true); err != nil {
+			return nil, err
+		}
+	}
 	soNeeded := reader.GetSoNeeded()
+	runpath := expandRunpath(reader.GetRunPath(), relpt)
 	for _, soName := range soNeeded {
-		path := VfsPathToSystemPath(ms.vfsRoot, soName)
-		_, err := os.Stat(path)
-		if err != nil {
-			ms.logger.Debug().Err(err).Str("soPath", path).Msgf("%s is required by %s but not exist", soName, filename)
-			continue
+		_, path, target, err := ms.findLibrary(ns, soName, runpath)
+		if err == nil && path != "" {
+			_, err = ms.LoadModuleIn(target, path, true)
+		}else if err != nil {
+			err = &LoadError{Chain: append(append([]string(nil), ms.loading...), soName), Err: err}
 		}
-		_, err = ms.LoadModule(path, true)
 		if err != nil {
-			ms.logger.Debug().Str("path", path).Err(err).Msg("required module failed to load")
-			continue
+			if ms.emu.config.StrictRelocations {
+				return nil, err
+			}
+			ms.logger.Warn().Err(err).Msgf("%s is required by %s but failed to load", soName, relpt)
 		}
 	}
 
@@ -259,87 +386,175 @@ func (ms *Modules) LoadModule(filename string, doInit bool) (*Module, error) {
 		}
 	}
 
+	if !exe {
+		if tls, err = ms.allocTLS(reader, loadBase, false); err != nil {
+			return nil, err
+		}
+	}
+	// unresolved symbols and unsupported relocations, fatal in strict mode
+	var problems []string
+	seen := map[string]bool{}
+	problem := func(msg string) {
+		if !seen[msg] {
+			seen[msg] = true
+			problems = append(problems, msg)
+		}
+	}
+	// relocated words are pointer sized, the math is done in 64 bit and the
+	// word cut down to the guest size
+	ptrSize := ms.emu.Arch.PtrSize
+	write := func(addr uint64, val uint64) error {
+		return ms.emu.Mu.MemWrite(addr, ms.emu.Arch.PutPtr(val))
+	}
+
 	// Relocate.
 	relocx := func(relname string, rel relx) (bool, error) { // continue or return
 		rInfoSym := rel.RInfoSym
-		if int(rInfoSym) >= len(symbols) {
+		if rInfoSym != 0 && int(rInfoSym) >= len(symbols) {
 //			ms.logger.Debug().Int("rInfoSym", int(rInfoSym)).Msg("rInfoSym more than symbols size, continue")
 			return true, nil
 		}
-		sym := symbols[int(rInfoSym)]
-		symVal := sym.StValue
+		var sym dyn
+		if int(rInfoSym) < len(symbols) {
+			sym = symbols[int(rInfoSym)]
+		}
 
-		relAddr := loadBase + uint64(rel.ROffset)
+		relAddr := loadBase + rel.ROffset
 		relInfoType := rel.RInfoType
 // Still debugging		
 //		ms.logger.Debug().Msgf("rel base:%08X rOffset:%08X type:%d", loadBase, rel.ROffset, relInfoType)
 		symName := reader.GetDynStringByRelSym(int(rInfoSym))
-//		if relAddr > lastSegSz {
-//			ms.logger.Debug().Msgf("symbol %q address 0x%08X lookup over page end", symName, relAddr)
-//			return true, nil
-//		}
+		// Rel keeps the addend at the target, Rela in the entry
+		addend := func() (uint64, error) {
+			if rel.HasAddend {
+				return uint64(rel.RAddend), nil
+			}
+			b, err := ms.emu.Mu.MemRead(relAddr, ptrSize)
+			if err != nil {
+				return 0, err
+			}
+			return LE_BytesToUint(b), nil
+		}
+		// S, the symbol address, weak undefined ones resolved to 0 already
+		symAddr := func() (uint64, bool) {
+			if rInfoSym == 0 {
+				return 0, true
+			}
+			addr, exist := symbolsResolved[symName]
+			if !exist {
+				problem("unresolved symbol " + symName)
+				log.Debug().Msgf(">>> not resolved %s", symName)
+			}
+			return uint64(addr), exist
+		}
 //		if reader.filename == "vfs/system/lib/libc.so" {
 //			log.Debug().Msgf(">>>> %s relInfoType %08X | relAddr %08X == loadBase %08X + roffset %08X", relname, relInfoType, relAddr, loadBase, rel.ROffset)
 //		}
-		if relInfoType == R_ARM_ABS32 {
-			if symAddr, exist := symbolsResolved[symName]; exist {
-				valOrigBytes, err := ms.emu.Mu.MemRead(uint64(relAddr), 4)
-				if err != nil {
-					return false, errors.Wrap(err, "failed to read from rel address R_ARM_ABS32")
-				}
-//				log.Debug().Msgf(">>>> Rel ABS32 symaddr:%08X symname:%s", symAddr, symName)
-				valOrig := bin.LittleEndian.Uint32(valOrigBytes)
-				//R_ARM_ABS32 how to relocate see android linker source code
-				//*reinterpret_cast<Elf32_Addr*>(reloc) += sym_addr;
-				val := symAddr + valOrig
-				newVal := make([]byte, 4)
-				bin.LittleEndian.PutUint32(newVal, val)
-				err = ms.emu.Mu.MemWrite(uint64(relAddr), newVal)
-				if err != nil {
-					return false, errors.Wrap(err, "unable to rewrite rel address")
-				}
-			}
-		}else if (relInfoType == R_ARM_GLOB_DAT || 
-			relInfoType == R_ARM_JUMP_SLOT ||
-			relInfoType == R_AARCH64_GLOB_DAT ||
-			relInfoType == R_AARCH64_JUMP_SLOT) {
+		switch relInfoType {
+		case R_ARM_NONE, R_AARCH64_NONE:
+		case R_ARM_ABS32, R_ARM_REL32, R_AARCH64_ABS64, R_AARCH64_PREL64:
+			s, exist := symAddr()
+			if !exist {
+				break
+			}
+			a, err := addend()
+			if err != nil {
+				return false, errors.Wrap(err, "failed to read from rel address R_ARM_ABS32")
+			}
+			//R_ARM_ABS32 how to relocate see android linker source code
+			//*reinterpret_cast<Elf32_Addr*>(reloc) += sym_addr;
+			val := s + a
+			if relInfoType == R_ARM_REL32 || relInfoType == R_AARCH64_PREL64 {
+				// S + A - P
+				val -= relAddr
+			}
+			if err = write(relAddr, val); err != nil {
+				return false, errors.Wrap(err, "unable to rewrite rel address")
+			}
+		case R_ARM_GLOB_DAT, R_ARM_JUMP_SLOT, R_AARCH64_GLOB_DAT, R_AARCH64_JUMP_SLOT:
 			// Resolve the symbol.
 			//R_ARM_GLOB_DAT，R_ARM_JUMP_SLOT how to relocate see android linker source code
 			//*reinterpret_cast<Elf32_Addr*>(reloc) = sym_addr;
-			if valx, exist := symbolsResolved[symName]; exist {
-				valB := make([]byte, 4)
-				bin.LittleEndian.PutUint32(valB, valx)
-//				log.Debug().Msgf(">>> Rel GLOB/JUMPSLOT symname:%s val:%08X", symName, valx)
-				err = ms.emu.Mu.MemWrite(relAddr, valB)
-				if err != nil {
-					return false, errors.Wrap(err, "unable to write on rel address GLOB_DATA, JUMP_SLOT")
-				}
-			}else{
-				log.Debug().Msgf(">>> not resolved %s",symName)
-			}
-		}else if (relInfoType == R_ARM_RELATIVE ||
-				relInfoType == R_AARCH64_RELATIVE) {
-			if symVal == 0 {
-				// Load address at which it was linked originally.
-				valOrigBytes, err := ms.emu.Mu.MemRead(relAddr, 4)
-				if err != nil {
-					return false, errors.Wrap(err, "failed to read from rel address RELATIVE")
-				}
-				valOrig := bin.LittleEndian.Uint32(valOrigBytes)
-				// Create the new value
-				val := uint32(loadBase) + valOrig
-//				log.Debug().Msgf(">>> Rel RELATIVE relAddr:%08X newVal:%08X orig:%08X", relAddr, val, valOrig)
-				// Write the new value
-				newVal := make([]byte, 4)
-				bin.LittleEndian.PutUint32(newVal, val)
-				err = ms.emu.Mu.MemWrite(uint64(relAddr), newVal)
-				if err != nil {
-					return false, errors.Wrap(err, "unable to rewrite rel address")
-				}
-			}else{
-					return false, ErrNotImplemented
+			valx, exist := symAddr()
+			if !exist {
+				break
+			}
+			if rel.HasAddend {
+				valx += uint64(rel.RAddend)
+			}
+//			log.Debug().Msgf(">>> Rel GLOB/JUMPSLOT symname:%s val:%08X", symName, valx)
+			if err := write(relAddr, valx); err != nil {
+				return false, errors.Wrap(err, "unable to write on rel address GLOB_DATA, JUMP_SLOT")
+			}
+		case R_ARM_RELATIVE, R_AARCH64_RELATIVE:
+			// B + A, the symbol only names the segment, which is loaded at
+			// the module base like the rest
+			valOrig, err := addend()
+			if err != nil {
+				return false, errors.Wrap(err, "failed to read from rel address RELATIVE")
+			}
+//			log.Debug().Msgf(">>> Rel RELATIVE relAddr:%08X newVal:%08X orig:%08X", relAddr, uint32(loadBase) + valOrig, valOrig)
+			if err = write(relAddr, loadBase + valOrig); err != nil {
+				return false, errors.Wrap(err, "unable to rewrite rel address")
+			}
+		case R_ARM_IRELATIVE, R_AARCH64_IRELATIVE:
+			// the addend is the ifunc resolver, it gets the hwcaps
+			a, err := addend()
+			if err != nil {
+				return false, errors.Wrap(err, "failed to read from rel address IRELATIVE")
 			}
-		}else{
+			resolver := loadBase + a
+			val, err := ms.emu.CallNative(uint32(resolver), ms.emu.Arch.Hwcap)
+			if err != nil {
+				return false, errors.Wrapf(err, "ifunc resolver 0x%08X failed", resolver)
+			}
+			if err = write(relAddr, val); err != nil {
+				return false, errors.Wrap(err, "unable to rewrite rel address")
+			}
+		case R_ARM_COPY, R_AARCH64_COPY:
+			// the executable owns the object, the data comes from the
+			// library that defines it
+			src, exist := ms.elfLookupSymbol(symName)
+			if !exist {
+				problem("unresolved copy symbol " + symName)
+				break
+			}
+			data, err := ms.emu.Mu.MemRead(uint64(src), uint64(sym.StSize))
+			if err == nil {
+				err = ms.emu.Mu.MemWrite(relAddr, data)
+			}
+			if err != nil {
+				return false, errors.Wrapf(err, "unable to copy %s", symName)
+			}
+		case R_ARM_TLS_DTPMOD32, R_ARM_TLS_DTPOFF32, R_ARM_TLS_TPOFF32,
+			R_AARCH64_TLS_DTPMOD64, R_AARCH64_TLS_DTPREL64, R_AARCH64_TLS_TPREL64:
+			owner, symVal, exist := ms.tlsSymbol(tls, sym, symName)
+			if !exist {
+				problem("unresolved TLS symbol " + symName)
+				break
+			}
+			a, err := addend()
+			if err != nil {
+				return false, errors.Wrap(err, "failed to read from rel address TLS")
+			}
+			if owner.Id == 0 {
+				problem("TLS symbol " + symName + " has no TLS segment")
+				break
+			}
+			val := uint64(symVal)
+			switch relInfoType {
+			case R_ARM_TLS_DTPMOD32, R_AARCH64_TLS_DTPMOD64:
+				val = uint64(owner.Id)
+			case R_ARM_TLS_DTPOFF32, R_AARCH64_TLS_DTPREL64:
+				val += a
+			case R_ARM_TLS_TPOFF32, R_AARCH64_TLS_TPREL64:
+				val += a + uint64(owner.Offset)
+			}
+			if err = write(relAddr, val); err != nil {
+				return false, errors.Wrap(err, "unable to rewrite rel address")
+			}
+		default:
+			problem(fmt.Sprintf("unsupported relocation type %d in %s", relInfoType, relname))
 			ms.logger.Debug().Msgf("unhandled relocation type %d", relInfoType)
 		}
 		return true, nil
@@ -348,38 +563,51 @@ func (ms *Modules) LoadModule(filename string, doInit bool) (*Module, error) {
 //	if reader.filename == "./bin/libcms_new.so" {
 //		ms.logger.Debug().Msgf("librels %+v", rels)
 //	}
-	//dynrel
-	for _, rel := range rels.dynrel {
-		if isContinue, err := relocx("dynrel", rel); isContinue {
-			continue
-		}else{
-			return nil, err
+	for _, set := range rels.sets() {
+		for _, rel := range set.list {
+			if isContinue, err := relocx(set.name, rel); !isContinue {
+				return nil, err
+			}
 		}
 	}
-	//relplt
-	for _, rel := range rels.relplt {
-		if isContinue, err := relocx("relplt", rel); isContinue {
-			continue
-		}else{
-			return nil, err
+	if len(problems) > 0 {
+		if ms.emu.config.StrictRelocations {
+			return nil, fmt.Errorf("%w in %s: %s", ErrELFRelocation, filename, strings.Join(problems, ", "))
+		}
+		ms.logger.Warn().Str("module", filename).Strs("problems", problems).Msg("module linked with unresolved relocations")
+	}
+	// the image may hold relocated pointers, copy it afterwards
+	if tls.Id != 0 {
+		if err = ms.emu.TLS.addModule(tls); err != nil {
+			return nil, errors.Wrapf(err, "cannot set up TLS of %s", filename)
 		}
 	}
 	//
 //	log.Debug().Msgf(">>> Add base:%08X Init_offset %08X Init_array %08X", loadBase, initOffset, initArrayOffset)
+	readArray := func(off, size uint32) error {
+		for i := 0; i < int(size)/int(ptrSize); i++ {
+			b, err := ms.emu.Mu.MemRead(loadBase+uint64(off), ptrSize)
+			if err != nil {
+				return errors.Wrap(err, "failed to read init array offset")
+			}
+			funPtr := bin.LittleEndian.Uint32(b)
+			if funPtr != 0 {
+				initArray = append(initArray, uint32(funPtr))
+			}
+//			log.Debug().Msgf(">> A INIT ptr %08X", funPtr)
+			off = off + uint32(ptrSize)
+		}
+		return nil
+	}
+	// DT_PREINIT_ARRAY runs before anything else, only executables have one
+	if err = readArray(reader.GetPreinitArray()); err != nil {
+		return nil, err
+	}
 	if initOffset != 0 {
 		initArray = append(initArray, uint32(loadBase)+initOffset)
 	}
-	for i := 0; i < int(initArraySize)/4; i++ {
-		b, err := ms.emu.Mu.MemRead(loadBase+uint64(initArrayOffset), 4)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to read init array offset")
-		}
-		funPtr := bin.LittleEndian.Uint32(b)
-		if funPtr != 0 {
-			initArray = append(initArray, uint32(funPtr))
-		}
-//		log.Debug().Msgf(">> A INIT ptr %08X", funPtr)
-		initArrayOffset = initArrayOffset + 4
+	if err = readArray(initArrayOffset, initArraySize); err != nil {
+		return nil, err
 	}
 //	log.Debug().Msgf(">> INITARRAY:%v",initArray)
 
@@ -393,10 +621,18 @@ func (ms *Modules) LoadModule(filename string, doInit bool) (*Module, error) {
 		symbolsResolved,
 		initArray,
 		uint32(ms.soinfoAreaBase),
+		reader,
+		tls,
 	)
+	module.soName = reader.GetSoName()
+	module.path = relpt
+	module.ns = ns
+	ns.modules = append(ns.modules, module)
 	ms.modules = append(ms.modules, module)
 	ms.soinfoAreaBase = ms.soinfoAreaBase + uint64(write_sz)
-	if doInit {
+	if doInit && ms.deferInit {
+		ms.deferred = append(ms.deferred, module)
+	}else if doInit {
 		module.CallInit(ms.emu)
 	}
 	ms.logger.Debug().Msgf("finish load lib %s base 0x%08X", filename, loadBase)
@@ -428,12 +664,66 @@ func (ms *Modules) elfGetSymVal(elfbase uint32, sym dyn) (uint32, bool) {
 	// Internally defined symbol.
 	return elfbase + sym.StValue, true
 }
+// allocTLS gives the PT_TLS segment of a module its id and a place in the
+// static TLS area. ARM uses variant 1, blocks follow the TCB upwards. Local
+// Exec code of the executable has its block at the TCB size rounded up to
+// the segment alignment, that offset is taken as is.
+func (ms *Modules) allocTLS(reader *ELFReader, loadBase uint64, exe bool) (moduleTLS, error) {
+	seg, exist := reader.GetTLS()
+	if !exist {
+		return moduleTLS{}, nil
+	}
+	align := seg.pAlign
+	if align == 0 {
+		align = 1
+	}
+	offset := (ms.tlsStaticEnd + align - 1) &^ (align - 1)
+	if exe {
+		offset = (ms.emu.Arch.TcbSize + align - 1) &^ (align - 1)
+		if uint64(offset) < BIONIC_TCB_SLOTS * ms.emu.Arch.PtrSize {
+			return moduleTLS{}, fmt.Errorf("%w: alignment %d", ErrTLSUnderaligned, seg.pAlign)
+		}
+		for _, t := range ms.tlsModules {
+			if t.Offset < offset + seg.pMemsz && offset < t.Offset + t.Segment.pMemsz {
+				return moduleTLS{}, fmt.Errorf("%w: a library loaded earlier holds the executable's block", ErrTLSFull)
+			}
+		}
+	}
+	t := moduleTLS{
+		Id: uint32(len(ms.tlsModules)) + 1,
+		Offset: offset,
+		Segment: seg,
+		image: loadBase + uint64(seg.pVaddr),
+	}
+	if end := t.Offset + seg.pMemsz; end > ms.tlsStaticEnd {
+		ms.tlsStaticEnd = end
+	}
+	ms.tlsModules = append(ms.tlsModules, t)
+	return t, nil
+}
+// tlsSymbol finds the module a TLS symbol lives in and its offset in that
+// module's block.
+func (ms *Modules) tlsSymbol(self moduleTLS, sym dyn, name string) (moduleTLS, uint32, bool) {
+	if name == "" || sym.StShndx != SHN_UNDEF {
+		return self, sym.StValue, true
+	}
+	k := newSymKey(name)
+	for _, md := range ms.modules {
+		if md.reader == nil {
+			continue
+		}
+		if d, exist := md.reader.lookupKey(k); exist {
+			return md.tls, d.StValue, true
+		}
+	}
+	return moduleTLS{}, 0, false
+}
+// elfLookupSymbol finds the first loaded module that defines name.
 func (ms *Modules) elfLookupSymbol(name string) (uint32, bool) {
+	k := newSymKey(name)
 	for _, md := range ms.modules {
-		if addr, exist := md.symbols[name]; exist {
-			if addr != 0 {
-				return addr, true
-			}
+		if addr, exist := md.findDefined(k); exist && addr != 0 {
+			return addr, true
 		}
 	}
 	return 0, false
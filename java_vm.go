@@ -2,7 +2,6 @@ package emulator
 
 import (
 	"github.com/pkg/errors"
-	bin  "encoding/binary"
 	zl   "github.com/rs/zerolog"
 //	uc   "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
@@ -60,9 +59,7 @@ func (jvm *JavaVM) getEnv(ctx NativeMethodContext) error {
 	jvm.logger.Debug().Msgf("java_vm: 0x%08x", java_vm)
 	jvm.logger.Debug().Msgf("env: 0x%08x", env)
 	jvm.logger.Debug().Msgf("version: 0x%08x", version)	
-	by := make([]byte, 4)
-	bin.LittleEndian.PutUint32(by, uint32(jvm.JniEnv.addressPtr))
-	err := ctx.Mu().MemWrite(env, by)
+	err := ctx.Mu().MemWrite(env, archOf(ctx.Mu()).PutPtr(jvm.JniEnv.addressPtr))
 	if err != nil {
 		jvm.logger.Debug().Uint64("envAddr", env).Err(err).Msg("cannot write JniEnv ptr")
 		return errors.Wrap(ctx.Return(JNI_ERR), "failed to write return GetEnv()")
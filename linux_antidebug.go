@@ -0,0 +1,177 @@
+package emulator
+
+import (
+	"fmt"
+	"bytes"
+	"strings"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	PTRACE_TRACEME  uint64 = 0
+	PTRACE_PEEKTEXT uint64 = 1
+	PTRACE_PEEKDATA uint64 = 2
+	PTRACE_CONT     uint64 = 7
+	PTRACE_ATTACH   uint64 = 16
+	PTRACE_DETACH   uint64 = 17
+	PTRACE_SEIZE    uint64 = 0x4206
+
+	// detection vectors, see AntiDebugProbe
+	PROBE_PTRACE = "ptrace"
+	PROBE_STATUS = "status"
+	PROBE_STAT   = "stat"
+	PROBE_WCHAN  = "wchan"
+	PROBE_COMM   = "comm"
+	PROBE_MAPS   = "maps"
+)
+
+// AntiDebugConfig is what the emulated process answers to debugger and
+// instrumentation checks. The defaults describe a clean, untraced app.
+type AntiDebugConfig struct {
+	// ptrace(2) results, 0 or a negative errno
+	PtraceTraceme int `json:"ptrace_traceme"`
+	PtraceAttach  int `json:"ptrace_attach"`
+	// TracerPid in status
+	TracerPid int `json:"tracer_pid"`
+	// single letter state for status and stat, "S" sleeping, "t" traced
+	TaskState string `json:"task_state"`
+	// content of wchan, "ptrace_stop" would give a debugger away
+	Wchan string `json:"wchan"`
+	// maps lines containing any of these are not shown
+	MapsHide []string `json:"maps_hide"`
+}
+
+func NewDefaultAntiDebugConfig() AntiDebugConfig {
+	return AntiDebugConfig{
+		TaskState: "S",
+		Wchan: "SyS_epoll_wait",
+		MapsHide: []string{"frida", "gum-js", "gadget", "xposed", "substrate", "magisk"},
+	}
+}
+
+// AntiDebugProbe is one detection attempt made by the guest.
+type AntiDebugProbe struct {
+	Vector   string
+	Detail   string
+	PC       uint64
+	Location string
+}
+
+// AntiDebug answers every detection vector from Config.AntiDebug, so the
+// answers stay consistent with each other, and records each probe.
+type AntiDebug struct {
+	emu     *Emulator
+	config  *Config
+	traced  bool
+	Probes  []AntiDebugProbe
+	logger  zl.Logger
+}
+func NewAntiDebug(emu *Emulator, sh *SyscallHandlers, logger zl.Logger) *AntiDebug {
+	ad := &AntiDebug{
+		emu: emu,
+		config: emu.config,
+		logger: logger,
+	}
+	sh.SetHandler(0x1A, "ptrace", 4, ad.ptraceHandle)
+	return ad
+}
+// Probe records a detection attempt.
+func (ad *AntiDebug) Probe(vector, detail string) {
+	p := AntiDebugProbe{
+		Vector: vector,
+		Detail: detail,
+	}
+	if pc, err := ad.emu.Mu.RegRead(ad.emu.Arch.PC); err == nil {
+		p.PC = pc
+		p.Location = ad.emu.Symbolize(pc)
+	}
+	ad.Probes = append(ad.Probes, p)
+	ad.logger.Warn().
+		Str("vector", vector).
+		Str("detail", detail).
+		Str("at", p.Location).
+		Msg("anti-debug detection attempt")
+}
+
+func (ad *AntiDebug) state() (string, string) {
+	st := ad.config.AntiDebug.TaskState
+	if ad.traced {
+		// PTRACE_TRACEME went through, the parent is the tracer
+		st = "t"
+	}
+	switch st {
+	case "R":
+		return st, "R (running)"
+	case "t":
+		return st, "t (tracing stop)"
+	case "T":
+		return st, "T (stopped)"
+	case "D":
+		return st, "D (disk sleep)"
+	}
+	return "S", "S (sleeping)"
+}
+// tracerPid is TracerPid in status, the configured one or, once the process
+// asked to be traced, its parent.
+func (ad *AntiDebug) tracerPid() int {
+	if pid := ad.config.AntiDebug.TracerPid; pid != 0 || !ad.traced {
+		return pid
+	}
+	return ad.config.Ppid
+}
+func (ad *AntiDebug) comm() string {
+	comm := ad.config.PkgName
+	if len(comm) > 15 {
+		comm = comm[len(comm)-15:]
+	}
+	return comm
+}
+// FilterMaps drops the lines matching Config.AntiDebug.MapsHide.
+func (ad *AntiDebug) FilterMaps(maps []byte) []byte {
+	hide := ad.config.AntiDebug.MapsHide
+	if len(hide) < 1 {
+		return maps
+	}
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(maps, []byte("\n")) {
+		lower := strings.ToLower(string(line))
+		drop := false
+		for _, h := range hide {
+			if h != "" && strings.Contains(lower, strings.ToLower(h)) {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
+
+/* syscall ptrace
+long ptrace(enum __ptrace_request request, pid_t pid, void *addr, void *data);
+*/
+func (ad *AntiDebug) ptraceHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	req, pid := args[0], int(int32(args[1]))
+	cfg := ad.config.AntiDebug
+	switch req {
+	case PTRACE_TRACEME:
+		ad.Probe(PROBE_PTRACE, "PTRACE_TRACEME")
+		if ad.traced {
+			// a process can only be traced once
+			return errnoRet(EPERM), true
+		}
+		if cfg.PtraceTraceme != 0 {
+			return uint64(int64(cfg.PtraceTraceme)), true
+		}
+		ad.traced = true
+		return 0, true
+	case PTRACE_ATTACH, PTRACE_SEIZE:
+		ad.Probe(PROBE_PTRACE, fmt.Sprintf("PTRACE_ATTACH pid %d", pid))
+		return uint64(int64(cfg.PtraceAttach)), true
+	}
+	ad.Probe(PROBE_PTRACE, fmt.Sprintf("request %d pid %d", req, pid))
+	return 0, true
+}
@@ -54,4 +54,159 @@ var (
 	F_WAIT  uint64=0x010		/* Wait until lock is granted */
 	F_FLOCK uint64=0x020	 	/* Use flock(2) semantics for lock */
 	F_POSIX uint64=0x040	 	/* Use POSIX semantics for lock */
-)
\ No newline at end of file
+)
+var (
+	//errno
+	EPERM     uint64 = 1
+	ENOENT    uint64 = 2
+	ESRCH     uint64 = 3
+	EINTR     uint64 = 4
+	EIO       uint64 = 5
+	ENXIO     uint64 = 6
+	E2BIG     uint64 = 7
+	ENOEXEC   uint64 = 8
+	EBADF     uint64 = 9
+	ECHILD    uint64 = 10
+	EAGAIN    uint64 = 11
+	ENOMEM    uint64 = 12
+	EACCES    uint64 = 13
+	EFAULT    uint64 = 14
+	EBUSY     uint64 = 16
+	EEXIST    uint64 = 17
+	EXDEV     uint64 = 18
+	ENODEV    uint64 = 19
+	ENOTDIR   uint64 = 20
+	EISDIR    uint64 = 21
+	EINVAL    uint64 = 22
+	ENFILE    uint64 = 23
+	EMFILE    uint64 = 24
+	ENOTTY    uint64 = 25
+	EFBIG     uint64 = 27
+	ENOSPC    uint64 = 28
+	ESPIPE    uint64 = 29
+	EROFS     uint64 = 30
+	EPIPE     uint64 = 32
+	ERANGE    uint64 = 34
+	EDEADLK   uint64 = 35
+	ENAMETOOLONG uint64 = 36
+	ENOSYS    uint64 = 38
+	ENOTEMPTY uint64 = 39
+	ELOOP     uint64 = 40
+	EOVERFLOW uint64 = 75
+	ENOTSOCK        uint64 = 88
+	EDESTADDRREQ    uint64 = 89
+	EPROTONOSUPPORT uint64 = 93
+	EOPNOTSUPP      uint64 = 95
+	EAFNOSUPPORT    uint64 = 97
+	EADDRINUSE      uint64 = 98
+	ENETUNREACH     uint64 = 101
+	ECONNRESET      uint64 = 104
+	EISCONN         uint64 = 106
+	ENOTCONN        uint64 = 107
+	ETIMEDOUT uint64 = 110
+	ECONNREFUSED    uint64 = 111
+	EHOSTUNREACH    uint64 = 113
+
+	//clone flags
+	CSIGNAL              uint64 = 0x000000ff
+	CLONE_VM             uint64 = 0x00000100
+	CLONE_FS             uint64 = 0x00000200
+	CLONE_FILES          uint64 = 0x00000400
+	CLONE_SIGHAND        uint64 = 0x00000800
+	CLONE_PTRACE         uint64 = 0x00002000
+	CLONE_VFORK          uint64 = 0x00004000
+	CLONE_PARENT         uint64 = 0x00008000
+	CLONE_THREAD         uint64 = 0x00010000
+	CLONE_SYSVSEM        uint64 = 0x00040000
+	CLONE_SETTLS         uint64 = 0x00080000
+	CLONE_PARENT_SETTID  uint64 = 0x00100000
+	CLONE_CHILD_CLEARTID uint64 = 0x00200000
+	CLONE_DETACHED       uint64 = 0x00400000
+	CLONE_CHILD_SETTID   uint64 = 0x01000000
+
+	//futex
+	FUTEX_BITSET_MATCH_ANY uint64 = 0xffffffff
+
+	FUTEX_OP_SET  uint64 = 0 /* *(int *)UADDR2 = OPARG; */
+	FUTEX_OP_ADD  uint64 = 1 /* *(int *)UADDR2 += OPARG; */
+	FUTEX_OP_OR   uint64 = 2 /* *(int *)UADDR2 |= OPARG; */
+	FUTEX_OP_ANDN uint64 = 3 /* *(int *)UADDR2 &= ~OPARG; */
+	FUTEX_OP_XOR  uint64 = 4 /* *(int *)UADDR2 ^= OPARG; */
+	FUTEX_OP_OPARG_SHIFT uint64 = 8 /* Use (1 << OPARG) instead of OPARG. */
+
+	FUTEX_OP_CMP_EQ uint64 = 0
+	FUTEX_OP_CMP_NE uint64 = 1
+	FUTEX_OP_CMP_LT uint64 = 2
+	FUTEX_OP_CMP_LE uint64 = 3
+	FUTEX_OP_CMP_GT uint64 = 4
+	FUTEX_OP_CMP_GE uint64 = 5
+)
+
+// errnoRet encodes errno the way the kernel returns it from a syscall.
+func errnoRet(errno uint64) uint64 {
+	return uint64(-int64(errno))
+}
+var (
+	//open flags, ARM values
+	O_ACCMODE   uint64 = 0003
+	O_RDONLY    uint64 = 0000
+	O_WRONLY    uint64 = 0001
+	O_RDWR      uint64 = 0002
+	O_CREAT     uint64 = 0100
+	O_EXCL      uint64 = 0200
+	O_NOCTTY    uint64 = 0400
+	O_TRUNC     uint64 = 01000
+	O_APPEND    uint64 = 02000
+	O_NONBLOCK  uint64 = 04000
+	O_DSYNC     uint64 = 010000
+	O_DIRECTORY uint64 = 040000
+	O_NOFOLLOW  uint64 = 0100000
+	O_DIRECT    uint64 = 0200000
+	O_LARGEFILE uint64 = 0400000
+	O_NOATIME   uint64 = 01000000
+	O_CLOEXEC   uint64 = 02000000
+	O_PATH      uint64 = 010000000
+
+	//*at
+	AT_FDCWD            int64  = -100
+	AT_SYMLINK_NOFOLLOW uint64 = 0x100
+	AT_REMOVEDIR        uint64 = 0x200
+	AT_EACCESS          uint64 = 0x200
+	AT_SYMLINK_FOLLOW   uint64 = 0x400
+	AT_EMPTY_PATH       uint64 = 0x1000
+
+	PATH_MAX = 4096
+	// longest single argv or envp string execve takes
+	MAX_ARG_STRLEN uint64 = 0x20000
+)
+var (
+	//st_mode
+	S_IFMT   uint64 = 0170000
+	S_IFSOCK uint64 = 0140000
+	S_IFLNK  uint64 = 0120000
+	S_IFREG  uint64 = 0100000
+	S_IFBLK  uint64 = 0060000
+	S_IFDIR  uint64 = 0040000
+	S_IFCHR  uint64 = 0020000
+	S_IFIFO  uint64 = 0010000
+
+	//linux_dirent64.d_type
+	DT_UNKNOWN uint8 = 0
+	DT_FIFO    uint8 = 1
+	DT_CHR     uint8 = 2
+	DT_DIR     uint8 = 4
+	DT_BLK     uint8 = 6
+	DT_REG     uint8 = 8
+	DT_LNK     uint8 = 10
+	DT_SOCK    uint8 = 12
+
+	//access
+	F_OK uint64 = 0
+	X_OK uint64 = 1
+	W_OK uint64 = 2
+	R_OK uint64 = 4
+
+	SEEK_SET uint64 = 0
+	SEEK_CUR uint64 = 1
+	SEEK_END uint64 = 2
+)
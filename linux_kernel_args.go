@@ -0,0 +1,204 @@
+package emulator
+
+import (
+	"os"
+	"math/rand"
+	bin "encoding/binary"
+)
+
+var (
+	// AT_PLATFORM of the guest CPU
+	AT_PLATFORM_ARM   = "v7l"
+	AT_PLATFORM_ARM64 = "aarch64"
+	// bionic's linker leaves the KernelArgumentBlock here for __libc_preinit
+	TLS_SLOT_BIONIC_PREINIT uint64 = 3
+	// argc, argv, envp, auxv, abort_message_ptr
+	KERNEL_ARGUMENT_BLOCK_WORDS uint64 = 5
+	AT_RANDOM_SIZE = 16
+)
+
+// ExecImage is the program the process was started with, as far as the
+// auxiliary vector cares. Addresses are in guest memory.
+type ExecImage struct {
+	Path  string
+	Phdr  uint64
+	Phent uint64
+	Phnum uint64
+	Entry uint64
+	// load base of the dynamic linker, 0 without one
+	Base  uint64
+}
+// ExecImageAt describes the ELF file path mapped at base as a whole, as
+// app_process is.
+func ExecImageAt(path, hostPath string, base uint64) (ExecImage, error) {
+	img := ExecImage{Path: path}
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return img, err
+	}
+	defer f.Close()
+	ehdr := make([]byte, 64)
+	if _, err = f.ReadAt(ehdr, 0); err != nil {
+		return img, err
+	}
+	if ehdr[4] == ELFCLASS64 {
+		img.Entry = bin.LittleEndian.Uint64(ehdr[24:32])
+		img.Phdr  = bin.LittleEndian.Uint64(ehdr[32:40])
+		img.Phent = uint64(bin.LittleEndian.Uint16(ehdr[54:56]))
+		img.Phnum = uint64(bin.LittleEndian.Uint16(ehdr[56:58]))
+	}else{
+		img.Entry = uint64(bin.LittleEndian.Uint32(ehdr[24:28]))
+		img.Phdr  = uint64(bin.LittleEndian.Uint32(ehdr[28:32]))
+		img.Phent = uint64(bin.LittleEndian.Uint16(ehdr[42:44]))
+		img.Phnum = uint64(bin.LittleEndian.Uint16(ehdr[44:46]))
+	}
+	img.Entry += base
+	img.Phdr  += base
+	return img, nil
+}
+// ExecImage describes a module loaded as the program, path is its guest
+// path.
+func (m *Module) ExecImage(path string) ExecImage {
+	img := ExecImage{
+		Path: path,
+		Phent: 32,
+		Phnum: uint64(len(m.reader.GetPhdrs())),
+		Entry: m.address + m.reader.Entry(),
+	}
+	if m.reader.Is64() {
+		img.Phent = 56
+	}
+	if phdr, exist := m.reader.GetPhdrAddr(); exist {
+		img.Phdr = m.address + phdr
+	}
+	return img
+}
+
+// KernelArgs is what the kernel leaves on the stack of a new process:
+// argc, argv, envp and the auxiliary vector, with the strings and the
+// AT_RANDOM bytes above them.
+type KernelArgs struct {
+	Argv   []string
+	Envp   []string
+	// type, value pairs ending with AT_NULL
+	Auxv   []uint64
+	Random []byte
+	// SP points at argc, the rest are the arrays and bionic's
+	// KernelArgumentBlock
+	SP, ArgvPtr, EnvpPtr, AuxvPtr, Block uint64
+}
+
+// SetupKernelArgs builds the startup stack of exe below top and points
+// SP under it, at the KernelArgumentBlock.
+func (emu *Emulator) SetupKernelArgs(exe ExecImage, argv, envp []string, top uint64) (*KernelArgs, error) {
+	arch := emu.Arch
+	ptr := arch.PtrSize
+	ka := &KernelArgs{
+		Argv: argv,
+		Envp: envp,
+		Random: make([]byte, AT_RANDOM_SIZE),
+	}
+	rand.Read(ka.Random)
+	// strings first, from the top down
+	pos := top
+	push := func(b []byte) (uint64, error) {
+		pos -= uint64(len(b))
+		return pos, emu.Mu.MemWrite(pos, b)
+	}
+	pushStr := func(s string) (uint64, error) {
+		return push(append([]byte(s), 0))
+	}
+	platform := AT_PLATFORM_ARM
+	if arch.Is64 {
+		platform = AT_PLATFORM_ARM64
+	}
+	execfn, err := pushStr(exe.Path)
+	if err != nil {
+		return nil, err
+	}
+	platformPtr, err := pushStr(platform)
+	if err != nil {
+		return nil, err
+	}
+	pos &^= 15
+	randomPtr, err := push(ka.Random)
+	if err != nil {
+		return nil, err
+	}
+	var argvPtrs, envpPtrs []uint64
+	for _, s := range ka.Argv {
+		p, err := pushStr(s)
+		if err != nil {
+			return nil, err
+		}
+		argvPtrs = append(argvPtrs, p)
+	}
+	for _, s := range ka.Envp {
+		p, err := pushStr(s)
+		if err != nil {
+			return nil, err
+		}
+		envpPtrs = append(envpPtrs, p)
+	}
+	uid := uint64(emu.config.Uid)
+	ka.Auxv = []uint64{
+		AT_PHDR, exe.Phdr,
+		AT_PHENT, exe.Phent,
+		AT_PHNUM, exe.Phnum,
+		AT_PAGESZ, PAGE_SIZE,
+		AT_BASE, exe.Base,
+		AT_FLAGS, 0,
+		AT_ENTRY, exe.Entry,
+		AT_UID, uid,
+		AT_EUID, uid,
+		AT_GID, uid,
+		AT_EGID, uid,
+		AT_PLATFORM, platformPtr,
+		AT_HWCAP, arch.Hwcap,
+		AT_CLKTCK, 100,
+		AT_SECURE, 0,
+		AT_RANDOM, randomPtr,
+	}
+	if !arch.Is64 {
+		ka.Auxv = append(ka.Auxv, AT_HWCAP2, 0x10)
+	}
+	ka.Auxv = append(ka.Auxv, AT_EXECFN, execfn, AT_NULL, 0)
+	// then the vector, argc at a 16 byte boundary
+	words := []uint64{uint64(len(argvPtrs))}
+	words = append(words, argvPtrs...)
+	words = append(words, 0)
+	words = append(words, envpPtrs...)
+	words = append(words, 0)
+	words = append(words, ka.Auxv...)
+	ka.SP = (pos - uint64(len(words)) * ptr) &^ 15
+	ka.ArgvPtr = ka.SP + ptr
+	ka.EnvpPtr = ka.ArgvPtr + uint64(len(argvPtrs) + 1) * ptr
+	ka.AuxvPtr = ka.EnvpPtr + uint64(len(envpPtrs) + 1) * ptr
+	var vec []byte
+	for _, w := range words {
+		vec = append(vec, arch.PutPtr(w)...)
+	}
+	if err = emu.Mu.MemWrite(ka.SP, vec); err != nil {
+		return nil, err
+	}
+	// KernelArgumentBlock, the linker keeps it on its own stack
+	ka.Block = (ka.SP - KERNEL_ARGUMENT_BLOCK_WORDS * ptr) &^ 15
+	block := []uint64{uint64(len(argvPtrs)), ka.ArgvPtr, ka.EnvpPtr, ka.AuxvPtr, 0}
+	vec = nil
+	for _, w := range block {
+		vec = append(vec, arch.PutPtr(w)...)
+	}
+	if err = emu.Mu.MemWrite(ka.Block, vec); err != nil {
+		return nil, err
+	}
+	if err = emu.Mu.RegWrite(arch.SP, ka.Block); err != nil {
+		return nil, err
+	}
+	// libc takes __stack_chk_guard from AT_RANDOM, so do the TLS slots
+	emu.TLS.StackGuard = uint64(bin.LittleEndian.Uint32(ka.Random))
+	if arch.Is64 {
+		emu.TLS.StackGuard = bin.LittleEndian.Uint64(ka.Random)
+	}
+	emu.KernelArgs = ka
+	return ka, nil
+}
@@ -0,0 +1,285 @@
+package emulator
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"math"
+	"time"
+	"bytes"
+	"strings"
+	bin "encoding/binary"
+	zl  "github.com/rs/zerolog"
+)
+
+var (
+	ANDROID_LOG_UNKNOWN = 0
+	ANDROID_LOG_DEFAULT = 1
+	ANDROID_LOG_VERBOSE = 2
+	ANDROID_LOG_DEBUG   = 3
+	ANDROID_LOG_INFO    = 4
+	ANDROID_LOG_WARN    = 5
+	ANDROID_LOG_ERROR   = 6
+	ANDROID_LOG_FATAL   = 7
+	ANDROID_LOG_SILENT  = 8
+
+	LOG_ID_MAIN     = 0
+	LOG_ID_RADIO    = 1
+	LOG_ID_EVENTS   = 2
+	LOG_ID_SYSTEM   = 3
+	LOG_ID_CRASH    = 4
+	LOG_ID_STATS    = 5
+	LOG_ID_SECURITY = 6
+
+	// datagram socket liblog writes to since Android 5
+	LOGDW_SOCKET = "/dev/socket/logdw"
+	// android_log_header_t: u8 id, u16 tid, u32 sec, u32 nsec
+	LOGD_HEADER_SIZE = 11
+	// longest tag plus message liblog passes on
+	LOGGER_ENTRY_MAX_PAYLOAD uint64 = 4068
+
+	// print every event to Logd.Output in logcat threadtime format
+	LOGCAT_PRINT = true
+)
+
+// log buffer names by log id
+var logBuffers = []string{"main", "radio", "events", "system", "crash", "stats", "security", "kernel"}
+
+func logBufferName(id int) string {
+	if id >= 0 && id < len(logBuffers) {
+		return logBuffers[id]
+	}
+	return fmt.Sprintf("log%d", id)
+}
+
+// LogEvent is one entry the guest logged.
+type LogEvent struct {
+	Time     time.Time
+	Pid      int
+	Tid      int
+	// main, system, radio, events, crash, or stdout and stderr
+	Buffer   string
+	Priority int
+	Tag      string
+	Message  string
+}
+// PriorityChar is the letter logcat shows for the priority.
+func (e *LogEvent) PriorityChar() byte {
+	if e.Priority >= 0 && e.Priority < len("??VDIWEFS") {
+		return "??VDIWEFS"[e.Priority]
+	}
+	return '?'
+}
+// String formats the event like logcat -v threadtime, one line per line
+// of the message.
+func (e *LogEvent) String() string {
+	prefix := fmt.Sprintf("%s %5d %5d %c %-8s: ",
+		e.Time.Format("01-02 15:04:05.000"), e.Pid, e.Tid, e.PriorityChar(), e.Tag)
+	var sb strings.Builder
+	for _, line := range strings.Split(e.Message, "\n") {
+		sb.WriteString(prefix)
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Logd stands in for the Android log daemon. It takes the legacy
+// /dev/log devices, the logdw socket, liblog calls and the std streams.
+type Logd struct {
+	emu      *Emulator
+	// Callback receives every parsed event.
+	Callback func(*LogEvent)
+	// Output gets the logcat lines when LOGCAT_PRINT is set.
+	Output   io.Writer
+	// stdio output not terminated by a newline yet
+	pending  map[string][]byte
+	logger   zl.Logger
+}
+func NewLogd(emu *Emulator, vfs *VirtualFileSystem, net *Network, logger zl.Logger) *Logd {
+	ld := &Logd{
+		emu: emu,
+		Output: os.Stdout,
+		pending: map[string][]byte{},
+		logger: logger,
+	}
+	vfs.Dev.Add(func(p string, flag int) (FileHandle, bool) {
+		if !strings.HasPrefix(p, "/dev/log/") {
+			return nil, false
+		}
+		for id, name := range logBuffers[:LOG_ID_CRASH+1] {
+			if p == "/dev/log/" + name {
+				return NewDeviceHandle(p, nil, ld.deviceWriter(id)), true
+			}
+		}
+		return nil, false
+	})
+	net.AddService(LOGDW_SOCKET, ld.logdwPacket)
+	vfs.Stdio = ld.stdio
+	return ld
+}
+
+func (ld *Logd) ids() (int, int) {
+	pid, tid := ld.emu.Processes.Pid(), 0
+	if t := ld.emu.Scheduler.Current(); t != nil {
+		tid = t.Tid
+	}
+	return pid, tid
+}
+// Emit hands an event to the callback and the logcat output.
+func (ld *Logd) Emit(e *LogEvent) {
+	if ld.Callback != nil {
+		ld.Callback(e)
+	}
+	if LOGCAT_PRINT && ld.Output != nil {
+		io.WriteString(ld.Output, e.String())
+	}
+}
+// Write logs a text message as the current thread.
+func (ld *Logd) Write(id, prio int, tag, msg string) {
+	pid, tid := ld.ids()
+	ld.Emit(&LogEvent{
+		Time: time.Now(),
+		Pid: pid,
+		Tid: tid,
+		Buffer: logBufferName(id),
+		Priority: prio,
+		Tag: tag,
+		Message: strings.TrimRight(msg, "\n"),
+	})
+}
+
+// parseText splits the prio, tag\0, msg\0 payload of text buffers.
+func parseText(b []byte) (int, string, string) {
+	if len(b) < 1 {
+		return ANDROID_LOG_UNKNOWN, "", ""
+	}
+	prio, rest := int(b[0]), b[1:]
+	tag := rest
+	if i := bytes.IndexByte(rest, 0); i >= 0 {
+		tag, rest = rest[:i], rest[i+1:]
+	}else{
+		rest = nil
+	}
+	msg := bytes.TrimRight(rest, "\x00")
+	return prio, string(tag), string(msg)
+}
+func (ld *Logd) writePayload(id int, payload []byte, pid, tid int, t time.Time) {
+	e := &LogEvent{
+		Time: t,
+		Pid: pid,
+		Tid: tid,
+		Buffer: logBufferName(id),
+	}
+	switch id {
+	case LOG_ID_EVENTS, LOG_ID_STATS, LOG_ID_SECURITY:
+		if len(payload) < 4 {
+			return
+		}
+		e.Priority = ANDROID_LOG_INFO
+		e.Tag = fmt.Sprint(bin.LittleEndian.Uint32(payload))
+		e.Message, _ = decodeEventPayload(payload[4:])
+	default:
+		e.Priority, e.Tag, e.Message = parseText(payload)
+		e.Message = strings.TrimRight(e.Message, "\n")
+	}
+	ld.Emit(e)
+}
+// deviceWriter parses writes to the pre logd kernel logger, every write is
+// one entry.
+func (ld *Logd) deviceWriter(id int) func([]byte) (int, error) {
+	return func(b []byte) (int, error) {
+		pid, tid := ld.ids()
+		ld.writePayload(id, b, pid, tid, time.Now())
+		return len(b), nil
+	}
+}
+// logdwPacket parses a datagram sent to logdw.
+func (ld *Logd) logdwPacket(b []byte) {
+	if len(b) < LOGD_HEADER_SIZE {
+		ld.logger.Debug().Bytes("data", b).Msg("short logd packet")
+		return
+	}
+	id := int(b[0])
+	tid := int(bin.LittleEndian.Uint16(b[1:]))
+	sec := bin.LittleEndian.Uint32(b[3:])
+	nsec := bin.LittleEndian.Uint32(b[7:])
+	pid, _ := ld.ids()
+	ld.writePayload(id, b[LOGD_HEADER_SIZE:], pid, tid, time.Unix(int64(sec), int64(nsec)))
+}
+// stdio turns std stream output into one event per line.
+func (ld *Logd) stdio(stream string, b []byte) {
+	buf := append(ld.pending[stream], b...)
+	prio := ANDROID_LOG_INFO
+	if stream == "stderr" {
+		prio = ANDROID_LOG_WARN
+	}
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		pid, tid := ld.ids()
+		ld.Emit(&LogEvent{
+			Time: time.Now(),
+			Pid: pid,
+			Tid: tid,
+			Buffer: stream,
+			Priority: prio,
+			Tag: stream,
+			Message: string(buf[:i]),
+		})
+		buf = buf[i+1:]
+	}
+	ld.pending[stream] = buf
+}
+
+// decodeEventPayload renders a binary event like logcat does, ints, longs,
+// floats, strings and lists of them.
+func decodeEventPayload(b []byte) (string, []byte) {
+	if len(b) < 1 {
+		return "", b
+	}
+	typ, b := b[0], b[1:]
+	switch typ {
+	case 0:
+		if len(b) < 4 {
+			return "", nil
+		}
+		return fmt.Sprint(int32(bin.LittleEndian.Uint32(b))), b[4:]
+	case 1:
+		if len(b) < 8 {
+			return "", nil
+		}
+		return fmt.Sprint(int64(bin.LittleEndian.Uint64(b))), b[8:]
+	case 2:
+		if len(b) < 4 {
+			return "", nil
+		}
+		l := int(bin.LittleEndian.Uint32(b))
+		b = b[4:]
+		if l > len(b) {
+			l = len(b)
+		}
+		return string(b[:l]), b[l:]
+	case 3:
+		if len(b) < 1 {
+			return "[]", nil
+		}
+		n := int(b[0])
+		b = b[1:]
+		items := make([]string, 0, n)
+		for i := 0; i < n && len(b) > 0; i++ {
+			var s string
+			s, b = decodeEventPayload(b)
+			items = append(items, s)
+		}
+		return "[" + strings.Join(items, ",") + "]", b
+	case 4:
+		if len(b) < 4 {
+			return "", nil
+		}
+		return fmt.Sprint(math.Float32frombits(bin.LittleEndian.Uint32(b))), b[4:]
+	}
+	return fmt.Sprintf("<type %d>", typ), nil
+}
@@ -0,0 +1,983 @@
+package emulator
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"strconv"
+	"syscall"
+	bin "encoding/binary"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	AF_UNSPEC  uint64 = 0
+	AF_UNIX    uint64 = 1
+	AF_INET    uint64 = 2
+	AF_INET6   uint64 = 10
+	AF_NETLINK uint64 = 16
+
+	SOCK_STREAM    uint64 = 1
+	SOCK_DGRAM     uint64 = 2
+	SOCK_RAW       uint64 = 3
+	SOCK_SEQPACKET uint64 = 5
+	SOCK_TYPE_MASK uint64 = 0xf
+	SOCK_NONBLOCK  = O_NONBLOCK
+	SOCK_CLOEXEC   = O_CLOEXEC
+
+	SHUT_RD   uint64 = 0
+	SHUT_WR   uint64 = 1
+	SHUT_RDWR uint64 = 2
+
+	MSG_PEEK     uint64 = 0x2
+	MSG_TRUNC    uint64 = 0x20
+	MSG_DONTWAIT uint64 = 0x40
+	MSG_NOSIGNAL uint64 = 0x4000
+
+	SOL_SOCKET uint64 = 1
+	SO_TYPE    uint64 = 3
+	SO_ERROR   uint64 = 4
+
+	// struct msghdr on arm and arm64, pointers and size_t follow the arch
+	MSGHDR_ARM   = msghdrLayout{size: 28, namelen: 4, iov: 8, iovlen: 12, controllen: 20, flags: 24}
+	MSGHDR_ARM64 = msghdrLayout{size: 56, namelen: 8, iov: 16, iovlen: 24, controllen: 40, flags: 48}
+	// first port handed to sockets the guest did not bind
+	NET_EPHEMERAL_PORT = 40000
+)
+
+// Sockaddr is a decoded struct sockaddr.
+type Sockaddr struct {
+	Family uint64
+	IP     net.IP
+	Port   int
+	// AF_UNIX, abstract names start with "@"
+	Path   string
+	// AF_NETLINK
+	Pid    uint32
+	Groups uint32
+}
+func (a *Sockaddr) String() string {
+	switch a.Family {
+	case AF_INET, AF_INET6:
+		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+	case AF_UNIX:
+		return a.Path
+	case AF_NETLINK:
+		return fmt.Sprintf("netlink:%d", a.Pid)
+	}
+	return fmt.Sprintf("family %d", a.Family)
+}
+
+func parseSockaddr(b []byte) (*Sockaddr, uint64) {
+	if len(b) < 2 {
+		return nil, EINVAL
+	}
+	a := &Sockaddr{Family: uint64(bin.LittleEndian.Uint16(b))}
+	switch a.Family {
+	case AF_INET:
+		if len(b) < 8 {
+			return nil, EINVAL
+		}
+		a.Port = int(bin.BigEndian.Uint16(b[2:]))
+		a.IP = net.IP(append([]byte{}, b[4:8]...))
+	case AF_INET6:
+		if len(b) < 24 {
+			return nil, EINVAL
+		}
+		a.Port = int(bin.BigEndian.Uint16(b[2:]))
+		a.IP = net.IP(append([]byte{}, b[8:24]...))
+	case AF_UNIX:
+		name := b[2:]
+		if len(name) > 0 && name[0] == 0 {
+			a.Path = "@" + string(name[1:])
+		}else{
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			a.Path = string(name)
+		}
+	case AF_NETLINK:
+		if len(b) < 12 {
+			return nil, EINVAL
+		}
+		a.Pid = bin.LittleEndian.Uint32(b[4:])
+		a.Groups = bin.LittleEndian.Uint32(b[8:])
+	default:
+		return nil, EAFNOSUPPORT
+	}
+	return a, 0
+}
+func (a *Sockaddr) bytes() []byte {
+	switch a.Family {
+	case AF_INET:
+		b := make([]byte, 16)
+		bin.LittleEndian.PutUint16(b, uint16(a.Family))
+		bin.BigEndian.PutUint16(b[2:], uint16(a.Port))
+		if ip := a.IP.To4(); ip != nil {
+			copy(b[4:], ip)
+		}
+		return b
+	case AF_INET6:
+		b := make([]byte, 28)
+		bin.LittleEndian.PutUint16(b, uint16(a.Family))
+		bin.BigEndian.PutUint16(b[2:], uint16(a.Port))
+		copy(b[8:], a.IP.To16())
+		return b
+	case AF_UNIX:
+		name := []byte(a.Path)
+		if len(name) > 0 && name[0] == '@' {
+			name[0] = 0
+			return append(IntToBytes(int64(a.Family), 4)[:2], name...)
+		}
+		return append(append(IntToBytes(int64(a.Family), 4)[:2], name...), 0)
+	case AF_NETLINK:
+		b := make([]byte, 12)
+		bin.LittleEndian.PutUint16(b, uint16(a.Family))
+		bin.LittleEndian.PutUint32(b[4:], a.Pid)
+		bin.LittleEndian.PutUint32(b[8:], a.Groups)
+		return b
+	}
+	return IntToBytes(int64(a.Family), 4)[:2]
+}
+
+type sockPacket struct {
+	data []byte
+	from *Sockaddr
+}
+
+// Socket is an emulated socket, guest fds point at it like at any file.
+type Socket struct {
+	Id       int
+	Family   uint64
+	Type     uint64
+	Protocol uint64
+	Local    *Sockaddr
+	Remote   *Sockaddr
+	// setsockopt values by level<<32 | name
+	Options  map[uint64][]byte
+
+	net       *Network
+	// in-process unix service the socket is connected to
+	service   func([]byte)
+	rx        []sockPacket
+	peer      *Socket
+	connected bool
+	listening bool
+	shutRd    bool
+	shutWr    bool
+	eof       bool
+	closed    bool
+	polling   bool
+}
+// Deliver queues data for the guest to receive.
+func (s *Socket) Deliver(data []byte, from *Sockaddr) {
+	s.rx = append(s.rx, sockPacket{data: append([]byte{}, data...), from: from})
+	s.net.vfs.ioChanged()
+}
+func (s *Socket) stream() bool {
+	return s.Type == SOCK_STREAM
+}
+// Polling reports whether the backend is asked on behalf of poll, which
+// only checks for data and must not wait for it.
+func (s *Socket) Polling() bool {
+	return s.polling
+}
+// fill asks the backend for data once the receive queue ran dry.
+func (s *Socket) fill(poll bool) uint64 {
+	if len(s.rx) > 0 || s.eof || s.peer != nil || s.service != nil || s.Family == AF_NETLINK || !s.connected {
+		return 0
+	}
+	s.polling = poll
+	data, errno := s.net.backend.Recv(s)
+	s.polling = false
+	if errno == EAGAIN {
+		return 0
+	}
+	if errno != 0 {
+		return errno
+	}
+	if data == nil {
+		s.eof = true
+	}else{
+		s.rx = append(s.rx, sockPacket{data: data, from: s.Remote})
+	}
+	return 0
+}
+// recv takes up to size bytes, a datagram is consumed whole. The result
+// is never larger than what was queued.
+func (s *Socket) recv(size uint64, peek bool) ([]byte, int, *Sockaddr, uint64) {
+	if s.shutRd {
+		return []byte{}, 0, nil, 0
+	}
+	if errno := s.fill(false); errno != 0 {
+		return nil, 0, nil, errno
+	}
+	if len(s.rx) < 1 {
+		if s.eof {
+			return []byte{}, 0, nil, 0
+		}
+		if s.stream() && !s.connected {
+			return nil, 0, nil, ENOTCONN
+		}
+		return nil, 0, nil, EAGAIN
+	}
+	p := s.rx[0]
+	n := len(p.data)
+	if uint64(n) > size {
+		n = int(size)
+	}
+	b := append([]byte{}, p.data[:n]...)
+	if peek {
+		return b, len(p.data), p.from, 0
+	}
+	if s.stream() && n < len(p.data) {
+		s.rx[0].data = p.data[n:]
+	}else{
+		s.rx = s.rx[1:]
+	}
+	return b, len(p.data), p.from, 0
+}
+func (s *Socket) send(data []byte, to *Sockaddr) (int, uint64) {
+	if s.shutWr {
+		return 0, EPIPE
+	}
+	if s.Family == AF_NETLINK {
+		return s.net.netlinkSend(s, data)
+	}
+	if s.peer != nil {
+		if s.peer.closed || s.peer.shutRd {
+			return 0, EPIPE
+		}
+		s.peer.Deliver(data, s.Local)
+		return len(data), 0
+	}
+	if s.stream() {
+		if !s.connected {
+			return 0, ENOTCONN
+		}
+		to = nil
+	}else{
+		if to == nil {
+			to = s.Remote
+		}
+		if to == nil {
+			return 0, EDESTADDRREQ
+		}
+		if !s.connected {
+			errno := s.net.connect(s, to)
+			if errno != 0 {
+				return 0, errno
+			}
+			s.connected = true
+			s.net.autobind(s, to)
+		}
+	}
+	if s.service != nil {
+		s.service(data)
+		return len(data), 0
+	}
+	return s.net.backend.Send(s, data, to)
+}
+func (s *Socket) Read(b []byte) (int, error) {
+	data, _, _, errno := s.recv(uint64(len(b)), false)
+	if errno != 0 {
+		return 0, syscall.Errno(errno)
+	}
+	return copy(b, data), nil
+}
+func (s *Socket) Write(b []byte) (int, error) {
+	n, errno := s.send(b, nil)
+	if errno != 0 {
+		return n, syscall.Errno(errno)
+	}
+	return n, nil
+}
+func (s *Socket) Seek(offset int64, whence int) (int64, error) {
+	return 0, syscall.ESPIPE
+}
+func (s *Socket) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.peer != nil {
+		s.peer.eof = true
+	}else if s.Family != AF_NETLINK && s.service == nil {
+		s.net.backend.Close(s)
+	}
+	s.net.vfs.ioChanged()
+	return nil
+}
+func (s *Socket) Stat() (os.FileInfo, error) {
+	return &fileInfo{
+		name: fmt.Sprintf("socket:[%d]", s.Id),
+		mode: os.ModeSocket | 0777,
+		modTime: time.Now(),
+	}, nil
+}
+func (s *Socket) poll() uint64 {
+	var ev uint64
+	if errno := s.fill(true); errno != 0 {
+		ev |= POLLERR
+	}
+	if len(s.rx) > 0 || s.eof || s.shutRd {
+		ev |= POLLIN | POLLRDNORM
+	}
+	if s.eof {
+		ev |= POLLHUP
+	}
+	if !s.shutWr && (s.connected || !s.stream() || s.peer != nil) {
+		ev |= POLLOUT | POLLWRNORM
+	}
+	return ev
+}
+
+// Network is the emulated socket layer. Nothing reaches the host unless
+// the backend does it, see Config.Network.
+type Network struct {
+	emu      *Emulator
+	vfs      *VirtualFileSystem
+	config   *Config
+	backend  NetBackend
+	services map[string]func([]byte)
+	sockets  int
+	nextPort int
+	logger   zl.Logger
+}
+func NewNetwork(emu *Emulator, sh *SyscallHandlers, vfs *VirtualFileSystem, logger zl.Logger) *Network {
+	n := &Network{
+		emu: emu,
+		vfs: vfs,
+		config: emu.config,
+		services: map[string]func([]byte){},
+		nextPort: NET_EPHEMERAL_PORT,
+		logger: logger,
+	}
+	if emu.config.Network == NET_HOST {
+		n.backend = NewHostNetBackend()
+	}else{
+		n.backend = NewDenyAllBackend()
+	}
+	sh.SetHandler(0x119, "socket", 3, n.socketHandle)
+	sh.SetHandler(0x11a, "bind", 3, n.bindHandle)
+	sh.SetHandler(0x11b, "connect", 3, n.connectHandle)
+	sh.SetHandler(0x11c, "listen", 2, n.listenHandle)
+	sh.SetHandler(0x11d, "accept", 3, n.acceptHandle)
+	sh.SetHandler(0x11e, "getsockname", 3, n.getsocknameHandle)
+	sh.SetHandler(0x11f, "getpeername", 3, n.getpeernameHandle)
+	sh.SetHandler(0x120, "socketpair", 4, n.socketpairHandle)
+	sh.SetHandler(0x121, "send", 4, n.sendHandle)
+	sh.SetHandler(0x122, "sendto", 6, n.sendtoHandle)
+	sh.SetHandler(0x123, "recv", 4, n.recvHandle)
+	sh.SetHandler(0x124, "recvfrom", 6, n.recvfromHandle)
+	sh.SetHandler(0x125, "shutdown", 2, n.shutdownHandle)
+	sh.SetHandler(0x126, "setsockopt", 5, n.setsockoptHandle)
+	sh.SetHandler(0x127, "getsockopt", 5, n.getsockoptHandle)
+	sh.SetHandler(0x128, "sendmsg", 3, n.sendmsgHandle)
+	sh.SetHandler(0x129, "recvmsg", 3, n.recvmsgHandle)
+	sh.SetHandler(0x16E, "accept4", 4, n.accept4Handle)
+	return n
+}
+func (n *Network) Backend() NetBackend {
+	return n.backend
+}
+// SetBackend replaces what the sockets opened from now on reach.
+func (n *Network) SetBackend(b NetBackend) {
+	n.backend = b
+}
+// AddService answers a unix socket path inside the emulator, whatever is
+// sent to it goes to recv and the backend never sees it.
+func (n *Network) AddService(path string, recv func([]byte)) {
+	n.services[path] = recv
+}
+func (n *Network) connect(s *Socket, a *Sockaddr) uint64 {
+	if a.Family == AF_UNIX {
+		if recv, exist := n.services[a.Path]; exist {
+			s.service = recv
+			return 0
+		}
+	}
+	return n.backend.Connect(s, a)
+}
+func (n *Network) localIP(family uint64) net.IP {
+	if family == AF_INET6 {
+		return macLinkLocal(n.config.Mac)
+	}
+	ip := net.ParseIP(n.config.Ip)
+	if ip == nil {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	return ip
+}
+// autobind gives a socket the local address a connect would.
+func (n *Network) autobind(s *Socket, to *Sockaddr) {
+	if s.Local != nil && (s.Local.Port != 0 || s.Family == AF_UNIX) {
+		return
+	}
+	switch s.Family {
+	case AF_INET, AF_INET6:
+		ip := n.localIP(s.Family)
+		if to != nil && to.IP.IsLoopback() {
+			ip = to.IP
+		}
+		s.Local = &Sockaddr{Family: s.Family, IP: ip, Port: n.nextPort}
+		n.nextPort++
+	case AF_UNIX:
+		s.Local = &Sockaddr{Family: AF_UNIX}
+	}
+}
+func (n *Network) socket(fd uint64) (*Socket, uint64) {
+	vf := n.vfs.pcb.GetFdDetail(uintptr(fd))
+	if vf == nil {
+		return nil, EBADF
+	}
+	s, ok := vf.fo.(*Socket)
+	if !ok {
+		return nil, ENOTSOCK
+	}
+	return s, 0
+}
+func (n *Network) newSocket(family, typ, protocol uint64) *Socket {
+	n.sockets++
+	return &Socket{
+		Id: n.sockets,
+		Family: family,
+		Type: typ,
+		Protocol: protocol,
+		Options: map[uint64][]byte{},
+		net: n,
+	}
+}
+func (n *Network) install(s *Socket, flags uint64) uint64 {
+	fd, ok := n.vfs.installAnon(fmt.Sprintf("socket:[%d]", s.Id), s, (flags & (SOCK_NONBLOCK | SOCK_CLOEXEC)) | O_RDWR)
+	if !ok {
+		return errnoRet(EMFILE)
+	}
+	return uint64(fd)
+}
+func (n *Network) readSockaddr(mu uc.Unicorn, addr, addrlen uint64) (*Sockaddr, uint64) {
+	if addrlen > 128 {
+		return nil, EINVAL
+	}
+	b, err := mu.MemRead(addr, addrlen)
+	if err != nil {
+		return nil, EFAULT
+	}
+	return parseSockaddr(b)
+}
+// writeSockaddr fills a sockaddr and its value-result length.
+func (n *Network) writeSockaddr(mu uc.Unicorn, a *Sockaddr, addr, addrlenPtr uint64) uint64 {
+	if addr == 0 || addrlenPtr == 0 {
+		return 0
+	}
+	lb, err := mu.MemRead(addrlenPtr, 4)
+	if err != nil {
+		return EFAULT
+	}
+	max := uint64(LE_BytesToUint32(lb))
+	b := a.bytes()
+	if uint64(len(b)) < max {
+		max = uint64(len(b))
+	}
+	err = mu.MemWrite(addr, b[:max])
+	if err == nil {
+		err = mu.MemWrite(addrlenPtr, IntToBytes(int64(len(b)), 4))
+	}
+	if err != nil {
+		return EFAULT
+	}
+	return 0
+}
+// blocking decides between parking the thread and EAGAIN.
+func (n *Network) blocking(mu uc.Unicorn, fd uint64, op string, flags uint64) (uint64, bool) {
+	vf := n.vfs.pcb.GetFdDetail(uintptr(fd))
+	if flags & MSG_DONTWAIT != 0 || vf == nil {
+		return errnoRet(EAGAIN), true
+	}
+	return n.vfs.wouldBlock(mu, vf, op)
+}
+
+/* syscall socket
+int socket(int domain, int type, int protocol);
+*/
+func (n *Network) socketHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	family, typ, protocol := args[0], args[1] & SOCK_TYPE_MASK, args[2]
+	flags := args[1] &^ SOCK_TYPE_MASK
+	switch family {
+	case AF_INET, AF_INET6, AF_UNIX:
+	case AF_NETLINK:
+		if protocol != NETLINK_ROUTE {
+			n.logger.Debug().Uint64("protocol", protocol).Msg("netlink protocol not emulated")
+			return errnoRet(EPROTONOSUPPORT), true
+		}
+	default:
+		return errnoRet(EAFNOSUPPORT), true
+	}
+	switch typ {
+	case SOCK_STREAM, SOCK_DGRAM, SOCK_SEQPACKET, SOCK_RAW:
+	default:
+		return errnoRet(EINVAL), true
+	}
+	s := n.newSocket(family, typ, protocol)
+	fd := n.install(s, flags)
+	n.logger.Debug().
+		Uint64("family", family).
+		Uint64("type", typ).
+		Uint64("protocol", protocol).
+		Int64("fd", int64(fd)).
+		Msg("socket")
+	return fd, true
+}
+/* syscall socketpair
+int socketpair(int domain, int type, int protocol, int sv[2]);
+*/
+func (n *Network) socketpairHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	family, typ, flags := args[0], args[1] & SOCK_TYPE_MASK, args[1] &^ SOCK_TYPE_MASK
+	if family != AF_UNIX {
+		return errnoRet(EOPNOTSUPP), true
+	}
+	a, b := n.newSocket(family, typ, args[2]), n.newSocket(family, typ, args[2])
+	a.peer, b.peer = b, a
+	a.connected, b.connected = true, true
+	a.Local = &Sockaddr{Family: AF_UNIX}
+	b.Local = &Sockaddr{Family: AF_UNIX}
+	a.Remote, b.Remote = b.Local, a.Local
+	fa := n.install(a, flags)
+	if int64(fa) < 0 {
+		return fa, true
+	}
+	fb := n.install(b, flags)
+	if int64(fb) < 0 {
+		n.vfs.pcb.Remove(uintptr(fa))
+		return fb, true
+	}
+	err := mu.MemWrite(args[3], append(IntToBytes(int64(fa), 4), IntToBytes(int64(fb), 4)...))
+	if err != nil {
+		n.vfs.pcb.Remove(uintptr(fa))
+		n.vfs.pcb.Remove(uintptr(fb))
+		return errnoRet(EFAULT), true
+	}
+	return 0, true
+}
+/* syscall bind
+int bind(int sockfd, const struct sockaddr *addr, socklen_t addrlen);
+*/
+func (n *Network) bindHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	a, errno := n.readSockaddr(mu, args[1], args[2])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	if a.Family != s.Family {
+		return errnoRet(EINVAL), true
+	}
+	if s.Family == AF_NETLINK && a.Pid == 0 {
+		a.Pid = uint32(n.emu.Processes.Pid())
+	}
+	if (a.Family == AF_INET || a.Family == AF_INET6) && a.Port == 0 {
+		a.Port = n.nextPort
+		n.nextPort++
+	}
+	s.Local = a
+	n.logger.Debug().Uint64("fd", args[0]).Str("addr", a.String()).Msg("bind")
+	return 0, true
+}
+/* syscall connect
+int connect(int sockfd, const struct sockaddr *addr, socklen_t addrlen);
+*/
+func (n *Network) connectHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	a, errno := n.readSockaddr(mu, args[1], args[2])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	if s.stream() && s.connected {
+		return errnoRet(EISCONN), true
+	}
+	if s.Family == AF_NETLINK {
+		s.Remote = a
+		s.connected = true
+		return 0, true
+	}
+	errno = n.connect(s, a)
+	n.logger.Info().
+		Uint64("fd", args[0]).
+		Str("addr", a.String()).
+		Uint64("errno", errno).
+		Msg("connect")
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	s.Remote = a
+	s.connected = true
+	n.autobind(s, a)
+	return 0, true
+}
+/* syscall listen
+int listen(int sockfd, int backlog);
+*/
+func (n *Network) listenHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	if !s.stream() && s.Type != SOCK_SEQPACKET {
+		return errnoRet(EOPNOTSUPP), true
+	}
+	s.listening = true
+	n.autobind(s, nil)
+	return 0, true
+}
+/* syscall accept
+int accept(int sockfd, struct sockaddr *addr, socklen_t *addrlen);
+*/
+func (n *Network) acceptHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return n.accept4Handle(mu, args[0], args[1], args[2], 0)
+}
+/* syscall accept4
+int accept4(int sockfd, struct sockaddr *addr, socklen_t *addrlen, int flags);
+*/
+func (n *Network) accept4Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	if !s.listening {
+		return errnoRet(EINVAL), true
+	}
+	// nobody ever connects to the emulated process
+	return n.blocking(mu, args[0], "accept", 0)
+}
+/* syscall getsockname
+int getsockname(int sockfd, struct sockaddr *addr, socklen_t *addrlen);
+*/
+func (n *Network) getsocknameHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	a := s.Local
+	if a == nil {
+		a = &Sockaddr{Family: s.Family, IP: net.IPv4zero}
+		if s.Family == AF_INET6 {
+			a.IP = net.IPv6zero
+		}
+		if s.Family == AF_NETLINK {
+			a.Pid = uint32(n.emu.Processes.Pid())
+		}
+	}
+	errno = n.writeSockaddr(mu, a, args[1], args[2])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return 0, true
+}
+/* syscall getpeername
+int getpeername(int sockfd, struct sockaddr *addr, socklen_t *addrlen);
+*/
+func (n *Network) getpeernameHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	if !s.connected || s.Remote == nil {
+		return errnoRet(ENOTCONN), true
+	}
+	errno = n.writeSockaddr(mu, s.Remote, args[1], args[2])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return 0, true
+}
+func (n *Network) sendto(mu uc.Unicorn, fd uint64, data []byte, to *Sockaddr, flags uint64) (uint64, bool) {
+	s, errno := n.socket(fd)
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	sent, errno := s.send(data, to)
+	if errno == EAGAIN {
+		return n.blocking(mu, fd, "send", flags)
+	}
+	if errno != 0 {
+		n.logger.Debug().Uint64("fd", fd).Uint64("errno", errno).Msg("send failed")
+		return errnoRet(errno), true
+	}
+	return uint64(sent), true
+}
+/* syscall send
+ssize_t send(int sockfd, const void *buf, size_t len, int flags);
+*/
+func (n *Network) sendHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return n.sendtoHandle(mu, args[0], args[1], args[2], args[3], 0, 0)
+}
+/* syscall sendto
+ssize_t sendto(int sockfd, const void *buf, size_t len, int flags, const struct sockaddr *dest_addr, socklen_t addrlen);
+*/
+func (n *Network) sendtoHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	data, err := mu.MemRead(args[1], args[2])
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	var to *Sockaddr
+	if args[4] != 0 {
+		var errno uint64
+		to, errno = n.readSockaddr(mu, args[4], args[5])
+		if errno != 0 {
+			return errnoRet(errno), true
+		}
+	}
+	return n.sendto(mu, args[0], data, to, args[3])
+}
+func (n *Network) recvfrom(mu uc.Unicorn, fd, size, flags uint64) ([]byte, int, *Sockaddr, uint64, bool) {
+	s, errno := n.socket(fd)
+	if errno != 0 {
+		return nil, 0, nil, errnoRet(errno), true
+	}
+	buf, full, from, errno := s.recv(size, flags & MSG_PEEK != 0)
+	if errno == EAGAIN {
+		ret, hasRet := n.blocking(mu, fd, "recv", flags)
+		return nil, 0, nil, ret, hasRet
+	}
+	if errno != 0 {
+		return nil, 0, nil, errnoRet(errno), true
+	}
+	return buf, full, from, uint64(len(buf)), true
+}
+/* syscall recv
+ssize_t recv(int sockfd, void *buf, size_t len, int flags);
+*/
+func (n *Network) recvHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return n.recvfromHandle(mu, args[0], args[1], args[2], args[3], 0, 0)
+}
+/* syscall recvfrom
+ssize_t recvfrom(int sockfd, void *buf, size_t len, int flags, struct sockaddr *src_addr, socklen_t *addrlen);
+*/
+func (n *Network) recvfromHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	data, full, from, ret, hasRet := n.recvfrom(mu, args[0], args[2], args[3])
+	if data == nil {
+		return ret, hasRet
+	}
+	err := mu.MemWrite(args[1], data)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	if from != nil {
+		if errno := n.writeSockaddr(mu, from, args[4], args[5]); errno != 0 {
+			return errnoRet(errno), true
+		}
+	}
+	if args[3] & MSG_TRUNC != 0 {
+		return uint64(full), true
+	}
+	return ret, true
+}
+/* syscall shutdown
+int shutdown(int sockfd, int how);
+*/
+func (n *Network) shutdownHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	if !s.connected {
+		return errnoRet(ENOTCONN), true
+	}
+	switch args[1] {
+	case SHUT_RD:
+		s.shutRd = true
+	case SHUT_WR:
+		s.shutWr = true
+	case SHUT_RDWR:
+		s.shutRd, s.shutWr = true, true
+	default:
+		return errnoRet(EINVAL), true
+	}
+	if s.shutWr && s.peer != nil {
+		s.peer.eof = true
+	}
+	n.vfs.ioChanged()
+	return 0, true
+}
+/* syscall setsockopt
+int setsockopt(int sockfd, int level, int optname, const void *optval, socklen_t optlen);
+*/
+func (n *Network) setsockoptHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	val, err := mu.MemRead(args[3], args[4])
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	s.Options[args[1] << 32 | args[2]] = val
+	return 0, true
+}
+/* syscall getsockopt
+int getsockopt(int sockfd, int level, int optname, void *optval, socklen_t *optlen);
+*/
+func (n *Network) getsockoptHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	s, errno := n.socket(args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	val, exist := s.Options[args[1] << 32 | args[2]]
+	if args[1] == SOL_SOCKET && args[2] == SO_TYPE {
+		val, exist = IntToBytes(int64(s.Type), 4), true
+	}
+	if !exist {
+		// SO_ERROR and anything never set read as 0
+		val = IntToBytes(0, 4)
+	}
+	lb, err := mu.MemRead(args[4], 4)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	max := int(LE_BytesToUint32(lb))
+	if len(val) < max {
+		max = len(val)
+	}
+	err = mu.MemWrite(args[3], val[:max])
+	if err == nil {
+		err = mu.MemWrite(args[4], IntToBytes(int64(max), 4))
+	}
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return 0, true
+}
+
+// msghdrLayout has the field offsets of struct msghdr, msg_name is at 0.
+type msghdrLayout struct {
+	size, namelen, iov, iovlen, controllen, flags uint64
+}
+type msghdr struct {
+	name    uint64
+	namelen uint64
+	iov     [][2]uint64
+	layout  msghdrLayout
+}
+func (n *Network) readMsghdr(mu uc.Unicorn, addr uint64) (*msghdr, uint64) {
+	arch := archOf(mu)
+	layout := MSGHDR_ARM
+	if arch.Is64 {
+		layout = MSGHDR_ARM64
+	}
+	b, err := mu.MemRead(addr, layout.size)
+	if err != nil {
+		return nil, EFAULT
+	}
+	word := func(off uint64) uint64 {
+		return LE_BytesToUint(b[off:off+arch.PtrSize])
+	}
+	m := &msghdr{
+		name: word(0),
+		namelen: uint64(LE_BytesToUint32(b[layout.namelen:])),
+		layout: layout,
+	}
+	var errno uint64
+	m.iov, errno = readIovec(mu, word(layout.iov), word(layout.iovlen))
+	if errno != 0 {
+		return nil, errno
+	}
+	return m, 0
+}
+/* syscall sendmsg
+ssize_t sendmsg(int sockfd, const struct msghdr *msg, int flags);
+*/
+func (n *Network) sendmsgHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	m, errno := n.readMsghdr(mu, args[1])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	var data []byte
+	for _, v := range m.iov {
+		b, err := mu.MemRead(v[0], v[1])
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		data = append(data, b...)
+	}
+	var to *Sockaddr
+	if m.name != 0 {
+		to, errno = n.readSockaddr(mu, m.name, m.namelen)
+		if errno != 0 {
+			return errnoRet(errno), true
+		}
+	}
+	return n.sendto(mu, args[0], data, to, args[2])
+}
+/* syscall recvmsg
+ssize_t recvmsg(int sockfd, struct msghdr *msg, int flags);
+*/
+func (n *Network) recvmsgHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	m, errno := n.readMsghdr(mu, args[1])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	// recv allocates what is queued, size only limits it
+	var size uint64
+	for _, v := range m.iov {
+		if size + v[1] < size {
+			size = ^uint64(0)
+			break
+		}
+		size += v[1]
+	}
+	data, full, from, ret, hasRet := n.recvfrom(mu, args[0], size, args[2])
+	if data == nil {
+		return ret, hasRet
+	}
+	rest := data
+	for _, v := range m.iov {
+		if len(rest) < 1 {
+			break
+		}
+		chunk := rest
+		if uint64(len(chunk)) > v[1] {
+			chunk = chunk[:v[1]]
+		}
+		if err := mu.MemWrite(v[0], chunk); err != nil {
+			return errnoRet(EFAULT), true
+		}
+		rest = rest[len(chunk):]
+	}
+	var msgFlags uint64
+	if full > len(data) {
+		msgFlags |= MSG_TRUNC
+	}
+	var namelen uint64
+	if from != nil && m.name != 0 {
+		b := from.bytes()
+		if uint64(len(b)) < m.namelen {
+			m.namelen = uint64(len(b))
+		}
+		if err := mu.MemWrite(m.name, b[:m.namelen]); err != nil {
+			return errnoRet(EFAULT), true
+		}
+		namelen = uint64(len(b))
+	}
+	// msg_namelen, msg_controllen and msg_flags are results
+	err := mu.MemWrite(args[1] + m.layout.namelen, IntToBytes(int64(namelen), 4))
+	if err == nil {
+		err = mu.MemWrite(args[1] + m.layout.controllen, archOf(mu).PutPtr(0))
+	}
+	if err == nil {
+		err = mu.MemWrite(args[1] + m.layout.flags, IntToBytes(int64(msgFlags), 4))
+	}
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return ret, true
+}
@@ -0,0 +1,273 @@
+package emulator
+
+import (
+	"io"
+	"os"
+	"net"
+	"time"
+	"bytes"
+	"strconv"
+)
+
+var (
+	// how long a host passthrough read waits before reporting EAGAIN
+	NET_HOST_READ_TIMEOUT = 2 * time.Second
+	// the same for poll, a deadline already passed fails before reading
+	// what the host has buffered
+	NET_HOST_POLL_TIMEOUT = time.Millisecond
+	NET_HOST_DIAL_TIMEOUT = 5 * time.Second
+)
+
+// NetBackend decides what the guest sockets reach. Errors are errno values.
+type NetBackend interface {
+	// Connect is called by connect, and by the first send of a datagram
+	// socket that was never connected.
+	Connect(s *Socket, addr *Sockaddr) uint64
+	// Send takes what the guest wrote, replies go through Socket.Deliver.
+	Send(s *Socket, data []byte, to *Sockaddr) (int, uint64)
+	// Recv is asked for more once the receive queue is empty, EAGAIN when
+	// nothing came yet, nil data without errno for the end of the stream.
+	// It must not wait when s.Polling() is set.
+	Recv(s *Socket) ([]byte, uint64)
+	Close(s *Socket)
+}
+
+/*
+	deny all
+*/
+
+// DenyAllBackend refuses every connection, the app sees no network.
+type DenyAllBackend struct {
+	Errno uint64
+}
+func NewDenyAllBackend() *DenyAllBackend {
+	return &DenyAllBackend{Errno: ENETUNREACH}
+}
+func (b *DenyAllBackend) Connect(s *Socket, addr *Sockaddr) uint64 {
+	if addr.Family == AF_UNIX {
+		return ECONNREFUSED
+	}
+	return b.Errno
+}
+func (b *DenyAllBackend) Send(s *Socket, data []byte, to *Sockaddr) (int, uint64) {
+	return 0, b.Errno
+}
+func (b *DenyAllBackend) Recv(s *Socket) ([]byte, uint64) {
+	return nil, EAGAIN
+}
+func (b *DenyAllBackend) Close(s *Socket) {}
+
+/*
+	scripted responder
+*/
+
+// NetRule answers payloads sent to Addr ("ip:port", a unix path, or "*"),
+// Match is a payload prefix, an empty Match answers anything.
+type NetRule struct {
+	Addr  string
+	Match []byte
+	Reply []byte
+	// end the stream once the reply is read
+	Close bool
+}
+
+// ScriptedBackend accepts connections to the addresses it has rules for
+// and replies with canned data.
+type ScriptedBackend struct {
+	Rules []*NetRule
+	// refuse connections no rule is for
+	Strict bool
+}
+func NewScriptedBackend() *ScriptedBackend {
+	return &ScriptedBackend{Strict: true}
+}
+// Add registers a reply for payloads starting with match.
+func (b *ScriptedBackend) Add(addr string, match, reply []byte) *NetRule {
+	r := &NetRule{Addr: addr, Match: match, Reply: reply}
+	b.Rules = append(b.Rules, r)
+	return r
+}
+func (b *ScriptedBackend) knows(addr *Sockaddr) bool {
+	for _, r := range b.Rules {
+		if r.Addr == "*" || r.Addr == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+func (b *ScriptedBackend) Connect(s *Socket, addr *Sockaddr) uint64 {
+	if b.Strict && !b.knows(addr) {
+		return ECONNREFUSED
+	}
+	return 0
+}
+func (b *ScriptedBackend) Send(s *Socket, data []byte, to *Sockaddr) (int, uint64) {
+	if to == nil {
+		to = s.Remote
+	}
+	for _, r := range b.Rules {
+		if r.Addr != "*" && r.Addr != to.String() {
+			continue
+		}
+		if !bytes.HasPrefix(data, r.Match) {
+			continue
+		}
+		if r.Reply != nil {
+			s.Deliver(r.Reply, to)
+		}
+		if r.Close {
+			s.eof = true
+		}
+		break
+	}
+	return len(data), 0
+}
+func (b *ScriptedBackend) Recv(s *Socket) ([]byte, uint64) {
+	return nil, EAGAIN
+}
+func (b *ScriptedBackend) Close(s *Socket) {}
+
+/*
+	recorder
+*/
+
+// NetRecord is one payload the guest wrote to a socket.
+type NetRecord struct {
+	Time   time.Time
+	Event  string
+	Family uint64
+	Type   uint64
+	Remote string
+	Data   []byte
+	Errno  uint64
+}
+
+// RecorderBackend captures every connect and payload, then hands it on.
+type RecorderBackend struct {
+	Next    NetBackend
+	Records []NetRecord
+}
+func NewRecorderBackend(next NetBackend) *RecorderBackend {
+	return &RecorderBackend{Next: next}
+}
+func (b *RecorderBackend) record(s *Socket, event string, addr *Sockaddr, data []byte, errno uint64) {
+	r := NetRecord{
+		Time: time.Now(),
+		Event: event,
+		Family: s.Family,
+		Type: s.Type,
+		Data: append([]byte{}, data...),
+		Errno: errno,
+	}
+	if addr != nil {
+		r.Remote = addr.String()
+	}
+	b.Records = append(b.Records, r)
+}
+func (b *RecorderBackend) Connect(s *Socket, addr *Sockaddr) uint64 {
+	errno := b.Next.Connect(s, addr)
+	b.record(s, "connect", addr, nil, errno)
+	return errno
+}
+func (b *RecorderBackend) Send(s *Socket, data []byte, to *Sockaddr) (int, uint64) {
+	n, errno := b.Next.Send(s, data, to)
+	if to == nil {
+		to = s.Remote
+	}
+	b.record(s, "send", to, data, errno)
+	return n, errno
+}
+func (b *RecorderBackend) Recv(s *Socket) ([]byte, uint64) {
+	return b.Next.Recv(s)
+}
+func (b *RecorderBackend) Close(s *Socket) {
+	b.Next.Close(s)
+}
+
+/*
+	host passthrough
+*/
+
+// HostNetBackend opens real connections for inet sockets, unix sockets
+// stay refused.
+type HostNetBackend struct {
+	conns map[*Socket]net.Conn
+}
+func NewHostNetBackend() *HostNetBackend {
+	return &HostNetBackend{conns: map[*Socket]net.Conn{}}
+}
+func (b *HostNetBackend) Connect(s *Socket, addr *Sockaddr) uint64 {
+	if addr.Family != AF_INET && addr.Family != AF_INET6 {
+		return ECONNREFUSED
+	}
+	network := "tcp"
+	if s.Type == SOCK_DGRAM {
+		network = "udp"
+	}
+	c, err := net.DialTimeout(network, net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)), NET_HOST_DIAL_TIMEOUT)
+	if err != nil {
+		return netErrno(err)
+	}
+	if old, exist := b.conns[s]; exist {
+		old.Close()
+	}
+	b.conns[s] = c
+	return 0
+}
+func (b *HostNetBackend) Send(s *Socket, data []byte, to *Sockaddr) (int, uint64) {
+	c, exist := b.conns[s]
+	if !exist {
+		return 0, ENOTCONN
+	}
+	n, err := c.Write(data)
+	if err != nil {
+		return n, netErrno(err)
+	}
+	return n, 0
+}
+func (b *HostNetBackend) Recv(s *Socket) ([]byte, uint64) {
+	c, exist := b.conns[s]
+	if !exist {
+		return nil, ENOTCONN
+	}
+	timeout := NET_HOST_READ_TIMEOUT
+	if s.Polling() {
+		timeout = NET_HOST_POLL_TIMEOUT
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 65536)
+	n, err := c.Read(buf)
+	if n > 0 {
+		return buf[:n], 0
+	}
+	if err == io.EOF {
+		return nil, 0
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, EAGAIN
+	}
+	return nil, netErrno(err)
+}
+func (b *HostNetBackend) Close(s *Socket) {
+	if c, exist := b.conns[s]; exist {
+		c.Close()
+		delete(b.conns, s)
+	}
+}
+
+func netErrno(err error) uint64 {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ETIMEDOUT
+	}
+	errno := vfsErrno(err)
+	if errno == EIO {
+		return ECONNREFUSED
+	}
+	return errno
+}
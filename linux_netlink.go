@@ -0,0 +1,220 @@
+package emulator
+
+import (
+	"net"
+	bin "encoding/binary"
+)
+
+var (
+	NETLINK_ROUTE uint64 = 0
+
+	NLMSG_HDRLEN = 16
+	NLMSG_NOOP   uint16 = 1
+	NLMSG_ERROR  uint16 = 2
+	NLMSG_DONE   uint16 = 3
+
+	NLM_F_REQUEST uint16 = 0x1
+	NLM_F_MULTI   uint16 = 0x2
+	NLM_F_ACK     uint16 = 0x4
+	NLM_F_DUMP    uint16 = 0x300
+
+	RTM_NEWLINK uint16 = 16
+	RTM_GETLINK uint16 = 18
+	RTM_NEWADDR uint16 = 20
+	RTM_GETADDR uint16 = 22
+
+	IFLA_ADDRESS   uint16 = 1
+	IFLA_BROADCAST uint16 = 2
+	IFLA_IFNAME    uint16 = 3
+	IFLA_MTU       uint16 = 4
+
+	IFA_ADDRESS   uint16 = 1
+	IFA_LOCAL     uint16 = 2
+	IFA_LABEL     uint16 = 3
+	IFA_BROADCAST uint16 = 4
+
+	IFF_UP        uint32 = 0x1
+	IFF_BROADCAST uint32 = 0x2
+	IFF_LOOPBACK  uint32 = 0x8
+	IFF_RUNNING   uint32 = 0x40
+	IFF_MULTICAST uint32 = 0x1000
+
+	ARPHRD_ETHER    uint16 = 1
+	ARPHRD_LOOPBACK uint16 = 772
+
+	RT_SCOPE_UNIVERSE uint8 = 0
+	RT_SCOPE_LINK     uint8 = 253
+	RT_SCOPE_HOST     uint8 = 254
+
+	// interface the app sees its Config.Ip on
+	NET_IFACE = "wlan0"
+)
+
+// netIface is an interface reported to RTM_GETLINK and RTM_GETADDR.
+type netIface struct {
+	index int32
+	name  string
+	typ   uint16
+	flags uint32
+	mtu   uint32
+	mac   []byte
+	addrs []*net.IPNet
+}
+
+func macLinkLocal(mac Mac) net.IP {
+	ip := make(net.IP, 16)
+	ip[0], ip[1] = 0xfe, 0x80
+	if len(mac) == 6 {
+		// modified EUI-64
+		copy(ip[8:], []byte{mac[0] ^ 2, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]})
+	}
+	return ip
+}
+func (n *Network) ifaces() []*netIface {
+	lo := &netIface{
+		index: 1,
+		name: "lo",
+		typ: ARPHRD_LOOPBACK,
+		flags: IFF_UP | IFF_LOOPBACK | IFF_RUNNING,
+		mtu: 65536,
+		mac: make([]byte, 6),
+		addrs: []*net.IPNet{
+			{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+	}
+	wlan := &netIface{
+		index: 2,
+		name: NET_IFACE,
+		typ: ARPHRD_ETHER,
+		flags: IFF_UP | IFF_BROADCAST | IFF_RUNNING | IFF_MULTICAST,
+		mtu: 1500,
+		mac: []byte(n.config.Mac),
+	}
+	if ip := net.ParseIP(n.config.Ip).To4(); ip != nil {
+		wlan.addrs = append(wlan.addrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)})
+	}
+	wlan.addrs = append(wlan.addrs, &net.IPNet{IP: macLinkLocal(n.config.Mac), Mask: net.CIDRMask(64, 128)})
+	return []*netIface{lo, wlan}
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	l := 4 + len(data)
+	b := make([]byte, (l + 3) &^ 3)
+	bin.LittleEndian.PutUint16(b, uint16(l))
+	bin.LittleEndian.PutUint16(b[2:], typ)
+	copy(b[4:], data)
+	return b
+}
+func nlMsg(typ, flags uint16, seq, pid uint32, payload []byte) []byte {
+	b := make([]byte, NLMSG_HDRLEN, NLMSG_HDRLEN + len(payload))
+	bin.LittleEndian.PutUint32(b, uint32(NLMSG_HDRLEN + len(payload)))
+	bin.LittleEndian.PutUint16(b[4:], typ)
+	bin.LittleEndian.PutUint16(b[6:], flags)
+	bin.LittleEndian.PutUint32(b[8:], seq)
+	bin.LittleEndian.PutUint32(b[12:], pid)
+	return append(b, payload...)
+}
+func linkMsg(i *netIface) []byte {
+	// struct ifinfomsg
+	b := make([]byte, 16)
+	bin.LittleEndian.PutUint16(b[2:], i.typ)
+	bin.LittleEndian.PutUint32(b[4:], uint32(i.index))
+	bin.LittleEndian.PutUint32(b[8:], i.flags)
+	b = append(b, nlAttr(IFLA_IFNAME, append([]byte(i.name), 0))...)
+	b = append(b, nlAttr(IFLA_ADDRESS, i.mac)...)
+	if i.flags & IFF_BROADCAST != 0 {
+		b = append(b, nlAttr(IFLA_BROADCAST, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})...)
+	}else{
+		b = append(b, nlAttr(IFLA_BROADCAST, make([]byte, len(i.mac)))...)
+	}
+	b = append(b, nlAttr(IFLA_MTU, IntToBytes(int64(i.mtu), 4))...)
+	return b
+}
+func addrMsg(i *netIface, a *net.IPNet) []byte {
+	ones, _ := a.Mask.Size()
+	ip, family := a.IP.To4(), AF_INET
+	if ip == nil {
+		ip, family = a.IP.To16(), AF_INET6
+	}
+	scope := RT_SCOPE_UNIVERSE
+	if a.IP.IsLoopback() {
+		scope = RT_SCOPE_HOST
+	}else if a.IP.IsLinkLocalUnicast() {
+		scope = RT_SCOPE_LINK
+	}
+	// struct ifaddrmsg
+	b := []byte{byte(family), byte(ones), 0, scope}
+	b = append(b, IntToBytes(int64(i.index), 4)...)
+	b = append(b, nlAttr(IFA_ADDRESS, ip)...)
+	if family == AF_INET {
+		b = append(b, nlAttr(IFA_LOCAL, ip)...)
+		if i.flags & IFF_BROADCAST != 0 {
+			bcast := make(net.IP, 4)
+			for k := range bcast {
+				bcast[k] = ip[k] | ^a.Mask[k]
+			}
+			b = append(b, nlAttr(IFA_BROADCAST, bcast)...)
+		}
+		b = append(b, nlAttr(IFA_LABEL, append([]byte(i.name), 0))...)
+	}
+	return b
+}
+
+// netlinkSend answers NETLINK_ROUTE requests, every reply becomes one
+// datagram on the socket.
+func (n *Network) netlinkSend(s *Socket, data []byte) (int, uint64) {
+	pid := uint32(n.emu.Processes.Pid())
+	if s.Local != nil && s.Local.Pid != 0 {
+		pid = s.Local.Pid
+	}
+	from := &Sockaddr{Family: AF_NETLINK}
+	for off := 0; off + NLMSG_HDRLEN <= len(data); {
+		l := int(bin.LittleEndian.Uint32(data[off:]))
+		if l < NLMSG_HDRLEN || off + l > len(data) {
+			return 0, EINVAL
+		}
+		typ := bin.LittleEndian.Uint16(data[off+4:])
+		flags := bin.LittleEndian.Uint16(data[off+6:])
+		seq := bin.LittleEndian.Uint32(data[off+8:])
+		family := AF_UNSPEC
+		if l > NLMSG_HDRLEN {
+			family = uint64(data[off+NLMSG_HDRLEN])
+		}
+		var reply []byte
+		switch {
+		case typ == RTM_GETLINK && flags & NLM_F_DUMP != 0:
+			for _, i := range n.ifaces() {
+				reply = append(reply, nlMsg(RTM_NEWLINK, NLM_F_MULTI, seq, pid, linkMsg(i))...)
+			}
+			reply = append(reply, nlMsg(NLMSG_DONE, NLM_F_MULTI, seq, pid, IntToBytes(0, 4))...)
+		case typ == RTM_GETADDR && flags & NLM_F_DUMP != 0:
+			for _, i := range n.ifaces() {
+				for _, a := range i.addrs {
+					v4 := a.IP.To4() != nil
+					if (family == AF_INET && !v4) || (family == AF_INET6 && v4) {
+						continue
+					}
+					reply = append(reply, nlMsg(RTM_NEWADDR, NLM_F_MULTI, seq, pid, addrMsg(i, a))...)
+				}
+			}
+			reply = append(reply, nlMsg(NLMSG_DONE, NLM_F_MULTI, seq, pid, IntToBytes(0, 4))...)
+		default:
+			n.logger.Debug().Uint16("type", typ).Uint16("flags", flags).Msg("netlink request not emulated")
+			errno := int64(-int64(EOPNOTSUPP))
+			if typ < RTM_NEWLINK {
+				errno = 0
+			}
+			if errno != 0 || flags & NLM_F_ACK != 0 {
+				// struct nlmsgerr, the error then the offending header
+				payload := append(IntToBytes(errno, 4), data[off:off+NLMSG_HDRLEN]...)
+				reply = nlMsg(NLMSG_ERROR, 0, seq, pid, payload)
+			}
+		}
+		if reply != nil {
+			s.Deliver(reply, from)
+		}
+		off += (l + 3) &^ 3
+	}
+	return len(data), 0
+}
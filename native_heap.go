@@ -0,0 +1,266 @@
+package emulator
+
+import (
+	"fmt"
+	"sort"
+	"runtime"
+	fp  "path/filepath"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// size of every arena the heap maps, larger blocks get their own
+	HEAP_ARENA_SIZE uint64 = 0x100000
+	HEAP_ALIGN      uint64 = 8
+	// label of the arenas in /proc/self/maps, the same bionic uses
+	HEAP_VMA_NAME = "[anon:libc_malloc]"
+)
+
+// HeapBlock is a live allocation of the Go side heap.
+type HeapBlock struct {
+	Addr   uint64
+	Size   uint64
+	// Go call site that allocated it
+	Caller string
+}
+
+type heapSpan struct {
+	start, end uint64
+}
+type heapArena struct {
+	start, end uint64
+	// free spans sorted by address, never adjacent
+	free []heapSpan
+}
+// take cuts [start, end) out of free span i.
+func (a *heapArena) take(i int, start, end uint64) {
+	s := a.free[i]
+	var rest []heapSpan
+	if s.start < start {
+		rest = append(rest, heapSpan{s.start, start})
+	}
+	if end < s.end {
+		rest = append(rest, heapSpan{end, s.end})
+	}
+	a.free = append(a.free[:i], append(rest, a.free[i+1:]...)...)
+}
+// give puts [start, end) back and joins it with its neighbours.
+func (a *heapArena) give(start, end uint64) {
+	i := sort.Search(len(a.free), func(i int) bool {
+		return a.free[i].start >= end
+	})
+	a.free = append(a.free, heapSpan{})
+	copy(a.free[i+1:], a.free[i:])
+	a.free[i] = heapSpan{start, end}
+	if i + 1 < len(a.free) && a.free[i+1].start == end {
+		a.free[i].end = a.free[i+1].end
+		a.free = append(a.free[:i+1], a.free[i+2:]...)
+	}
+	if i > 0 && a.free[i-1].end == start {
+		a.free[i-1].end = a.free[i].end
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	}
+}
+// fit finds room for size bytes at an align boundary.
+func (a *heapArena) fit(size, align uint64) (int, uint64, bool) {
+	for i, s := range a.free {
+		start := (s.start + align - 1) &^ (align - 1)
+		if start + size <= s.end {
+			return i, start, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Heap is a malloc for Go code, it hands out guest memory for JNI strings
+// and arrays or for scratch buffers of callbacks. The guest libc never sees
+// it.
+type Heap struct {
+	mu     uc.Unicorn
+	mem    *MemoryMap
+	arenas []*heapArena
+	blocks map[uint64]*HeapBlock
+	logger zl.Logger
+}
+func NewHeap(mu uc.Unicorn, mem *MemoryMap, logger zl.Logger) *Heap {
+	return &Heap{
+		mu: mu,
+		mem: mem,
+		blocks: map[uint64]*HeapBlock{},
+		logger: logger,
+	}
+}
+func heapCaller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return "?"
+	}
+	return fmt.Sprintf("%s:%d", fp.Base(file), line)
+}
+func (h *Heap) grow(size uint64) (*heapArena, error) {
+	sz := HEAP_ARENA_SIZE
+	if size > sz {
+		sz = PageEnd(size)
+	}
+	addr, err := h.mem.Map(0, sz, uc.PROT_READ | uc.PROT_WRITE, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	h.mem.SetName(addr, sz, HEAP_VMA_NAME)
+	a := &heapArena{
+		start: addr,
+		end: addr + sz,
+		free: []heapSpan{{addr, addr + sz}},
+	}
+	h.arenas = append(h.arenas, a)
+	return a, nil
+}
+func (h *Heap) alloc(size, align uint64, caller string) (uint64, error) {
+	if size == 0 {
+		size = 1
+	}
+	if align < HEAP_ALIGN {
+		align = HEAP_ALIGN
+	}
+	size = (size + HEAP_ALIGN - 1) &^ (HEAP_ALIGN - 1)
+	for _, a := range h.arenas {
+		if i, start, ok := a.fit(size, align); ok {
+			a.take(i, start, start + size)
+			h.blocks[start] = &HeapBlock{Addr: start, Size: size, Caller: caller}
+			return start, nil
+		}
+	}
+	a, err := h.grow(size + align)
+	if err != nil {
+		return 0, fmt.Errorf("heap: %w", err)
+	}
+	i, start, _ := a.fit(size, align)
+	a.take(i, start, start + size)
+	h.blocks[start] = &HeapBlock{Addr: start, Size: size, Caller: caller}
+	return start, nil
+}
+func (h *Heap) arenaOf(addr uint64) *heapArena {
+	for _, a := range h.arenas {
+		if addr >= a.start && addr < a.end {
+			return a
+		}
+	}
+	return nil
+}
+// Malloc returns size bytes of guest memory, the content is undefined.
+func (h *Heap) Malloc(size uint64) (uint64, error) {
+	return h.alloc(size, HEAP_ALIGN, heapCaller(2))
+}
+// Calloc returns n*size zeroed bytes.
+func (h *Heap) Calloc(n, size uint64) (uint64, error) {
+	total := n * size
+	if size != 0 && total / size != n {
+		return 0, fmt.Errorf("heap: calloc %d*%d overflows", n, size)
+	}
+	addr, err := h.alloc(total, HEAP_ALIGN, heapCaller(2))
+	if err != nil {
+		return 0, err
+	}
+	return addr, h.mu.MemWrite(addr, make([]byte, h.blocks[addr].Size))
+}
+// Memalign returns size bytes at a multiple of align, a power of two.
+func (h *Heap) Memalign(align, size uint64) (uint64, error) {
+	if align == 0 || align & (align - 1) != 0 {
+		return 0, fmt.Errorf("heap: alignment %d is not a power of two", align)
+	}
+	return h.alloc(size, align, heapCaller(2))
+}
+// Realloc resizes the block at addr, moving it when it has to. addr 0
+// allocates, size 0 frees.
+func (h *Heap) Realloc(addr, size uint64) (uint64, error) {
+	if addr == 0 {
+		return h.alloc(size, HEAP_ALIGN, heapCaller(2))
+	}
+	b, exist := h.blocks[addr]
+	if !exist {
+		return 0, fmt.Errorf("heap: realloc of unknown block 0x%08x", addr)
+	}
+	if size == 0 {
+		return 0, h.Free(addr)
+	}
+	need := (size + HEAP_ALIGN - 1) &^ (HEAP_ALIGN - 1)
+	if need <= b.Size {
+		if need < b.Size {
+			h.arenaOf(addr).give(addr + need, addr + b.Size)
+			b.Size = need
+		}
+		return addr, nil
+	}
+	naddr, err := h.alloc(size, HEAP_ALIGN, b.Caller)
+	if err != nil {
+		return 0, err
+	}
+	data, err := h.mu.MemRead(addr, b.Size)
+	if err == nil {
+		err = h.mu.MemWrite(naddr, data)
+	}
+	if err != nil {
+		h.Free(naddr)
+		return 0, err
+	}
+	return naddr, h.Free(addr)
+}
+// Free gives the block at addr back, freeing 0 does nothing.
+func (h *Heap) Free(addr uint64) error {
+	if addr == 0 {
+		return nil
+	}
+	b, exist := h.blocks[addr]
+	if !exist {
+		return fmt.Errorf("heap: free of unknown block 0x%08x", addr)
+	}
+	delete(h.blocks, addr)
+	h.arenaOf(addr).give(addr, addr + b.Size)
+	return nil
+}
+// AllocBytes copies b into a new block.
+func (h *Heap) AllocBytes(b []byte) (uint64, error) {
+	addr, err := h.alloc(uint64(len(b)), HEAP_ALIGN, heapCaller(2))
+	if err != nil {
+		return 0, err
+	}
+	return addr, h.mu.MemWrite(addr, b)
+}
+// Strdup copies s as a NUL terminated string.
+func (h *Heap) Strdup(s string) (uint64, error) {
+	addr, err := h.alloc(uint64(len(s)) + 1, HEAP_ALIGN, heapCaller(2))
+	if err != nil {
+		return 0, err
+	}
+	return addr, h.mu.MemWrite(addr, append([]byte(s), 0))
+}
+// Leaks lists the blocks still allocated, by address.
+func (h *Heap) Leaks() []*HeapBlock {
+	res := make([]*HeapBlock, 0, len(h.blocks))
+	for _, b := range h.blocks {
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Addr < res[j].Addr
+	})
+	return res
+}
+// ReportLeaks logs every block still allocated and returns how many
+// there were.
+func (h *Heap) ReportLeaks() int {
+	leaks := h.Leaks()
+	var total uint64
+	for _, b := range leaks {
+		total += b.Size
+		h.logger.Warn().
+			Str("addr", ConvHex("0x%08X", b.Addr)).
+			Uint64("size", b.Size).
+			Str("caller", b.Caller).
+			Msg("heap block leaked")
+	}
+	if len(leaks) > 0 {
+		h.logger.Warn().Int("blocks", len(leaks)).Uint64("bytes", total).Msg("heap leaks at shutdown")
+	}
+	return len(leaks)
+}
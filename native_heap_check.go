@@ -0,0 +1,327 @@
+package emulator
+
+import (
+	"fmt"
+	"sort"
+	"bytes"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// freed blocks stay inaccessible until this many more are freed
+	HEAP_CHECK_QUARANTINE = 256
+	// fills the slack around every block, checked when it is freed
+	HEAP_CHECK_REDZONE byte = 0xab
+
+	HEAP_OVERFLOW     = "heap-buffer-overflow"
+	HEAP_UNDERFLOW    = "heap-buffer-underflow"
+	HEAP_USE_AFTER_FREE = "heap-use-after-free"
+	HEAP_DOUBLE_FREE  = "double-free"
+	HEAP_INVALID_FREE = "invalid-free"
+)
+
+// HeapSite is the guest code that called into the allocator.
+type HeapSite struct {
+	PC       uint64
+	Location string
+}
+func (s HeapSite) String() string {
+	return fmt.Sprintf("0x%08x (%s)", s.PC, s.Location)
+}
+
+// GuardedBlock is an allocation of the checked heap. It has a mapping of
+// its own, [guard][data][guard], the block ends right at the upper guard.
+type GuardedBlock struct {
+	Addr  uint64
+	Size  uint64
+	Alloc HeapSite
+	Free  HeapSite
+	Freed bool
+	// whole mapping, guards included
+	start, end uint64
+}
+func (b *GuardedBlock) dataStart() uint64 {
+	return b.start + PAGE_SIZE
+}
+func (b *GuardedBlock) dataEnd() uint64 {
+	return b.end - PAGE_SIZE
+}
+
+// HeapReport is one error the checker found.
+type HeapReport struct {
+	Kind   string
+	Addr   uint64
+	// the faulting access or the bad free
+	Site   HeapSite
+	Access string
+	Block  *GuardedBlock
+}
+func (r *HeapReport) String() string {
+	s := fmt.Sprintf("%s on 0x%08x at %s", r.Kind, r.Addr, r.Site)
+	if r.Access != "" {
+		s += ", " + r.Access
+	}
+	if b := r.Block; b != nil {
+		s += fmt.Sprintf(", %d bytes block 0x%08x allocated at %s", b.Size, b.Addr, b.Alloc)
+		if b.Freed {
+			s += fmt.Sprintf(", freed at %s", b.Free)
+		}
+	}
+	return s
+}
+
+// HeapChecker replaces the libc allocator with one that puts guard pages
+// around every block and keeps freed blocks unreadable for a while, the
+// faults it causes become HeapReport. Enable it with Config.HeapCheck.
+type HeapChecker struct {
+	emu        *Emulator
+	mem        *MemoryMap
+	blocks     map[uint64]*GuardedBlock
+	quarantine []*GuardedBlock
+	Reports    []*HeapReport
+	logger     zl.Logger
+}
+func NewHeapChecker(emu *Emulator, mem *MemoryMap, logger zl.Logger) *HeapChecker {
+	hc := &HeapChecker{
+		emu: emu,
+		mem: mem,
+		blocks: map[uint64]*GuardedBlock{},
+		logger: logger,
+	}
+	_, err := emu.Mu.HookAdd(uc.HOOK_MEM_READ_PROT | uc.HOOK_MEM_WRITE_PROT, hc.hookProt, 1, 0)
+	if err != nil {
+		logger.Debug().Err(err).Msg("failed to add heap check hook")
+	}
+	return hc
+}
+
+func (hc *HeapChecker) site(pc uint64) HeapSite {
+	return HeapSite{PC: pc, Location: hc.emu.Symbolize(pc &^ 1)}
+}
+func (hc *HeapChecker) report(r *HeapReport) {
+	hc.Reports = append(hc.Reports, r)
+	ev := hc.logger.Error().
+		Str("kind", r.Kind).
+		Str("addr", ConvHex("0x%08X", r.Addr)).
+		Str("at", r.Site.String())
+	if r.Access != "" {
+		ev = ev.Str("access", r.Access)
+	}
+	if b := r.Block; b != nil {
+		ev = ev.Str("block", ConvHex("0x%08X", b.Addr)).
+			Uint64("size", b.Size).
+			Str("allocated", b.Alloc.String())
+		if b.Freed {
+			ev = ev.Str("freed", b.Free.String())
+		}
+	}
+	ev.Msg("heap check")
+}
+// lookup finds the live or quarantined block whose mapping holds addr.
+func (hc *HeapChecker) lookup(addr uint64) *GuardedBlock {
+	for _, b := range hc.blocks {
+		if addr >= b.start && addr < b.end {
+			return b
+		}
+	}
+	for _, b := range hc.quarantine {
+		if addr >= b.start && addr < b.end {
+			return b
+		}
+	}
+	return nil
+}
+
+// Alloc maps a guarded block of size bytes at a multiple of align.
+func (hc *HeapChecker) Alloc(size, align uint64, caller uint64) (uint64, error) {
+	if align < HEAP_ALIGN {
+		align = HEAP_ALIGN
+	}
+	room := (size + HEAP_ALIGN - 1) &^ (HEAP_ALIGN - 1)
+	if room == 0 {
+		room = HEAP_ALIGN
+	}
+	data := PageEnd(room + align - HEAP_ALIGN)
+	start, err := hc.mem.Map(0, data + 2 * PAGE_SIZE, uc.PROT_READ | uc.PROT_WRITE, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	b := &GuardedBlock{
+		Size: size,
+		Alloc: hc.site(caller),
+		start: start,
+		end: start + data + 2 * PAGE_SIZE,
+	}
+	b.Addr = (b.dataEnd() - room) &^ (align - 1)
+	hc.mem.SetName(start, b.end - start, HEAP_VMA_NAME)
+	hc.mem.Protect(b.start, PAGE_SIZE, uc.PROT_NONE)
+	hc.mem.Protect(b.dataEnd(), PAGE_SIZE, uc.PROT_NONE)
+	err = hc.fill(b.dataStart(), b.Addr)
+	if err == nil {
+		err = hc.fill(b.Addr + size, b.dataEnd())
+	}
+	if err != nil {
+		hc.mem.Unmap(b.start, b.end - b.start)
+		return 0, err
+	}
+	hc.blocks[b.Addr] = b
+	return b.Addr, nil
+}
+func (hc *HeapChecker) fill(start, end uint64) error {
+	if start >= end {
+		return nil
+	}
+	return hc.emu.Mu.MemWrite(start, bytes.Repeat([]byte{HEAP_CHECK_REDZONE}, int(end - start)))
+}
+// checkRedzone reports writes that went past the block but not as far as
+// a guard page.
+func (hc *HeapChecker) checkRedzone(b *GuardedBlock, site HeapSite) {
+	check := func(kind string, start, end uint64) {
+		if start >= end {
+			return
+		}
+		data, err := hc.emu.Mu.MemRead(start, end - start)
+		if err != nil {
+			return
+		}
+		for i, c := range data {
+			if c != HEAP_CHECK_REDZONE {
+				hc.report(&HeapReport{
+					Kind: kind,
+					Addr: start + uint64(i),
+					Site: site,
+					Access: "redzone overwritten",
+					Block: b,
+				})
+				return
+			}
+		}
+	}
+	check(HEAP_UNDERFLOW, b.dataStart(), b.Addr)
+	check(HEAP_OVERFLOW, b.Addr + b.Size, b.dataEnd())
+}
+// Free quarantines the block at addr, caller is the return address of the
+// free call.
+func (hc *HeapChecker) Free(addr uint64, caller uint64) {
+	if addr == 0 {
+		return
+	}
+	site := hc.site(caller)
+	b, exist := hc.blocks[addr]
+	if !exist {
+		r := &HeapReport{Kind: HEAP_INVALID_FREE, Addr: addr, Site: site}
+		if r.Block = hc.lookup(addr); r.Block != nil && r.Block.Freed && r.Block.Addr == addr {
+			r.Kind = HEAP_DOUBLE_FREE
+		}
+		hc.report(r)
+		return
+	}
+	hc.checkRedzone(b, site)
+	delete(hc.blocks, addr)
+	b.Freed = true
+	b.Free = site
+	hc.mem.Protect(b.dataStart(), b.dataEnd() - b.dataStart(), uc.PROT_NONE)
+	hc.quarantine = append(hc.quarantine, b)
+	for len(hc.quarantine) > HEAP_CHECK_QUARANTINE {
+		old := hc.quarantine[0]
+		hc.quarantine = hc.quarantine[1:]
+		hc.mem.Unmap(old.start, old.end - old.start)
+	}
+}
+// Realloc moves the block to a new guarded one, so stale pointers to the
+// old copy fault.
+func (hc *HeapChecker) Realloc(addr, size uint64, caller uint64) (uint64, error) {
+	if addr == 0 {
+		return hc.Alloc(size, HEAP_ALIGN, caller)
+	}
+	b, exist := hc.blocks[addr]
+	if !exist {
+		hc.Free(addr, caller)
+		return 0, nil
+	}
+	if size == 0 {
+		hc.Free(addr, caller)
+		return 0, nil
+	}
+	naddr, err := hc.Alloc(size, HEAP_ALIGN, caller)
+	if err != nil {
+		return 0, err
+	}
+	n := b.Size
+	if size < n {
+		n = size
+	}
+	data, err := hc.emu.Mu.MemRead(addr, n)
+	if err == nil {
+		err = hc.emu.Mu.MemWrite(naddr, data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	hc.Free(addr, caller)
+	return naddr, nil
+}
+// UsableSize is what malloc_usable_size says, the requested size.
+func (hc *HeapChecker) UsableSize(addr uint64) uint64 {
+	if b, exist := hc.blocks[addr]; exist {
+		return b.Size
+	}
+	return 0
+}
+// Live lists the blocks not freed yet, by address.
+func (hc *HeapChecker) Live() []*GuardedBlock {
+	res := make([]*GuardedBlock, 0, len(hc.blocks))
+	for _, b := range hc.blocks {
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Addr < res[j].Addr
+	})
+	return res
+}
+
+// hookProt tells guard page and quarantine hits apart, the fault itself is
+// still raised by FaultHandler.
+func (hc *HeapChecker) hookProt(mu uc.Unicorn, access int, addr uint64, size int, value int64) bool {
+	b := hc.lookup(addr)
+	if b == nil {
+		return false
+	}
+	pc, _ := mu.RegRead(hc.emu.Arch.PC)
+	r := &HeapReport{
+		Addr: addr,
+		Site: hc.site(pc),
+		Access: fmt.Sprintf("read of %d bytes", size),
+		Block: b,
+	}
+	if access == uc.MEM_WRITE_PROT {
+		r.Access = fmt.Sprintf("write of %d bytes", size)
+	}
+	switch {
+	case b.Freed:
+		r.Kind = HEAP_USE_AFTER_FREE
+	case addr < b.dataStart():
+		r.Kind = HEAP_UNDERFLOW
+	default:
+		r.Kind = HEAP_OVERFLOW
+	}
+	hc.report(r)
+	return false
+}
+// ReportLeaks logs the blocks still allocated with their call sites and
+// returns how many there were.
+func (hc *HeapChecker) ReportLeaks() int {
+	live := hc.Live()
+	for _, b := range live {
+		hc.logger.Warn().
+			Str("addr", ConvHex("0x%08X", b.Addr)).
+			Uint64("size", b.Size).
+			Str("allocated", b.Alloc.String()).
+			Msg("guest heap block leaked")
+	}
+	if len(hc.Reports) > 0 {
+		hc.logger.Error().Int("reports", len(hc.Reports)).Msg("heap check found errors")
+	}
+	return len(live)
+}
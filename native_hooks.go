@@ -2,6 +2,7 @@ package emulator
 
 import (
 	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
 type NativeHooks struct {
@@ -17,5 +18,175 @@ func NewNativeHooks(emu *Emulator,nm *NativeMemory,ms *Modules,hk *Hooker,vfs *V
 		emu: emu,nm: nm,ms: ms,hk: hk,vfs: vfs,
 		logger: logger,
 	}
+	nh.hookLiblog()
+	nh.hookMalloc()
 	return nh
-}
\ No newline at end of file
+}
+// register makes imports of name resolve to f.
+func (nh *NativeHooks) register(name string, f HookerCallback) {
+	addr, err := nh.hk.writeFunction(f)
+	if err != nil {
+		nh.logger.Debug().Err(err).Str("name", name).Msg("failed to write native hook")
+		return
+	}
+	nh.ms.AddSymbolHook(name, nh.emu.Arch.CodeAddr(addr))
+}
+func (nh *NativeHooks) readString(mu uc.Unicorn, addr uint64) string {
+	if addr == 0 {
+		return ""
+	}
+	// liblog truncates longer ones as well
+	b, err := ReadCString(mu, addr, LOGGER_ENTRY_MAX_PAYLOAD)
+	if err != nil && err != ErrStringTooLong {
+		return ""
+	}
+	return string(b)
+}
+// varargs are the arguments from index first on, the stub pushed two
+// registers before the callback runs on arm.
+func (nh *NativeHooks) varargs(mu uc.Unicorn, first int) *CArgs {
+	sp, _ := mu.RegRead(nh.emu.Arch.SP)
+	return NewCArgs(mu, first, sp + nh.emu.Arch.StackOffset)
+}
+
+// hookLiblog sends the liblog entry points to Logd, so apps log even when
+// liblog.so is not in the vfs.
+func (nh *NativeHooks) hookLiblog() {
+	logd := nh.emu.Logd
+	if logd == nil {
+		return
+	}
+	write := func(ctx NativeMethodContext, id, prio int, tag, msg string) error {
+		logd.Write(id, prio, tag, msg)
+		return ctx.Return(uint64(len(msg)))
+	}
+	/* int __android_log_write(int prio, const char* tag, const char* text); */
+	nh.register("__android_log_write", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(3)
+		return write(ctx, LOG_ID_MAIN, int(args[0]), nh.readString(ctx.mu, args[1]), nh.readString(ctx.mu, args[2]))
+	})
+	/* int __android_log_buf_write(int bufID, int prio, const char* tag, const char* text); */
+	nh.register("__android_log_buf_write", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(4)
+		return write(ctx, int(args[0]), int(args[1]), nh.readString(ctx.mu, args[2]), nh.readString(ctx.mu, args[3]))
+	})
+	/* int __android_log_print(int prio, const char* tag, const char* fmt, ...); */
+	nh.register("__android_log_print", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(3)
+		msg := CFormat(nh.readString(ctx.mu, args[2]), nh.varargs(ctx.mu, 3))
+		return write(ctx, LOG_ID_MAIN, int(args[0]), nh.readString(ctx.mu, args[1]), msg)
+	})
+	/* int __android_log_buf_print(int bufID, int prio, const char* tag, const char* fmt, ...); */
+	nh.register("__android_log_buf_print", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(4)
+		msg := CFormat(nh.readString(ctx.mu, args[3]), nh.varargs(ctx.mu, 4))
+		return write(ctx, int(args[0]), int(args[1]), nh.readString(ctx.mu, args[2]), msg)
+	})
+	/* int __android_log_vprint(int prio, const char* tag, const char* fmt, va_list ap); */
+	nh.register("__android_log_vprint", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(4)
+		msg := CFormat(nh.readString(ctx.mu, args[2]), NewCArgsVaList(ctx.mu, args[3]))
+		return write(ctx, LOG_ID_MAIN, int(args[0]), nh.readString(ctx.mu, args[1]), msg)
+	})
+	/* void __android_log_assert(const char* cond, const char* tag, const char* fmt, ...); */
+	nh.register("__android_log_assert", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(3)
+		var msg string
+		if args[2] != 0 {
+			msg = CFormat(nh.readString(ctx.mu, args[2]), nh.varargs(ctx.mu, 3))
+		}else if args[0] != 0 {
+			msg = "Assertion failed: " + nh.readString(ctx.mu, args[0])
+		}else{
+			msg = "Unspecified assertion failed"
+		}
+		logd.Write(LOG_ID_MAIN, ANDROID_LOG_FATAL, nh.readString(ctx.mu, args[1]), msg)
+		// it never returns, the guest would abort here
+		return ErrAndroidLogAssert
+	})
+}
+
+// hookMalloc routes the libc allocator to HeapChecker when it is enabled.
+func (nh *NativeHooks) hookMalloc() {
+	hc := nh.emu.HeapChecker
+	if hc == nil {
+		return
+	}
+	caller := func(ctx NativeMethodContext) uint64 {
+		lr, _ := ctx.mu.RegRead(nh.emu.Arch.LR)
+		return lr
+	}
+	alloc := func(ctx NativeMethodContext, size, align uint64) error {
+		addr, err := hc.Alloc(size, align, caller(ctx))
+		if err != nil {
+			nh.logger.Debug().Err(err).Uint64("size", size).Msg("heap check allocation failed")
+			addr = 0
+		}
+		return ctx.Return(addr)
+	}
+	/* void* malloc(size_t size); */
+	nh.register("malloc", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(1)
+		return alloc(ctx, args[0], HEAP_ALIGN)
+	})
+	/* void* calloc(size_t n, size_t size); */
+	nh.register("calloc", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(2)
+		n, size := args[0], args[1]
+		if !nh.emu.Arch.Is64 {
+			n, size = n & 0xffffffff, size & 0xffffffff
+			if size != 0 && n * size > 0xffffffff {
+				return ctx.Return(0)
+			}
+		}else if size != 0 && n * size / size != n {
+			return ctx.Return(0)
+		}
+		// fresh mappings are zeroed already
+		return alloc(ctx, n * size, HEAP_ALIGN)
+	})
+	/* void* memalign(size_t alignment, size_t size); */
+	nh.register("memalign", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(2)
+		align := args[0]
+		if align & (align - 1) != 0 {
+			return ctx.Return(0)
+		}
+		return alloc(ctx, args[1], align)
+	})
+	/* int posix_memalign(void** memptr, size_t alignment, size_t size); */
+	nh.register("posix_memalign", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(3)
+		align := args[1]
+		if align < nh.emu.Arch.PtrSize || align & (align - 1) != 0 {
+			return ctx.Return(uint64(EINVAL))
+		}
+		addr, err := hc.Alloc(args[2], align, caller(ctx))
+		if err != nil {
+			return ctx.Return(uint64(ENOMEM))
+		}
+		if err = ctx.mu.MemWrite(args[0], nh.emu.Arch.PutPtr(addr)); err != nil {
+			return err
+		}
+		return ctx.Return(0)
+	})
+	/* void* realloc(void* p, size_t size); */
+	nh.register("realloc", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(2)
+		addr, err := hc.Realloc(args[0], args[1], caller(ctx))
+		if err != nil {
+			nh.logger.Debug().Err(err).Uint64("size", args[1]).Msg("heap check reallocation failed")
+			addr = 0
+		}
+		return ctx.Return(addr)
+	})
+	/* void free(void* p); */
+	nh.register("free", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(1)
+		hc.Free(args[0], caller(ctx))
+		return nil
+	})
+	/* size_t malloc_usable_size(const void* p); */
+	nh.register("malloc_usable_size", func(ctx NativeMethodContext) error {
+		args := ctx.GetArgs(1)
+		return ctx.Return(hc.UsableSize(args[0]))
+	})
+}
@@ -6,78 +6,259 @@ import (
 	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
+var (
+	MAP_SHARED          uint64 = 0x01
+	MAP_PRIVATE         uint64 = 0x02
+	MAP_SHARED_VALIDATE uint64 = 0x03
+	MAP_TYPE            uint64 = 0x0f
+	MAP_FIXED           uint64 = 0x10
+	MAP_ANONYMOUS       uint64 = 0x20
+
+	// mmap2 takes its offset in these units
+	MMAP2_UNIT uint64 = 4096
+
+	MS_ASYNC      uint64 = 1
+	MS_INVALIDATE uint64 = 2
+	MS_SYNC       uint64 = 4
+
+	// room kept free after the program break
+	BRK_MAX_SIZE uint64 = 0x04000000
+
+	PR_SET_VMA           uint64 = 0x53564d41
+	PR_SET_VMA_ANON_NAME uint64 = 0
+	// longest name PR_SET_VMA_ANON_NAME takes
+	ANON_VMA_NAME_MAX_LEN uint64 = 80
+)
+
 
 type NativeMemory struct {
 	mu      uc.Unicorn
 	mem     *MemoryMap
 	sh      *SyscallHandlers
 	vfs     *VirtualFileSystem
+	ms      *Modules
+	// program break, placed on the first brk call
+	brkBase uint64
+	brkCur  uint64
 	logger  zl.Logger
 }
-func NewNativeMemory(mu uc.Unicorn, mem *MemoryMap, sh *SyscallHandlers, vfs *VirtualFileSystem, logger zl.Logger) *NativeMemory {
+func NewNativeMemory(mu uc.Unicorn, mem *MemoryMap, sh *SyscallHandlers, vfs *VirtualFileSystem, ms *Modules, logger zl.Logger) *NativeMemory {
 	nm := &NativeMemory{
 		mu: mu,
 		mem:mem,sh: sh,
 		vfs: vfs,
+		ms: ms,
 		logger: logger,
 	}
-	nm.sh.SetHandler(0x2D, "brk", 1, nm.handeBrk)
+	nm.sh.SetHandler(0x2D, "brk", 1, nm.handleBrk)
 	nm.sh.SetHandler(0x5B, "munmap", 2, nm.handleMunmap)
 	nm.sh.SetHandler(0x7D, "mprotect", 3, nm.handleMprotect)
+	nm.sh.SetHandler(0x90, "msync", 3, nm.handleMsync)
+	nm.sh.SetHandler(0xAC, "prctl", 5, nm.handlePrctl)
 	nm.sh.SetHandler(0xC0, "mmap2", 6, nm.handleMmap2)
 	nm.sh.SetHandler(0xDC, "madvise", 3, nm.handleMadvise)
 	return nm
 }
-func (nm *NativeMemory) handeBrk(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	//TODO: set errno
-	//TODO: implement
-	jx := int64(-1)
-	return uint64(jx), true
+// Brk returns the program break range, both 0 before the first brk.
+func (nm *NativeMemory) Brk() (uint64, uint64) {
+	return nm.brkBase, nm.brkCur
+}
+// initBrk puts the break after the highest loaded module. Modules are
+// packed upwards, those loaded later go above the room the heap may take.
+func (nm *NativeMemory) initBrk() {
+	var top uint64
+	for _, md := range nm.ms.GetModules() {
+		if end := md.address + md.size; end > top {
+			top = end
+		}
+	}
+	if top < nm.ms.counterMemory {
+		top = nm.ms.counterMemory
+	}
+	nm.brkBase = PageEnd(top)
+	nm.brkCur = nm.brkBase
+	nm.ms.counterMemory = nm.brkBase + BRK_MAX_SIZE
+	nm.logger.Debug().Str("base", ConvHex("0x%08X", nm.brkBase)).Msg("program break placed")
+}
+/* syscall brk
+unsigned long brk(unsigned long brk);
+the kernel call returns the new break, or the old one when it failed
+*/
+func (nm *NativeMemory) handleBrk(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	addr := args[0]
+	if nm.brkBase == 0 {
+		nm.initBrk()
+	}
+	if addr < nm.brkBase || addr > nm.brkBase + BRK_MAX_SIZE {
+		return nm.brkCur, true
+	}
+	oldEnd, newEnd := PageEnd(nm.brkCur), PageEnd(addr)
+	if newEnd > oldEnd {
+		_, err := nm.mem.Map(oldEnd, newEnd - oldEnd, uc.PROT_READ | uc.PROT_WRITE, nil, 0)
+		if err != nil {
+			nm.logger.Debug().Err(err).Msg("brk failed to grow")
+			return nm.brkCur, true
+		}
+		nm.mem.SetName(oldEnd, newEnd - oldEnd, "[heap]")
+	}else if newEnd < oldEnd {
+		err := nm.mem.Unmap(newEnd, oldEnd - newEnd)
+		if err != nil {
+			nm.logger.Debug().Err(err).Msg("brk failed to shrink")
+			return nm.brkCur, true
+		}
+	}
+	nm.brkCur = addr
+	return nm.brkCur, true
 }
+/* syscall munmap
+int munmap(void *addr, size_t length);
+*/
 func (nm *NativeMemory) handleMunmap(mu uc.Unicorn, args ...uint64) (uint64, bool){
 	addr, len_in := args[0], args[1]
+	if !nm.mem.IsMultiple(addr) || len_in == 0 {
+		return errnoRet(EINVAL), true
+	}
 	err := nm.mem.Unmap(addr, len_in)
 	if err != nil {
-		ret := int64(-1)
-		return uint64(ret), true
+		nm.logger.Debug().Err(err).Msg("munmap failed")
+		return errnoRet(EINVAL), true
 	}
 	return 0, true
 }
+/* syscall mprotect
+int mprotect(void *addr, size_t len, int prot);
+*/
 func (nm *NativeMemory) handleMprotect(mu uc.Unicorn, args ...uint64) (uint64, bool) {
 	addr, len_in, prot := args[0], args[1], args[2]
+	if !nm.mem.IsMultiple(addr) || prot &^ uint64(uc.PROT_ALL) != 0 {
+		return errnoRet(EINVAL), true
+	}
 	err := nm.mem.Protect(addr, len_in, int(prot))
 	if err != nil {
-		ret := int64(-1)
-		return uint64(ret), true
+		return errnoRet(ENOMEM), true
+	}
+	return 0, true
+}
+/* syscall prctl
+int prctl(int option, unsigned long arg2, unsigned long arg3, unsigned long arg4, unsigned long arg5);
+only PR_SET_VMA does something, it names anonymous mappings
+*/
+func (nm *NativeMemory) handlePrctl(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	option := args[0]
+	if option != PR_SET_VMA {
+		return 0, true
+	}
+	if args[1] != PR_SET_VMA_ANON_NAME || !nm.mem.IsMultiple(args[2]) {
+		return errnoRet(EINVAL), true
+	}
+	addr, size := args[2], args[3]
+	name := ""
+	if args[4] != 0 {
+		b, err := ReadCString(mu, args[4], ANON_VMA_NAME_MAX_LEN - 1)
+		if err == ErrStringTooLong {
+			return errnoRet(EINVAL), true
+		}
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		name = "[anon:" + string(b) + "]"
+	}
+	for _, v := range nm.mem.Vmas() {
+		if v.Start < addr + size && v.End > addr && v.File != nil {
+			return errnoRet(EBADF), true
+		}
 	}
+	nm.mem.SetName(addr, size, name)
 	return 0, true
 }
+/* syscall mmap2
+void *mmap2(void *addr, size_t length, int prot, int flags, int fd, off_t pgoffset);
+*/
 func (nm *NativeMemory) handleMmap2(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	addr, length, prot, flags, fd, offset := args[0], args[1], args[2], args[3], args[4], args[5]
-	_ = flags
+	addr, length, prot, flags, fd, pgoff := args[0], args[1], args[2], args[3], args[4], args[5]
+	typ := flags & MAP_TYPE
+	if length == 0 || (typ != MAP_SHARED && typ != MAP_PRIVATE && typ != MAP_SHARED_VALIDATE) {
+		return errnoRet(EINVAL), true
+	}
+	size := PageEnd(length)
+	if size < length {
+		return errnoRet(ENOMEM), true
+	}
+	shared := typ != MAP_PRIVATE
+	offset := pgoff * MMAP2_UNIT
+	var vf *VirtualFile
+	if flags & MAP_ANONYMOUS == 0 {
+		vf = nm.vfs.pcb.GetFdDetail(uintptr(fd))
+		if vf == nil {
+			return errnoRet(EBADF), true
+		}
+		acc := vf.Flags & O_ACCMODE
+		if acc == O_WRONLY || (shared && prot & uc.PROT_WRITE != 0 && acc != O_RDWR) {
+			return errnoRet(EACCES), true
+		}
+		// directories, pipes and sockets have nothing to map
+		if fi, err := vf.fo.Stat(); err == nil && fi.IsDir() {
+			return errnoRet(ENODEV), true
+		}
+		if _, err := vf.fo.Seek(0, 1); err != nil {
+			return errnoRet(ENODEV), true
+		}
+	}
+	if flags & MAP_FIXED != 0 {
+		if !nm.mem.IsMultiple(addr) {
+			return errnoRet(EINVAL), true
+		}
+		// the new mapping replaces what was there
+		err := nm.mem.Unmap(addr, size)
+		if err != nil {
+			nm.logger.Debug().Err(err).Msg("mmap fixed unmap failed")
+			return errnoRet(ENOMEM), true
+		}
+	}else if addr != 0 {
+		// only a hint, taken when the range is free
+		addr = PageStart(addr)
+		if !nm.mem.IsFree(addr, size) {
+			addr = 0
+		}
+	}
 	var (
 		res uint64
 		err error
 	)
-	if fd != 0xffffffff {
-		if fd <= 2 {
-			panic("not implemented")
-		}
-		if !nm.vfs.pcb.HasFd(uintptr(fd)) {
-			panic(ErrNotImplemented)
-		}
-		vf := nm.vfs.pcb.fds[uintptr(fd)]
-		res, err = nm.mem.Map(addr, length, int(prot), vf, offset)
+	if vf == nil {
+		res, err = nm.mem.MapProt(addr, size, int(prot), MAP_PRIVATE, nil, 0)
+	}else if shared {
+		res, err = nm.mem.MapProt(addr, size, int(prot), MAP_SHARED, vf, offset)
 	}else{
-		res, err = nm.mem.Map(addr, length, int(prot), nil, 0)
+		// a private copy, guest writes never reach the file
+		res, err = nm.mem.MapProt(addr, size, int(prot), MAP_PRIVATE, vf, offset)
 	}
 	if err != nil {
 		nm.logger.Debug().Err(err).Msg("mmap got error!")
-		return 0, true
+		return errnoRet(ENOMEM), true
 	}
 	nm.logger.Debug().Msgf("mmap return 0x%08X", res)
 	return res, true
 }
+/* syscall msync
+int msync(void *addr, size_t length, int flags);
+*/
+func (nm *NativeMemory) handleMsync(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	addr, length, flags := args[0], args[1], args[2]
+	if !nm.mem.IsMultiple(addr) || flags &^ (MS_ASYNC | MS_INVALIDATE | MS_SYNC) != 0 ||
+		flags & (MS_ASYNC | MS_SYNC) == (MS_ASYNC | MS_SYNC) {
+		return errnoRet(EINVAL), true
+	}
+	if ok, _ := nm.mem.CheckAddr(addr, 0); !ok {
+		return errnoRet(ENOMEM), true
+	}
+	err := nm.mem.Sync(addr, PageEnd(length))
+	if err != nil {
+		nm.logger.Debug().Err(err).Msg("msync failed")
+		return errnoRet(EIO), true
+	}
+	return 0, true
+}
 func (nm *NativeMemory) handleMadvise(mu uc.Unicorn, args ...uint64) (uint64, bool) {
 	//We don't need your advise.
 	return 0, true
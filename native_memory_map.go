@@ -1,7 +1,6 @@
 package emulator
 
 import (
-	"os"
 	"io"
 	"fmt"
 	"sort"
@@ -9,24 +8,19 @@ import (
 	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
-type filemap struct {
-	offset uint64
-	sz     uint64
-	fs     *os.File
-}
 type MemoryMap struct {
 	mu    uc.Unicorn
 
 	allocMinAddr uint64
 	allocMaxAddr uint64
-	fileMapAddr  map[uint64]filemap
+	// every mapping, sorted by address
+	vmas         vmaList
 }
 func NewMemoryMap(mu uc.Unicorn, allocMinAddr, allocMaxAddr uint64) *MemoryMap {
 	return &MemoryMap{
 		mu: mu,
 		allocMinAddr: allocMinAddr,
 		allocMaxAddr: allocMaxAddr,
-		fileMapAddr: map[uint64]filemap{},
 	}
 }
 func (m *MemoryMap) CheckAddr(addr uint64, prot int) (bool, error) {
@@ -52,9 +46,6 @@ func (m *MemoryMap) mapInternal(address, size uint64, prot int) (uint64, error)
 		memregs []*uc.MemRegion
 		err error
 	)
-	if prot == 0 {
-		prot = uc.PROT_READ | uc.PROT_WRITE
-	}
 	if size <= 0 {
 		return 0, ErrHeapLessEqualZero
 	}
@@ -101,7 +92,7 @@ func (m *MemoryMap) mapInternal(address, size uint64, prot int) (uint64, error)
 		}
 		return map_base, nil
 	}else{
-		//MAP_FIXED
+		//MAP_FIXED, pages already mapped are kept and reprotected
 		err = m.mu.MemMapProt(address, size, prot)
 		if errno, able := err.(uc.UcError); err != nil && able && errno == uc.ERR_MAP {
 			blocks := map[uint64]bool{}
@@ -141,7 +132,30 @@ func (m *MemoryMap) mapInternal(address, size uint64, prot int) (uint64, error)
 	}
 	return 0, ErrUnknownBehavior
 }
+// Map maps a private copy of vf, anonymous memory when vf is nil. A prot
+// of 0 is read and write here, the callers that want PROT_NONE use
+// MapProt.
 func (m *MemoryMap) Map(address, size uint64, prot int, vf interface{}, offset uint64) (uint64, error) {
+	o, _ := vf.(*VirtualFile)
+	return m.mapVma(address, size, defaultProt(prot), MAP_PRIVATE, o, offset)
+}
+// MapShared maps vf like Map, guest writes reach the file on Sync and
+// Unmap.
+func (m *MemoryMap) MapShared(address, size uint64, prot int, vf *VirtualFile, offset uint64) (uint64, error) {
+	return m.mapVma(address, size, defaultProt(prot), MAP_SHARED, vf, offset)
+}
+// MapProt is Map or MapShared with prot taken as is, mmap reservations and
+// guard regions are PROT_NONE.
+func (m *MemoryMap) MapProt(address, size uint64, prot int, flags uint64, vf *VirtualFile, offset uint64) (uint64, error) {
+	return m.mapVma(address, size, prot, flags, vf, offset)
+}
+func defaultProt(prot int) int {
+	if prot == 0 {
+		return uc.PROT_READ | uc.PROT_WRITE
+	}
+	return prot
+}
+func (m *MemoryMap) mapVma(address, size uint64, prot int, flags uint64, o *VirtualFile, offset uint64) (uint64, error) {
 	if !m.IsMultiple(address) {
 		return 0, fmt.Errorf("%w: (%d mod %d = %d)", ErrMapAddrNotMultiple, address, PAGE_SIZE, address % PAGE_SIZE)
 	}
@@ -153,7 +167,13 @@ func (m *MemoryMap) Map(address, size uint64, prot int, vf interface{}, offset u
 	if err != nil {
 		return 0, fmt.Errorf("map error: %w", err)
 	}
-	if o, ok := vf.(*VirtualFile); ok {
+	vma := &Vma{
+		Start: res_addr,
+		End: res_addr + al_size,
+		Prot: prot,
+		Flags: flags,
+	}
+	if o != nil {
 		oriOff, err := o.fo.Seek(0, 1)
 		if err != nil {
 			return 0, fmt.Errorf("map error: %w", err)
@@ -173,162 +193,278 @@ func (m *MemoryMap) Map(address, size uint64, prot int, vf interface{}, offset u
 		if err != nil {
 			return 0, fmt.Errorf("map fs mem error: %w", err)
 		}
-		m.fileMapAddr[al_address] = filemap{
-			sz: al_address+al_size,
-			offset: offset,
-			fs: o.fo,
-		}
 		_, err = o.fo.Seek(oriOff, 0)//
 		if err != nil {
 			return 0, fmt.Errorf("map error: %w", err)
 		}
+		vma.File, vma.Offset, vma.Name = o, offset, o.Name
+		if vma.Shared() {
+			o.refs++
+		}
+	}else{
+		vma.Flags |= MAP_ANONYMOUS
 	}
+	// a fixed mapping may land on pages mapInternal kept
+	m.release(m.carve(vma.Start, vma.End))
+	m.vmas = m.vmas.insert(vma)
 	return res_addr, nil
 }
-func (m *MemoryMap) readFully(fd *os.File, size uint64) ([]byte, error) {
+// readFully reads up to size bytes, less only at the end of the file.
+func (m *MemoryMap) readFully(fd io.Reader, size uint64) ([]byte, error) {
 	resx := make([]byte, int(size))
-	cnt, err := fd.Read(resx)
+	cnt, err := io.ReadFull(fd, resx)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
 	if err != nil {
 		return nil, err
 	}
 	return resx[:cnt], nil
 }
+// IsFree tells whether nothing is mapped in [addr, addr+size).
+func (m *MemoryMap) IsFree(addr, size uint64) bool {
+	memregs, err := m.mu.MemRegions()
+	if err != nil {
+		return false
+	}
+	for _, r := range memregs {
+		if addr < r.End+1 && r.Begin < addr+size {
+			return false
+		}
+	}
+	return true
+}
+
+// Vmas returns a copy of the mappings in address order.
+func (m *MemoryMap) Vmas() []*Vma {
+	return m.vmas.clone()
+}
+// FindVma returns the mapping addr lies in, nil when it is unmapped.
+func (m *MemoryMap) FindVma(addr uint64) *Vma {
+	if i := m.vmas.find(addr); i >= 0 {
+		return m.vmas[i].clone()
+	}
+	return nil
+}
+// SetName labels [addr, addr+size), like prctl(PR_SET_VMA_ANON_NAME).
+func (m *MemoryMap) SetName(addr, size uint64, name string) {
+	m.update(addr, PageEnd(addr+size), func(v *Vma) {
+		v.Name = name
+	})
+}
+// carve takes [start, end) out of the vma list.
+func (m *MemoryMap) carve(start, end uint64) []*Vma {
+	var removed []*Vma
+	m.vmas, removed = m.vmas.carve(start, end)
+	return removed
+}
+// update changes the vmas in [start, end) and merges what matches again.
+func (m *MemoryMap) update(start, end uint64, f func(*Vma)) {
+	m.vmas = m.vmas.split(start).split(end)
+	for _, v := range m.vmas {
+		if v.Start >= start && v.End <= end {
+			f(v)
+		}
+	}
+	m.vmas = m.vmas.mergeAll()
+}
+// release writes removed shared mappings back and drops their file
+// references.
+func (m *MemoryMap) release(removed []*Vma) {
+	for _, v := range removed {
+		if v.File == nil || !v.Shared() {
+			continue
+		}
+		err := m.writeBack(v, v.Start, v.End)
+		if err != nil {
+			log.Debug().Err(err).Str("file", v.Name).Msg("shared mapping write back failed")
+		}
+		v.File.refs--
+		if v.File.refs <= 0 {
+			v.File.CloseResource()
+		}
+	}
+}
+// writeBack stores the part of shared mapping v that lies in [addr, end)
+// to its file, the file never grows.
+func (m *MemoryMap) writeBack(v *Vma, addr, end uint64) error {
+	if addr < v.Start {
+		addr = v.Start
+	}
+	if end > v.End {
+		end = v.End
+	}
+	if addr >= end {
+		return nil
+	}
+	fo := v.File.fo
+	off := v.Offset + addr - v.Start
+	fi, err := fo.Stat()
+	if err != nil {
+		return err
+	}
+	if fsz := uint64(fi.Size()); off >= fsz {
+		return nil
+	}else if off + end - addr > fsz {
+		end = addr + fsz - off
+	}
+	data, err := m.mu.MemRead(addr, end-addr)
+	if err != nil {
+		return err
+	}
+	oriOff, err := fo.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	_, err = fo.Seek(int64(off), 0)
+	if err == nil {
+		_, err = fo.Write(data)
+	}
+	fo.Seek(oriOff, 0)
+	return err
+}
+// Sync writes the shared file mappings in [addr, addr+size) back, as
+// msync does.
+func (m *MemoryMap) Sync(addr, size uint64) error {
+	for _, v := range m.vmas {
+		if v.File == nil || !v.Shared() || v.Start >= addr+size || v.End <= addr {
+			continue
+		}
+		err := m.writeBack(v, addr, addr+size)
+		if err != nil {
+			return fmt.Errorf("sync %s: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+// Protect changes the protection of [addr, addr+lenx), splitting the
+// mappings it cuts through.
 func (m *MemoryMap) Protect(addr, lenx uint64, prot int) error {
 	if !m.IsMultiple(addr) {
 		return fmt.Errorf("%w: (%d mod %d = %d)", ErrMapAddrNotMultiple, addr, PAGE_SIZE, addr % PAGE_SIZE)
 	}
-	len_in := PageEnd(addr-lenx) - addr
+	len_in := PageEnd(lenx)
 	err := m.mu.MemProtect(addr, len_in, prot)
 	if err != nil {
 		//TODO: just for debug
 		log.Debug().Msgf("Warnning mprotect with addr:0x%08X len:0x%08X prot:0x%08X failed!!!", addr, lenx, prot)
+		return err
 	}
-	return err
+	m.update(addr, addr+len_in, func(v *Vma) {
+		v.Prot = prot
+	})
+	return nil
 }
+// Unmap removes whatever is mapped in [addr, addr+size), parts of a
+// mapping included.
 func (m *MemoryMap) Unmap(addr, size uint64) error {
 	if !m.IsMultiple(addr) {
 		return fmt.Errorf("%w: (%d mod %d = %d)", ErrMapAddrNotMultiple, addr, PAGE_SIZE, addr % PAGE_SIZE)
 	}
 	size = PageEnd(addr+size) - addr
-	log.Debug().Msgf("unmap 0x%08X sz:0x%08X end=0x%08X", addr,size, addr+size)
-	if fx, exist := m.fileMapAddr[addr]; exist {
-		if addr+size != fx.sz {
-			return fmt.Errorf("unmap error, range 0x%08X-0x%08X does not match file map range 0x%08X-0x%08X from file %s",
-				addr, addr+size, addr, fx.sz, fx.fs.Name())
+	end := addr + size
+	log.Debug().Msgf("unmap 0x%08X sz:0x%08X end=0x%08X", addr,size, end)
+	m.release(m.carve(addr, end))
+	memregs, err := m.mu.MemRegions()
+	if err != nil {
+		return err
+	}
+	for _, r := range memregs {
+		b, e := r.Begin, r.End+1
+		if b < addr {
+			b = addr
+		}
+		if e > end {
+			e = end
+		}
+		if b >= e {
+			continue
+		}
+		err = m.mu.MemUnmap(b, e-b)
+		if err != nil {
+			return err
 		}
-		delete(m.fileMapAddr, addr)
 	}
-	return m.mu.MemUnmap(addr, size)
+	return nil
 }
-
-func (m *MemoryMap) getMapAttr(start, end uint64) (uint64, string) {
-	for addr, v := range m.fileMapAddr {
-		mstart := addr
-		mend := v.sz
-		if start >= mstart && end <= mend {
-			vf := v.fs
-			return v.offset, vf.Name()
+// DumpMaps writes the mappings in /proc/self/maps format.
+func (m *MemoryMap) DumpMaps(wrt io.Writer) error {
+	for _, v := range m.vmas {
+		_, err := io.WriteString(wrt, v.String() + "\n")
+		if err != nil {
+			return err
 		}
 	}
-	return 0, ""
+	return nil
 }
-type attrMem struct {
-	Begin, End uint64
-	Prot string
-	Offset uint64
-	Name string
+
+type regionSnapshot struct {
+	begin, end uint64
+	prot       int
+	data       []byte
 }
-func (m *MemoryMap) getAttrs(mreg *uc.MemRegion) (ret *attrMem) {
-	r := ""
-	kx := mreg.Prot
-	if kx & 0x1 == 1 {
-		r = r + "r"
-	}else{
-		r = r + "-"
+// MemorySnapshot is a copy of every mapped region, see MemoryMap.Snapshot.
+type MemorySnapshot struct {
+	regions []regionSnapshot
+	vmas    vmaList
+}
+// Snapshot copies the whole guest address space, it is as large as
+// everything currently mapped. The copy holds a reference to the files of
+// shared mappings, so unmapping them meanwhile leaves them open.
+func (m *MemoryMap) Snapshot() (*MemorySnapshot, error) {
+	memregs, err := m.mu.MemRegions()
+	if err != nil {
+		return nil, err
 	}
-	if kx & 0x2 == 1 {
-		r = r + "w"
-	}else{
-		r = r + "-"
+	snap := &MemorySnapshot{
+		vmas: m.vmas.clone(),
 	}
-	if kx & 0x3 == 1 {
-		r = r + "x"
-	}else{
-		r = r + "-"
+	for _, v := range snap.vmas {
+		if v.File != nil && v.Shared() {
+			v.File.refs++
+		}
 	}
-	r = r + "p"
-	off, name := m.getMapAttr(mreg.Begin, mreg.End+1)
-	return &attrMem{
-		Begin: mreg.Begin, End: mreg.End,
-		Prot: r,
-		Offset: off,
-		Name: name,
+	for _, r := range memregs {
+		data, err := m.mu.MemRead(r.Begin, r.End-r.Begin+1)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot 0x%08X-0x%08X: %w", r.Begin, r.End+1, err)
+		}
+		snap.regions = append(snap.regions, regionSnapshot{
+			begin: r.Begin,
+			end: r.End,
+			prot: r.Prot,
+			data: data,
+		})
 	}
+	return snap, nil
 }
-func (m *MemoryMap) DumpMaps(wrt io.Writer) error {
+// Restore puts the address space back to what Snapshot saw, mappings
+// created since are dropped. The snapshot's file references go to the
+// restored mappings, it cannot be restored twice.
+func (m *MemoryMap) Restore(snap *MemorySnapshot) error {
 	memregs, err := m.mu.MemRegions()
 	if err != nil {
 		return err
 	}
-	sort.Slice(memregs, func(i, j int) bool {
-		return memregs[i].Begin > memregs[j].Begin
-	})
-	//不有memreg
-	if len(memregs) < 1 {
-		return nil
+	m.release(m.vmas)
+	m.vmas = nil
+	for _, r := range memregs {
+		err = m.mu.MemUnmap(r.Begin, r.End-r.Begin+1)
+		if err != nil {
+			return fmt.Errorf("restore unmap 0x%08X-0x%08X: %w", r.Begin, r.End+1, err)
+		}
 	}
-	s_attr := m.getAttrs(memregs[0])
-	output := []*attrMem{}
-	start := s_attr.Begin
-	for _, mm := range memregs[1:] {
-		attr := m.getAttrs(mm)
-		if s_attr.End == attr.Begin && (
-			s_attr.Prot == attr.Prot &&
-			s_attr.Offset == attr.Offset &&
-			s_attr.Name == attr.Name) {
-		}else{
-			output = append(output, &attrMem{
-				Begin: start,
-				End: s_attr.End,
-				Prot: s_attr.Prot,
-				Offset: s_attr.Offset,
-				Name: s_attr.Name,
-			})
-			start = attr.Begin
+	for _, r := range snap.regions {
+		err = m.mu.MemMapProt(r.begin, r.end-r.begin+1, r.prot)
+		if err != nil {
+			return fmt.Errorf("restore map 0x%08X-0x%08X: %w", r.begin, r.end+1, err)
+		}
+		err = m.mu.MemWrite(r.begin, r.data)
+		if err != nil {
+			return fmt.Errorf("restore write 0x%08X-0x%08X: %w", r.begin, r.end+1, err)
 		}
-		s_attr = attr
-	}
-	output = append(output, &attrMem{
-		Begin: start,
-		End:s_attr.End,
-		Prot: s_attr.Prot,
-		Offset: s_attr.Offset,
-		Name: s_attr.Name,
-	})
-
-	for _, item := range output {
-		fmrt := fmt.Sprintf(
-			"%08x-%08x %s %08x 00:00 0 \t\t %s\n",
-			item.Begin, item.End, item.Prot,
-			item.Offset, item.Name,
-		)
-		wrt.Write([]byte(fmrt))
 	}
+	m.vmas = snap.vmas
+	snap.vmas = nil
 	return nil
 }
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
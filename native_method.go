@@ -3,63 +3,49 @@ package emulator
 import (
 	"fmt"
 	"github.com/pkg/errors"
-	bin  "encoding/binary"
 	log  "github.com/rs/zerolog/log"
 	uc   "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
+// NativeWriteArgs sets up a call: the argument registers first, the rest
+// on the stack in pointer sized slots.
 func NativeWriteArgs(emu *Emulator, args ...interface{}) error {
 	var err error
 	amount := len(args)
 	if amount == 0 {
 		return nil
 	}
-
-	if amount >= 1 {
-		err = NativeWriteArgRegister(emu, uc.ARM_REG_R0, args[0])
-		if err != nil {
-			return errors.Wrap(err, "write reg r0 failed")
-		}
-	}
-	if amount >= 2 {
-		err = NativeWriteArgRegister(emu, uc.ARM_REG_R1, args[1])
-		if err != nil {
-			return errors.Wrap(err, "write reg r1 failed")
+	arch := emu.Arch
+	for i, reg := range arch.ArgRegs {
+		if i >= amount {
+			break
 		}
-	}
-	if amount >= 3 {
-		err = NativeWriteArgRegister(emu, uc.ARM_REG_R2, args[2])
-		if err != nil {
-			return errors.Wrap(err, "write reg r2 failed")
-		}
-	}
-	if amount >= 4 {
-		err = NativeWriteArgRegister(emu, uc.ARM_REG_R3, args[3])
+		err = NativeWriteArgRegister(emu, reg, args[i])
 		if err != nil {
-			return errors.Wrap(err, "write reg r3 failed")
+			return errors.Wrapf(err, "write arg %d register failed", i)
 		}
 	}
-	if amount >= 5 {
-		spStart, err := emu.Mu.RegRead(uc.ARM_REG_SP)
+	nreg := len(arch.ArgRegs)
+	if amount > nreg {
+		spStart, err := emu.Mu.RegRead(arch.SP)
 		if err != nil {
-			log.Debug().Err(err).Msg("failed to read registry ARM_REG_SP writeArgs")
+			log.Debug().Err(err).Msg("failed to read registry SP writeArgs")
 			return err
 		}
-		spCurrent := spStart - STACK_OFFSET
-		spCurrent = spCurrent - (4 * (uint64(amount) - 4))
+		spCurrent := spStart - arch.StackOffset
+		spCurrent = spCurrent - (arch.PtrSize * (uint64(amount) - uint64(nreg)))
+		spCurrent = spCurrent &^ (arch.StackAlign - 1)
 		spEnd := spCurrent
-		for _, arg := range args[4:] {
+		for _, arg := range args[nreg:] {
 			ptr := NativeTranslateArg(emu, arg)
-			byt := make([]byte, 4)
-			bin.LittleEndian.PutUint32(byt, uint32(ptr))
-			err = emu.Mu.MemWrite(spCurrent, byt)
+			err = emu.Mu.MemWrite(spCurrent, arch.PutPtr(ptr))
 			if err != nil {
 				log.Debug().Err(err).Msg("failed to write sp reg args val")
 				return errors.Wrap(err, "failed to write sp reg arg val")
 			}
-			spCurrent = spCurrent + 4
+			spCurrent = spCurrent + arch.PtrSize
 		}
-		err = emu.Mu.RegWrite(uc.ARM_REG_SP, spEnd)
+		err = emu.Mu.RegWrite(arch.SP, spEnd)
 		if err != nil {
 			log.Debug().Err(err).Msg("failed to write sp reg end address")
 			return errors.Wrap(err, "failed to write sp reg end address")
@@ -68,53 +54,38 @@ func NativeWriteArgs(emu *Emulator, args ...interface{}) error {
 	return nil
 }
 
+// NativeReadArgs reads the arguments of the call a hook stub is handling.
 func NativeReadArgs(mu uc.Unicorn, argsCount int) []uint64 {
+	arch := archOf(mu)
 	// init with 0
 	nativeArgs := make([]uint64, argsCount)
-	if argsCount >= 1 {
-		pt, err := mu.RegRead(uc.ARM_REG_R0)
-		if err != nil {
-			log.Debug().Err(err).Msg("failed to read reg r0")
+	for i, reg := range arch.ArgRegs {
+		if i >= argsCount {
+			break
 		}
-		nativeArgs[0] = pt
-	}
-	if argsCount >= 2 {
-		pt, err := mu.RegRead(uc.ARM_REG_R1)
-		if err != nil {
-			log.Debug().Err(err).Msg("failed to read reg r1")
-		}
-		nativeArgs[1] = pt
-	}
-	if argsCount >= 3 {
-		pt, err := mu.RegRead(uc.ARM_REG_R2)
+		pt, err := mu.RegRead(reg)
 		if err != nil {
-			log.Debug().Err(err).Msg("failed to read reg r2")
+			log.Debug().Err(err).Int("arg", i).Msg("failed to read arg register")
 		}
-		nativeArgs[2] = pt
+		nativeArgs[i] = pt
 	}
-	if argsCount >= 4 {
-		pt, err := mu.RegRead(uc.ARM_REG_R3)
-		if err != nil {
-			log.Debug().Err(err).Msg("failed to read reg r2")
-		}
-		nativeArgs[3] = pt
-	}
-	sp, err := mu.RegRead(uc.ARM_REG_SP)
+	nreg := len(arch.ArgRegs)
+	sp, err := mu.RegRead(arch.SP)
 	if err != nil {
 		log.Debug().Err(err).Msg("failed to read reg SP for reading args")
 		return nativeArgs
 	}
-	sp = sp + STACK_OFFSET
-	if argsCount >= 5 {
+	sp = sp + arch.StackOffset
+	if argsCount > nreg {
 		var i uint64
-		for i = 0; i < uint64(argsCount - 4); i++ {
-			by, err := mu.MemRead(sp + (i * 4), 4)
+		for i = 0; i < uint64(argsCount - nreg); i++ {
+			addr := sp + (i * arch.PtrSize)
+			by, err := mu.MemRead(addr, arch.PtrSize)
 			if err != nil {
-				log.Debug().Uint64("addrSp", sp+(i*4)).Err(err).Msg("failed to read memory for reading arg")
+				log.Debug().Uint64("addrSp", addr).Err(err).Msg("failed to read memory for reading arg")
 				continue
 			}
-			ptr := uint64(bin.LittleEndian.Uint32(by))
-			nativeArgs[4+int(i)] = ptr
+			nativeArgs[nreg+int(i)] = LE_BytesToUint(by)
 		}
 	}
 	return nativeArgs
@@ -160,14 +131,19 @@ func (nmc NativeMethodContext) GetArgs(count int) []uint64 {
 	return NativeReadArgs(nmc.mu, count)
 }
 func (nmc NativeMethodContext) Return(res uint64) error {
-	return NativeWriteArgRegister(nmc.emu, uc.ARM_REG_R0, res)
+	return NativeWriteArgRegister(nmc.emu, nmc.emu.Arch.ArgRegs[0], res)
 }
+// Return2 returns a 64 bit value, split over R0 and R1 on arm.
 func (nmc NativeMethodContext) Return2(low, high uint64) error {
-	err := NativeWriteArgRegister(nmc.emu, uc.ARM_REG_R0, low)
+	arch := nmc.emu.Arch
+	if arch.Is64 {
+		return NativeWriteArgRegister(nmc.emu, arch.ArgRegs[0], low & 0xffffffff | high << 32)
+	}
+	err := NativeWriteArgRegister(nmc.emu, arch.ArgRegs[0], low)
 	if err != nil {
 		return err
 	}
-	err = NativeWriteArgRegister(nmc.emu, uc.ARM_REG_R1, high)
+	err = NativeWriteArgRegister(nmc.emu, arch.ArgRegs[1], high)
 	if err != nil {
 		return err
 	}
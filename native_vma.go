@@ -0,0 +1,178 @@
+package emulator
+
+import (
+	"fmt"
+	"sort"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// column /proc/self/maps pads the path to
+	MAPS_NAME_COLUMN = 49
+)
+
+// Vma is one mapping of the guest address space, [Start, End).
+type Vma struct {
+	Start  uint64
+	End    uint64
+	Prot   int
+	// MAP_* flags it was created with
+	Flags  uint64
+	// backing file, nil for anonymous memory
+	File   *VirtualFile
+	Offset uint64
+	// the path of the file, or a label like [stack] or [anon:libc_malloc]
+	Name   string
+}
+func (v *Vma) Size() uint64 {
+	return v.End - v.Start
+}
+func (v *Vma) Shared() bool {
+	return v.Flags & MAP_TYPE != MAP_PRIVATE
+}
+func (v *Vma) Contains(addr uint64) bool {
+	return addr >= v.Start && addr < v.End
+}
+// ProtString is the permission column of /proc/self/maps.
+func (v *Vma) ProtString() string {
+	b := []byte("---p")
+	if v.Prot & uc.PROT_READ != 0 {
+		b[0] = 'r'
+	}
+	if v.Prot & uc.PROT_WRITE != 0 {
+		b[1] = 'w'
+	}
+	if v.Prot & uc.PROT_EXEC != 0 {
+		b[2] = 'x'
+	}
+	if v.Shared() {
+		b[3] = 's'
+	}
+	return string(b)
+}
+// String renders the /proc/self/maps line, without the newline.
+func (v *Vma) String() string {
+	var dev, ino uint64
+	if v.File != nil {
+		dev, ino = statDev(v.Name), statIno(v.Name)
+	}
+	line := fmt.Sprintf("%08x-%08x %s %08x %02x:%02x %d",
+		v.Start, v.End, v.ProtString(), v.Offset, dev >> 8, dev & 0xff, ino)
+	if v.Name == "" {
+		return line + " "
+	}
+	for len(line) < MAPS_NAME_COLUMN {
+		line += " "
+	}
+	return line + " " + v.Name
+}
+func (v *Vma) clone() *Vma {
+	c := *v
+	return &c
+}
+// mergeable tells whether next continues v seamlessly.
+func (v *Vma) mergeable(next *Vma) bool {
+	if v.End != next.Start || v.Prot != next.Prot || v.Flags != next.Flags || v.File != next.File || v.Name != next.Name {
+		return false
+	}
+	return v.File == nil || v.Offset + v.Size() == next.Offset
+}
+
+// vmaList keeps the mappings sorted and never overlapping.
+type vmaList []*Vma
+
+func (l vmaList) find(addr uint64) int {
+	i := sort.Search(len(l), func(i int) bool {
+		return l[i].End > addr
+	})
+	if i < len(l) && l[i].Contains(addr) {
+		return i
+	}
+	return -1
+}
+// split cuts the vma covering addr in two, so a range can start or end
+// there.
+func (l vmaList) split(addr uint64) vmaList {
+	i := l.find(addr)
+	if i < 0 || l[i].Start == addr {
+		return l
+	}
+	v := l[i]
+	tail := v.clone()
+	tail.Start = addr
+	if v.File != nil {
+		tail.Offset += addr - v.Start
+	}
+	v.End = addr
+	if v.File != nil && v.Shared() {
+		v.File.refs++
+	}
+	l = append(l, nil)
+	copy(l[i+2:], l[i+1:])
+	l[i+1] = tail
+	return l
+}
+// carve takes [start, end) out of the list and returns what it held.
+func (l vmaList) carve(start, end uint64) (vmaList, []*Vma) {
+	l = l.split(start).split(end)
+	var kept vmaList
+	var removed []*Vma
+	for _, v := range l {
+		if v.Start >= start && v.End <= end {
+			removed = append(removed, v)
+		}else{
+			kept = append(kept, v)
+		}
+	}
+	return kept, removed
+}
+// insert adds v where nothing is mapped and merges it with its neighbours.
+func (l vmaList) insert(v *Vma) vmaList {
+	i := sort.Search(len(l), func(i int) bool {
+		return l[i].Start >= v.End
+	})
+	l = append(l, nil)
+	copy(l[i+1:], l[i:])
+	l[i] = v
+	return l.merge(i)
+}
+// merge joins the vma at i with the ones next to it when they match.
+func (l vmaList) merge(i int) vmaList {
+	if i + 1 < len(l) && l[i].mergeable(l[i+1]) {
+		l[i].End = l[i+1].End
+		l.drop(l[i+1])
+		l = append(l[:i+1], l[i+2:]...)
+	}
+	if i > 0 && l[i-1].mergeable(l[i]) {
+		l[i-1].End = l[i].End
+		l.drop(l[i])
+		l = append(l[:i], l[i+1:]...)
+	}
+	return l
+}
+// mergeAll joins every run of matching vmas.
+func (l vmaList) mergeAll() vmaList {
+	var res vmaList
+	for _, v := range l {
+		if n := len(res); n > 0 && res[n-1].mergeable(v) {
+			res[n-1].End = v.End
+			l.drop(v)
+			continue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+// drop lets go of the file reference a merged away shared vma held.
+func (l vmaList) drop(v *Vma) {
+	if v.File != nil && v.Shared() {
+		v.File.refs--
+	}
+}
+func (l vmaList) clone() vmaList {
+	c := make(vmaList, len(l))
+	for i, v := range l {
+		c[i] = v.clone()
+	}
+	return c
+}
@@ -0,0 +1,134 @@
+package emulator
+
+import (
+	"testing"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+type vmaSpan struct {
+	start, end, offset uint64
+}
+
+func vmaSpans(l vmaList) []vmaSpan {
+	var spans []vmaSpan
+	for _, v := range l {
+		spans = append(spans, vmaSpan{v.Start, v.End, v.Offset})
+	}
+	return spans
+}
+
+func checkVmas(t *testing.T, l vmaList, want ...vmaSpan) {
+	t.Helper()
+	got := vmaSpans(l)
+	if len(got) != len(want) {
+		t.Fatalf("vmas %#x, want %#x", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("vmas %#x, want %#x", got, want)
+		}
+	}
+}
+
+func anonVma(start, end uint64) *Vma {
+	return &Vma{Start: start, End: end, Prot: uc.PROT_READ | uc.PROT_WRITE, Flags: MAP_PRIVATE | MAP_ANONYMOUS}
+}
+
+func sharedVma(f *VirtualFile, start, end, offset uint64) *Vma {
+	f.refs++
+	return &Vma{Start: start, End: end, Prot: uc.PROT_READ, Flags: MAP_SHARED, File: f, Offset: offset, Name: f.Name}
+}
+
+func TestVmaListSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		addr uint64
+		want []vmaSpan
+	}{
+		{"middle", 0x3000, []vmaSpan{{0x1000, 0x3000, 0}, {0x3000, 0x5000, 0}, {0x8000, 0x9000, 0}}},
+		{"at start", 0x1000, []vmaSpan{{0x1000, 0x5000, 0}, {0x8000, 0x9000, 0}}},
+		{"at end", 0x5000, []vmaSpan{{0x1000, 0x5000, 0}, {0x8000, 0x9000, 0}}},
+		{"in a hole", 0x6000, []vmaSpan{{0x1000, 0x5000, 0}, {0x8000, 0x9000, 0}}},
+		{"last", 0x8800, []vmaSpan{{0x1000, 0x5000, 0}, {0x8000, 0x8800, 0}, {0x8800, 0x9000, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := vmaList{anonVma(0x1000, 0x5000), anonVma(0x8000, 0x9000)}
+			checkVmas(t, l.split(tt.addr), tt.want...)
+		})
+	}
+}
+
+func TestVmaListSplitFile(t *testing.T) {
+	f := &VirtualFile{Name: "/dev/ashmem"}
+	l := vmaList{sharedVma(f, 0x1000, 0x5000, 0x2000)}
+	l = l.split(0x2000).split(0x4000)
+	checkVmas(t, l, vmaSpan{0x1000, 0x2000, 0x2000}, vmaSpan{0x2000, 0x4000, 0x3000}, vmaSpan{0x4000, 0x5000, 0x5000})
+	if f.refs != 3 {
+		t.Errorf("refs after two splits = %d, want 3", f.refs)
+	}
+	l = l.mergeAll()
+	checkVmas(t, l, vmaSpan{0x1000, 0x5000, 0x2000})
+	if f.refs != 1 {
+		t.Errorf("refs after merging = %d, want 1", f.refs)
+	}
+}
+
+func TestVmaListCarve(t *testing.T) {
+	l := vmaList{anonVma(0x1000, 0x5000), anonVma(0x6000, 0x8000)}
+	kept, removed := l.carve(0x3000, 0x7000)
+	checkVmas(t, kept, vmaSpan{0x1000, 0x3000, 0}, vmaSpan{0x7000, 0x8000, 0})
+	checkVmas(t, removed, vmaSpan{0x3000, 0x5000, 0}, vmaSpan{0x6000, 0x7000, 0})
+}
+
+func TestVmaListInsertMerge(t *testing.T) {
+	f := &VirtualFile{Name: "/dev/ashmem"}
+	g := &VirtualFile{Name: "/dev/ashmem"}
+	tests := []struct {
+		name string
+		v    func() *Vma
+		want []vmaSpan
+	}{
+		{"both sides", func() *Vma { return anonVma(0x2000, 0x3000) },
+			[]vmaSpan{{0x1000, 0x4000, 0}, {0x4000, 0x5000, 0x1000}}},
+		{"other prot", func() *Vma {
+				v := anonVma(0x2000, 0x3000)
+				v.Prot = uc.PROT_READ
+				return v
+			},
+			[]vmaSpan{{0x1000, 0x2000, 0}, {0x2000, 0x3000, 0}, {0x3000, 0x4000, 0}, {0x4000, 0x5000, 0x1000}}},
+		{"file continues", func() *Vma { return sharedVma(f, 0x5000, 0x6000, 0x2000) },
+			[]vmaSpan{{0x1000, 0x2000, 0}, {0x3000, 0x4000, 0}, {0x4000, 0x6000, 0x1000}}},
+		{"file offset gap", func() *Vma { return sharedVma(f, 0x5000, 0x6000, 0x3000) },
+			[]vmaSpan{{0x1000, 0x2000, 0}, {0x3000, 0x4000, 0}, {0x4000, 0x5000, 0x1000}, {0x5000, 0x6000, 0x3000}}},
+		{"other file", func() *Vma { return sharedVma(g, 0x5000, 0x6000, 0x2000) },
+			[]vmaSpan{{0x1000, 0x2000, 0}, {0x3000, 0x4000, 0}, {0x4000, 0x5000, 0x1000}, {0x5000, 0x6000, 0x2000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.refs, g.refs = 0, 0
+			l := vmaList{anonVma(0x1000, 0x2000), anonVma(0x3000, 0x4000), sharedVma(f, 0x4000, 0x5000, 0x1000)}
+			v := tt.v()
+			l = l.insert(v)
+			checkVmas(t, l, tt.want...)
+			// every shared vma left holds one reference
+			refs := map[*VirtualFile]int{}
+			for _, v := range l {
+				if v.File != nil {
+					refs[v.File]++
+				}
+			}
+			if f.refs != refs[f] || g.refs != refs[g] {
+				t.Errorf("refs %d, %d, want %d, %d", f.refs, g.refs, refs[f], refs[g])
+			}
+		})
+	}
+}
+
+func TestVmaListClone(t *testing.T) {
+	l := vmaList{anonVma(0x1000, 0x3000)}
+	c := l.clone()
+	c = c.split(0x2000)
+	checkVmas(t, l, vmaSpan{0x1000, 0x3000, 0})
+	checkVmas(t, c, vmaSpan{0x1000, 0x2000, 0}, vmaSpan{0x2000, 0x3000, 0})
+}
@@ -1,65 +1,160 @@
 package emulator
 
 import (
-	"os"
-	"syscall"
+	"sort"
 )
 
 var (
-	GPcb *Pcb
+	// RLIMIT_NOFILE of the emulated process
+	MAX_FDS uintptr = 1024
 )
 
-func GetPcb() *Pcb {
-	if GPcb == nil {
-		GPcb = NewPcb()
-	}
-	return GPcb
+// fdEntry is one slot of the fd table, dup'ed fds share the VirtualFile
+// (the open file description) but each has its own FD_CLOEXEC.
+type fdEntry struct {
+	file    *VirtualFile
+	cloexec bool
 }
 
+// Pcb is the per emulator process control block, it owns the guest fd
+// table. Guest fd numbers have nothing to do with host fds.
 type Pcb struct {
-	fds map[uintptr]*VirtualFile
-	pid int
+	fds    map[uintptr]*fdEntry
+	pid    int
+	cwd    string
 }
-func NewPcb() *Pcb {
+func NewPcb(pid int) *Pcb {
 	return &Pcb{
-		fds: map[uintptr]*VirtualFile{
-			uintptr(syscall.Stdin):   NewVirtualFile("stdin",  "", os.Stdin),
-			uintptr(syscall.Stdout):  NewVirtualFile("stdout", "", os.Stdout),
-			uintptr(syscall.Stderr):  NewVirtualFile("stderr", "", os.Stderr),
-		},
-		pid: os.Getpid(),
+		fds: map[uintptr]*fdEntry{},
+		pid: pid,
+		cwd: "/",
 	}
 }
 func (p *Pcb) GetPid() int {
 	return p.pid
 }
-func (p *Pcb) AddFd(name, nameInSystem string, fo *os.File) uintptr {
-	var x = NewVirtualFile(name, nameInSystem, fo)
-	p.fds[x.Description] = x
-	return x.Description
+func (p *Pcb) Cwd() string {
+	return p.cwd
+}
+func (p *Pcb) SetCwd(cwd string) {
+	p.cwd = cwd
+}
+// lowestFd returns the lowest free slot not below min.
+func (p *Pcb) lowestFd(min uintptr) (uintptr, bool) {
+	for fd := min; fd < MAX_FDS; fd++ {
+		if _, used := p.fds[fd]; !used {
+			return fd, true
+		}
+	}
+	return 0, false
+}
+// AddFd opens a new description on the lowest free fd, -1 when the table
+// is full.
+func (p *Pcb) AddFd(name, nameInSystem string, fo FileHandle) uintptr {
+	vf := NewVirtualFile(name, nameInSystem, fo)
+	fd, ok := p.AllocFd(vf, 0, false)
+	if !ok {
+		vf.CloseResource()
+		return ^uintptr(0)
+	}
+	vf.Description = fd
+	return fd
+}
+// AllocFd puts vf on the lowest free fd not below min.
+func (p *Pcb) AllocFd(vf *VirtualFile, min uintptr, cloexec bool) (uintptr, bool) {
+	fd, ok := p.lowestFd(min)
+	if !ok {
+		return 0, false
+	}
+	p.InstallFd(fd, vf, cloexec)
+	return fd, true
+}
+// InstallFd puts vf on fd, closing what was there, like dup2.
+func (p *Pcb) InstallFd(fd uintptr, vf *VirtualFile, cloexec bool) {
+	vf.refs++
+	p.Remove(fd)
+	p.fds[fd] = &fdEntry{
+		file: vf,
+		cloexec: cloexec,
+	}
 }
 func (p *Pcb) GetFdDetail(fd uintptr) *VirtualFile {
 	ob, exist := p.fds[fd]
 	if !exist {
 		return nil
 	}
-	return ob
+	return ob.file
 }
 func (p *Pcb) HasFd(fd uintptr) bool {
 	_, exist := p.fds[fd]
 	return exist
 }
+func (p *Pcb) CloseOnExec(fd uintptr) bool {
+	ob, exist := p.fds[fd]
+	return exist && ob.cloexec
+}
+func (p *Pcb) SetCloseOnExec(fd uintptr, cloexec bool) {
+	if ob, exist := p.fds[fd]; exist {
+		ob.cloexec = cloexec
+	}
+}
+// Fds lists the open fds in ascending order.
+func (p *Pcb) Fds() []uintptr {
+	res := make([]uintptr, 0, len(p.fds))
+	for fd := range p.fds {
+		res = append(res, fd)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+// Remove closes fd, the description goes away with its last fd.
 func (p *Pcb) Remove(fd uintptr) {
-	if p.HasFd(fd) {
-		p.fds[fd].CloseResource()
-		delete(p.fds, fd)
+	ob, exist := p.fds[fd]
+	if !exist {
+		return
+	}
+	delete(p.fds, fd)
+	ob.file.refs--
+	if ob.file.refs <= 0 {
+		ob.file.CloseResource()
+	}
+}
+// PcbSnapshot is the fd table at a fork. It holds a reference to every
+// description, so the child closing one leaves it open for the parent.
+type PcbSnapshot struct {
+	fds map[uintptr]fdEntry
+	cwd string
+}
+func (p *Pcb) Snapshot() *PcbSnapshot {
+	snap := &PcbSnapshot{
+		fds: map[uintptr]fdEntry{},
+		cwd: p.cwd,
+	}
+	for fd, ob := range p.fds {
+		ob.file.refs++
+		snap.fds[fd] = *ob
+	}
+	return snap
+}
+// Restore closes the current table and puts the snapshot back, the
+// snapshot's references go to the restored fds.
+func (p *Pcb) Restore(snap *PcbSnapshot) {
+	for _, fd := range p.Fds() {
+		p.Remove(fd)
+	}
+	for fd, ob := range snap.fds {
+		entry := ob
+		p.fds[fd] = &entry
+	}
+	p.cwd = snap.cwd
+}
+// CloseExecFds closes every fd marked FD_CLOEXEC, as a successful execve does.
+func (p *Pcb) CloseExecFds() {
+	for _, fd := range p.Fds() {
+		if p.fds[fd].cloexec {
+			p.Remove(fd)
+		}
 	}
 }
-
-
-
-
-
-
-
-
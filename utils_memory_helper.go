@@ -40,11 +40,14 @@ func LE_BytesToUint(b []byte) uint64 {
 }
 
 func ReadPtr(mu uc.Unicorn, address uint64) (uint64, error) {
-	var sz uint64 = 4
+	sz := archOf(mu).PtrSize
 	by, err := mu.MemRead(address, sz)
 	if err != nil {
 		return 0, err
 	}
+	if sz == 8 {
+		return bin.LittleEndian.Uint64(by), nil
+	}
 	res := bin.LittleEndian.Uint32(by)
 	return uint64(res), nil
 }
@@ -52,28 +55,35 @@ func ReadByteArray(mu uc.Unicorn, address, size uint64) ([]byte, error) {
 	return mu.MemRead(address, size)
 }
 func ReadUtf8(mu uc.Unicorn, address uint64) ([]byte, error) {
+	return ReadCString(mu, address, ^uint64(0))
+}
+// ReadCString reads the NUL terminated string at address, at most max
+// bytes without the NUL. Longer strings are ErrStringTooLong, with their
+// first max bytes.
+func ReadCString(mu uc.Unicorn, address, max uint64) ([]byte, error) {
 	var (
 		buffAddr     uint64 = address
-		buffReadSize uint64 = 32
+		buffReadSize uint64 = 64
 	)
 	bb := []byte{}
-	foundNullPos := false
-	nullPos := 0
-	for {
-		if foundNullPos {
-			break
+	for uint64(len(bb)) <= max {
+		if max - uint64(len(bb)) < buffReadSize {
+			buffReadSize = max - uint64(len(bb)) + 1
 		}
 		by, err := mu.MemRead(buffAddr, buffReadSize)
 		if err != nil {
-			return nil, err
+			// the string may end right before an unmapped page
+			if by, err = mu.MemRead(buffAddr, 1); err != nil {
+				return nil, err
+			}
 		}
-		if bytes.Contains(by, []byte{0x0}) {
-			nullPos = bytes.Index(by, []byte{0x0})
-			foundNullPos = true
+		if nullPos := bytes.IndexByte(by, 0); nullPos >= 0 {
+			return append(bb, by[:nullPos]...), nil
 		}
 		bb = append(bb, by...)
+		buffAddr += uint64(len(by))
 	}
-	return bb[:nullPos], nil
+	return bb[:max], ErrStringTooLong
 }
 func ReadUints(mu uc.Unicorn, address uint64, num int) ([]uint64, error) {
 	var r []uint64
@@ -107,98 +117,41 @@ func WriteUints(mu uc.Unicorn, address uint64, nums []uint64) (err error) {
 
 type RegistryContext struct {
 	R0,R1,R2,R3,R4,R5,R6,R7,R8,R9,R10,R11,R12,SP,LR,PC,CPSR uint64
+	// arm64 only, X13 to X29, R0-R12 hold X0-X12 and CPSR the NZCV flags
+	Ext []uint64
+}
+func (ctx *RegistryContext) gp() []*uint64 {
+	return []*uint64{
+		&ctx.R0, &ctx.R1, &ctx.R2, &ctx.R3, &ctx.R4, &ctx.R5, &ctx.R6,
+		&ctx.R7, &ctx.R8, &ctx.R9, &ctx.R10, &ctx.R11, &ctx.R12,
+	}
 }
 func RegContextSave(mu uc.Unicorn) (*RegistryContext, error) {
-	var (
-		tmp uint64
-		err error
-	)
+	arch := archOf(mu)
 	ctx := &RegistryContext{}
-	tmp, err = mu.RegRead(uc.ARM_REG_R0)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R0 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R1)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R1 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R2)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R2 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R3)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R3 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R4)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R4 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R5)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R5 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R6)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R6 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R7)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R7 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R8)
-	if err != nil {
-		return nil, err
-	}	
-	ctx.R8 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R9)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R9 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R10)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R10 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R11)
-	if err != nil {
-		return nil, err
-	}
-	ctx.R11 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_R12)
-	if err != nil {
-		return nil, err
-	}	
-	ctx.R12 = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_SP)
-	if err != nil {
-		return nil, err
-	}
-	ctx.SP = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_LR)
-	if err != nil {
-		return nil, err
+	gp := ctx.gp()
+	for i, reg := range arch.GPRegs {
+		tmp, err := mu.RegRead(reg)
+		if err != nil {
+			return nil, err
+		}
+		*gp[i] = tmp
 	}
-	ctx.LR = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_PC)
-	if err != nil {
-		return nil, err
+	for _, reg := range arch.ExtRegs {
+		tmp, err := mu.RegRead(reg)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Ext = append(ctx.Ext, tmp)
 	}
-	ctx.PC = tmp
-	tmp, err = mu.RegRead(uc.ARM_REG_CPSR)
-	if err != nil {
-		return nil, err
+	regs := []int{arch.SP, arch.LR, arch.PC, arch.Status}
+	for i, dst := range []*uint64{&ctx.SP, &ctx.LR, &ctx.PC, &ctx.CPSR} {
+		tmp, err := mu.RegRead(regs[i])
+		if err != nil {
+			return nil, err
+		}
+		*dst = tmp
 	}
-	ctx.CPSR = tmp
 	return ctx, nil
 }
 
@@ -206,91 +159,26 @@ func RegContextRestore(mu uc.Unicorn, ctx *RegistryContext) error {
 	if ctx == nil {
 		return nil
 	}
-	var err error
-	err = mu.RegWrite(uc.ARM_REG_R0, ctx.R0)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R1, ctx.R1)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R2, ctx.R2)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R3, ctx.R3)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R4, ctx.R4)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R5, ctx.R5)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R6, ctx.R6)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R7, ctx.R7)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R8, ctx.R8)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R9, ctx.R9)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R10, ctx.R10)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R11, ctx.R11)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_R12, ctx.R12)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_SP, ctx.SP)
-	if err != nil {
-		return err
-	}
-	err = mu.RegWrite(uc.ARM_REG_LR, ctx.LR)
-	if err != nil {
-		return err
+	arch := archOf(mu)
+	gp := ctx.gp()
+	for i, reg := range arch.GPRegs {
+		if err := mu.RegWrite(reg, *gp[i]); err != nil {
+			return err
+		}
 	}
-	err = mu.RegWrite(uc.ARM_REG_PC, ctx.PC)
-	if err != nil {
-		return err
+	for i, reg := range arch.ExtRegs {
+		if i >= len(ctx.Ext) {
+			break
+		}
+		if err := mu.RegWrite(reg, ctx.Ext[i]); err != nil {
+			return err
+		}
 	}
-	err = mu.RegWrite(uc.ARM_REG_CPSR, ctx.CPSR)
-	if err != nil {
-		return err
+	regs := []int{arch.SP, arch.LR, arch.PC, arch.Status}
+	for i, v := range []uint64{ctx.SP, ctx.LR, ctx.PC, ctx.CPSR} {
+		if err := mu.RegWrite(regs[i], v); err != nil {
+			return err
+		}
 	}
 	return nil
 }
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
@@ -69,8 +69,9 @@ func PageStart(addr uint64) uint64 {
 	return addr & -(PAGE_SIZE)
 }
 
+// PageEnd rounds addr up to a page boundary.
 func PageEnd(addr uint64) uint64 {
-	return PageStart(addr) + PAGE_SIZE
+	return PageStart(addr + PAGE_SIZE - 1)
 }
 
 func GetSegmentProtection(prot_in uint32) int {
@@ -0,0 +1,250 @@
+package emulator
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// longest %s argument CFormat reads, the rest is cut off
+	CFORMAT_MAX_STR uint64 = 0x10000
+)
+
+// CArgs walks the variadic arguments of an AAPCS call, first the core
+// registers that are left, then the stack. arm64 takes doubles from the FP
+// registers, which have their own count.
+type CArgs struct {
+	mu     uc.Unicorn
+	arch   *Arch
+	regs   []uint64
+	fpRegs []uint64
+	sp     uint64
+}
+// NewCArgs starts at argument index first of the current call, sp is the
+// stack pointer the callee sees.
+func NewCArgs(mu uc.Unicorn, first int, sp uint64) *CArgs {
+	a := &CArgs{mu: mu, arch: archOf(mu), sp: sp}
+	regs := a.arch.ArgRegs
+	for i := first; i < len(regs); i++ {
+		v, _ := mu.RegRead(regs[i])
+		a.regs = append(a.regs, v)
+	}
+	if first > len(regs) {
+		a.sp += uint64(first - len(regs)) * a.arch.PtrSize
+	}
+	for _, reg := range a.arch.FPArgRegs {
+		v, _ := mu.RegRead(reg)
+		a.fpRegs = append(a.fpRegs, v)
+	}
+	return a
+}
+// NewCArgsVaList reads the arguments behind a va_list. That is a plain
+// pointer to the stack slots on arm. On arm64 ap points at the structure
+// { __stack, __gr_top, __vr_top, __gr_offs, __vr_offs }, the offsets are
+// negative while saved registers are left below the tops.
+func NewCArgsVaList(mu uc.Unicorn, ap uint64) *CArgs {
+	a := &CArgs{mu: mu, arch: archOf(mu), sp: ap}
+	if !a.arch.Is64 {
+		return a
+	}
+	b, err := mu.MemRead(ap, 32)
+	if err != nil {
+		return a
+	}
+	a.sp = LE_BytesToUint64(b[0:])
+	grTop, vrTop := LE_BytesToUint64(b[8:]), LE_BytesToUint64(b[16:])
+	grOffs, vrOffs := int32(LE_BytesToUint32(b[24:])), int32(LE_BytesToUint32(b[28:]))
+	if grOffs < 0 {
+		if saved, err := mu.MemRead(grTop - uint64(-int64(grOffs)), uint64(-int64(grOffs))); err == nil {
+			for i := 0; i + 8 <= len(saved); i += 8 {
+				a.regs = append(a.regs, LE_BytesToUint64(saved[i:]))
+			}
+		}
+	}
+	if vrOffs < 0 {
+		// V registers are saved 16 bytes apart, doubles in the low half
+		if saved, err := mu.MemRead(vrTop - uint64(-int64(vrOffs)), uint64(-int64(vrOffs))); err == nil {
+			for i := 0; i + 16 <= len(saved); i += 16 {
+				a.fpRegs = append(a.fpRegs, LE_BytesToUint64(saved[i:]))
+			}
+		}
+	}
+	return a
+}
+// Word takes a pointer sized argument.
+func (a *CArgs) Word() uint64 {
+	if a.arch.Is64 {
+		return a.Dword()
+	}
+	if len(a.regs) > 0 {
+		v := a.regs[0]
+		a.regs = a.regs[1:]
+		return v & 0xffffffff
+	}
+	v, _ := ReadPtr(a.mu, a.sp)
+	a.sp += a.arch.PtrSize
+	return v
+}
+// Dword takes a 64 bit argument, those start on an even register or an
+// 8 byte aligned stack slot and never straddle both. On arm64 every
+// argument is one register or one slot.
+func (a *CArgs) Dword() uint64 {
+	if a.arch.Is64 && len(a.regs) > 0 {
+		v := a.regs[0]
+		a.regs = a.regs[1:]
+		return v
+	}
+	if !a.arch.Is64 && len(a.regs) % 2 == 1 {
+		a.regs = a.regs[1:]
+	}
+	if len(a.regs) >= 2 {
+		v := a.regs[0] & 0xffffffff | a.regs[1] << 32
+		a.regs = a.regs[2:]
+		return v
+	}
+	a.regs = nil
+	a.sp = (a.sp + 7) &^ 7
+	b, err := a.mu.MemRead(a.sp, 8)
+	a.sp += 8
+	if err != nil {
+		return 0
+	}
+	return LE_BytesToUint64(b)
+}
+// Double takes a double argument.
+func (a *CArgs) Double() float64 {
+	if !a.arch.Is64 {
+		return math.Float64frombits(a.Dword())
+	}
+	if len(a.fpRegs) > 0 {
+		v := a.fpRegs[0]
+		a.fpRegs = a.fpRegs[1:]
+		return math.Float64frombits(v)
+	}
+	b, err := a.mu.MemRead(a.sp, 8)
+	a.sp += 8
+	if err != nil {
+		return 0
+	}
+	return math.Float64frombits(LE_BytesToUint64(b))
+}
+// Str takes a char pointer argument.
+func (a *CArgs) Str() string {
+	p := a.Word()
+	if p == 0 {
+		return "(null)"
+	}
+	b, err := ReadCString(a.mu, p, CFORMAT_MAX_STR)
+	if err != nil && err != ErrStringTooLong {
+		return "(bad)"
+	}
+	return string(b)
+}
+
+// CFormat renders a printf format against the guest arguments.
+func CFormat(format string, a *CArgs) string {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			break
+		}
+		spec := "%"
+		for ; i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0; i++ {
+			spec += string(format[i])
+		}
+		// width and precision, '*' takes them from the arguments
+		for _, prefix := range []string{"", "."} {
+			if prefix != "" {
+				if i >= len(format) || format[i] != '.' {
+					break
+				}
+				spec += "."
+				i++
+			}
+			if i < len(format) && format[i] == '*' {
+				spec += fmt.Sprint(int32(a.Word()))
+				i++
+				continue
+			}
+			for ; i < len(format) && format[i] >= '0' && format[i] <= '9'; i++ {
+				spec += string(format[i])
+			}
+		}
+		length := ""
+		for ; i < len(format) && strings.IndexByte("hlLqjzt", format[i]) >= 0; i++ {
+			length += string(format[i])
+		}
+		if i >= len(format) {
+			break
+		}
+		long := length == "ll" || length == "q" || length == "j" || length == "L"
+		if a.arch.Is64 && (length == "l" || length == "z" || length == "t") {
+			// long, size_t and ptrdiff_t are 64 bit on arm64
+			long = true
+		}
+		switch conv := format[i]; conv {
+		case 'd', 'i':
+			var v int64
+			if long {
+				v = int64(a.Dword())
+			}else{
+				v = int64(int32(a.Word()))
+			}
+			switch length {
+			case "hh":
+				v = int64(int8(v))
+			case "h":
+				v = int64(int16(v))
+			}
+			sb.WriteString(fmt.Sprintf(spec + "d", v))
+		case 'u', 'x', 'X', 'o':
+			var v uint64
+			if long {
+				v = a.Dword()
+			}else{
+				// the upper half of a 32 bit argument is unspecified on arm64
+				v = a.Word() & 0xffffffff
+			}
+			switch length {
+			case "hh":
+				v = uint64(uint8(v))
+			case "h":
+				v = uint64(uint16(v))
+			}
+			if conv == 'u' {
+				conv = 'd'
+			}
+			sb.WriteString(fmt.Sprintf(spec + string(conv), v))
+		case 'c':
+			sb.WriteString(fmt.Sprintf(spec + "c", rune(byte(a.Word()))))
+		case 's':
+			sb.WriteString(fmt.Sprintf(spec + "s", a.Str()))
+		case 'p':
+			sb.WriteString(fmt.Sprintf("0x%x", a.Word()))
+		case 'f', 'F', 'e', 'E', 'g', 'G', 'a', 'A':
+			// float varargs are promoted to double
+			v := a.Double()
+			if conv == 'a' {
+				conv = 'x'
+			}else if conv == 'A' {
+				conv = 'X'
+			}
+			sb.WriteString(fmt.Sprintf(spec + string(conv), v))
+		case 'n':
+			a.Word()
+		case '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteString(spec + length + string(conv))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,182 @@
+package emulator
+
+import (
+	"math"
+	"errors"
+	"strings"
+	"testing"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// fakeMu is a guest with a few registers and one mapped region, enough to
+// walk call arguments.
+type fakeMu struct {
+	uc.Unicorn
+	regs map[int]uint64
+	base uint64
+	mem  []byte
+}
+
+var errFakeUnmapped = errors.New("unmapped")
+
+func newFakeMu(base, size uint64) *fakeMu {
+	return &fakeMu{regs: map[int]uint64{}, base: base, mem: make([]byte, size)}
+}
+func (f *fakeMu) RegRead(reg int) (uint64, error) {
+	return f.regs[reg], nil
+}
+func (f *fakeMu) MemRead(addr, size uint64) ([]byte, error) {
+	if addr < f.base || addr + size > f.base + uint64(len(f.mem)) {
+		return nil, errFakeUnmapped
+	}
+	b := make([]byte, size)
+	copy(b, f.mem[addr - f.base:])
+	return b, nil
+}
+func (f *fakeMu) MemWrite(addr uint64, data []byte) error {
+	if addr < f.base || addr + uint64(len(data)) > f.base + uint64(len(f.mem)) {
+		return errFakeUnmapped
+	}
+	copy(f.mem[addr - f.base:], data)
+	return nil
+}
+
+const (
+	fakeMemBase  = 0x10000
+	fakeMemSize  = 0x1000
+	fakeStack    = 0x10000
+	fakeStrShort = 0x10400
+	fakeStrLong  = 0x10800
+)
+
+var longStr = strings.Repeat("0123456789", 10)
+
+func fakeArgsMu(t *testing.T, arch *Arch, regs []uint64, stack []uint64) *fakeMu {
+	mu := newFakeMu(fakeMemBase, fakeMemSize)
+	bindArch(mu, arch)
+	for i, v := range regs {
+		mu.regs[arch.ArgRegs[i]] = v
+	}
+	for i, v := range stack {
+		if err := mu.MemWrite(fakeStack + uint64(i) * arch.PtrSize, arch.PutPtr(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	WriteUtf8(mu, fakeStrShort, []byte("abc"))
+	WriteUtf8(mu, fakeStrLong, []byte(longStr))
+	// ends on the last mapped byte, a chunked read runs off the region
+	WriteUtf8(mu, fakeMemBase + fakeMemSize - 5, []byte("tail"))
+	return mu
+}
+
+func TestCFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		arch   *Arch
+		format string
+		// argument registers after the format, then stack slots
+		regs   []uint64
+		stack  []uint64
+		want   string
+	}{
+		{"plain", ARCH_ARM32, "no args %% here", nil, nil, "no args % here"},
+		{"negative", ARCH_ARM32, "%d %i %hhd %hd", []uint64{0, 0xffffffff, 0x80000000, 0x1ff}, []uint64{0xfffe},
+			"-1 -2147483648 -1 -2"},
+		{"unsigned", ARCH_ARM32, "%u %x %X %o %hhu", []uint64{0, 0xffffffff, 0xbeef, 0xbeef}, []uint64{8, 0x1ff},
+			"4294967295 beef BEEF 10 255"},
+		{"flags and width", ARCH_ARM32, "[%5d|%-5d|%05x|%+d|%*d]", []uint64{0, 42, 42, 42}, []uint64{42, 4, 7},
+			"[   42|42   |0002a|+42|   7]"},
+		{"stack", ARCH_ARM32, "%d %d %d %d %d", []uint64{0, 1, 2, 3}, []uint64{4, 5}, "1 2 3 4 5"},
+		{"long long in registers", ARCH_ARM32, "%d %lld", []uint64{0, 7, 0xfffffffe, 0xffffffff}, nil, "7 -2"},
+		{"long long on stack", ARCH_ARM32, "%d %d %lld %d", []uint64{0, 1, 2, 0xdead}, []uint64{0xfffffffd, 0xffffffff, 9},
+			"1 2 -3 9"},
+		{"strings", ARCH_ARM32, "%s|%5s|%-5s|%.2s", []uint64{0, fakeStrShort, fakeStrShort, fakeStrShort}, []uint64{fakeStrShort},
+			"abc|  abc|abc  |ab"},
+		{"long string", ARCH_ARM32, "[%s]", []uint64{0, fakeStrLong}, nil, "[" + longStr + "]"},
+		{"string at region end", ARCH_ARM32, "%s", []uint64{0, fakeMemBase + fakeMemSize - 5}, nil, "tail"},
+		{"null string", ARCH_ARM32, "%s", []uint64{0, 0}, nil, "(null)"},
+		{"bad string", ARCH_ARM32, "%s", []uint64{0, 0x20000}, nil, "(bad)"},
+		{"char and pointer", ARCH_ARM32, "%c%c %p", []uint64{0, 'o', 'k', 0x1234}, nil, "ok 0x1234"},
+		{"unknown", ARCH_ARM32, "%y %d", []uint64{0, 3}, nil, "%y 3"},
+		{"arm64", ARCH_ARM64, "%d %ld %lld %zu %s", []uint64{0, 0xffffffff, 0xfffffffffffffffe, 1 << 40, 3, fakeStrShort}, nil,
+			"-1 -2 1099511627776 3 abc"},
+		{"arm64 32 bit unsigned", ARCH_ARM64, "%x %u %lx", []uint64{0, 0xdeadbeef00000010, 0xffffffff00000003, 0xdeadbeef00000010}, nil,
+			"10 3 deadbeef00000010"},
+		{"arm double", ARCH_ARM32, "%d %f %.1f", []uint64{0, 1, 0, 0x3ff80000}, []uint64{0, 0x40040000},
+			"1 1.500000 2.5"},
+		{"arm64 stack", ARCH_ARM64, "%d %d %d %d %d %d %d %d %ld", []uint64{0, 1, 2, 3, 4, 5, 6, 7}, []uint64{8, 1 << 33},
+			"1 2 3 4 5 6 7 8 8589934592"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu := fakeArgsMu(t, tt.arch, tt.regs, tt.stack)
+			if got := CFormat(tt.format, NewCArgs(mu, 1, fakeStack)); got != tt.want {
+				t.Errorf("CFormat(%q) = %q, want %q", tt.format, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCFormatStringCap(t *testing.T) {
+	saved := CFORMAT_MAX_STR
+	defer func() { CFORMAT_MAX_STR = saved }()
+	CFORMAT_MAX_STR = 8
+	mu := fakeArgsMu(t, ARCH_ARM32, []uint64{0, fakeStrLong, fakeStrShort}, nil)
+	if got, want := CFormat("%s %s", NewCArgs(mu, 1, fakeStack)), longStr[:8] + " abc"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCFormatVaList(t *testing.T) {
+	mu := fakeArgsMu(t, ARCH_ARM32, nil, []uint64{5, fakeStrShort})
+	if got, want := CFormat("%d %s", NewCArgsVaList(mu, fakeStack)), "5 abc"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCFormatArm64Doubles(t *testing.T) {
+	mu := fakeArgsMu(t, ARCH_ARM64, []uint64{0, 7, 0xffffffff00000010}, []uint64{math.Float64bits(0.5)})
+	for i, v := range []float64{2.5, -0.25, 1, 2, 3, 4, 5, 6} {
+		mu.regs[ARCH_ARM64.FPArgRegs[i]] = math.Float64bits(v)
+	}
+	format := "%d %f %x %g %g %g %g %g %g %g %g"
+	want := "7 2.500000 10 -0.25 1 2 3 4 5 6 0.5"
+	if got := CFormat(format, NewCArgs(mu, 1, fakeStack)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCFormatVaListArm64(t *testing.T) {
+	mu := fakeArgsMu(t, ARCH_ARM64, nil, nil)
+	const (
+		ap    = 0x10000
+		stack = 0x10100
+		grTop = 0x10200
+		vrTop = 0x10300
+	)
+	var b []byte
+	for _, v := range []uint64{stack, grTop, vrTop} {
+		b = append(b, IntToBytes(int64(v), 8)...)
+	}
+	b = append(b, IntToBytes(-16, 4)...)
+	b = append(b, IntToBytes(-32, 4)...)
+	writes := []struct {
+		addr uint64
+		data []byte
+	}{
+		{ap, b},
+		{grTop - 16, append(IntToBytes(5, 8), IntToBytes(fakeStrShort, 8)...)},
+		{vrTop - 32, IntToBytes(int64(math.Float64bits(1.5)), 8)},
+		{vrTop - 16, IntToBytes(int64(math.Float64bits(3)), 8)},
+		{stack, append(IntToBytes(9, 8), IntToBytes(int64(math.Float64bits(0.5)), 8)...)},
+	}
+	for _, w := range writes {
+		if err := mu.MemWrite(w.addr, w.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "5 abc 1.500000 3.000000 9 0.500000"
+	if got := CFormat("%d %s %f %f %d %f", NewCArgsVaList(mu, ap)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
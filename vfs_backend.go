@@ -0,0 +1,534 @@
+package emulator
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+	"strings"
+	"syscall"
+	"io/ioutil"
+	fp  "path/filepath"
+)
+
+// FileHandle is an open file of any VFS backend, *os.File satisfies it.
+type FileHandle interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// VfsBackend resolves guest paths to files. Paths are absolute and clean,
+// a backend that does not know a path answers os.ErrNotExist.
+type VfsBackend interface {
+	Open(path string, flag int) (FileHandle, error)
+	Stat(path string) (os.FileInfo, error)
+}
+
+func isWriteFlag(flag int) bool {
+	return flag & (os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC) != 0
+}
+
+// fileInfo is the os.FileInfo of files that do not exist on the host.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+/*
+	host overlay
+*/
+
+var (
+	// links a host path lookup follows before ELOOP
+	MAX_SYMLINKS = 40
+)
+
+// HostBackend exposes the vfs root directory read-only.
+type HostBackend struct {
+	root string
+}
+func NewHostBackend(root string) *HostBackend {
+	return &HostBackend{root: root}
+}
+// Path is the host path of guest path p, see resolve.
+func (hb *HostBackend) Path(p string) string {
+	host, _ := hb.resolve(p, true)
+	return host
+}
+// resolve maps guest path p below the root. Symlinks of the host tree are
+// followed here, the way the guest sees them, absolute targets start at
+// the root, so neither ".." nor a link leaves it. The last component is
+// followed unless followLast is false. On error the path is still one
+// below the root.
+func (hb *HostBackend) resolve(p string, followLast bool) (string, error) {
+	pending := strings.Split(path.Clean("/" + p), "/")
+	cur := "/"
+	links := 0
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			cur = path.Dir(cur)
+			continue
+		}
+		next := path.Join(cur, name)
+		if len(pending) == 0 && !followLast {
+			cur = next
+			break
+		}
+		host := VfsPathToSystemPath(hb.root, next)
+		fi, err := os.Lstat(host)
+		if err != nil || fi.Mode() & os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		links++
+		if links > MAX_SYMLINKS {
+			return VfsPathToSystemPath(hb.root, cur), syscall.ELOOP
+		}
+		target, err := os.Readlink(host)
+		if err != nil {
+			return VfsPathToSystemPath(hb.root, cur), err
+		}
+		if strings.HasPrefix(target, "/") {
+			cur = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return VfsPathToSystemPath(hb.root, cur), nil
+}
+func (hb *HostBackend) Open(path string, flag int) (FileHandle, error) {
+	if isWriteFlag(flag) {
+		return nil, os.ErrPermission
+	}
+	host, err := hb.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return MyOpen(host, os.O_RDONLY)
+}
+func (hb *HostBackend) Stat(path string) (os.FileInfo, error) {
+	host, err := hb.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(host)
+}
+func (hb *HostBackend) Lstat(path string) (os.FileInfo, error) {
+	host, err := hb.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(host)
+}
+func (hb *HostBackend) Readlink(path string) (string, error) {
+	host, err := hb.resolve(path, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(host)
+}
+
+/*
+	in-memory layer
+*/
+
+type memNode struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// MemoryBackend holds every file the guest creates or modifies. It belongs
+// to a single emulator, nothing is written to the host.
+type MemoryBackend struct {
+	nodes map[string]*memNode
+}
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		nodes: map[string]*memNode{
+			"/": {mode: os.ModeDir | 0755, modTime: time.Now()},
+		},
+	}
+}
+func (mb *MemoryBackend) Open(path string, flag int) (FileHandle, error) {
+	return mb.OpenFile(path, flag, 0600)
+}
+// OpenFile is Open with the permission bits of a created file.
+func (mb *MemoryBackend) OpenFile(path string, flag int, perm os.FileMode) (FileHandle, error) {
+	n, exist := mb.nodes[path]
+	if !exist {
+		if flag & os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		n = mb.create(path, perm, nil)
+	}else if flag & (os.O_CREATE | os.O_EXCL) == os.O_CREATE | os.O_EXCL {
+		return nil, os.ErrExist
+	}
+	if n.mode.IsDir() && isWriteFlag(flag) {
+		return nil, os.ErrPermission
+	}
+	if flag & os.O_TRUNC != 0 {
+		n.data = n.data[:0]
+		n.modTime = time.Now()
+	}
+	return &memHandle{
+		name: fp.Base(path),
+		node: n,
+		flag: flag,
+	}, nil
+}
+func (mb *MemoryBackend) Stat(path string) (os.FileInfo, error) {
+	n, exist := mb.nodes[path]
+	if !exist {
+		return nil, os.ErrNotExist
+	}
+	return n.info(fp.Base(path)), nil
+}
+func (mb *MemoryBackend) create(path string, perm os.FileMode, data []byte) *memNode {
+	n := &memNode{
+		data: data,
+		mode: perm,
+		modTime: time.Now(),
+	}
+	mb.nodes[path] = n
+	return n
+}
+// WriteFile creates or replaces a file.
+func (mb *MemoryBackend) WriteFile(path string, data []byte, perm os.FileMode) {
+	mb.create(path, perm, append([]byte{}, data...))
+}
+func (mb *MemoryBackend) Mkdir(path string, perm os.FileMode) error {
+	if _, exist := mb.nodes[path]; exist {
+		return os.ErrExist
+	}
+	mb.create(path, os.ModeDir | perm, nil)
+	return nil
+}
+func (mb *MemoryBackend) Remove(path string) error {
+	if _, exist := mb.nodes[path]; !exist {
+		return os.ErrNotExist
+	}
+	delete(mb.nodes, path)
+	return nil
+}
+// MemoryBackendSnapshot is the memory layer at a fork. Nodes keep their
+// identity, descriptors the parent still holds see the restored contents.
+type MemoryBackendSnapshot struct {
+	nodes map[string]*memNode
+	saved map[*memNode]memNode
+}
+func (mb *MemoryBackend) Snapshot() *MemoryBackendSnapshot {
+	snap := &MemoryBackendSnapshot{
+		nodes: map[string]*memNode{},
+		saved: map[*memNode]memNode{},
+	}
+	for p, n := range mb.nodes {
+		snap.nodes[p] = n
+		saved := *n
+		// writes within the length change data in place
+		saved.data = append([]byte(nil), n.data...)
+		snap.saved[n] = saved
+	}
+	return snap
+}
+// Restore drops what was created since the snapshot and puts back the
+// contents of every file that existed then.
+func (mb *MemoryBackend) Restore(snap *MemoryBackendSnapshot) {
+	mb.nodes = map[string]*memNode{}
+	for p, n := range snap.nodes {
+		*n = snap.saved[n]
+		mb.nodes[p] = n
+	}
+}
+// ReadDir lists the direct children of a directory.
+func (mb *MemoryBackend) ReadDir(path string) []os.FileInfo {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	var res []os.FileInfo
+	for p, n := range mb.nodes {
+		if p == "/" || !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		if strings.Contains(p[len(prefix):], "/") {
+			continue
+		}
+		res = append(res, n.info(fp.Base(p)))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name() < res[j].Name()
+	})
+	return res
+}
+func (n *memNode) info(name string) os.FileInfo {
+	return &fileInfo{
+		name: name,
+		size: int64(len(n.data)),
+		mode: n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// memHandle is an open memNode, handles on the same node share its data.
+type memHandle struct {
+	name   string
+	node   *memNode
+	flag   int
+	off    int64
+	closed bool
+}
+func (h *memHandle) Read(b []byte) (int, error) {
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if h.flag & os.O_WRONLY != 0 {
+		return 0, os.ErrPermission
+	}
+	if h.off >= int64(len(h.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, h.node.data[h.off:])
+	h.off += int64(n)
+	return n, nil
+}
+func (h *memHandle) Write(b []byte) (int, error) {
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if !isWriteFlag(h.flag) {
+		return 0, os.ErrPermission
+	}
+	if h.flag & os.O_APPEND != 0 {
+		h.off = int64(len(h.node.data))
+	}
+	end := h.off + int64(len(b))
+	if end > int64(len(h.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, h.node.data)
+		h.node.data = grown
+	}
+	copy(h.node.data[h.off:], b)
+	h.off = end
+	h.node.modTime = time.Now()
+	return len(b), nil
+}
+func (h *memHandle) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekCurrent:
+		base = h.off
+	case io.SeekEnd:
+		base = int64(len(h.node.data))
+	}
+	if base + offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	h.off = base + offset
+	return h.off, nil
+}
+func (h *memHandle) Close() error {
+	h.closed = true
+	return nil
+}
+func (h *memHandle) Stat() (os.FileInfo, error) {
+	return h.node.info(h.name), nil
+}
+
+// overlayHandle reads from the host until the first write, the file is then
+// copied into the memory layer and the write lands there.
+type overlayHandle struct {
+	path string
+	mem  *MemoryBackend
+	host FileHandle
+	rw   FileHandle
+	flag int
+}
+func (h *overlayHandle) cur() FileHandle {
+	if h.rw != nil {
+		return h.rw
+	}
+	return h.host
+}
+func (h *overlayHandle) copyUp() error {
+	off, err := h.host.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = h.host.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(h.host)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0600)
+	if st, err := h.host.Stat(); err == nil {
+		perm = st.Mode().Perm()
+	}
+	h.mem.WriteFile(h.path, data, perm)
+	rw, err := h.mem.Open(h.path, h.flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC))
+	if err != nil {
+		return err
+	}
+	_, err = rw.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	h.host.Close()
+	h.rw = rw
+	return nil
+}
+func (h *overlayHandle) Read(b []byte) (int, error) {
+	return h.cur().Read(b)
+}
+func (h *overlayHandle) Write(b []byte) (int, error) {
+	if h.rw == nil {
+		err := h.copyUp()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return h.rw.Write(b)
+}
+func (h *overlayHandle) Seek(offset int64, whence int) (int64, error) {
+	return h.cur().Seek(offset, whence)
+}
+func (h *overlayHandle) Close() error {
+	return h.cur().Close()
+}
+func (h *overlayHandle) Stat() (os.FileInfo, error) {
+	return h.cur().Stat()
+}
+
+/*
+	synthetic files
+*/
+
+// SyntheticOpener returns a handle when it serves path.
+type SyntheticOpener func(path string, flag int) (FileHandle, bool)
+
+// SyntheticFS serves generated files such as procfs and devfs, paths
+// nobody claims fall through to the other layers.
+type SyntheticFS struct {
+	openers []SyntheticOpener
+}
+func NewSyntheticFS() *SyntheticFS {
+	return &SyntheticFS{}
+}
+func (sf *SyntheticFS) Add(op SyntheticOpener) {
+	sf.openers = append(sf.openers, op)
+}
+// AddFile serves a read-only file rendered by gen when it is opened.
+func (sf *SyntheticFS) AddFile(path string, gen func() []byte) {
+	sf.Add(func(p string, flag int) (FileHandle, bool) {
+		if p != path {
+			return nil, false
+		}
+		return NewStaticHandle(p, gen()), true
+	})
+}
+func (sf *SyntheticFS) Open(path string, flag int) (FileHandle, error) {
+	for _, op := range sf.openers {
+		if h, ok := op(path, flag); ok {
+			return h, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+func (sf *SyntheticFS) Stat(path string) (os.FileInfo, error) {
+	h, err := sf.Open(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	return h.Stat()
+}
+
+// NewStaticHandle wraps data in a read-only handle.
+func NewStaticHandle(path string, data []byte) FileHandle {
+	return &memHandle{
+		name: fp.Base(path),
+		node: &memNode{data: data, mode: 0444, modTime: time.Now()},
+		flag: os.O_RDONLY,
+	}
+}
+
+// dirHandle is an open directory, it only carries the path and its info.
+type dirHandle struct {
+	path string
+	info os.FileInfo
+}
+func NewDirHandle(path string, info os.FileInfo) FileHandle {
+	return &dirHandle{path: path, info: info}
+}
+func (h *dirHandle) Read(b []byte) (int, error) {
+	return 0, syscall.EISDIR
+}
+func (h *dirHandle) Write(b []byte) (int, error) {
+	return 0, syscall.EISDIR
+}
+func (h *dirHandle) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+func (h *dirHandle) Close() error {
+	return nil
+}
+func (h *dirHandle) Stat() (os.FileInfo, error) {
+	return h.info, nil
+}
+
+// deviceHandle is a character device, reads and writes go to callbacks.
+type deviceHandle struct {
+	name  string
+	read  func([]byte) (int, error)
+	write func([]byte) (int, error)
+}
+// NewDeviceHandle creates a device handle, a nil read gives EOF and a nil
+// write discards.
+func NewDeviceHandle(path string, read, write func([]byte) (int, error)) FileHandle {
+	return &deviceHandle{
+		name: fp.Base(path),
+		read: read,
+		write: write,
+	}
+}
+func (h *deviceHandle) Read(b []byte) (int, error) {
+	if h.read == nil {
+		return 0, io.EOF
+	}
+	return h.read(b)
+}
+func (h *deviceHandle) Write(b []byte) (int, error) {
+	if h.write == nil {
+		return len(b), nil
+	}
+	return h.write(b)
+}
+func (h *deviceHandle) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+func (h *deviceHandle) Close() error {
+	return nil
+}
+func (h *deviceHandle) Stat() (os.FileInfo, error) {
+	return &fileInfo{
+		name: h.name,
+		mode: os.ModeDevice | os.ModeCharDevice | 0666,
+		modTime: time.Now(),
+	}, nil
+}
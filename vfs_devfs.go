@@ -0,0 +1,39 @@
+package emulator
+
+import (
+	"math/rand"
+)
+
+// setupDev registers the character devices, nothing of them is backed by
+// the host.
+func (vfs *VirtualFileSystem) setupDev() {
+	random := func(b []byte) (int, error) {
+		if OVERRIDE_URANDOM {
+			for i := range b {
+				b[i] = byte(OVERRIDE_URANDOM_INT)
+			}
+			return len(b), nil
+		}
+		return rand.Read(b)
+	}
+	zero := func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = 0
+		}
+		return len(b), nil
+	}
+	devices := map[string]func([]byte) (int, error){
+		"/dev/urandom": random,
+		"/dev/random": random,
+		"/dev/zero": zero,
+		"/dev/null": nil,
+		"/dev/input/event0": nil,
+	}
+	vfs.Dev.Add(func(p string, flag int) (FileHandle, bool) {
+		read, exist := devices[p]
+		if !exist {
+			return nil, false
+		}
+		return NewDeviceHandle(p, read, nil), true
+	})
+}
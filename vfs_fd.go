@@ -0,0 +1,144 @@
+package emulator
+
+import (
+	"syscall"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	F_DUPFD_CLOEXEC uint64 = 1030
+	// status flags F_SETFL may change
+	O_SETFL_MASK = O_APPEND | O_NONBLOCK | O_DIRECT | O_NOATIME
+)
+
+// setupStdio gives the guest its own std streams, stdin reads as
+// /dev/null and output goes to Stdio or the log.
+func (vfs *VirtualFileSystem) setupStdio() {
+	logWriter := func(stream string) func([]byte) (int, error) {
+		return func(b []byte) (int, error) {
+			if vfs.Stdio != nil {
+				vfs.Stdio(stream, b)
+			}else{
+				vfs.logger.Debug().Bytes(stream, b).Msg("write to " + stream)
+			}
+			return len(b), nil
+		}
+	}
+	stdio := []*VirtualFile{
+		NewVirtualFile("stdin", "", NewDeviceHandle("/dev/null", nil, nil)),
+		NewVirtualFile("stdout", "", NewDeviceHandle("/dev/null", nil, logWriter("stdout"))),
+		NewVirtualFile("stderr", "", NewDeviceHandle("/dev/null", nil, logWriter("stderr"))),
+	}
+	for fd, vf := range stdio {
+		vf.Description = uintptr(fd)
+		vf.Flags = O_RDWR
+		vfs.pcb.InstallFd(uintptr(fd), vf, false)
+	}
+}
+
+// dupFd duplicates oldfd onto the lowest free fd not below min.
+func (vfs *VirtualFileSystem) dupFd(oldfd, min uint64, cloexec bool) uint64 {
+	vf := vfs.pcb.GetFdDetail(uintptr(oldfd))
+	if vf == nil {
+		return errnoRet(EBADF)
+	}
+	if min >= uint64(MAX_FDS) {
+		return errnoRet(EINVAL)
+	}
+	fd, ok := vfs.pcb.AllocFd(vf, uintptr(min), cloexec)
+	if !ok {
+		return errnoRet(EMFILE)
+	}
+	return uint64(fd)
+}
+/* syscall dup
+int dup(int oldfd);
+*/
+func (vfs *VirtualFileSystem) dupHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.dupFd(args[0], 0, false), true
+}
+/* syscall dup2
+int dup2(int oldfd, int newfd);
+*/
+func (vfs *VirtualFileSystem) dup2Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	oldfd, newfd := args[0], args[1]
+	if oldfd == newfd {
+		if !vfs.pcb.HasFd(uintptr(oldfd)) {
+			return errnoRet(EBADF), true
+		}
+		return newfd, true
+	}
+	return vfs.dup3Handle(mu, oldfd, newfd, 0)
+}
+/* syscall dup3
+int dup3(int oldfd, int newfd, int flags);
+*/
+func (vfs *VirtualFileSystem) dup3Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	oldfd, newfd, flags := args[0], args[1], args[2]
+	if flags &^ O_CLOEXEC != 0 || oldfd == newfd {
+		return errnoRet(EINVAL), true
+	}
+	vf := vfs.pcb.GetFdDetail(uintptr(oldfd))
+	if vf == nil {
+		return errnoRet(EBADF), true
+	}
+	if newfd >= uint64(MAX_FDS) {
+		return errnoRet(EBADF), true
+	}
+	vfs.pcb.InstallFd(uintptr(newfd), vf, flags & O_CLOEXEC != 0)
+	return newfd, true
+}
+/* syscall fcntl, fcntl64
+int fcntl(int fd, int cmd, ... arg);
+*/
+func (vfs *VirtualFileSystem) fcntl64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	fd, cmd, arg := args[0], args[1], args[2]
+	vf := vfs.pcb.GetFdDetail(uintptr(fd))
+	if vf == nil {
+		return errnoRet(EBADF), true
+	}
+	switch cmd {
+	case F_DUPFD:
+		return vfs.dupFd(fd, arg, false), true
+	case F_DUPFD_CLOEXEC:
+		return vfs.dupFd(fd, arg, true), true
+	case F_GETFD:
+		if vfs.pcb.CloseOnExec(uintptr(fd)) {
+			return FD_CLOEXEC, true
+		}
+		return 0, true
+	case F_SETFD:
+		vfs.pcb.SetCloseOnExec(uintptr(fd), arg & FD_CLOEXEC != 0)
+		return 0, true
+	case F_GETFL:
+		return vf.Flags, true
+	case F_SETFL:
+		vf.Flags = (vf.Flags &^ O_SETFL_MASK) | (arg & O_SETFL_MASK)
+		return 0, true
+	case F_GETLK, F_SETLK, F_SETLKW:
+		// a single process never contends for its own locks
+		if cmd == F_GETLK && arg != 0 {
+			// l_type = F_UNLCK
+			err := mu.MemWrite(arg, []byte{byte(F_UNLCK), 0})
+			if err != nil {
+				return errnoRet(EFAULT), true
+			}
+		}
+		return 0, true
+	case F_GETOWN, F_SETOWN:
+		return 0, true
+	}
+	vfs.logger.Debug().Uint64("fd", fd).Uint64("cmd", cmd).Msg("fcntl unsupported command")
+	return errnoRet(EINVAL), true
+}
+
+// writeFd writes through the description, honouring O_APPEND.
+func (vfs *VirtualFileSystem) writeFd(vf *VirtualFile, data []byte) (int, error) {
+	if vf.Flags & O_ACCMODE == O_RDONLY {
+		return 0, syscall.EBADF
+	}
+	if vf.Flags & O_APPEND != 0 {
+		vf.fo.Seek(0, 2)
+	}
+	return vf.fo.Write(data)
+}
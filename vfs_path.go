@@ -0,0 +1,222 @@
+package emulator
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// mounted read-only on a device, writes fail with EROFS
+	READONLY_PATHS = []string{"/system", "/vendor"}
+)
+
+// vfsErrno maps a backend error to the errno the guest sees.
+func vfsErrno(err error) uint64 {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return uint64(errno)
+	}
+	switch {
+	case os.IsNotExist(err):
+		return ENOENT
+	case os.IsExist(err):
+		return EEXIST
+	case os.IsPermission(err):
+		return EACCES
+	case err == os.ErrInvalid:
+		return EINVAL
+	}
+	return EIO
+}
+func isReadOnlyPath(p string) bool {
+	for _, ro := range READONLY_PATHS {
+		if p == ro || strings.HasPrefix(p, ro + "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// osOpenFlags decodes the guest O_* flags into os.O_* values.
+func osOpenFlags(flags uint64) int {
+	var flag int
+	switch flags & O_ACCMODE {
+	case O_WRONLY:
+		flag = os.O_WRONLY
+	case O_RDWR:
+		flag = os.O_RDWR
+	default:
+		flag = os.O_RDONLY
+	}
+	if flags & O_CREAT != 0 {
+		flag |= os.O_CREATE
+	}
+	if flags & O_EXCL != 0 {
+		flag |= os.O_EXCL
+	}
+	if flags & O_TRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	if flags & O_APPEND != 0 {
+		flag |= os.O_APPEND
+	}
+	return flag
+}
+
+// resolve turns a guest path, relative to dirfd or the cwd, into a clean
+// absolute path. Cleaning a rooted path drops any ".." above "/", host
+// symlinks are kept below the root by HostBackend.
+func (vfs *VirtualFileSystem) resolve(dirfd int64, name string) (string, uint64) {
+	if name == "" {
+		return "", ENOENT
+	}
+	if len(name) >= PATH_MAX {
+		return "", ENAMETOOLONG
+	}
+	if strings.HasPrefix(name, "/") {
+		return path.Clean(name), 0
+	}
+	base := vfs.pcb.Cwd()
+	if dirfd != AT_FDCWD {
+		vf := vfs.pcb.GetFdDetail(uintptr(dirfd))
+		if vf == nil {
+			return "", EBADF
+		}
+		fi, err := vf.fo.Stat()
+		if err != nil || !fi.IsDir() {
+			return "", ENOTDIR
+		}
+		base = vf.Name
+	}
+	return path.Clean(base + "/" + name), 0
+}
+func (vfs *VirtualFileSystem) readPath(mu uc.Unicorn, addr uint64) (string, uint64) {
+	if addr == 0 {
+		return "", EFAULT
+	}
+	var buf []byte
+	for len(buf) < PATH_MAX {
+		chunk, err := mu.MemRead(addr + uint64(len(buf)), 64)
+		if err != nil {
+			// the string may end right before an unmapped page
+			chunk, err = mu.MemRead(addr + uint64(len(buf)), 1)
+			if err != nil {
+				return "", EFAULT
+			}
+		}
+		for _, c := range chunk {
+			if c == 0 {
+				return string(buf), 0
+			}
+			buf = append(buf, c)
+		}
+	}
+	return "", ENAMETOOLONG
+}
+
+// openAt is open(2) and openat(2), it returns the new fd or an errno.
+func (vfs *VirtualFileSystem) openAt(dirfd int64, name string, flags, mode uint64) uint64 {
+	p, errno := vfs.resolve(dirfd, name)
+	if errno != 0 {
+		return errnoRet(errno)
+	}
+	flag := osOpenFlags(flags)
+	vfs.logger.Debug().
+		Str("path", p).
+		Str("flags", ConvHex("0%o", flags)).
+		Str("mode", ConvHex("0%o", mode)).
+		Msg("open file")
+	if flags & O_NOFOLLOW != 0 {
+		if fi, err := vfs.Lstat(p); err == nil && fi.Mode() & os.ModeSymlink != 0 {
+			return errnoRet(ELOOP)
+		}
+	}
+	var fo FileHandle
+	fi, err := vfs.Stat(p)
+	switch {
+	case err == nil:
+		if flags & O_CREAT != 0 && flags & O_EXCL != 0 {
+			return errnoRet(EEXIST)
+		}
+		if fi.IsDir() {
+			if flags & O_ACCMODE != O_RDONLY || flags & O_CREAT != 0 {
+				return errnoRet(EISDIR)
+			}
+			fo = NewDirHandle(p, fi)
+		}else if flags & O_DIRECTORY != 0 {
+			return errnoRet(ENOTDIR)
+		}
+	case !os.IsNotExist(err):
+		return errnoRet(vfsErrno(err))
+	case flags & O_CREAT == 0:
+		return errnoRet(ENOENT)
+	default:
+		parent, err := vfs.Stat(path.Dir(p))
+		if err != nil {
+			return errnoRet(ENOENT)
+		}
+		if !parent.IsDir() {
+			return errnoRet(ENOTDIR)
+		}
+	}
+	if fo == nil {
+		if isWriteFlag(flag) && isReadOnlyPath(p) {
+			return errnoRet(EROFS)
+		}
+		fo, err = vfs.OpenFile(p, flag, os.FileMode(mode & 0777))
+		if err != nil {
+			vfs.logger.Debug().Err(err).Str("path", p).Msg("failed to open file")
+			return errnoRet(vfsErrno(err))
+		}
+	}
+	vf := NewVirtualFile(p, vfs.host.Path(p), fo)
+	vf.Flags = flags &^ (O_CREAT | O_EXCL | O_NOCTTY | O_TRUNC | O_CLOEXEC)
+	fd, ok := vfs.pcb.AllocFd(vf, 0, flags & O_CLOEXEC != 0)
+	if !ok {
+		fo.Close()
+		return errnoRet(EMFILE)
+	}
+	vf.Description = fd
+	return uint64(fd)
+}
+
+// Mkdir creates a directory in the writable layer.
+func (vfs *VirtualFileSystem) Mkdir(p string, perm os.FileMode) uint64 {
+	if _, err := vfs.Lstat(p); err == nil {
+		return EEXIST
+	}
+	parent, err := vfs.Stat(path.Dir(p))
+	if err != nil {
+		return ENOENT
+	}
+	if !parent.IsDir() {
+		return ENOTDIR
+	}
+	if isReadOnlyPath(p) {
+		return EROFS
+	}
+	if vfs.mountFor(p) != nil {
+		return EACCES
+	}
+	err = vfs.files.Mkdir(p, perm)
+	if err != nil {
+		return vfsErrno(err)
+	}
+	return 0
+}
+func (vfs *VirtualFileSystem) chdir(p string) uint64 {
+	fi, err := vfs.Stat(p)
+	if err != nil {
+		return vfsErrno(err)
+	}
+	if !fi.IsDir() {
+		return ENOTDIR
+	}
+	vfs.pcb.SetCwd(p)
+	return 0
+}
@@ -0,0 +1,299 @@
+package emulator
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"syscall"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// default pipe capacity of the kernel
+	PIPE_SIZE = 65536
+
+	EFD_SEMAPHORE uint64 = 1
+	// largest value an eventfd counter holds
+	EVENTFD_MAX uint64 = 0xfffffffffffffffe
+
+	POLLIN     uint64 = 0x0001
+	POLLPRI    uint64 = 0x0002
+	POLLOUT    uint64 = 0x0004
+	POLLERR    uint64 = 0x0008
+	POLLHUP    uint64 = 0x0010
+	POLLNVAL   uint64 = 0x0020
+	POLLRDNORM uint64 = 0x0040
+	POLLWRNORM uint64 = 0x0100
+)
+
+// pollable is implemented by handles whose readiness changes, other
+// handles are always readable and writable.
+type pollable interface {
+	poll() uint64
+}
+
+func pollEvents(fo FileHandle) uint64 {
+	if p, ok := fo.(pollable); ok {
+		return p.poll()
+	}
+	return POLLIN | POLLOUT | POLLRDNORM | POLLWRNORM
+}
+
+// ioChanged lets threads blocked on a pipe, eventfd or socket retry.
+func (vfs *VirtualFileSystem) ioChanged() {
+	if vfs.sched != nil {
+		vfs.sched.ioWake()
+	}
+}
+// wouldBlock parks the caller until some I/O object changes, or fails with
+// EAGAIN for O_NONBLOCK descriptions and when nothing else could run.
+func (vfs *VirtualFileSystem) wouldBlock(mu uc.Unicorn, vf *VirtualFile, op string) (uint64, bool) {
+	if vf.Flags & O_NONBLOCK == 0 && vfs.sched != nil {
+		if vfs.sched.ioBlock(mu, fmt.Sprintf("%s %s", op, vf.Name), false) {
+			return 0, false
+		}
+		vfs.logger.Debug().Str("op", op).Str("file", vf.Name).Msg("would block forever, single thread")
+	}
+	return errnoRet(EAGAIN), true
+}
+// installAnon puts a handle without a path on a new fd.
+func (vfs *VirtualFileSystem) installAnon(name string, fo FileHandle, flags uint64) (uintptr, bool) {
+	vf := NewVirtualFile(name, "", fo)
+	vf.Flags = flags &^ O_CLOEXEC
+	fd, ok := vfs.pcb.AllocFd(vf, 0, flags & O_CLOEXEC != 0)
+	if !ok {
+		return 0, false
+	}
+	vf.Description = fd
+	return fd, true
+}
+
+/*
+	pipes
+*/
+
+type pipeBuffer struct {
+	ino     uint64
+	data    []byte
+	readers int
+	writers int
+	vfs     *VirtualFileSystem
+}
+
+// pipeEnd is one side of a pipe.
+type pipeEnd struct {
+	pipe   *pipeBuffer
+	write  bool
+	closed bool
+}
+func (h *pipeEnd) Read(b []byte) (int, error) {
+	p := h.pipe
+	if h.write {
+		return 0, syscall.EBADF
+	}
+	if len(p.data) < 1 {
+		if p.writers < 1 {
+			return 0, nil
+		}
+		return 0, syscall.EAGAIN
+	}
+	n := copy(b, p.data)
+	p.data = p.data[n:]
+	p.vfs.ioChanged()
+	return n, nil
+}
+func (h *pipeEnd) Write(b []byte) (int, error) {
+	p := h.pipe
+	if !h.write {
+		return 0, syscall.EBADF
+	}
+	if p.readers < 1 {
+		return 0, syscall.EPIPE
+	}
+	space := PIPE_SIZE - len(p.data)
+	if space < 1 {
+		return 0, syscall.EAGAIN
+	}
+	if len(b) > space {
+		b = b[:space]
+	}
+	p.data = append(p.data, b...)
+	p.vfs.ioChanged()
+	return len(b), nil
+}
+func (h *pipeEnd) Seek(offset int64, whence int) (int64, error) {
+	return 0, syscall.ESPIPE
+}
+func (h *pipeEnd) Close() error {
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	if h.write {
+		h.pipe.writers--
+	}else{
+		h.pipe.readers--
+	}
+	h.pipe.vfs.ioChanged()
+	return nil
+}
+func (h *pipeEnd) Stat() (os.FileInfo, error) {
+	return &fileInfo{
+		name: fmt.Sprintf("pipe:[%d]", h.pipe.ino),
+		size: int64(len(h.pipe.data)),
+		mode: os.ModeNamedPipe | 0600,
+		modTime: time.Now(),
+	}, nil
+}
+func (h *pipeEnd) poll() uint64 {
+	p := h.pipe
+	var ev uint64
+	if h.write {
+		if p.readers < 1 {
+			ev |= POLLERR
+		}else if len(p.data) < PIPE_SIZE {
+			ev |= POLLOUT | POLLWRNORM
+		}
+		return ev
+	}
+	if len(p.data) > 0 {
+		ev |= POLLIN | POLLRDNORM
+	}
+	if p.writers < 1 {
+		ev |= POLLHUP
+	}
+	return ev
+}
+
+func (vfs *VirtualFileSystem) pipe(mu uc.Unicorn, pipefd, flags uint64) uint64 {
+	if flags &^ (O_CLOEXEC | O_NONBLOCK | O_DIRECT) != 0 {
+		return errnoRet(EINVAL)
+	}
+	p := &pipeBuffer{
+		ino: statIno(fmt.Sprintf("pipe:%d", time.Now().UnixNano())),
+		readers: 1,
+		writers: 1,
+		vfs: vfs,
+	}
+	name := fmt.Sprintf("pipe:[%d]", p.ino)
+	r, w := &pipeEnd{pipe: p}, &pipeEnd{pipe: p, write: true}
+	rfd, ok := vfs.installAnon(name, r, flags | O_RDONLY)
+	if !ok {
+		return errnoRet(EMFILE)
+	}
+	wfd, ok := vfs.installAnon(name, w, flags | O_WRONLY)
+	if !ok {
+		vfs.pcb.Remove(rfd)
+		w.Close()
+		return errnoRet(EMFILE)
+	}
+	buf := append(IntToBytes(int64(rfd), 4), IntToBytes(int64(wfd), 4)...)
+	err := mu.MemWrite(pipefd, buf)
+	if err != nil {
+		vfs.pcb.Remove(rfd)
+		vfs.pcb.Remove(wfd)
+		return errnoRet(EFAULT)
+	}
+	vfs.logger.Debug().Uint64("r", uint64(rfd)).Uint64("w", uint64(wfd)).Msg("pipe created")
+	return 0
+}
+/* syscall pipe
+int pipe(int pipefd[2]);
+*/
+func (vfs *VirtualFileSystem) pipeHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.pipe(mu, args[0], 0), true
+}
+/* syscall pipe2
+int pipe2(int pipefd[2], int flags);
+*/
+func (vfs *VirtualFileSystem) pipe2Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.pipe(mu, args[0], args[1]), true
+}
+
+/*
+	eventfd
+*/
+
+type eventFd struct {
+	count     uint64
+	semaphore bool
+	vfs       *VirtualFileSystem
+}
+func (h *eventFd) Read(b []byte) (int, error) {
+	if len(b) < 8 {
+		return 0, syscall.EINVAL
+	}
+	if h.count == 0 {
+		return 0, syscall.EAGAIN
+	}
+	v := h.count
+	if h.semaphore {
+		v = 1
+	}
+	h.count -= v
+	copy(b, IntToBytes(int64(v), 8))
+	h.vfs.ioChanged()
+	return 8, nil
+}
+func (h *eventFd) Write(b []byte) (int, error) {
+	if len(b) < 8 {
+		return 0, syscall.EINVAL
+	}
+	v := LE_BytesToUint64(b[:8])
+	if v > EVENTFD_MAX {
+		return 0, syscall.EINVAL
+	}
+	if h.count + v > EVENTFD_MAX || h.count + v < h.count {
+		return 0, syscall.EAGAIN
+	}
+	h.count += v
+	h.vfs.ioChanged()
+	return 8, nil
+}
+func (h *eventFd) Seek(offset int64, whence int) (int64, error) {
+	return 0, syscall.ESPIPE
+}
+func (h *eventFd) Close() error {
+	return nil
+}
+func (h *eventFd) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: "[eventfd]", mode: 0600, modTime: time.Now()}, nil
+}
+func (h *eventFd) poll() uint64 {
+	var ev uint64
+	if h.count > 0 {
+		ev |= POLLIN | POLLRDNORM
+	}
+	if h.count < EVENTFD_MAX {
+		ev |= POLLOUT | POLLWRNORM
+	}
+	return ev
+}
+
+func (vfs *VirtualFileSystem) eventfd(initval, flags uint64) uint64 {
+	if flags &^ (O_CLOEXEC | O_NONBLOCK | EFD_SEMAPHORE) != 0 {
+		return errnoRet(EINVAL)
+	}
+	h := &eventFd{
+		count: initval & 0xffffffff,
+		semaphore: flags & EFD_SEMAPHORE != 0,
+		vfs: vfs,
+	}
+	fd, ok := vfs.installAnon("anon_inode:[eventfd]", h, (flags &^ EFD_SEMAPHORE) | O_RDWR)
+	if !ok {
+		return errnoRet(EMFILE)
+	}
+	return uint64(fd)
+}
+/* syscall eventfd
+int eventfd(unsigned int initval);
+*/
+func (vfs *VirtualFileSystem) eventfdHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.eventfd(args[0], 0), true
+}
+/* syscall eventfd2
+int eventfd2(unsigned int initval, int flags);
+*/
+func (vfs *VirtualFileSystem) eventfd2Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.eventfd(args[0], args[1]), true
+}
@@ -0,0 +1,402 @@
+package emulator
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"syscall"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	EPOLL_CTL_ADD uint64 = 1
+	EPOLL_CTL_DEL uint64 = 2
+	EPOLL_CTL_MOD uint64 = 3
+
+	EPOLLRDHUP   uint64 = 0x2000
+	EPOLLONESHOT uint64 = 1 << 30
+	EPOLLET      uint64 = 1 << 31
+
+	// struct epoll_event is not packed on ARM EABI
+	EPOLL_EVENT_SIZE uint64 = 16
+	// struct pollfd
+	POLLFD_SIZE uint64 = 8
+	// bits in an fd_set
+	FD_SETSIZE uint64 = 1024
+)
+
+type epollItem struct {
+	fd       uintptr
+	file     *VirtualFile
+	events   uint64
+	data     uint64
+	disabled bool
+	// last readiness reported, for EPOLLET
+	last     uint64
+}
+
+// epollFd is the interest list of an epoll instance.
+type epollFd struct {
+	vfs   *VirtualFileSystem
+	items []*epollItem
+}
+func (h *epollFd) Read(b []byte) (int, error) {
+	return 0, syscall.EINVAL
+}
+func (h *epollFd) Write(b []byte) (int, error) {
+	return 0, syscall.EINVAL
+}
+func (h *epollFd) Seek(offset int64, whence int) (int64, error) {
+	return 0, syscall.ESPIPE
+}
+func (h *epollFd) Close() error {
+	h.items = nil
+	return nil
+}
+func (h *epollFd) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: "[eventpoll]", mode: 0600, modTime: time.Now()}, nil
+}
+func (h *epollFd) find(fd uintptr) int {
+	for i, it := range h.items {
+		if it.fd == fd {
+			return i
+		}
+	}
+	return -1
+}
+// ready collects up to max events, it drops items whose fd was closed.
+func (h *epollFd) ready(max int) []*epollItem {
+	var res []*epollItem
+	live := h.items[:0]
+	for _, it := range h.items {
+		if h.vfs.pcb.GetFdDetail(it.fd) != it.file {
+			continue
+		}
+		live = append(live, it)
+		if it.disabled || len(res) >= max {
+			continue
+		}
+		var ev uint64
+		if _, nested := it.file.fo.(*epollFd); !nested {
+			ev = pollEvents(it.file.fo) & (it.events | POLLERR | POLLHUP)
+		}
+		if it.events & EPOLLET != 0 {
+			fresh := ev &^ it.last
+			it.last = ev
+			ev = fresh
+		}
+		if ev == 0 {
+			continue
+		}
+		if it.events & EPOLLONESHOT != 0 {
+			it.disabled = true
+		}
+		res = append(res, &epollItem{fd: it.fd, events: ev, data: it.data})
+	}
+	h.items = live
+	return res
+}
+func (h *epollFd) poll() uint64 {
+	for _, it := range h.items {
+		if it.disabled {
+			continue
+		}
+		if _, nested := it.file.fo.(*epollFd); nested {
+			continue
+		}
+		if pollEvents(it.file.fo) & (it.events | POLLERR | POLLHUP) != 0 {
+			return POLLIN | POLLRDNORM
+		}
+	}
+	return 0
+}
+
+// blockPoll decides what a poll call with nothing ready does, timeout is
+// in milliseconds with -1 for forever. It returns hasRet false when the
+// thread was parked.
+func (vfs *VirtualFileSystem) blockPoll(mu uc.Unicorn, what string, timeout int64) (uint64, bool) {
+	if timeout == 0 {
+		return 0, true
+	}
+	if vfs.sched != nil && vfs.sched.ioBlock(mu, what, timeout > 0) {
+		return 0, false
+	}
+	if timeout > 0 {
+		// time is virtual, the timeout elapses right away
+		return 0, true
+	}
+	vfs.logger.Debug().Str("call", what).Msg("would block forever, single thread")
+	return errnoRet(EAGAIN), true
+}
+// readTimespecMs reads a struct timespec, two longs.
+func readTimespecMs(mu uc.Unicorn, addr uint64) (int64, error) {
+	if addr == 0 {
+		return -1, nil
+	}
+	ptr := archOf(mu).PtrSize
+	b, err := mu.MemRead(addr, 2 * ptr)
+	if err != nil {
+		return 0, err
+	}
+	sec := int64(int32(LE_BytesToUint32(b[0:4])))
+	nsec := int64(int32(LE_BytesToUint32(b[4:8])))
+	if ptr == 8 {
+		sec = int64(LE_BytesToUint64(b[0:8]))
+		nsec = int64(LE_BytesToUint64(b[8:16]))
+	}
+	return sec * 1000 + nsec / 1000000, nil
+}
+
+func (vfs *VirtualFileSystem) epollCreate(flags uint64) uint64 {
+	if flags &^ O_CLOEXEC != 0 {
+		return errnoRet(EINVAL)
+	}
+	fd, ok := vfs.installAnon("anon_inode:[eventpoll]", &epollFd{vfs: vfs}, flags | O_RDWR)
+	if !ok {
+		return errnoRet(EMFILE)
+	}
+	return uint64(fd)
+}
+/* syscall epoll_create
+int epoll_create(int size);
+*/
+func (vfs *VirtualFileSystem) epollCreateHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	if int32(args[0]) <= 0 {
+		return errnoRet(EINVAL), true
+	}
+	return vfs.epollCreate(0), true
+}
+/* syscall epoll_create1
+int epoll_create1(int flags);
+*/
+func (vfs *VirtualFileSystem) epollCreate1Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.epollCreate(args[0]), true
+}
+/* syscall epoll_ctl
+int epoll_ctl(int epfd, int op, int fd, struct epoll_event *event);
+*/
+func (vfs *VirtualFileSystem) epollCtlHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	epfd, op, fd, event := args[0], args[1], uintptr(args[2]), args[3]
+	ep := vfs.pcb.GetFdDetail(uintptr(epfd))
+	vf := vfs.pcb.GetFdDetail(fd)
+	if ep == nil || vf == nil {
+		return errnoRet(EBADF), true
+	}
+	h, ok := ep.fo.(*epollFd)
+	if !ok || ep == vf {
+		return errnoRet(EINVAL), true
+	}
+	var events, data uint64
+	if op != EPOLL_CTL_DEL {
+		b, err := mu.MemRead(event, EPOLL_EVENT_SIZE)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		events = uint64(LE_BytesToUint32(b[0:4]))
+		data = LE_BytesToUint64(b[8:16])
+	}
+	idx := h.find(fd)
+	switch op {
+	case EPOLL_CTL_ADD:
+		if idx >= 0 {
+			return errnoRet(EEXIST), true
+		}
+		h.items = append(h.items, &epollItem{fd: fd, file: vf, events: events, data: data})
+	case EPOLL_CTL_MOD:
+		if idx < 0 {
+			return errnoRet(ENOENT), true
+		}
+		it := h.items[idx]
+		it.events, it.data, it.disabled, it.last = events, data, false, 0
+	case EPOLL_CTL_DEL:
+		if idx < 0 {
+			return errnoRet(ENOENT), true
+		}
+		h.items = append(h.items[:idx], h.items[idx+1:]...)
+	default:
+		return errnoRet(EINVAL), true
+	}
+	vfs.logger.Debug().
+		Uint64("epfd", epfd).
+		Uint64("op", op).
+		Uint64("fd", uint64(fd)).
+		Str("events", ConvHex("0x%X", events)).
+		Msg("epoll_ctl")
+	return 0, true
+}
+func (vfs *VirtualFileSystem) epollWait(mu uc.Unicorn, epfd, events, maxevents uint64, timeout int64) (uint64, bool) {
+	ep := vfs.pcb.GetFdDetail(uintptr(epfd))
+	if ep == nil {
+		return errnoRet(EBADF), true
+	}
+	h, ok := ep.fo.(*epollFd)
+	if !ok || int32(maxevents) <= 0 {
+		return errnoRet(EINVAL), true
+	}
+	ready := h.ready(int(int32(maxevents)))
+	if len(ready) < 1 {
+		return vfs.blockPoll(mu, fmt.Sprintf("epoll_wait %d", epfd), timeout)
+	}
+	buf := make([]byte, uint64(len(ready)) * EPOLL_EVENT_SIZE)
+	for i, it := range ready {
+		off := uint64(i) * EPOLL_EVENT_SIZE
+		copy(buf[off:], IntToBytes(int64(it.events), 4))
+		copy(buf[off+8:], IntToBytes(int64(it.data), 8))
+	}
+	err := mu.MemWrite(events, buf)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return uint64(len(ready)), true
+}
+/* syscall epoll_wait
+int epoll_wait(int epfd, struct epoll_event *events, int maxevents, int timeout);
+*/
+func (vfs *VirtualFileSystem) epollWaitHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.epollWait(mu, args[0], args[1], args[2], int64(int32(args[3])))
+}
+/* syscall epoll_pwait
+int epoll_pwait(int epfd, struct epoll_event *events, int maxevents, int timeout, const sigset_t *sigmask);
+*/
+func (vfs *VirtualFileSystem) epollPwaitHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.epollWait(mu, args[0], args[1], args[2], int64(int32(args[3])))
+}
+
+func (vfs *VirtualFileSystem) poll(mu uc.Unicorn, fds, nfds uint64, timeout int64) (uint64, bool) {
+	if nfds > uint64(MAX_FDS) {
+		return errnoRet(EINVAL), true
+	}
+	if nfds == 0 {
+		return vfs.blockPoll(mu, "poll", timeout)
+	}
+	buf, err := mu.MemRead(fds, nfds * POLLFD_SIZE)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	n := uint64(0)
+	for i := uint64(0); i < nfds; i++ {
+		ent := buf[i*POLLFD_SIZE:]
+		fd := int32(LE_BytesToUint32(ent[0:4]))
+		events := uint64(ent[4]) | uint64(ent[5]) << 8
+		var revents uint64
+		if fd >= 0 {
+			vf := vfs.pcb.GetFdDetail(uintptr(fd))
+			if vf == nil {
+				revents = POLLNVAL
+			}else{
+				revents = pollEvents(vf.fo) & (events | POLLERR | POLLHUP)
+			}
+		}
+		ent[6], ent[7] = byte(revents), byte(revents >> 8)
+		if revents != 0 {
+			n++
+		}
+	}
+	// a retried call reads events again, revents can be cleared now
+	err = mu.MemWrite(fds, buf)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	if n == 0 {
+		return vfs.blockPoll(mu, "poll", timeout)
+	}
+	return n, true
+}
+/* syscall poll
+int poll(struct pollfd *fds, nfds_t nfds, int timeout);
+*/
+func (vfs *VirtualFileSystem) pollHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.poll(mu, args[0], args[1], int64(int32(args[2])))
+}
+/* syscall ppoll
+int ppoll(struct pollfd *fds, nfds_t nfds, const struct timespec *tmo_p, const sigset_t *sigmask);
+*/
+func (vfs *VirtualFileSystem) ppollHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	timeout, err := readTimespecMs(mu, args[2])
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return vfs.poll(mu, args[0], args[1], timeout)
+}
+
+func (vfs *VirtualFileSystem) selectFds(mu uc.Unicorn, nfds, readfds, writefds, exceptfds uint64, timeout int64) (uint64, bool) {
+	if int32(nfds) < 0 || nfds > FD_SETSIZE {
+		return errnoRet(EINVAL), true
+	}
+	size := (nfds + 31) / 32 * 4
+	sets := []uint64{readfds, writefds, exceptfds}
+	want := []uint64{POLLIN | POLLHUP | POLLERR, POLLOUT | POLLERR, POLLPRI}
+	in := make([][]byte, 3)
+	out := make([][]byte, 3)
+	for i, addr := range sets {
+		if addr == 0 || size == 0 {
+			continue
+		}
+		b, err := mu.MemRead(addr, size)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		in[i] = b
+		out[i] = make([]byte, size)
+	}
+	n := uint64(0)
+	for fd := uint64(0); fd < nfds; fd++ {
+		byteIdx, bit := fd / 8, byte(1) << (fd % 8)
+		for i := range sets {
+			if in[i] == nil || in[i][byteIdx] & bit == 0 {
+				continue
+			}
+			vf := vfs.pcb.GetFdDetail(uintptr(fd))
+			if vf == nil {
+				return errnoRet(EBADF), true
+			}
+			if pollEvents(vf.fo) & want[i] != 0 {
+				out[i][byteIdx] |= bit
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		ret, hasRet := vfs.blockPoll(mu, "select", timeout)
+		if !hasRet || ret != 0 {
+			// a parked thread needs its sets as they were
+			return ret, hasRet
+		}
+	}
+	for i, addr := range sets {
+		if out[i] == nil {
+			continue
+		}
+		err := mu.MemWrite(addr, out[i])
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+	}
+	return n, true
+}
+/* syscall _newselect
+int select(int nfds, fd_set *readfds, fd_set *writefds, fd_set *exceptfds, struct timeval *timeout);
+*/
+func (vfs *VirtualFileSystem) newselectHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	timeout := int64(-1)
+	if args[4] != 0 {
+		b, err := mu.MemRead(args[4], 8)
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		sec := int64(int32(LE_BytesToUint32(b[0:4])))
+		usec := int64(int32(LE_BytesToUint32(b[4:8])))
+		timeout = sec * 1000 + usec / 1000
+	}
+	return vfs.selectFds(mu, args[0], args[1], args[2], args[3], timeout)
+}
+/* syscall pselect6
+int pselect6(int nfds, fd_set *readfds, fd_set *writefds, fd_set *exceptfds, const struct timespec *timeout, void *sigmask);
+*/
+func (vfs *VirtualFileSystem) pselect6Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	timeout, err := readTimespecMs(mu, args[4])
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return vfs.selectFds(mu, args[0], args[1], args[2], args[3], timeout)
+}
@@ -0,0 +1,564 @@
+package emulator
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"time"
+	"bytes"
+	"strings"
+	"strconv"
+	fp  "path/filepath"
+	zl  "github.com/rs/zerolog"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	PROC_ENVIRON = []string{
+		"ANDROID_ROOT=/system",
+		"ANDROID_DATA=/data",
+		"ANDROID_STORAGE=/storage",
+		"EXTERNAL_STORAGE=/sdcard",
+		"ASEC_MOUNTPOINT=/mnt/asec",
+		"PATH=/sbin:/system/sbin:/system/bin:/system/xbin:/vendor/bin",
+		"BOOTCLASSPATH=/system/framework/core-libart.jar:/system/framework/framework.jar",
+		"ANDROID_ASSETS=/system/app",
+		"ANDROID_BOOTLOGO=1",
+	}
+	PROC_VERSION = "Linux version 3.18.71-perf (builder@android) (gcc version 4.9.x 20150123 (prerelease) (GCC) ) #1 SMP PREEMPT Tue Jan 8 12:00:00 CST 2019\n"
+	PROC_MOUNTS = `rootfs / rootfs ro,seclabel,relatime 0 0
+tmpfs /dev tmpfs rw,seclabel,nosuid,relatime,mode=755 0 0
+devpts /dev/pts devpts rw,seclabel,relatime,mode=600 0 0
+proc /proc proc rw,relatime,gid=3009,hidepid=2 0 0
+sysfs /sys sysfs rw,seclabel,relatime 0 0
+/dev/block/dm-0 /system ext4 ro,seclabel,relatime,discard,data=ordered 0 0
+/dev/block/dm-1 /vendor ext4 ro,seclabel,relatime,discard,data=ordered 0 0
+/dev/block/dm-2 /data ext4 rw,seclabel,nosuid,nodev,noatime,noauto_da_alloc,data=ordered 0 0
+tmpfs /storage tmpfs rw,seclabel,relatime,mode=755,gid=1000 0 0
+/dev/fuse /storage/emulated fuse rw,nosuid,nodev,noexec,noatime,user_id=1023,group_id=1023,default_permissions,allow_other 0 0
+`
+	PROC_CPUINFO_CORES = 4
+	PROC_MEM_TOTAL_KB uint64 = 3809548
+	PROC_STATUS = `Name:	{comm}
+State:	{state}
+Tgid:	{tgid}
+Pid:	{pid}
+PPid:	{ppid}
+TracerPid:	{tracer_pid}
+Uid:	{uid}	{uid}	{uid}	{uid}
+Gid:	{uid}	{uid}	{uid}	{uid}
+FDSize:	{fd_size}
+Groups:	3003 9997 {data_gid}
+VmPeak:	{vm_kb} kB
+VmSize:	{vm_kb} kB
+VmLck:	       0 kB
+VmPin:	       0 kB
+VmHWM:	{rss_kb} kB
+VmRSS:	{rss_kb} kB
+VmData:	{data_kb} kB
+VmStk:	{stk_kb} kB
+VmExe:	       8 kB
+VmLib:	{lib_kb} kB
+VmPTE:	     536 kB
+VmSwap:	       0 kB
+Threads:	{threads}
+SigQ:	0/12272
+SigPnd:	{sig_pnd}
+ShdPnd:	{shd_pnd}
+SigBlk:	{sig_blk}
+SigIgn:	{sig_ign}
+SigCgt:	{sig_cgt}
+CapInh:	0000000000000000
+CapPrm:	0000000000000000
+CapEff:	0000000000000000
+CapBnd:	0000000000000000
+Cpus_allowed:	f
+Cpus_allowed_list:	0-3
+voluntary_ctxt_switches:	5225
+nonvoluntary_ctxt_switches:	11520
+`
+	// AT_* keys of the rendered auxv
+	AT_NULL   uint64 = 0
+	AT_PHDR   uint64 = 3
+	AT_PHENT  uint64 = 4
+	AT_PHNUM  uint64 = 5
+	AT_PAGESZ uint64 = 6
+	AT_BASE   uint64 = 7
+	AT_FLAGS  uint64 = 8
+	AT_ENTRY  uint64 = 9
+	AT_UID    uint64 = 11
+	AT_EUID   uint64 = 12
+	AT_GID    uint64 = 13
+	AT_EGID   uint64 = 14
+	AT_PLATFORM uint64 = 15
+	AT_HWCAP  uint64 = 16
+	AT_CLKTCK uint64 = 17
+	AT_SECURE uint64 = 23
+	AT_RANDOM uint64 = 25
+	AT_HWCAP2 uint64 = 26
+	AT_EXECFN uint64 = 31
+
+	// swp half thumb fastmult vfp edsp neon vfpv3 tls vfpv4 idiva idivt
+	ARM_HWCAP uint64 = 0x0007b0d7
+)
+
+// ProcFS renders /proc from the live emulator on every read, a file that
+// is read again after mmap or clone shows the change.
+type ProcFS struct {
+	emu    *Emulator
+	logger zl.Logger
+}
+func NewProcFS(emu *Emulator, logger zl.Logger) *ProcFS {
+	return &ProcFS{
+		emu: emu,
+		logger: logger,
+	}
+}
+
+// procNode is what a /proc path resolves to.
+type procNode struct {
+	path   string
+	render func() []byte
+	link   string
+	dir    func() []string
+}
+
+// procHandle renders its file again on every read, like seq_file.
+type procHandle struct {
+	name   string
+	render func() []byte
+	off    int64
+}
+func (h *procHandle) Read(b []byte) (int, error) {
+	data := h.render()
+	if h.off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, data[h.off:])
+	h.off += int64(n)
+	return n, nil
+}
+func (h *procHandle) Write(b []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+func (h *procHandle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += h.off
+	case io.SeekEnd:
+		offset += int64(len(h.render()))
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	h.off = offset
+	return h.off, nil
+}
+func (h *procHandle) Close() error {
+	return nil
+}
+func (h *procHandle) Stat() (os.FileInfo, error) {
+	// procfs files report a zero size
+	return &fileInfo{name: h.name, mode: 0444, modTime: time.Now()}, nil
+}
+
+func (pf *ProcFS) pid() int {
+	return pf.emu.Processes.Pid()
+}
+func (pf *ProcFS) tids() []int {
+	var res []int
+	for _, t := range pf.emu.Scheduler.Threads() {
+		if t.State != ThreadExited {
+			res = append(res, t.Tid)
+		}
+	}
+	if len(res) < 1 {
+		res = append(res, pf.pid())
+	}
+	return res
+}
+func (pf *ProcFS) probe(vector, path string) {
+	pf.emu.AntiDebug.Probe(vector, path)
+}
+
+// lookup resolves a clean path below /proc.
+func (pf *ProcFS) lookup(p string) *procNode {
+	rel := strings.TrimPrefix(p, "/proc")
+	rel = strings.TrimPrefix(rel, "/")
+	switch rel {
+	case "":
+		return &procNode{path: p, dir: func() []string {
+			return []string{"self", strconv.Itoa(pf.pid()), "cpuinfo", "meminfo", "version", "mounts", "net"}
+		}}
+	case "cpuinfo":
+		return &procNode{path: p, render: pf.cpuinfo}
+	case "meminfo":
+		return &procNode{path: p, render: pf.meminfo}
+	case "version":
+		return &procNode{path: p, render: func() []byte { return []byte(PROC_VERSION) }}
+	case "mounts":
+		return &procNode{path: p, render: func() []byte { return []byte(PROC_MOUNTS) }}
+	case "net":
+		return &procNode{path: p, dir: func() []string { return []string{"tcp", "tcp6"} }}
+	case "net/tcp", "net/tcp6":
+		return &procNode{path: p, render: pf.netTcp}
+	}
+	parts := strings.SplitN(rel, "/", 2)
+	if parts[0] != "self" && parts[0] != strconv.Itoa(pf.pid()) {
+		return nil
+	}
+	rest := ""
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+	return pf.lookupProcess(p, pf.pid(), rest)
+}
+func (pf *ProcFS) lookupProcess(p string, tid int, rel string) *procNode {
+	switch rel {
+	case "":
+		return &procNode{path: p, dir: func() []string {
+			return []string{"auxv", "cgroup", "cmdline", "comm", "cwd", "environ", "exe",
+				"fd", "maps", "mounts", "net", "stat", "status", "task", "wchan"}
+		}}
+	case "maps":
+		return &procNode{path: p, render: pf.maps}
+	case "status":
+		return &procNode{path: p, render: func() []byte { return pf.status(tid) }}
+	case "stat":
+		return &procNode{path: p, render: func() []byte { return pf.stat(tid) }}
+	case "cmdline":
+		return &procNode{path: p, render: func() []byte { return append([]byte(pf.emu.config.PkgName), 0) }}
+	case "comm":
+		return &procNode{path: p, render: func() []byte { return []byte(pf.emu.AntiDebug.comm() + "\n") }}
+	case "wchan":
+		return &procNode{path: p, render: func() []byte { return []byte(pf.emu.config.AntiDebug.Wchan) }}
+	case "cgroup":
+		return &procNode{path: p, render: func() []byte {
+			return []byte(fmt.Sprintf("2:cpu:/apps\n1:cpuacct:/uid/%d\n", pf.emu.config.Uid))
+		}}
+	case "environ":
+		return &procNode{path: p, render: pf.environ}
+	case "auxv":
+		return &procNode{path: p, render: pf.auxv}
+	case "mounts":
+		return &procNode{path: p, render: func() []byte { return []byte(PROC_MOUNTS) }}
+	case "net":
+		return &procNode{path: p, dir: func() []string { return []string{"tcp", "tcp6"} }}
+	case "net/tcp", "net/tcp6":
+		return &procNode{path: p, render: pf.netTcp}
+	case "exe":
+		return &procNode{path: p, link: pf.emu.Arch.AppProcess}
+	case "cwd":
+		return &procNode{path: p, link: pf.emu.Pcb.Cwd()}
+	case "fd":
+		return &procNode{path: p, dir: pf.fdNames}
+	case "task":
+		return &procNode{path: p, dir: func() []string {
+			var res []string
+			for _, t := range pf.tids() {
+				res = append(res, strconv.Itoa(t))
+			}
+			return res
+		}}
+	}
+	if strings.HasPrefix(rel, "fd/") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(rel, "fd/"))
+		if err != nil {
+			return nil
+		}
+		vf := pf.emu.Pcb.GetFdDetail(uintptr(fd))
+		if vf == nil {
+			return nil
+		}
+		return &procNode{path: p, link: pf.fdTarget(vf)}
+	}
+	if strings.HasPrefix(rel, "task/") && tid == pf.pid() {
+		parts := strings.SplitN(strings.TrimPrefix(rel, "task/"), "/", 2)
+		t, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil
+		}
+		found := false
+		for _, x := range pf.tids() {
+			if x == t {
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+		rest := ""
+		if len(parts) == 2 {
+			rest = parts[1]
+		}
+		switch rest {
+		case "", "status", "stat", "comm", "wchan", "cgroup":
+			return pf.lookupProcess(p, t, rest)
+		}
+	}
+	return nil
+}
+
+func (pf *ProcFS) Open(path string, flag int) (FileHandle, error) {
+	n := pf.lookup(path)
+	if n == nil {
+		return nil, os.ErrNotExist
+	}
+	if n.link != "" {
+		// follow the link through the vfs
+		return pf.emu.Vfs.Open(n.link, flag)
+	}
+	if n.render == nil {
+		return nil, os.ErrPermission
+	}
+	if isWriteFlag(flag) {
+		return nil, os.ErrPermission
+	}
+	switch fp.Base(path) {
+	case "status":
+		pf.probe(PROBE_STATUS, path)
+	case "stat":
+		pf.probe(PROBE_STAT, path)
+	case "wchan":
+		pf.probe(PROBE_WCHAN, path)
+	case "comm":
+		pf.probe(PROBE_COMM, path)
+	case "maps":
+		pf.probe(PROBE_MAPS, path)
+	}
+	return &procHandle{
+		name: fp.Base(path),
+		render: n.render,
+	}, nil
+}
+func (pf *ProcFS) Stat(path string) (os.FileInfo, error) {
+	n := pf.lookup(path)
+	if n == nil {
+		return nil, os.ErrNotExist
+	}
+	fi := &fileInfo{name: fp.Base(path), mode: 0444, modTime: time.Now()}
+	if n.dir != nil {
+		fi.mode = os.ModeDir | 0555
+	}else if n.link != "" {
+		return pf.emu.Vfs.Stat(n.link)
+	}
+	return fi, nil
+}
+// Lstat is Stat without following /proc links.
+func (pf *ProcFS) Lstat(path string) (os.FileInfo, error) {
+	n := pf.lookup(path)
+	if n != nil && n.link != "" {
+		return &fileInfo{name: fp.Base(path), mode: os.ModeSymlink | 0777, modTime: time.Now()}, nil
+	}
+	return pf.Stat(path)
+}
+// ReadDir lists a /proc directory.
+func (pf *ProcFS) ReadDir(path string) ([]os.FileInfo, error) {
+	n := pf.lookup(path)
+	if n == nil {
+		return nil, os.ErrNotExist
+	}
+	if n.dir == nil {
+		return nil, os.ErrInvalid
+	}
+	var res []os.FileInfo
+	for _, name := range n.dir() {
+		fi, err := pf.Lstat(path + "/" + name)
+		if err != nil {
+			continue
+		}
+		res = append(res, fi)
+	}
+	return res, nil
+}
+// Readlink resolves exe, cwd and fd/N.
+func (pf *ProcFS) Readlink(path string) (string, error) {
+	n := pf.lookup(path)
+	if n == nil {
+		return "", os.ErrNotExist
+	}
+	if n.link == "" {
+		return "", os.ErrInvalid
+	}
+	return n.link, nil
+}
+
+/*
+	renderers
+*/
+
+func (pf *ProcFS) fdNames() []string {
+	var res []string
+	for _, fd := range pf.emu.Pcb.Fds() {
+		res = append(res, strconv.Itoa(int(fd)))
+	}
+	return res
+}
+func (pf *ProcFS) fdTarget(vf *VirtualFile) string {
+	switch vf.Name {
+	case "stdin", "stdout", "stderr":
+		// zygote children have their std streams on /dev/null
+		return "/dev/null"
+	}
+	return vf.Name
+}
+func (pf *ProcFS) maps() []byte {
+	var maps bytes.Buffer
+	err := pf.emu.Memory.DumpMaps(&maps)
+	if err != nil {
+		pf.logger.Debug().Err(err).Msg("failed to dump maps memory")
+	}
+	return pf.emu.AntiDebug.FilterMaps(maps.Bytes())
+}
+
+// memStats returns the mapped, stack and library sizes in kB.
+func (pf *ProcFS) memStats() (total, stack, lib uint64) {
+	for _, v := range pf.emu.Memory.Vmas() {
+		sz := v.Size()
+		total += sz
+		if v.Name == "[stack]" {
+			stack += sz
+		}
+		if v.File != nil && v.Prot & uc.PROT_EXEC != 0 {
+			lib += sz
+		}
+	}
+	return total / 1024, stack / 1024, lib / 1024
+}
+func sigSetHex(set uint64) string {
+	return fmt.Sprintf("%016x", set)
+}
+func (pf *ProcFS) status(tid int) []byte {
+	emu := pf.emu
+	_, state := emu.AntiDebug.state()
+	vm, stk, lib := pf.memStats()
+	var sigPnd, sigBlk, sigIgn, sigCgt, shdPnd uint64
+	if t := emu.Scheduler.FindThread(tid); t != nil {
+		sigPnd, sigBlk = t.sigPending, t.sigMask
+	}
+	if sg := emu.Signals; sg != nil {
+		shdPnd = sg.pending
+		for sig := 1; sig <= NSIG; sig++ {
+			act := sg.Action(sig)
+			if act.Handler == SIG_IGN {
+				sigIgn |= sigBit(sig)
+			}else if act.Handler != SIG_DFL {
+				sigCgt |= sigBit(sig)
+			}
+		}
+	}
+	fdSize := 32
+	for len(emu.Pcb.fds) > fdSize {
+		fdSize *= 2
+	}
+	uid := strconv.Itoa(emu.config.Uid)
+	r := strings.NewReplacer(
+		"{comm}", emu.AntiDebug.comm(),
+		"{state}", state,
+		"{tgid}", strconv.Itoa(pf.pid()),
+		"{pid}", strconv.Itoa(tid),
+		"{ppid}", strconv.Itoa(emu.config.Ppid),
+		"{tracer_pid}", strconv.Itoa(emu.AntiDebug.tracerPid()),
+		"{uid}", uid,
+		"{data_gid}", strconv.Itoa(emu.config.Uid + 40000),
+		"{fd_size}", strconv.Itoa(fdSize),
+		"{vm_kb}", fmt.Sprintf("%8d", vm),
+		"{rss_kb}", fmt.Sprintf("%8d", vm),
+		"{data_kb}", fmt.Sprintf("%8d", vm - stk - lib),
+		"{stk_kb}", fmt.Sprintf("%8d", stk),
+		"{lib_kb}", fmt.Sprintf("%8d", lib),
+		"{threads}", strconv.Itoa(len(pf.tids())),
+		"{sig_pnd}", sigSetHex(sigPnd),
+		"{shd_pnd}", sigSetHex(shdPnd),
+		"{sig_blk}", sigSetHex(sigBlk),
+		"{sig_ign}", sigSetHex(sigIgn),
+		"{sig_cgt}", sigSetHex(sigCgt),
+	)
+	return []byte(r.Replace(PROC_STATUS))
+}
+func (pf *ProcFS) stat(tid int) []byte {
+	emu := pf.emu
+	st, _ := emu.AntiDebug.state()
+	vm, _, _ := pf.memStats()
+	ppid := emu.config.Ppid
+	// pid comm state ppid pgrp session tty tpgid flags minflt cminflt majflt
+	// cmajflt utime stime cutime cstime prio nice threads itreal starttime
+	// vsize rss rsslim, then zeros for the address and signal fields
+	line := fmt.Sprintf("%d (%s) %s %d %d 0 0 -1 1077952832 2950 0 0 0 41 17 0 0 20 0 %d 0 4120 %d %d 4294967295",
+		tid, emu.AntiDebug.comm(), st, ppid, ppid, len(pf.tids()), vm * 1024, vm * 1024 / PAGE_SIZE)
+	line += strings.Repeat(" 0", 15)
+	// exit_signal processor rt_priority policy
+	line += fmt.Sprintf(" 17 %d 0 0", tid % PROC_CPUINFO_CORES)
+	line += strings.Repeat(" 0", 11) + "\n"
+	return []byte(line)
+}
+func (pf *ProcFS) environ() []byte {
+	var buf bytes.Buffer
+	for _, e := range PROC_ENVIRON {
+		buf.WriteString(e)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+// Auxv is the auxiliary vector the emulated process was started with.
+func (pf *ProcFS) Auxv() []uint64 {
+	if ka := pf.emu.KernelArgs; ka != nil {
+		return ka.Auxv
+	}
+	uid := uint64(pf.emu.config.Uid)
+	return []uint64{
+		AT_HWCAP, pf.emu.Arch.Hwcap,
+		AT_PAGESZ, PAGE_SIZE,
+		AT_CLKTCK, 100,
+		AT_FLAGS, 0,
+		AT_UID, uid,
+		AT_EUID, uid,
+		AT_GID, uid,
+		AT_EGID, uid,
+		AT_SECURE, 0,
+		AT_HWCAP2, 0x10,
+		AT_NULL, 0,
+	}
+}
+func (pf *ProcFS) auxv() []byte {
+	var buf bytes.Buffer
+	for _, v := range pf.Auxv() {
+		buf.Write(pf.emu.Arch.PutPtr(v))
+	}
+	return buf.Bytes()
+}
+func (pf *ProcFS) cpuinfo() []byte {
+	var buf bytes.Buffer
+	is64 := pf.emu.Arch.Is64
+	for i := 0; i < PROC_CPUINFO_CORES; i++ {
+		buf.WriteString(fmt.Sprintf("processor\t: %d\n", i))
+		if is64 {
+			// arm64 kernels print no model name
+			buf.WriteString("BogoMIPS\t: 38.40\n")
+			buf.WriteString("Features\t: fp asimd evtstrm aes pmull sha1 sha2 crc32 cpuid\n")
+			buf.WriteString("CPU implementer\t: 0x51\nCPU architecture: 8\nCPU variant\t: 0xa\nCPU part\t: 0x801\nCPU revision\t: 4\n\n")
+			continue
+		}
+		buf.WriteString("model name\t: ARMv7 Processor rev 4 (v7l)\n")
+		buf.WriteString("BogoMIPS\t: 38.40\n")
+		buf.WriteString("Features\t: half thumb fastmult vfp edsp neon vfpv3 tls vfpv4 idiva idivt lpae evtstrm aes pmull sha1 sha2 crc32\n")
+		buf.WriteString("CPU implementer\t: 0x51\nCPU architecture: 7\nCPU variant\t: 0xa\nCPU part\t: 0x801\nCPU revision\t: 4\n\n")
+	}
+	buf.WriteString("Hardware\t: Qualcomm Technologies, Inc MSM8953\nRevision\t: 0000\nSerial\t\t: 0000000000000000\n")
+	return buf.Bytes()
+}
+func (pf *ProcFS) meminfo() []byte {
+	vm, _, _ := pf.memStats()
+	total := PROC_MEM_TOTAL_KB
+	free := total / 8
+	avail := total / 2
+	if vm < avail {
+		avail -= vm
+	}
+	return []byte(fmt.Sprintf(
+		"MemTotal:       %8d kB\nMemFree:        %8d kB\nMemAvailable:   %8d kB\nBuffers:        %8d kB\nCached:         %8d kB\nSwapCached:            0 kB\nSwapTotal:      %8d kB\nSwapFree:       %8d kB\n",
+		total, free, avail, total / 64, total / 3, total / 4, total / 4))
+}
+func (pf *ProcFS) netTcp() []byte {
+	return []byte("  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n")
+}
@@ -0,0 +1,597 @@
+package emulator
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"hash/fnv"
+	"io/ioutil"
+	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+var (
+	// sizeof(struct stat64) on ARM EABI
+	STAT64_SIZE = 104
+	// sizeof(struct stat) on arm64
+	STAT_ARM64_SIZE = 128
+
+	// st_dev of the fake partitions, new_encode_dev(major, minor)
+	STAT_DEV_SYSTEM uint64 = 0xfd00 // dm-0
+	STAT_DEV_DATA   uint64 = 0xfd02 // dm-2
+	STAT_DEV_TMPFS  uint64 = 0x0010
+	STAT_DEV_PROC   uint64 = 0x0004
+
+	// st_rdev of the character devices under /dev
+	STAT_RDEV = map[string]uint64{
+		"null": 0x0103,
+		"zero": 0x0105,
+		"random": 0x0108,
+		"urandom": 0x0109,
+		"event0": 0x0d40,
+	}
+
+	// well known Android ids
+	AID_ROOT   = 0
+	AID_SYSTEM = 1000
+	AID_SHELL  = 2000
+)
+
+// ReadDir merges the listings of every layer, mounts hide what they cover.
+func (vfs *VirtualFileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	p := path.Clean("/" + dir)
+	fi, err := vfs.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	entries := map[string]os.FileInfo{}
+	served := false
+	if b := vfs.mountFor(p); b != nil {
+		if l, ok := b.(interface{ ReadDir(string) ([]os.FileInfo, error) }); ok {
+			list, err := l.ReadDir(p)
+			if err == nil {
+				served = true
+				for _, e := range list {
+					entries[e.Name()] = e
+				}
+			}
+		}
+	}
+	if !served {
+		host, _ := ioutil.ReadDir(vfs.host.Path(p))
+		for _, e := range host {
+			entries[e.Name()] = e
+		}
+		for _, e := range vfs.files.ReadDir(p) {
+			entries[e.Name()] = e
+		}
+	}
+	for _, m := range vfs.mounts {
+		if m.prefix != p && path.Dir(m.prefix) == p {
+			if mfi, err := vfs.Stat(m.prefix); err == nil {
+				entries[path.Base(m.prefix)] = mfi
+			}
+		}
+	}
+	res := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name() < res[j].Name()
+	})
+	return res, nil
+}
+// Readlink reads a link of a synthetic backend or of the host tree.
+func (vfs *VirtualFileSystem) Readlink(name string) (string, error) {
+	p := path.Clean("/" + name)
+	if b := vfs.mountFor(p); b != nil {
+		if l, ok := b.(interface{ Readlink(string) (string, error) }); ok {
+			target, err := l.Readlink(p)
+			if err == nil || !os.IsNotExist(err) {
+				return target, err
+			}
+		}
+	}
+	if _, err := vfs.files.Stat(p); err == nil {
+		// the memory layer has no links
+		return "", os.ErrInvalid
+	}
+	target, err := vfs.host.Readlink(p)
+	if err != nil {
+		if _, serr := vfs.host.Stat(p); serr == nil {
+			return "", os.ErrInvalid
+		}
+		return "", err
+	}
+	return target, nil
+}
+
+func (vfs *VirtualFileSystem) isAppDataPath(p string) bool {
+	pkg := vfs.config.PkgName
+	if pkg == "" {
+		return false
+	}
+	for _, base := range []string{"/data/data/", "/data/user/0/"} {
+		root := base + pkg
+		if p == root || strings.HasPrefix(p, root + "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// statOwner fakes owner and permissions the way a device shows them to an
+// app, whatever the host files look like.
+func (vfs *VirtualFileSystem) statOwner(p string, fi os.FileInfo) (uid, gid int, perm uint64) {
+	perm = uint64(fi.Mode().Perm())
+	exec := perm & 0111 != 0
+	switch {
+	case !strings.HasPrefix(p, "/"):
+		// pipes and anon inodes belong to the process
+		uid, gid = vfs.config.Uid, vfs.config.Uid
+		perm = 0600
+	case vfs.isAppDataPath(p):
+		uid, gid = vfs.config.Uid, vfs.config.Uid
+		if fi.IsDir() {
+			perm = 0771
+		}else if exec {
+			perm = 0700
+		}else{
+			perm = 0600
+		}
+	case strings.HasPrefix(p, "/proc/"):
+		uid, gid = vfs.config.Uid, vfs.config.Uid
+	case strings.HasPrefix(p, "/dev/"):
+		uid, gid = AID_ROOT, AID_ROOT
+	case p == "/data" || strings.HasPrefix(p, "/data/"):
+		uid, gid = AID_SYSTEM, AID_SYSTEM
+		if fi.IsDir() {
+			perm = 0771
+		}
+	default:
+		uid, gid = AID_ROOT, AID_ROOT
+		if isReadOnlyPath(p) && strings.Contains(p, "/bin/") {
+			gid = AID_SHELL
+		}
+		if fi.IsDir() || exec {
+			perm = 0755
+		}else{
+			perm = 0644
+		}
+	}
+	if fi.Mode() & os.ModeSymlink != 0 {
+		perm = 0777
+	}
+	return
+}
+func statDev(p string) uint64 {
+	switch {
+	case strings.HasPrefix(p, "/proc/"), p == "/proc":
+		return STAT_DEV_PROC
+	case strings.HasPrefix(p, "/dev/"), p == "/dev":
+		return STAT_DEV_TMPFS
+	case isReadOnlyPath(p):
+		return STAT_DEV_SYSTEM
+	}
+	return STAT_DEV_DATA
+}
+func statIno(p string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(p))
+	return uint64(h.Sum32())
+}
+func statType(m os.FileMode) uint64 {
+	switch {
+	case m.IsDir():
+		return S_IFDIR
+	case m & os.ModeSymlink != 0:
+		return S_IFLNK
+	case m & os.ModeNamedPipe != 0:
+		return S_IFIFO
+	case m & os.ModeSocket != 0:
+		return S_IFSOCK
+	case m & os.ModeCharDevice != 0:
+		return S_IFCHR
+	case m & os.ModeDevice != 0:
+		return S_IFBLK
+	}
+	return S_IFREG
+}
+func direntType(m os.FileMode) uint8 {
+	switch statType(m) {
+	case S_IFDIR:
+		return DT_DIR
+	case S_IFLNK:
+		return DT_LNK
+	case S_IFIFO:
+		return DT_FIFO
+	case S_IFSOCK:
+		return DT_SOCK
+	case S_IFCHR:
+		return DT_CHR
+	case S_IFBLK:
+		return DT_BLK
+	}
+	return DT_REG
+}
+
+/*
+struct stat64 {
+	unsigned long long st_dev;      // 0
+	unsigned char __pad0[4];
+	unsigned long __st_ino;         // 12
+	unsigned int st_mode;           // 16
+	unsigned int st_nlink;          // 20
+	unsigned long st_uid;           // 24
+	unsigned long st_gid;           // 28
+	unsigned long long st_rdev;     // 32
+	unsigned char __pad3[4];
+	long long st_size;              // 48
+	unsigned long st_blksize;       // 56
+	unsigned long long st_blocks;   // 64
+	unsigned long st_atime;         // 72
+	unsigned long st_atime_nsec;
+	unsigned long st_mtime;         // 80
+	unsigned long st_mtime_nsec;
+	unsigned long st_ctime;         // 88
+	unsigned long st_ctime_nsec;
+	unsigned long long st_ino;      // 96
+};
+arm64 has the generic struct stat instead, the same up to st_blocks but
+with a 64 bit st_ino at 8 and 64 bit times from 72 on.
+*/
+func (vfs *VirtualFileSystem) packStat64(p string, fi os.FileInfo, is64 bool) []byte {
+	uid, gid, perm := vfs.statOwner(p, fi)
+	typ := statType(fi.Mode())
+	ino := statIno(p)
+	var nlink, size, rdev uint64 = 1, uint64(fi.Size()), 0
+	switch typ {
+	case S_IFDIR:
+		nlink, size = 2, 4096
+	case S_IFCHR:
+		rdev, size = STAT_RDEV[fi.Name()], 0
+	case S_IFLNK:
+		if target, err := vfs.Readlink(p); err == nil {
+			size = uint64(len(target))
+		}
+	}
+	bufSize := STAT64_SIZE
+	if is64 {
+		bufSize = STAT_ARM64_SIZE
+	}
+	buf := make([]byte, bufSize)
+	put := func(off int, v uint64, sz int) {
+		copy(buf[off:], IntToBytes(int64(v), sz))
+	}
+	put(0, statDev(p), 8)
+	if is64 {
+		put(8, ino, 8)
+	}else{
+		put(12, ino, 4)
+		put(96, ino, 8)
+	}
+	put(16, typ | perm, 4)
+	put(20, nlink, 4)
+	put(24, uint64(uid), 4)
+	put(28, uint64(gid), 4)
+	put(32, rdev, 8)
+	put(48, size, 8)
+	put(56, 4096, 4)
+	put(64, (size + 4095) / 4096 * 8, 8)
+	if WRITE_FSTAT_TIMES {
+		t := fi.ModTime()
+		for i := 0; i < 3; i++ {
+			if is64 {
+				put(72 + i * 16, uint64(t.Unix()), 8)
+				put(80 + i * 16, uint64(t.Nanosecond()), 8)
+			}else{
+				put(72 + i * 8, uint64(t.Unix()), 4)
+				put(76 + i * 8, uint64(t.Nanosecond()), 4)
+			}
+		}
+	}
+	return buf
+}
+func (vfs *VirtualFileSystem) writeStat64(mu uc.Unicorn, addr uint64, p string, fi os.FileInfo) uint64 {
+	err := mu.MemWrite(addr, vfs.packStat64(p, fi, archOf(mu).Is64))
+	if err != nil {
+		return errnoRet(EFAULT)
+	}
+	return 0
+}
+// statAt is fstatat64, flags takes AT_SYMLINK_NOFOLLOW and AT_EMPTY_PATH.
+func (vfs *VirtualFileSystem) statAt(mu uc.Unicorn, dirfd int64, name string, buf, flags uint64) uint64 {
+	if name == "" && flags & AT_EMPTY_PATH != 0 {
+		return vfs.fstat(mu, uint64(dirfd), buf)
+	}
+	p, errno := vfs.resolve(dirfd, name)
+	if errno != 0 {
+		return errnoRet(errno)
+	}
+	var fi os.FileInfo
+	var err error
+	if flags & AT_SYMLINK_NOFOLLOW != 0 {
+		fi, err = vfs.Lstat(p)
+	}else{
+		fi, err = vfs.Stat(p)
+	}
+	if err != nil {
+		vfs.logger.Debug().Str("path", p).Err(err).Msg("stat failed")
+		return errnoRet(vfsErrno(err))
+	}
+	return vfs.writeStat64(mu, buf, p, fi)
+}
+func (vfs *VirtualFileSystem) fstat(mu uc.Unicorn, fd, buf uint64) uint64 {
+	vf := vfs.pcb.GetFdDetail(uintptr(fd))
+	if vf == nil {
+		return errnoRet(EBADF)
+	}
+	fi, err := vf.fo.Stat()
+	if err != nil {
+		return errnoRet(vfsErrno(err))
+	}
+	return vfs.writeStat64(mu, buf, vf.Name, fi)
+}
+// accessAt checks mode against the faked owner and permissions.
+func (vfs *VirtualFileSystem) accessAt(dirfd int64, name string, mode uint64) uint64 {
+	if mode &^ (R_OK | W_OK | X_OK) != 0 {
+		return errnoRet(EINVAL)
+	}
+	p, errno := vfs.resolve(dirfd, name)
+	if errno != 0 {
+		return errnoRet(errno)
+	}
+	fi, err := vfs.Stat(p)
+	if err != nil {
+		return errnoRet(vfsErrno(err))
+	}
+	if mode == F_OK {
+		return 0
+	}
+	if mode & W_OK != 0 && isReadOnlyPath(p) {
+		return errnoRet(EROFS)
+	}
+	uid, gid, perm := vfs.statOwner(p, fi)
+	var bits uint64
+	switch {
+	case uid == vfs.config.Uid:
+		bits = perm >> 6 & 7
+	case gid == vfs.config.Uid:
+		bits = perm >> 3 & 7
+	default:
+		bits = perm & 7
+	}
+	if mode & bits != mode {
+		return errnoRet(EACCES)
+	}
+	return 0
+}
+func (vfs *VirtualFileSystem) readlinkAt(mu uc.Unicorn, dirfd int64, name string, buf, size uint64) uint64 {
+	if int64(size) <= 0 {
+		return errnoRet(EINVAL)
+	}
+	p, errno := vfs.resolve(dirfd, name)
+	if errno != 0 {
+		return errnoRet(errno)
+	}
+	target, err := vfs.Readlink(p)
+	if err != nil {
+		vfs.logger.Debug().Str("path", p).Err(err).Msg("readlink failed")
+		return errnoRet(vfsErrno(err))
+	}
+	vfs.logger.Debug().Str("path", p).Str("target", target).Msg("readlink")
+	// not NUL terminated, silently truncated
+	data := []byte(target)
+	if uint64(len(data)) > size {
+		data = data[:size]
+	}
+	err = mu.MemWrite(buf, data)
+	if err != nil {
+		return errnoRet(EFAULT)
+	}
+	return uint64(len(data))
+}
+func (vfs *VirtualFileSystem) seek(fd uint64, offset int64, whence uint64) (int64, uint64) {
+	vf := vfs.pcb.GetFdDetail(uintptr(fd))
+	if vf == nil {
+		return 0, EBADF
+	}
+	if whence > SEEK_END {
+		return 0, EINVAL
+	}
+	if fi, err := vf.fo.Stat(); err == nil && fi.IsDir() {
+		// only rewinding a directory stream makes sense here
+		if offset == 0 && whence == SEEK_SET {
+			vf.dirOff = 0
+		}
+		return int64(vf.dirOff), 0
+	}
+	pos, err := vf.fo.Seek(offset, int(whence))
+	if err != nil {
+		return 0, vfsErrno(err)
+	}
+	return pos, 0
+}
+
+/* syscall stat64
+int stat64(const char *pathname, struct stat64 *statbuf);
+*/
+func (vfs *VirtualFileSystem) stat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return vfs.statAt(mu, AT_FDCWD, name, args[1], 0), true
+}
+/* syscall lstat64
+int lstat64(const char *pathname, struct stat64 *statbuf);
+*/
+func (vfs *VirtualFileSystem) lstat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return vfs.statAt(mu, AT_FDCWD, name, args[1], AT_SYMLINK_NOFOLLOW), true
+}
+/* syscall fstat64
+int fstat64(int fd, struct stat64 *statbuf);
+*/
+func (vfs *VirtualFileSystem) fstat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	return vfs.fstat(mu, args[0], args[1]), true
+}
+/* syscall fstatat64
+int fstatat64(int dirfd, const char *pathname, struct stat64 *statbuf, int flags);
+*/
+func (vfs *VirtualFileSystem) fstatat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	var name string
+	var errno uint64
+	if args[1] != 0 || args[3] & AT_EMPTY_PATH == 0 {
+		name, errno = vfs.readPath(mu, args[1])
+		if errno != 0 {
+			return errnoRet(errno), true
+		}
+	}
+	return vfs.statAt(mu, int64(int32(args[0])), name, args[2], args[3]), true
+}
+/* syscall getdents64
+int getdents64(unsigned int fd, struct linux_dirent64 *dirp, unsigned int count);
+
+struct linux_dirent64 {
+	u64  d_ino;
+	s64  d_off;
+	u16  d_reclen;
+	u8   d_type;
+	char d_name[];
+};
+*/
+func (vfs *VirtualFileSystem) getdents64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	fd, dirp, count := args[0], args[1], args[2]
+	vf := vfs.pcb.GetFdDetail(uintptr(fd))
+	if vf == nil {
+		return errnoRet(EBADF), true
+	}
+	fi, err := vf.fo.Stat()
+	if err != nil || !fi.IsDir() {
+		return errnoRet(ENOTDIR), true
+	}
+	list, err := vfs.ReadDir(vf.Name)
+	if err != nil {
+		return errnoRet(vfsErrno(err)), true
+	}
+	type dirent struct {
+		name string
+		ino  uint64
+		typ  uint8
+	}
+	ents := []dirent{
+		{".", statIno(vf.Name), DT_DIR},
+		{"..", statIno(path.Dir(vf.Name)), DT_DIR},
+	}
+	for _, e := range list {
+		ents = append(ents, dirent{e.Name(), statIno(path.Join(vf.Name, e.Name())), direntType(e.Mode())})
+	}
+	var out []byte
+	for vf.dirOff < len(ents) {
+		e := ents[vf.dirOff]
+		reclen := (19 + len(e.name) + 1 + 7) &^ 7
+		if uint64(len(out) + reclen) > count {
+			break
+		}
+		rec := make([]byte, reclen)
+		copy(rec[0:], IntToBytes(int64(e.ino), 8))
+		copy(rec[8:], IntToBytes(int64(vf.dirOff + 1), 8))
+		rec[16] = byte(reclen)
+		rec[17] = byte(reclen >> 8)
+		rec[18] = e.typ
+		copy(rec[19:], e.name)
+		out = append(out, rec...)
+		vf.dirOff++
+	}
+	if len(out) < 1 && vf.dirOff < len(ents) {
+		// not even one entry fits
+		return errnoRet(EINVAL), true
+	}
+	err = mu.MemWrite(dirp, out)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return uint64(len(out)), true
+}
+/* syscall access
+int access(const char *pathname, int mode);
+*/
+func (vfs *VirtualFileSystem) accessHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return vfs.accessAt(AT_FDCWD, name, args[1]), true
+}
+/* syscall faccessat
+int faccessat(int dirfd, const char *pathname, int mode, int flags);
+*/
+func (vfs *VirtualFileSystem) faccessatHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[1])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return vfs.accessAt(int64(int32(args[0])), name, args[2]), true
+}
+/* syscall readlink
+ssize_t readlink(const char *pathname, char *buf, size_t bufsiz);
+*/
+func (vfs *VirtualFileSystem) readlinkHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return vfs.readlinkAt(mu, AT_FDCWD, name, args[1], args[2]), true
+}
+/* syscall readlinkat
+ssize_t readlinkat(int dirfd, const char *pathname, char *buf, size_t bufsiz);
+*/
+func (vfs *VirtualFileSystem) readlinkatHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[1])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return vfs.readlinkAt(mu, int64(int32(args[0])), name, args[2], args[3]), true
+}
+/* syscall lseek
+off_t lseek(int fd, off_t offset, int whence);
+*/
+func (vfs *VirtualFileSystem) lseekHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	is64 := archOf(mu).Is64
+	offset := int64(int32(args[1]))
+	if is64 {
+		// off_t is 64 bit on arm64
+		offset = int64(args[1])
+	}
+	pos, errno := vfs.seek(args[0], offset, args[2])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	if !is64 && pos > 0x7fffffff {
+		return errnoRet(EOVERFLOW), true
+	}
+	return uint64(pos), true
+}
+/* syscall _llseek
+int _llseek(unsigned int fd, unsigned long offset_high, unsigned long offset_low, loff_t *result, unsigned int whence);
+*/
+func (vfs *VirtualFileSystem) llseekHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	offset := int64(args[1] << 32 | args[2] & 0xffffffff)
+	pos, errno := vfs.seek(args[0], offset, args[4])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	err := mu.MemWrite(args[3], IntToBytes(pos, 8))
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return 0, true
+}
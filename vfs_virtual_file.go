@@ -1,24 +1,30 @@
 package emulator
 
-import (
-	"os"
-)
-
+// VirtualFile is an open file description, fds created by dup share it and
+// with it the offset and the status flags.
 type VirtualFile struct {
 	Name         string
 	NameInSystem string
+	// fd the description was first opened on
 	Description  uintptr
-	fo           *os.File
+	// O_* status flags
+	Flags        uint64
+	fo           FileHandle
+	refs         int
+	// getdents64 position of a directory
+	dirOff       int
 }
 
-func NewVirtualFile(name, nameInSystem string, fo *os.File) *VirtualFile {
+func NewVirtualFile(name, nameInSystem string, fo FileHandle) *VirtualFile {
 	return &VirtualFile{
 		Name: name, 
 		NameInSystem: nameInSystem,
-		Description: fo.Fd(),
 		fo: fo,
 	}
 }
+func (vf *VirtualFile) Handle() FileHandle {
+	return vf.fo
+}
 func (vf *VirtualFile) CloseResource() {
 	vf.fo.Close()
-}
\ No newline at end of file
+}
@@ -1,12 +1,12 @@
 package emulator
 
 import (
+	"io"
 	"os"
-	"fmt"
+	"path"
+	"sort"
 	"strings"
-	"io/ioutil"
-	"math/rand"
-	fp  "path/filepath"
+	"syscall"
 	zl  "github.com/rs/zerolog"
 	uc  "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
@@ -14,47 +14,21 @@ import (
 var (
 	OVERRIDE_URANDOM = false
 	OVERRIDE_URANDOM_INT = 1
-	S_STATUS = `
-Name:   {pkg_name}
-State:  R (running)
-Tgid:   1434
-Pid:    1434
-PPid:   197
-TracerPid:      0
-Uid:    10054   10054   10054   10054
-Gid:    10054   10054   10054   10054
-FDSize: 512
-Groups: 1015 1028 3003 50054 
-VmPeak:  1229168 kB
-VmSize:  1115232 kB
-VmLck:         0 kB
-VmPin:         0 kB
-VmHWM:    179992 kB
-VmRSS:    179836 kB
-VmData:   191904 kB
-VmStk:       136 kB
-VmExe:         8 kB
-VmLib:     48448 kB
-VmPTE:       536 kB
-VmSwap:        0 kB
-Threads:        105
-SigQ:   0/12272
-SigPnd: 0000000000000000
-ShdPnd: 0000000000000000
-SigBlk: 0000000000001204
-SigIgn: 0000000000000000
-SigCgt: 00000002000094f8
-CapInh: 0000000000000000
-CapPrm: 0000000000000000
-CapEff: 0000000000000000
-CapBnd: fffffff000000000
-Cpus_allowed:   f
-Cpus_allowed_list:      0-3
-voluntary_ctxt_switches:        5225
-nonvoluntary_ctxt_switches:     11520
-`
+
+	// most iovecs readv and writev take
+	IOV_MAX uint64 = 1024
+	// host buffer size a read fills at a time
+	READ_CHUNK_SIZE uint64 = 0x10000
 )
 
+type vfsMount struct {
+	prefix  string
+	backend VfsBackend
+}
+
+// VirtualFileSystem layers the guest view of the file system: mounted
+// synthetic backends first, then the in-memory writable layer, then the
+// read-only host overlay under vfsRoot.
 type VirtualFileSystem struct {
 	vfsRoot  string
 	sh       *SyscallHandlers
@@ -62,105 +36,244 @@ type VirtualFileSystem struct {
 	mem      *MemoryMap
 	logger   zl.Logger
 	config   *Config
+	antiDbg  *AntiDebug
+	sched    *Scheduler
+
+	host     *HostBackend
+	files    *MemoryBackend
+	mounts   []vfsMount
+	Dev      *SyntheticFS
+	// Stdio receives what the guest writes to stdout and stderr
+	Stdio    func(stream string, data []byte)
 }
-func NewVirtualFileSystem(root string,sh *SyscallHandlers,mem *MemoryMap,logger zl.Logger, config *Config) *VirtualFileSystem {
+func NewVirtualFileSystem(root string,sh *SyscallHandlers,mem *MemoryMap,logger zl.Logger, config *Config, pcb *Pcb, antiDbg *AntiDebug, sched *Scheduler) *VirtualFileSystem {
 	vfs := &VirtualFileSystem{
 		vfsRoot: root,
 		sh: sh,
-		pcb: GetPcb(),
+		pcb: pcb,
 		mem: mem,
 		logger: logger,
 		config: config,
+		antiDbg: antiDbg,
+		sched: sched,
+		host: NewHostBackend(root),
+		files: NewMemoryBackend(),
+		Dev: NewSyntheticFS(),
 	}
-	vfs.ClearProcDir()
+	vfs.setupDev()
+	vfs.setupStdio()
+	vfs.Mount("/dev", vfs.Dev)
 	vfs.sh.SetHandler(0x3, "read", 3, vfs.readHandle)
 	vfs.sh.SetHandler(0x4, "write", 3, vfs.writeHandle)
 	vfs.sh.SetHandler(0x5, "open", 3, vfs.openHandle)
 	vfs.sh.SetHandler(0x6, "close", 1, vfs.closeHandle)
+	vfs.sh.SetHandler(0x8, "creat", 2, vfs.creatHandle)
 	vfs.sh.SetHandler(0x0A, "unlink", 1, vfs.unlinkHandle)
+	vfs.sh.SetHandler(0x0C, "chdir", 1, vfs.chdirHandle)
 	vfs.sh.SetHandler(0x13, "lseek", 3, vfs.lseekHandle)
 	vfs.sh.SetHandler(0x21, "access", 2, vfs.accessHandle)
 	vfs.sh.SetHandler(0x27, "mkdir", 2, vfs.mkdirHandle)
+	vfs.sh.SetHandler(0x29, "dup", 1, vfs.dupHandle)
+	vfs.sh.SetHandler(0x2A, "pipe", 1, vfs.pipeHandle)
 	vfs.sh.SetHandler(0x36, "ioctl", 6, vfs.ioctlHandle)
 	vfs.sh.SetHandler(0x37, "fcntl", 6, vfs.fcntl64Handle)
+	vfs.sh.SetHandler(0x3F, "dup2", 2, vfs.dup2Handle)
+	vfs.sh.SetHandler(0x55, "readlink", 3, vfs.readlinkHandle)
+	vfs.sh.SetHandler(0x85, "fchdir", 1, vfs.fchdirHandle)
+	vfs.sh.SetHandler(0x8C, "_llseek", 5, vfs.llseekHandle)
+	vfs.sh.SetHandler(0x8E, "_newselect", 5, vfs.newselectHandle)
+	vfs.sh.SetHandler(0x91, "readv", 3, vfs.readvHandle)
 	vfs.sh.SetHandler(0x92, "writev", 3, vfs.writevHandle)
+	vfs.sh.SetHandler(0xA8, "poll", 3, vfs.pollHandle)
+	vfs.sh.SetHandler(0xB7, "getcwd", 2, vfs.getcwdHandle)
 	vfs.sh.SetHandler(0xC3, "stat64", 2, vfs.stat64Handle)
 	vfs.sh.SetHandler(0xC4, "lstat64", 2, vfs.lstat64Handle)
 	vfs.sh.SetHandler(0xC5, "fstat64", 2, vfs.fstat64Handle)
 	vfs.sh.SetHandler(0xD9, "getdents64", 3, vfs.getdents64Handle)
 	vfs.sh.SetHandler(0xDD, "fcntl64", 6, vfs.fcntl64Handle)
+	vfs.sh.SetHandler(0xFA, "epoll_create", 1, vfs.epollCreateHandle)
+	vfs.sh.SetHandler(0xFB, "epoll_ctl", 4, vfs.epollCtlHandle)
+	vfs.sh.SetHandler(0xFC, "epoll_wait", 4, vfs.epollWaitHandle)
 	vfs.sh.SetHandler(0x10A, "statfs64", 3, vfs.statfs64Handle)
 	vfs.sh.SetHandler(0x142, "openat", 4, vfs.openatHandle)
+	vfs.sh.SetHandler(0x143, "mkdirat", 3, vfs.mkdiratHandle)
 	vfs.sh.SetHandler(0x147, "fstatat64", 4, vfs.fstatat64Handle)
 	vfs.sh.SetHandler(0x14c, "readlinkat", 4, vfs.readlinkatHandle)
 	vfs.sh.SetHandler(0x14e, "faccessat", 4, vfs.faccessatHandle)
+	vfs.sh.SetHandler(0x14F, "pselect6", 6, vfs.pselect6Handle)
+	vfs.sh.SetHandler(0x150, "ppoll", 5, vfs.ppollHandle)
+	vfs.sh.SetHandler(0x15A, "epoll_pwait", 6, vfs.epollPwaitHandle)
+	vfs.sh.SetHandler(0x15F, "eventfd", 1, vfs.eventfdHandle)
+	vfs.sh.SetHandler(0x164, "eventfd2", 2, vfs.eventfd2Handle)
+	vfs.sh.SetHandler(0x165, "epoll_create1", 1, vfs.epollCreate1Handle)
+	vfs.sh.SetHandler(0x166, "dup3", 3, vfs.dup3Handle)
+	vfs.sh.SetHandler(0x167, "pipe2", 2, vfs.pipe2Handle)
 	return vfs
 }
-//with caution of escape-access
+// TranslatePath maps a guest path below the vfs root, ".." cannot escape it
 func (vfs *VirtualFileSystem) TranslatePath(filename string) string {
-	return VfsPathToSystemPath(vfs.vfsRoot, filename)
+	return vfs.host.Path(filename)
 }
-//WIP, add failback
-func (vfs *VirtualFileSystem) ClearProcDir() error {
-	proc := "/proc"
-	proc = vfs.TranslatePath(proc)
-	items, err := ioutil.ReadDir(proc)
-	if err != nil {
-		return err
-	}
-	numericPrefix := []string{"0","1","2","3","4","5","6","7","8","9"}
-	for _, item := range items {
-		if item.IsDir() {
-			hasNumericPrefix := false
-			for _,np := range numericPrefix {
-				if strings.HasPrefix(item.Name(), np) {
-					hasNumericPrefix = true
-					break
-				}
-			}
-			if hasNumericPrefix {
-				os.RemoveAll(proc+"/"+item.Name())
-			}
+// Mount puts a backend in front of the layers for everything below prefix.
+func (vfs *VirtualFileSystem) Mount(prefix string, b VfsBackend) {
+	vfs.mounts = append(vfs.mounts, vfsMount{
+		prefix: path.Clean(prefix),
+		backend: b,
+	})
+	// longest prefix wins
+	sort.SliceStable(vfs.mounts, func(i, j int) bool {
+		return len(vfs.mounts[i].prefix) > len(vfs.mounts[j].prefix)
+	})
+}
+// Files is the writable in-memory layer.
+func (vfs *VirtualFileSystem) Files() *MemoryBackend {
+	return vfs.files
+}
+func (vfs *VirtualFileSystem) mountFor(p string) VfsBackend {
+	for _, m := range vfs.mounts {
+		if p == m.prefix || strings.HasPrefix(p, m.prefix + "/") {
+			return m.backend
 		}
 	}
 	return nil
 }
+// Open resolves a guest path through the layers, flag takes os.O_* values.
+func (vfs *VirtualFileSystem) Open(filename string, flag int) (FileHandle, error) {
+	return vfs.OpenFile(filename, flag, 0600)
+}
+// OpenFile is Open with the permission bits of a created file.
+func (vfs *VirtualFileSystem) OpenFile(filename string, flag int, perm os.FileMode) (FileHandle, error) {
+	p := path.Clean("/" + filename)
+	if b := vfs.mountFor(p); b != nil {
+		h, err := b.Open(p, flag)
+		if err == nil || !os.IsNotExist(err) {
+			return h, err
+		}
+	}
+	h, err := vfs.files.Open(p, flag &^ os.O_CREATE)
+	if err == nil || !os.IsNotExist(err) {
+		return h, err
+	}
+	host, err := vfs.host.Open(p, os.O_RDONLY)
+	if err == nil {
+		if flag & os.O_CREATE != 0 && flag & os.O_EXCL != 0 {
+			host.Close()
+			return nil, os.ErrExist
+		}
+		if !isWriteFlag(flag) {
+			return host, nil
+		}
+		oh := &overlayHandle{
+			path: p,
+			mem: vfs.files,
+			host: host,
+			flag: flag,
+		}
+		if flag & os.O_TRUNC != 0 {
+			// nothing to keep from the host copy
+			oh.host.Close()
+			vfs.files.WriteFile(p, nil, perm)
+			return vfs.files.Open(p, flag &^ os.O_TRUNC)
+		}
+		return oh, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if flag & os.O_CREATE != 0 {
+		return vfs.files.OpenFile(p, flag, perm)
+	}
+	return nil, os.ErrNotExist
+}
+// Stat resolves a guest path the same way Open does.
+func (vfs *VirtualFileSystem) Stat(filename string) (os.FileInfo, error) {
+	p := path.Clean("/" + filename)
+	if b := vfs.mountFor(p); b != nil {
+		fi, err := b.Stat(p)
+		if err == nil || !os.IsNotExist(err) {
+			return fi, err
+		}
+	}
+	fi, err := vfs.files.Stat(p)
+	if err == nil {
+		return fi, nil
+	}
+	return vfs.host.Stat(p)
+}
+// Lstat is Stat without following the links synthetic backends know of.
+func (vfs *VirtualFileSystem) Lstat(filename string) (os.FileInfo, error) {
+	p := path.Clean("/" + filename)
+	if b := vfs.mountFor(p); b != nil {
+		if l, ok := b.(interface{ Lstat(string) (os.FileInfo, error) }); ok {
+			fi, err := l.Lstat(p)
+			if err == nil || !os.IsNotExist(err) {
+				return fi, err
+			}
+		}
+	}
+	fi, err := vfs.files.Stat(p)
+	if err == nil {
+		return fi, nil
+	}
+	return vfs.host.Lstat(p)
+}
 /* syscall read
 ssize_t read(int fd, void *buf, size_t count);
 */
 func (vfs *VirtualFileSystem) readHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
 	fd, bufAddr, count := args[0], args[1], args[2]
-	if fd <= 2 {
-		vfs.logger.Debug().Uint64("fd", fd).Msg("skip read fd")
-		return 0, true
+	buf, ret, hasRet := vfs.read(mu, fd, count)
+	if buf == nil {
+		return ret, hasRet
+	}
+	sz := len(buf)
+	err := mu.MemWrite(bufAddr, buf)
+	if err != nil {
+		vfs.logger.Debug().Uint64("fd", fd).Err(err).Msg("read syscall write buf error")
+		return errnoRet(EFAULT), true
 	}
+	vfs.logger.Debug().Uint64("fd", fd).Int("sz", sz).Msg("read syscall readed")
+	return uint64(sz), true
+}
+// read takes up to count bytes from fd, a nil buffer means the call ends
+// with the returned result.
+func (vfs *VirtualFileSystem) read(mu uc.Unicorn, fd, count uint64) ([]byte, uint64, bool) {
 	vf := vfs.pcb.GetFdDetail(uintptr(fd))
-	if vf != nil {
+	if vf == nil {
 		vfs.logger.Debug().Uint64("fd", fd).Msg("fd not exist")
-		return 0, true
+		return nil, errnoRet(EBADF), true
 	}
-	// prevent screw up heap
-	if st, err := vf.fo.Stat(); err == nil {
-		if maxSz := uint64(st.Size()); count > maxSz {
-			count = maxSz
-		}
-	}else{
-		vfs.logger.Debug().Uint64("fd", fd).Err(err).Err(err).Msg("read syscall unable file stat")
-		return 0, true
+	if vf.Flags & O_ACCMODE == O_WRONLY {
+		return nil, errnoRet(EBADF), true
 	}
-	buf := make([]byte, int(count))
-	sz, err := vf.fo.Read(buf);
-	if err != nil {
-		vfs.logger.Debug().Uint64("fd", fd).Err(err).Msg("read syscall error!")
-		return 0, true
+	// the host buffer grows with what is there, not with count. Only
+	// regular files end, anything else gets a short read.
+	regular := false
+	if fi, err := vf.fo.Stat(); err == nil {
+		regular = fi.Mode().IsRegular()
 	}
-	err = mu.MemWrite(bufAddr, buf[:sz])
-	if err != nil {
-		vfs.logger.Debug().Uint64("fd", fd).Err(err).Msg("read syscall write buf error")
-		return 0, true
+	buf := []byte{}
+	for uint64(len(buf)) < count {
+		n := count - uint64(len(buf))
+		if n > READ_CHUNK_SIZE {
+			n = READ_CHUNK_SIZE
+		}
+		chunk := make([]byte, n)
+		sz, err := vf.fo.Read(chunk)
+		buf = append(buf, chunk[:sz]...)
+		if err == syscall.EAGAIN && len(buf) == 0 {
+			ret, hasRet := vfs.wouldBlock(mu, vf, "read")
+			return nil, ret, hasRet
+		}
+		if err != nil && err != io.EOF && err != syscall.EAGAIN && len(buf) == 0 {
+			vfs.logger.Debug().Uint64("fd", fd).Err(err).Msg("read syscall error!")
+			return nil, errnoRet(vfsErrno(err)), true
+		}
+		if err != nil || uint64(sz) < n || !regular {
+			break
+		}
 	}
-	vfs.logger.Debug().Uint64("fd", fd).Int("sz", sz).Msg("read syscall readed")
-	return uint64(sz), true
+	return buf, 0, true
 }
 /* syscall write */
 func (vfs *VirtualFileSystem) writeHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
@@ -168,44 +281,45 @@ func (vfs *VirtualFileSystem) writeHandle(mu uc.Unicorn, args ...uint64) (uint64
 	data, err := mu.MemRead(bufAddr, count)
 	if err != nil {
 		vfs.logger.Debug().Uint64("fd", fd).Err(err).Msg("write syscall read buf error")
-		return 0, true
-	}
-	if fd == 1 { // stdout
-		vfs.logger.Debug().Bytes("stdout", data).Msg("write to stdout")
-		return uint64(len(data)), true
-	} else if fd == 2 { // stderr
-		vfs.logger.Debug().Bytes("stderr", data).Msg("write to stderr")
-		return uint64(len(data)), true
+		return errnoRet(EFAULT), true
 	}
-
+	return vfs.write(mu, fd, data)
+}
+func (vfs *VirtualFileSystem) write(mu uc.Unicorn, fd uint64, data []byte) (uint64, bool) {
 	vf := vfs.pcb.GetFdDetail(uintptr(fd))
-	var n int
-	if vf != nil {
+	if vf == nil {
 		vfs.logger.Debug().Uint64("fd", fd).Msg("write fd not exist")
-		n = -1
-		return uint64(n), true
+		return errnoRet(EBADF), true
+	}
+	n, err := vfs.writeFd(vf, data)
+	if err == syscall.EAGAIN {
+		return vfs.wouldBlock(mu, vf, "write")
 	}
-	n, err = vf.fo.Write(data)
 	if err != nil {
 		vfs.logger.Debug().Uint64("fd", fd).Err(err).Msg("write fd failed")
-		n = -1
-		return uint64(n), true
+		return errnoRet(vfsErrno(err)), true
 	}
 	return uint64(n), true
 }
-/* syscall open */
+/* syscall open
+int open(const char *pathname, int flags, mode_t mode);
+*/
 func (vfs *VirtualFileSystem) openHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	var fd int64
-	filename_ptr, flags, mode := args[0], args[1], args[2]
-	filename, err := ReadUtf8(mu, filename_ptr)
-	if err != nil {
-		fd = -1
-		return uint64(fd), true
+	filename, errno := vfs.readPath(mu, args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	return vfs.openAt(AT_FDCWD, filename, args[1], args[2]), true
+}
+/* syscall creat
+int creat(const char *pathname, mode_t mode);
+*/
+func (vfs *VirtualFileSystem) creatHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	filename, errno := vfs.readPath(mu, args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
 	}
-	vfs.logger.Debug().Str("filename", string(filename)).Msg("open called")
-	_ = flags
-	fd, _ = vfs.openFile(string(filename), mode)
-	return uint64(fd), true
+	return vfs.openAt(AT_FDCWD, filename, O_CREAT | O_WRONLY | O_TRUNC, args[1]), true
 }
 // syscall close
 func (vfs *VirtualFileSystem) closeHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
@@ -214,65 +328,166 @@ func (vfs *VirtualFileSystem) closeHandle(mu uc.Unicorn, args ...uint64) (uint64
 		vfs.pcb.Remove(fd)
 		return 0, true
 	}
-	var tmp int64 = -1
-	return uint64(tmp), true
+	return errnoRet(EBADF), true
 }
 // syscall unlink
 func (vfs *VirtualFileSystem) unlinkHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
 	return 0, true
 }
-// syscall lseek
-func (vfs *VirtualFileSystem) lseekHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
-}
-// syscall access
-func (vfs *VirtualFileSystem) accessHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
-}
-// syscall mkdir
+/* syscall mkdir
+int mkdir(const char *pathname, mode_t mode);
+*/
 func (vfs *VirtualFileSystem) mkdirHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
+	return vfs.mkdiratHandle(mu, uint64(AT_FDCWD), args[0], args[1])
 }
-// syscall ioctl
-func (vfs *VirtualFileSystem) ioctlHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+/* syscall mkdirat
+int mkdirat(int dirfd, const char *pathname, mode_t mode);
+*/
+func (vfs *VirtualFileSystem) mkdiratHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[1])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	p, errno := vfs.resolve(int64(int32(args[0])), name)
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	errno = vfs.Mkdir(p, os.FileMode(args[2] & 0777))
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
 	return 0, true
 }
-// syscall fcntl
-func (vfs *VirtualFileSystem) fcntlHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+/* syscall chdir
+int chdir(const char *path);
+*/
+func (vfs *VirtualFileSystem) chdirHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	name, errno := vfs.readPath(mu, args[0])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	p, errno := vfs.resolve(AT_FDCWD, name)
+	if errno == 0 {
+		errno = vfs.chdir(p)
+	}
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
 	return 0, true
 }
-// syscall writev
-func (vfs *VirtualFileSystem) writevHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+/* syscall fchdir
+int fchdir(int fd);
+*/
+func (vfs *VirtualFileSystem) fchdirHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	vf := vfs.pcb.GetFdDetail(uintptr(args[0]))
+	if vf == nil {
+		return errnoRet(EBADF), true
+	}
+	errno := vfs.chdir(vf.Name)
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
 	return 0, true
 }
-// syscall stat64
-func (vfs *VirtualFileSystem) stat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
+/* syscall getcwd
+long getcwd(char *buf, unsigned long size);
+*/
+func (vfs *VirtualFileSystem) getcwdHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	buf, size := args[0], args[1]
+	cwd := append([]byte(vfs.pcb.Cwd()), 0)
+	if uint64(len(cwd)) > size {
+		return errnoRet(ERANGE), true
+	}
+	err := mu.MemWrite(buf, cwd)
+	if err != nil {
+		return errnoRet(EFAULT), true
+	}
+	return uint64(len(cwd)), true
 }
-// syscall lstat64
-func (vfs *VirtualFileSystem) lstat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+// syscall ioctl
+func (vfs *VirtualFileSystem) ioctlHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
 	return 0, true
 }
-// syscall fstat64
-func (vfs *VirtualFileSystem) fstat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
+// readIovec reads an array of struct iovec, two pointer sized words each.
+func readIovec(mu uc.Unicorn, iov, iovcnt uint64) ([][2]uint64, uint64) {
+	if iovcnt > IOV_MAX {
+		return nil, EINVAL
+	}
+	if iovcnt == 0 {
+		return nil, 0
+	}
+	ptr := archOf(mu).PtrSize
+	b, err := mu.MemRead(iov, iovcnt * 2 * ptr)
+	if err != nil {
+		return nil, EFAULT
+	}
+	vec := make([][2]uint64, iovcnt)
+	for i := range vec {
+		off := uint64(i) * 2 * ptr
+		vec[i] = [2]uint64{LE_BytesToUint(b[off:off+ptr]), LE_BytesToUint(b[off+ptr:off+2*ptr])}
+	}
+	return vec, 0
 }
-// syscall getdents64
-func (vfs *VirtualFileSystem) getdents64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
+/* syscall readv
+ssize_t readv(int fd, const struct iovec *iov, int iovcnt);
+*/
+func (vfs *VirtualFileSystem) readvHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	vec, errno := readIovec(mu, args[1], args[2])
+	if errno != 0 {
+		return errnoRet(errno), true
+	}
+	var total uint64
+	for _, v := range vec {
+		total += v[1]
+	}
+	buf, ret, hasRet := vfs.read(mu, args[0], total)
+	if buf == nil {
+		return ret, hasRet
+	}
+	n := uint64(len(buf))
+	for _, v := range vec {
+		if len(buf) < 1 {
+			break
+		}
+		part := buf
+		if uint64(len(part)) > v[1] {
+			part = part[:v[1]]
+		}
+		if err := mu.MemWrite(v[0], part); err != nil {
+			return errnoRet(EFAULT), true
+		}
+		buf = buf[len(part):]
+	}
+	return n, true
 }
-// syscall fcntl64
-func (vfs *VirtualFileSystem) fcntl64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	if isWin {
-		return 0, true
+/* syscall writev
+ssize_t writev(int fd, const struct iovec *iov, int iovcnt);
+*/
+func (vfs *VirtualFileSystem) writevHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
+	vec, errno := readIovec(mu, args[1], args[2])
+	if errno != 0 {
+		return errnoRet(errno), true
 	}
-	//TODO
-	return 0, true
+	// gathered into one write so datagram and log devices see one record
+	var data []byte
+	for _, v := range vec {
+		b, err := mu.MemRead(v[0], v[1])
+		if err != nil {
+			return errnoRet(EFAULT), true
+		}
+		data = append(data, b...)
+	}
+	return vfs.write(mu, args[0], data)
 }
 // syscall statfs64
 func (vfs *VirtualFileSystem) statfs64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
 	// char* path, size_t sz, void* buf	
 	pathAddr, _, buf := args[0], args[1], args[2]
+	is64 := archOf(mu).Is64
+	if is64 {
+		// statfs(path, buf), struct statfs of longs
+		buf = args[1]
+	}
 	path, err := ReadUtf8(mu, pathAddr)
 	if err != nil {
 		vfs.logger.Debug().Err(err).Msg("statfs64 read utf faied")
@@ -313,7 +528,7 @@ func (vfs *VirtualFileSystem) statfs64Handle(mu uc.Unicorn, args ...uint64) (uin
 	f_flag=1024
 	f_namemax=255
 	*/
-	for i, err := range []error{
+	writes := []error{
 		mu.MemWrite(buf, IntToBytes(0xef53, 4)), //
 		mu.MemWrite(buf+4, IntToBytes(f_bsize, 4)),
 		mu.MemWrite(buf+8, IntToBytes(f_blocks, 8)),
@@ -326,198 +541,37 @@ func (vfs *VirtualFileSystem) statfs64Handle(mu uc.Unicorn, args ...uint64) (uin
 		mu.MemWrite(buf+60, IntToBytes(f_frsize, 4)),
 		mu.MemWrite(buf+64, IntToBytes(f_flags, 4)),
 		mu.MemWrite(buf+68, IntToBytes(0, 16)),
-	} {
+	}
+	if is64 {
+		writes = []error{
+			mu.MemWrite(buf, IntToBytes(0xef53, 8)),
+			mu.MemWrite(buf+8, IntToBytes(f_bsize, 8)),
+			mu.MemWrite(buf+16, IntToBytes(f_blocks, 8)),
+			mu.MemWrite(buf+24, IntToBytes(f_bfree, 8)),
+			mu.MemWrite(buf+32, IntToBytes(f_bavail, 8)),
+			mu.MemWrite(buf+40, IntToBytes(f_files, 8)),
+			mu.MemWrite(buf+48, IntToBytes(f_ffree, 8)),
+			mu.MemWrite(buf+56, IntToBytes(f_fsid, 8)),
+			mu.MemWrite(buf+64, IntToBytes(f_namemax, 8)),
+			mu.MemWrite(buf+72, IntToBytes(f_frsize, 8)),
+			mu.MemWrite(buf+80, IntToBytes(f_flags, 8)),
+			mu.MemWrite(buf+88, make([]byte, 32)),
+		}
+	}
+	for i, err := range writes {
 		if err != nil {
 			vfs.logger.Debug().Int("f", i).Err(err).Msg("statfs64 write ptr failed")
 		}
 	}
 	return 0, true
 }
-// syscall openat
+/* syscall openat
+int openat(int dirfd, const char *pathname, int flags, mode_t mode);
+*/
 func (vfs *VirtualFileSystem) openatHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
-}
-// syscall fstatat64
-func (vfs *VirtualFileSystem) fstatat64Handle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
-}
-// syscall readlinkat
-func (vfs *VirtualFileSystem) readlinkatHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
-}
-// syscall faccessaat
-func (vfs *VirtualFileSystem) faccessatHandle(mu uc.Unicorn, args ...uint64) (uint64, bool) {
-	return 0, true
-}
-
-func (vfs *VirtualFileSystem) createFdLink(fd uintptr, target string) {
-	if isWin {
-		return
-	}
-	if fd >= 0 {
-		pid := vfs.pcb.GetPid()
-		fdbase := fmt.Sprintf("/proc/%d/fd/", pid)
-		fdbase = vfs.TranslatePath(fdbase)
-		_, err := os.Stat(fdbase)
-		if err == nil {
-			err = os.Remove(fdbase)
-			if err != nil {
-				vfs.logger.Debug().Err(err).Msg("failed to delete fd symlink")
-			}
-		}
-		p := fmt.Sprintf("%s/%d", fdbase, fd)
-		err = os.Symlink(target, p)
-		if err != nil {
-			vfs.logger.Debug().Str("from",target).Str("to", p).Err(err).Msg("failed to create symlink fd")
-		}
-	}
-	return
-}
-func (vfs *VirtualFileSystem) delFdLink(fd uintptr) {
-	if isWin {
-		return
-	}
-	if fd >= 0 {
-		pid := vfs.pcb.GetPid()
-		fdbase := fmt.Sprintf("/proc/%d/fd/", pid)
-		fdbase = vfs.TranslatePath(fdbase)
-		p := fmt.Sprintf("%s/%d", fdbase, fd)
-		if _, err := os.Stat(fdbase); err == nil {
-			err = os.Remove(p)
-			if err != nil {
-				vfs.logger.Debug().Err(err).Msg("failed to delete fd")
-			}
-		}
+	filename, errno := vfs.readPath(mu, args[1])
+	if errno != 0 {
+		return errnoRet(errno), true
 	}
+	return vfs.openAt(int64(int32(args[0])), filename, args[2], args[3]), true
 }
-func (vfs *VirtualFileSystem) openFile(filename string, mode uint64) (int64, *os.File) {
-	var (
-		f *os.File
-		err error
-	)
-	filepath := vfs.TranslatePath(filename)
-	vfs.logger.Debug().Str("path", filepath).Msg("open file")
-	if filename == "/dev/urandom" {
-		parent := fp.Dir(filepath)
-		os.MkdirAll(parent, os.ModePerm)
-		f, err = os.Create(filepath)
-		if err != nil {
-			vfs.logger.Debug().Err(err).Msg("failed to open file")
-			return -1, nil
-		}
-		ran := make([]byte, 2<<6)
-		rand.Read(ran)
-		f.Write(ran)
-	}else if strings.HasPrefix(filename, "/proc") {
-		parent := fp.Dir(filepath)
-		os.MkdirAll(parent, os.ModePerm)
-		pobj := GetPcb()
-		pid := pobj.GetPid()
-		filename2 := strings.Replace(filename, fmt.Sprintf("%d", pid), "self", -1)
-		mapPath := "/proc/self/maps"
-		if filename2 == mapPath {
-			f, err = os.Create(filepath)
-			if err != nil {
-				vfs.logger.Debug().Err(err).Msg("failed to open file")
-				return -1, nil
-			}
-			err = vfs.mem.DumpMaps(f)
-			if err != nil {
-				vfs.logger.Debug().Err(err).Msg("failed to dump maps memory")
-				return -1, nil
-			}
-		}
-		cmdlinePath := "/proc/self/cmdline"
-		if filename2 == cmdlinePath {
-			f, err = os.Create(filepath)
-			if err != nil {
-				vfs.logger.Debug().Err(err).Msg("failed to open file")
-				return -1, nil
-			}
-			f.Write([]byte(vfs.config.PkgName))
-		}
-		cgroupPath := "/proc/self/cgroup"
-		if filename2 == cgroupPath {
-			f, err = os.Create(filepath)
-			if err != nil {
-				vfs.logger.Debug().Err(err).Msg("failed to open file")
-				return -1, nil
-			}
-			content := fmt.Sprintf("2:cpu:/apps\n1:cpuacct:/uid/%d\n",vfs.config.Uid)
-			f.Write([]byte(content))
-		}
-		statusPath := "/proc/self/status"
-		if filename2 == statusPath {
-			f, err = os.Create(filepath)
-			if err != nil {
-				vfs.logger.Debug().Err(err).Msg("failed to open file")
-				return -1, nil
-			}
-			statsx := []byte(strings.Replace(S_STATUS, "{pkg_name}", vfs.config.PkgName, -1))
-			f.Write(statsx)
-		}
-
-	}
-	//
-	virtualFile := []string{
-		"/dev/log/main",
-		"/dev/log/events",
-		"/dev/log/radio",
-		"/dev/log/system",
-		"/dev/input/event0",
-	}
-	for _, _ = range virtualFile {
-		parent := fp.Dir(filepath)
-		os.MkdirAll(parent, os.ModePerm)
-		f, err = os.Create(filepath)
-		if err != nil {
-			continue
-		}
-		f.Close()
-	}
-	wi, err := os.Stat(filepath)
-	fmt.Printf("filestat %+#v %s\n", wi, err)
-	if err != nil {
-		vfs.logger.Debug().Err(err).Msg("failed to see stat, it may does not exist")
-		return -1, nil
-	}
-	if !wi.IsDir() {
-		flags := os.O_RDWR
-		vfs.logger.Debug().Msg("+RDWR")
-		if (mode & 100) != 0 {
-			flags |= os.O_CREATE
-			vfs.logger.Debug().Msg("+CREATE")
-		}
-		if (mode & 2000) != 0 {
-			flags |= os.O_APPEND
-			vfs.logger.Debug().Msg("+APPEND")
-		}
-		fo, err := MyOpen(filepath, flags)
-		if err != nil {
-			vfs.logger.Debug().Err(err).Msgf("failed to open file, flags %d", flags)
-			return -1, nil
-		}
-		fdx := vfs.pcb.AddFd(filename, filepath, fo)
-		vfs.createFdLink(fdx, filepath)
-		return int64(fdx), fo
-	}
-	return -1, nil
-}
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-